@@ -23,5 +23,22 @@ test_and_append_coverage src/util
 test_and_append_coverage src/raw_ad
 test_and_append_coverage src/aes
 test_and_append_coverage src/set
-# test_and_append_coverage src/pacing # to pass travis-ci
+test_and_append_coverage src/real_api/sign
+test_and_append_coverage src/vast_module
+test_and_append_coverage src/http_context
+test_and_append_coverage src/encoder
+test_and_append_coverage src/retrieval
+test_and_append_coverage src/graceful
+test_and_append_coverage src/supervisor
+test_and_append_coverage src/config
+test_and_append_coverage src/metrics
+test_and_append_coverage src/status
+test_and_append_coverage src/logger
+test_and_append_coverage src/rank
+test_and_append_coverage src/estimator
+test_and_append_coverage src/creative_bandit
+test_and_append_coverage src/experiment
+test_and_append_coverage src/rank/client
+test_and_append_coverage src/offer_cap
+test_and_append_coverage src/pacing
 test_and_append_coverage src/offer
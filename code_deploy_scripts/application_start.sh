@@ -2,12 +2,15 @@
 
 pushd /opt/real_api_server
 
-killall tguard
-killall tworker
+# keep the running tworker if new config is invalid
+bin/tworker -check-config > /dev/null || exit 1
+
+killall -w tguard  # tguard forwards SIGTERM to tworker and waits in-flight requests drained
+killall -w tworker # in case tworker is left
 
 sleep 1
 
-nohup bin/tguard /pdata1/log/offer/tworker.log > /pdata1/log/offer/guard.log 2>&1 &
+nohup bin/tguard -health-url http://127.0.0.1:19991/healthz /pdata1/log/offer/tworker.log tworker.pid > /pdata1/log/offer/guard.log 2>&1 &
 
 sleep 1
 
@@ -14,10 +14,11 @@ type ImgObj struct {
 }
 
 type VideoObj struct {
-	Id  string `json:"id"`
-	Url string `json:"video_url"`
-	W   int    `json:"videow"`
-	H   int    `json:"videoh"`
+	Id       string `json:"id"`
+	Url      string `json:"video_url"`
+	W        int    `json:"videow"`
+	H        int    `json:"videoh"`
+	Duration int    `json:"duration,omitempty"` // 秒
 }
 
 type PreCreativeObj struct {
@@ -280,6 +281,8 @@ type VideoAdObj struct {
 	ImpTks []string `json:"-"`
 	ClkTks []string `json:"-"`
 
+	VideoTks map[string][]string `json:"-"` // 第三方视频播放进度监测, vast event -> urls
+
 	Ext interface{} `json:"-"` // 该字段用于灵活处理一些第三方广告的附加信息
 }
 
@@ -316,6 +319,8 @@ type NativeVideoV4Ad struct {
 	ImpTks      []string        `json:"imp_tks"`
 	ClkTks      []string        `json:"clk_tks"`
 
+	VideoTks map[string][]string `json:"-"` // 第三方视频播放进度监测, vast event -> urls
+
 	// 调试时方便观察
 	Video VideoObj `json:"d_video"`
 	Image ImgObj   `json:"d_image"`
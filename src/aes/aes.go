@@ -3,6 +3,7 @@ package aes
 import (
 	"crypto/aes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/rand"
 	"strconv"
@@ -17,14 +18,27 @@ var key []byte
 
 func Init(cf *Conf) {
 	rand.Seed(time.Now().Unix())
-	var err error
-	key, err = hex.DecodeString(cf.Key)
-	if err != nil {
+	if err := CheckKey(cf.Key); err != nil {
 		panic(err)
 	}
-	if len(key) != 32 {
-		panic("key size error, only 32 bytes key supported (64 bytes hex string)")
+	key, _ = hex.DecodeString(cf.Key)
+}
+
+// CheckKey returns error if hexKey is not a 64 bytes hex string
+func CheckKey(hexKey string) error {
+	k, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return err
 	}
+	if len(k) != 32 {
+		return errors.New("key size error, only 32 bytes key supported (64 bytes hex string)")
+	}
+	return nil
+}
+
+// Inited reports whether aes key is loaded
+func Inited() bool {
+	return len(key) == 32
 }
 
 func Encrypt(text string) string {
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
@@ -51,12 +52,12 @@ func Del(userHash int, key string) (string, error) {
 	return redis.String(conn.Do("DEL", key))
 }
 
-func IncrFreq(userHash int, key string, fields []string, expire int64) error {
+func IncrFreq(ctx context.Context, userHash int, key string, fields []string, expire int64) error {
 	if len(key) == 0 || len(fields) == 0 || expire < 0 {
 		return errors.New("[IncrPreClickFreq] empty key or fields or invalid expire")
 	}
 
-	conn := GetConn(userHash)
+	conn := GetConnContext(ctx, userHash)
 	defer conn.Close()
 
 	for _, field := range fields {
@@ -76,12 +77,12 @@ func IncrFreq(userHash int, key string, fields []string, expire int64) error {
 	return nil
 }
 
-func HGetAllFreq(userHash int, key string) (map[string]int, error) {
+func HGetAllFreq(ctx context.Context, userHash int, key string) (map[string]int, error) {
 	if len(key) == 0 {
 		return nil, errors.New("empty key")
 	}
 
-	conn := GetConn(userHash)
+	conn := GetConnContext(ctx, userHash)
 	defer conn.Close()
 
 	return redis.IntMap(conn.Do("HGETALL", key))
@@ -98,14 +99,14 @@ func HGetFreq(userHash int, key, field string) (int, error) {
 	return redis.Int(conn.Do("HGET", key, field))
 }
 
-func GetAndSetVideoCtrlInfos(userHash int, serverCidKey, convKey, vCompleteKey, vRequestKey,
+func GetAndSetVideoCtrlInfos(ctx context.Context, userHash int, serverCidKey, convKey, vCompleteKey, vRequestKey,
 	vFreqField string) (map[string]int, *set.Set, int, int, error) {
 
 	if len(serverCidKey) == 0 && len(convKey) == 0 && len(vCompleteKey) == 0 && len(vRequestKey) == 0 {
 		return nil, nil, 0, 0, errors.New("empty key")
 	}
 
-	conn := GetConn(userHash)
+	conn := GetConnContext(ctx, userHash)
 	defer conn.Close()
 
 	if err := conn.Send("HGETALL", serverCidKey); err != nil {
@@ -1,11 +1,16 @@
 package cache
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
+
+	"metrics"
 )
 
 type Conf struct {
@@ -36,7 +41,7 @@ func Init(cf *Conf) {
 				IdleTimeout: 240 * time.Second,
 				Dial: func() (redis.Conn, error) {
 					c, err := redis.DialTimeout("tcp", host+":"+port,
-						50*time.Millisecond, 50*time.Millisecond, 50*time.Millisecond)
+						50*time.Millisecond, rwTimeout, rwTimeout)
 					if err != nil {
 						return nil, err
 					}
@@ -54,7 +59,117 @@ func Init(cf *Conf) {
 	}
 }
 
+var (
+	redisDuration = metrics.NewHistogramVec("offer_redis_duration_seconds", "Latency of redis commands.",
+		[]float64{.0005, .001, .0025, .005, .01, .025, .05, .1}, "cmd")
+	redisErrors = metrics.NewCounterVec("offer_redis_errors_total", "Failed redis commands.", "cmd")
+)
+
+// PoolNum returns the number of redis pools, keys of userHash are in pool userHash % PoolNum()
+func PoolNum() int {
+	return len(defaultPools)
+}
+
 func GetConn(userHash int) redis.Conn {
 	n := userHash % len(defaultPools)
-	return defaultPools[n].Get()
+	return timedConn{defaultPools[n].Get()}
+}
+
+// timedConn records latency and errors of each command, pipelined commands are recorded by FLUSH
+type timedConn struct {
+	redis.Conn
+}
+
+func observeRedis(cmd string, start time.Time, err error) {
+	if cmd == "" {
+		cmd = "PIPELINE" // Do("")用于读取pipeline的所有回复
+	}
+	redisDuration.With(cmd).Observe(metrics.Since(start))
+	if err != nil {
+		redisErrors.With(cmd).Inc()
+	}
+}
+
+func (c timedConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := c.Conn.Do(cmd, args...)
+	observeRedis(cmd, start, err)
+	return reply, err
+}
+
+func (c timedConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := redis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+	observeRedis(cmd, start, err)
+	return reply, err
+}
+
+func (c timedConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return redis.ReceiveWithTimeout(c.Conn, timeout)
+}
+
+func (c timedConn) Flush() error {
+	start := time.Now()
+	err := c.Conn.Flush()
+	observeRedis("FLUSH", start, err)
+	return err
+}
+
+// redis连接默认的读写超时，请求剩余时间更短时使用剩余时间
+const rwTimeout = 50 * time.Millisecond
+
+var ErrDeadline = errors.New("redis: request deadline exceeded")
+
+// GetConnContext returns a conn whose commands are bounded by deadline of ctx
+func GetConnContext(ctx context.Context, userHash int) redis.Conn {
+	conn := GetConn(userHash)
+	if deadline, ok := ctx.Deadline(); ok {
+		return &deadlineConn{Conn: conn, deadline: deadline}
+	}
+	return conn
+}
+
+type deadlineConn struct {
+	redis.Conn
+	deadline time.Time
+}
+
+func (c *deadlineConn) timeout() time.Duration {
+	t := time.Until(c.deadline)
+	if t > rwTimeout {
+		return rwTimeout
+	}
+	return t
+}
+
+func (c *deadlineConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	t := c.timeout()
+	if t <= 0 {
+		return nil, ErrDeadline
+	}
+	return redis.DoWithTimeout(c.Conn, t, cmd, args...)
+}
+
+func (c *deadlineConn) Receive() (interface{}, error) {
+	t := c.timeout()
+	if t <= 0 {
+		return nil, ErrDeadline
+	}
+	return redis.ReceiveWithTimeout(c.Conn, t)
+}
+
+// Ping checks every redis pool, it is used by readiness probe
+func Ping(timeout time.Duration) error {
+	if len(defaultPools) == 0 {
+		return errors.New("redis pools not initialized")
+	}
+	for i, pool := range defaultPools {
+		conn := pool.Get()
+		_, err := redis.DoWithTimeout(conn, timeout, "PING")
+		conn.Close()
+		if err != nil {
+			return fmt.Errorf("redis[%d] ping error: %v", i, err)
+		}
+	}
+	return nil
 }
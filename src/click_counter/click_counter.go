@@ -110,3 +110,11 @@ func (ck *ClickCounter) AddClick(oid string, nClick int) {
 func AddClick(oid string, nClick int) {
 	defaultCounter.AddClick(oid, nClick)
 }
+
+// Flush submits pending click counts, it is called before process exit
+func Flush() {
+	if defaultCounter == nil || defaultCounter.apiAddr == "" {
+		return
+	}
+	defaultCounter.Update()
+}
@@ -0,0 +1,331 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/brg-liuwei/gotools"
+
+	"aes"
+	"cache"
+	"cpt"
+	"creative_bandit"
+	"estimator"
+	"experiment"
+	"graceful"
+	"logger"
+	"offer_cap"
+	"pacing"
+	"rank"
+	"real_api"
+	"real_api/sign"
+	"retrieval"
+	"update"
+	"util"
+)
+
+/*
+tworker配置加载顺序：
+	1. 解析json配置文件
+	2. 填充默认值
+	3. 环境变量覆盖(主要用于secret，见env.go)
+	4. 展开所有字符串中的${secret:ref}(secret来自环境变量或real_api_conf.secrets_path，见sign.ExpandAll)
+	5. 按section校验，一次返回所有错误
+*/
+
+type Conf struct {
+	RetrievalConf retrieval.Conf       `json:"retrieval_config"`
+	UtilConf      util.Conf            `json:"util_config"`
+	AesConf       aes.Conf             `json:"aes_config"`
+	RealApi       real_api.Conf        `json:"real_api_conf"`
+	GracefulConf  graceful.Conf        `json:"graceful_config"`
+	LogConf       logger.Conf          `json:"log_config"`
+	RankConf      rank.Conf            `json:"rank_config"`
+	EstimatorConf estimator.Conf       `json:"estimator_config"`
+	BanditConf    creative_bandit.Conf `json:"creative_bandit_config"`
+	ExpConf       experiment.Conf      `json:"experiment_config"`
+	CacheConf     cache.Conf           `json:"cache_config"`
+	CapConf       offer_cap.Conf       `json:"offer_cap_config"`
+	BudgetConf    pacing.BudgetConf    `json:"budget_pacing_config"`
+	CptEnabled    bool                 `json:"cpt_enabled"` // cpt_config只在开启时生效
+	CptConf       cpt.Conf             `json:"cpt_config"`
+	UpdateConf    update.Conf          `json:"update_config"`
+}
+
+// Errors collects all validation errors of a conf
+type Errors []error
+
+func (errs Errors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (errs *Errors) add(section string, format string, args ...interface{}) {
+	*errs = append(*errs, fmt.Errorf(section+": "+format, args...))
+}
+
+// Load decodes conf file, applies defaults and env overrides, then validates it
+func Load(path string) (*Conf, error) {
+	cf := &Conf{}
+	if err := gotools.DecodeJsonFile(path, cf); err != nil {
+		return nil, fmt.Errorf("decode %s error: %v", path, err)
+	}
+	cf.setDefault()
+	if err := applyEnv(cf, envPrefix); err != nil {
+		return nil, err
+	}
+	var errs Errors
+	cf.expandSecrets(&errs)
+	if err := cf.Validate(); err != nil {
+		errs = append(errs, err.(Errors)...)
+	}
+	if len(errs) > 0 {
+		return cf, errs
+	}
+	return cf, nil
+}
+
+// expandSecrets resolves ${secret:ref} of every string field, such as token of api urls
+func (cf *Conf) expandSecrets(errs *Errors) {
+	if path := cf.RealApi.SecretsPath; path != "" {
+		if err := sign.LoadSecrets(path); err != nil {
+			errs.add("real_api_conf", "secrets_path: %v", err)
+			return
+		}
+	}
+	*errs = append(*errs, sign.ExpandAll(cf)...)
+}
+
+func (cf *Conf) setDefault() {
+	rc := &cf.RetrievalConf
+	if rc.ServerName == "" {
+		rc.ServerName = "0.0.0.0"
+	}
+	if rc.RequestTimeoutMs <= 0 {
+		rc.RequestTimeoutMs = 300
+	}
+	if rc.MaxRequestTimeoutMs <= 0 {
+		rc.MaxRequestTimeoutMs = 2000
+	}
+
+	gc := &cf.GracefulConf
+	if gc.ShutdownTimeout <= 0 {
+		gc.ShutdownTimeout = 10
+	}
+	if gc.HandoffTimeout <= 0 {
+		gc.HandoffTimeout = 120
+	}
+}
+
+// Validate checks all sections and returns Errors if any
+func (cf *Conf) Validate() error {
+	var errs Errors
+	cf.validateRetrieval(&errs)
+	cf.validateAes(&errs)
+	cf.validateRealApi(&errs)
+	cf.validateGraceful(&errs)
+	cf.validateLog(&errs)
+	cf.validateRank(&errs)
+	cf.validateEstimator(&errs)
+	cf.validateBandit(&errs)
+	cf.validateExperiment(&errs)
+	cf.validateCache(&errs)
+	cf.validateCap(&errs)
+	cf.validateBudget(&errs)
+	cf.validateCpt(&errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (cf *Conf) validateRetrieval(errs *Errors) {
+	const section = "retrieval_config"
+	rc := &cf.RetrievalConf
+
+	if rc.ListenPort <= 0 || rc.ListenPort > 65535 {
+		errs.add(section, "listen_port %d out of range", rc.ListenPort)
+	}
+	if rc.LogPath == "" {
+		errs.add(section, "log_path required")
+	}
+	if err := rc.PacingInstances.Validate(rc.AutoscalingGroupName); err != nil {
+		errs.add(section, "pacing_instances: %v", err)
+	}
+	if err := rc.DistributedPacing.Validate(); err != nil {
+		errs.add(section, "distributed_pacing: %v", err)
+	}
+	if rc.MaxRequestTimeoutMs < rc.RequestTimeoutMs {
+		errs.add(section, "max_request_timeout_ms %d less than request_timeout_ms %d",
+			rc.MaxRequestTimeoutMs, rc.RequestTimeoutMs)
+	}
+
+	paths := []struct {
+		name, path string
+	}{
+		{"path", rc.Path},
+		{"native_path", rc.NativePath},
+		{"realtime_path", rc.RealtimePath},
+		{"promotion_path", rc.PromotionPath},
+		{"video_path", rc.VideoPath},
+		{"wugan_path", rc.WuganPath},
+		{"funny_path", rc.FunnyPath},
+		{"jstag_path", rc.JstagPath},
+		{"jstag_h5_path", rc.JstagH5Path},
+		{"app_wall_path", rc.AppWallPath},
+		{"interstitial_path", rc.InterstitialPath},
+		{"pagead_path", rc.PageadPath},
+		{"life_path", rc.LifePath},
+		{"jstag_media_path", rc.JstagMediaPath},
+	}
+	// retrieval.Service固定注册的path
+	seen := map[string]string{
+		"/get_sub_ad":            "builtin handler",
+		"/video/v4/creative/get": "builtin handler",
+		"/video/v4/ad/get":       "builtin handler",
+		"/video/v4/native/get":   "builtin handler",
+		"/healthz":               "builtin handler",
+		"/readyz":                "builtin handler",
+		"/metrics":               "builtin handler",
+		"/admin/log":             "builtin handler",
+		"/track":                 "builtin handler",
+		"/estimator":             "builtin handler",
+		"/creative/track":        "builtin handler",
+		"/creative/report":       "builtin handler",
+		"/rank/shadow":           "builtin handler",
+	}
+	for _, p := range paths {
+		switch {
+		case p.path == "":
+			errs.add(section, "%s required", p.name)
+		case !strings.HasPrefix(p.path, "/"):
+			errs.add(section, "%s %q must start with /", p.name, p.path)
+		case seen[p.path] != "":
+			errs.add(section, "%s %q conflicts with %s", p.name, p.path, seen[p.path])
+		default:
+			seen[p.path] = p.name
+		}
+	}
+}
+
+func (cf *Conf) validateAes(errs *Errors) {
+	if err := aes.CheckKey(cf.AesConf.Key); err != nil {
+		errs.add("aes_config", "key: %v", err)
+	}
+}
+
+func (cf *Conf) validateRealApi(errs *Errors) {
+	if err := real_api.Validate(&cf.RealApi); err != nil {
+		errs.add("real_api_conf", "%v", err)
+	}
+}
+
+func (cf *Conf) validateGraceful(errs *Errors) {
+	if cf.GracefulConf.Handoff && cf.GracefulConf.PidFile == "" {
+		errs.add("graceful_config", "pid_file required when handoff enabled, tguard tracks new process by it")
+	}
+}
+
+func (cf *Conf) validateLog(errs *Errors) {
+	if err := cf.LogConf.Validate(); err != nil {
+		errs.add("log_config", "%v", err)
+	}
+}
+
+func (cf *Conf) validateRank(errs *Errors) {
+	const section = "rank_config"
+	rc := &cf.RankConf
+	if len(rc.RankApis) == 0 {
+		errs.add(section, "rank_apis required")
+	}
+	if rc.ImpRankApi == "" {
+		errs.add(section, "imp_rank_api required")
+	}
+	if rc.VideoRankApi == "" {
+		errs.add(section, "video_rank_api required")
+	}
+	if err := rank.ValidateLocal(&rc.LocalRank); err != nil {
+		errs.add(section, "local_rank: %v", err)
+	}
+	if err := rc.Shadow.Validate(); err != nil {
+		errs.add(section, "shadow: %v", err)
+	}
+	if err := rc.Client.Validate(); err != nil {
+		errs.add(section, "client: %v", err)
+	}
+	apis := map[string]bool{rc.ImpRankApi: true, rc.VideoRankApi: true}
+	for _, api := range rc.RankApis {
+		apis[api] = true
+	}
+	for api := range rc.Client.Weights {
+		if !apis[api] {
+			errs.add(section, "client: weight of unknown api %s", api)
+		}
+	}
+}
+
+func (cf *Conf) validateEstimator(errs *Errors) {
+	if err := cf.EstimatorConf.Validate(); err != nil {
+		errs.add("estimator_config", "%v", err)
+	}
+}
+
+func (cf *Conf) validateBandit(errs *Errors) {
+	if err := cf.BanditConf.Validate(); err != nil {
+		errs.add("creative_bandit_config", "%v", err)
+	}
+}
+
+func (cf *Conf) validateExperiment(errs *Errors) {
+	if err := cf.ExpConf.Validate(); err != nil {
+		errs.add("experiment_config", "%v", err)
+	}
+}
+
+func (cf *Conf) validateCache(errs *Errors) {
+	const section = "cache_config"
+	hosts, ports := strings.Split(cf.CacheConf.Hosts, ","), strings.Split(cf.CacheConf.Ports, ",")
+	if cf.CacheConf.Hosts == "" {
+		errs.add(section, "hosts required")
+		return
+	}
+	if len(hosts) != len(ports) {
+		errs.add(section, "%d hosts but %d ports", len(hosts), len(ports))
+		return
+	}
+	for _, port := range ports {
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			errs.add(section, "bad port %q", port)
+		}
+	}
+}
+
+func (cf *Conf) validateCap(errs *Errors) {
+	if err := cf.CapConf.Validate(); err != nil {
+		errs.add("offer_cap_config", "%v", err)
+	}
+}
+
+func (cf *Conf) validateBudget(errs *Errors) {
+	const section = "budget_pacing_config"
+	if err := cf.BudgetConf.Validate(); err != nil {
+		errs.add(section, "%v", err)
+	}
+	if cf.BudgetConf.Enabled && !cf.CapConf.Enabled {
+		errs.add(section, "offer_cap_config should be enabled")
+	}
+}
+
+func (cf *Conf) validateCpt(errs *Errors) {
+	const section = "cpt_config"
+	if err := cf.CptConf.Validate(); err != nil {
+		errs.add(section, "%v", err)
+	}
+	if cf.CptEnabled && cf.CptConf.DailyImps() && !cf.CapConf.Enabled {
+		errs.add(section, "daily_imps requires offer_cap_config enabled")
+	}
+}
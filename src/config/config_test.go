@@ -0,0 +1,333 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+const testConf = `{
+    "retrieval_config": {
+        "listen_port": 19991,
+        "path": "/get",
+        "native_path": "/native",
+        "realtime_path": "/realtime",
+        "promotion_path": "/promotion",
+        "video_path": "/video",
+        "wugan_path": "/wugan",
+        "funny_path": "/funny",
+        "inmobi_path": "/inmobi",
+        "jstag_path": "/jstag",
+        "jstag_h5_path": "/jstag_h5",
+        "ngp_path": "/ngp",
+        "app_wall_path": "/app_wall",
+        "interstitial_path": "/interstitial",
+        "pagead_path": "/pagead",
+        "life_path": "/life",
+        "jstag_media_path": "/jstag_media",
+        "log_path": "/tmp/retrieval.log",
+        "vast_server_api": "http://vast.example.com/api?t=abcdef&slot=1",
+        "pacing_instances": {"provider": "static", "instances": 4},
+        "distributed_pacing": {"enabled": true, "lease": 5}
+    },
+    "aes_config": {
+        "key": "` + testKey + `"
+    },
+    "real_api_conf": {
+        "huicheng_api": "http://hc.example.com/ad?token=123456",
+        "huicheng_sign": {
+            "method": "md5",
+            "secret_ref": "env:CONFIG_TEST_SECRET"
+        }
+    },
+    "graceful_config": {
+        "handoff": true,
+        "pid_file": "tworker.pid"
+    },
+    "log_config": {
+        "level": "info",
+        "sample": {"debug": 0.01}
+    },
+    "rank_config": {
+        "rank_apis": ["http://127.0.0.1:9986/rank"],
+        "imp_rank_api": "http://127.0.0.1:9987/rank",
+        "video_rank_api": "http://127.0.0.1:9988/rank",
+        "local_rank": {"primary_slots": ["1244"], "explore_rate": 0.1},
+        "client": {"timeout_ms": 200, "weights": {"http://127.0.0.1:9986/rank": 2}},
+        "shadow": {"rank_apis": ["http://127.0.0.1:9989/rank"], "rate": 0.01}
+    },
+    "experiment_config": {
+        "layers": [{"id": "rank", "experiments": [
+            {"id": "rank_local", "from": 0, "to": 100, "params": {"ranker": "local"}},
+            {"id": "rank_floor", "from": 100, "to": 200, "params": {"floor_factor": 1.2}}
+        ]}]
+    },
+    "cache_config": {
+        "hosts": "127.0.0.1,127.0.0.1",
+        "ports": "6379,6380"
+    },
+    "offer_cap_config": {
+        "enabled": true,
+        "soft_ratio": 0.8
+    },
+    "budget_pacing_config": {
+        "enabled": true,
+        "gain": 0.5
+    },
+    "cpt_enabled": true,
+    "cpt_config": [
+        {"offers": ["ym_1"], "slots": [{"slot_id": "756"}], "start_time": "2024-04-01 00:00:00", "daily_imps": 1000}
+    ],
+    "update_config": {
+        "offer_update_api": "http://10.17.0.187:17771/dump?key=654321&channel="
+    }
+}`
+
+func writeConf(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "offer.conf")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	os.Setenv("CONFIG_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("CONFIG_TEST_SECRET")
+
+	cf, err := Load(writeConf(t, testConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.RetrievalConf.ServerName != "0.0.0.0" {
+		t.Error("default server_name: ", cf.RetrievalConf.ServerName)
+	}
+	if cf.RetrievalConf.RequestTimeoutMs != 300 || cf.RetrievalConf.MaxRequestTimeoutMs != 2000 {
+		t.Error("default timeouts: ", cf.RetrievalConf.RequestTimeoutMs, cf.RetrievalConf.MaxRequestTimeoutMs)
+	}
+	if cf.GracefulConf.ShutdownTimeout != 10 {
+		t.Error("default shutdown_timeout: ", cf.GracefulConf.ShutdownTimeout)
+	}
+}
+
+// each case breaks one section of testConf, errors are the messages expected from it and nothing else
+var errorCases = []struct {
+	name    string
+	replace []string // old, new, ...
+	errors  []string
+}{
+	{"retrieval", []string{
+		`"listen_port": 19991`, `"listen_port": 0`,
+		`"native_path": "/native"`, `"native_path": "/get"`,
+		`"life_path": "/life"`, `"life_path": "life"`,
+	}, []string{
+		"retrieval_config: listen_port 0",
+		"retrieval_config: native_path \"/get\" conflicts with path",
+		"retrieval_config: life_path \"life\" must start with /",
+	}},
+	{"pacing_instances", []string{`"provider": "static"`, `"provider": "consul"`},
+		[]string{"retrieval_config: pacing_instances: unknown provider \"consul\""}},
+	{"distributed_pacing", []string{`"lease": 5`, `"lease": -1`},
+		[]string{"retrieval_config: distributed_pacing: refill_ms, lease and fallback_seconds should not be negative"}},
+	{"aes", []string{testKey, "abcd"}, []string{"aes_config: key"}},
+	{"real_api", []string{"env:CONFIG_TEST_SECRET", "env:CONFIG_TEST_MISSING"},
+		[]string{"real_api_conf: secret env CONFIG_TEST_MISSING not set"}},
+	{"secret", []string{"token=123456", "token=${secret:missing}"},
+		[]string{"real_api_conf.huicheng_api: secret missing not found"}},
+	{"graceful", []string{`"pid_file": "tworker.pid"`, `"pid_file": ""`},
+		[]string{"graceful_config: pid_file required"}},
+	{"log", []string{`"level": "info"`, `"level": "verbose"`}, []string{"log_config: unknown log level"}},
+	{"rank", []string{
+		`"explore_rate": 0.1`, `"explore_rate": 2`,
+		`"rate": 0.01`, `"rate": 1.5`,
+		`"http://127.0.0.1:9986/rank": 2`, `"http://127.0.0.1:9999/rank": 2`,
+	}, []string{
+		"rank_config: local_rank: explore_rate",
+		"rank_config: shadow: rate should be 0~1",
+		"rank_config: client: weight of unknown api http://127.0.0.1:9999/rank",
+	}},
+	{"experiment", []string{`"from": 100`, `"from": 50`},
+		[]string{"experiment_config: experiment rank_floor: bucket [50, 200) overlaps rank_local"}},
+	{"cache", []string{`"ports": "6379,6380"`, `"ports": "6379,redis"`},
+		[]string{"cache_config: bad port \"redis\""}},
+	{"offer_cap", []string{`"soft_ratio": 0.8`, `"soft_ratio": 1.2`},
+		[]string{"offer_cap_config: soft_ratio and soft_pass should be 0~1"}},
+	{"offer_cap_disabled", []string{`"enabled": true,
+        "soft_ratio"`, `"enabled": false,
+        "soft_ratio"`}, []string{
+		"budget_pacing_config: offer_cap_config should be enabled",
+		"cpt_config: daily_imps requires offer_cap_config enabled",
+	}},
+	{"budget", []string{`"gain": 0.5`, `"gain": 2`},
+		[]string{"budget_pacing_config: gain, min_prob and shape_learning_rate should be 0~1"}},
+	{"cpt", []string{`"start_time": "2024-04-01 00:00:00"`, `"start_time": "2024-04-01"`},
+		[]string{"cpt_config: parsing time \"2024-04-01\""}},
+}
+
+func loadErrors(t *testing.T, conf string) Errors {
+	_, err := Load(writeConf(t, conf))
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("expect Errors, got %v", err)
+	}
+	return errs
+}
+
+func TestLoadErrors(t *testing.T) {
+	os.Setenv("CONFIG_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("CONFIG_TEST_SECRET")
+
+	for _, c := range errorCases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := testConf
+			for i := 0; i < len(c.replace); i += 2 {
+				conf = strings.Replace(conf, c.replace[i], c.replace[i+1], 1)
+			}
+			errs := loadErrors(t, conf)
+			for _, want := range c.errors {
+				if !strings.Contains(errs.Error(), want) {
+					t.Errorf("missing error %q in:\n%s", want, errs.Error())
+				}
+			}
+			for _, err := range errs {
+				expected := false
+				for _, want := range c.errors {
+					expected = expected || strings.HasPrefix(err.Error(), want)
+				}
+				if !expected {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// TestLoadAllErrors checks that errors of every section are returned by one Load
+func TestLoadAllErrors(t *testing.T) {
+	os.Setenv("CONFIG_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("CONFIG_TEST_SECRET")
+
+	conf := testConf
+	for _, c := range errorCases {
+		for i := 0; i < len(c.replace); i += 2 {
+			conf = strings.Replace(conf, c.replace[i], c.replace[i+1], 1)
+		}
+	}
+	errs := loadErrors(t, conf)
+	for _, c := range errorCases {
+		for _, want := range c.errors {
+			if !strings.Contains(errs.Error(), want) {
+				t.Errorf("%s: missing error %q in:\n%s", c.name, want, errs.Error())
+			}
+		}
+	}
+}
+
+func TestCptDisabled(t *testing.T) {
+	os.Setenv("CONFIG_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("CONFIG_TEST_SECRET")
+
+	conf := strings.Replace(testConf, `"cpt_enabled": true`, `"cpt_enabled": false`, 1)
+	if _, err := Load(writeConf(t, conf)); err != nil {
+		t.Fatal(err)
+	}
+	conf = strings.Replace(conf, `"offer_cap_config": {
+        "enabled": true`, `"offer_cap_config": {
+        "enabled": false`, 1)
+	if errs := loadErrors(t, conf); strings.Contains(errs.Error(), "cpt_config") {
+		t.Error("disabled cpt_config should not require offer_cap_config: ", errs)
+	}
+}
+
+func TestEnvOverride(t *testing.T) {
+	os.Setenv("CONFIG_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("CONFIG_TEST_SECRET")
+
+	newKey := strings.Repeat("ff", 32)
+	envs := map[string]string{
+		"OFFER_AES_CONFIG__KEY":                          newKey,
+		"OFFER_RETRIEVAL_CONFIG__LISTEN_PORT":            "8888",
+		"OFFER_REAL_API_CONF__ENABLE_VIDEO":              "true",
+		"OFFER_REAL_API_CONF__HUICHENG_SIGN__SECRET_REF": "env:CONFIG_TEST_SECRET",
+	}
+	for k, v := range envs {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	conf := strings.Replace(testConf, testKey, "", 1)
+	conf = strings.Replace(conf, "env:CONFIG_TEST_SECRET", "missing", 1)
+	cf, err := Load(writeConf(t, conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.AesConf.Key != newKey || cf.RetrievalConf.ListenPort != 8888 || !cf.RealApi.EnableVideo {
+		t.Errorf("env not applied: %+v", cf)
+	}
+
+	os.Setenv("OFFER_RETRIEVAL_CONFIG__LISTEN_PORT", "abc")
+	if _, err := Load(writeConf(t, conf)); err == nil ||
+		!strings.Contains(err.Error(), "env OFFER_RETRIEVAL_CONFIG__LISTEN_PORT") {
+		t.Error("expect env parse error, got ", err)
+	}
+}
+
+func TestExpandSecrets(t *testing.T) {
+	os.Setenv("CONFIG_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("CONFIG_TEST_SECRET")
+
+	conf := strings.Replace(testConf, "t=abcdef", "t=${secret:env:CONFIG_TEST_SECRET}", 1)
+	conf = strings.Replace(conf, "token=123456", "token=${secret:env:CONFIG_TEST_SECRET}", 1)
+	conf = strings.Replace(conf, "key=654321", "key=${secret:env:CONFIG_TEST_SECRET}", 1)
+	cf, err := Load(writeConf(t, conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cf.RetrievalConf.VastServerApi, "t=s3cret") || !strings.Contains(cf.RealApi.HuichengApi, "token=s3cret") {
+		t.Error("secrets not expanded: ", cf.RetrievalConf.VastServerApi, cf.RealApi.HuichengApi)
+	}
+	if !strings.Contains(cf.UpdateConf.OfferUpdateApi, "key=s3cret&") {
+		t.Error("update secret not expanded: ", cf.UpdateConf.OfferUpdateApi)
+	}
+
+	conf = strings.Replace(testConf, "t=abcdef", "t=${secret:offer_api_token}", 1)
+	if _, err := Load(writeConf(t, conf)); err == nil ||
+		!strings.Contains(err.Error(), "retrieval_config.vast_server_api: secret offer_api_token not found") {
+		t.Error("expect secret error, got ", err)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	os.Setenv("CONFIG_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("CONFIG_TEST_SECRET")
+
+	cf, err := Load(writeConf(t, testConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := cf.Redacted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(b)
+
+	for _, secret := range []string{testKey, "abcdef", "123456"} {
+		if strings.Contains(s, secret) {
+			t.Errorf("secret %s not redacted:\n%s", secret, s)
+		}
+	}
+	for _, kept := range []string{"env:CONFIG_TEST_SECRET", "slot=1", "/tmp/retrieval.log"} {
+		if !strings.Contains(s, kept) {
+			t.Errorf("%s should be kept:\n%s", kept, s)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+环境变量覆盖配置，key和secret不必写在配置文件里：
+	OFFER_<SECTION>__<FIELD>[__<FIELD>...]，名字取json tag的大写，例如
+	OFFER_AES_CONFIG__KEY
+	OFFER_REAL_API_CONF__HUICHENG_API
+	OFFER_REAL_API_CONF__HUICHENG_SIGN__SECRET_REF
+只支持string、整数、浮点和bool字段；指针字段为nil时不覆盖
+*/
+
+const envPrefix = "OFFER"
+
+func applyEnv(cf *Conf, prefix string) error {
+	var errs Errors
+	walkEnv(reflect.ValueOf(cf).Elem(), prefix, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func walkEnv(v reflect.Value, name string, errs *Errors) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+		tag := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		key := strings.ToUpper(tag)
+		if name == envPrefix {
+			key = name + "_" + key
+		} else {
+			key = name + "__" + key
+		}
+
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() || fv.Elem().Kind() != reflect.Struct {
+				continue
+			}
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Struct {
+			walkEnv(fv, key, errs)
+			continue
+		}
+
+		s, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		if err := setValue(fv, s); err != nil {
+			*errs = append(*errs, fmt.Errorf("env %s: %v", key, err))
+		}
+	}
+}
+
+func setValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+// url中需要隐藏的query参数
+var secretParams = map[string]bool{
+	"t":            true,
+	"token":        true,
+	"key":          true,
+	"secret":       true,
+	"sign":         true,
+	"password":     true,
+	"access_token": true,
+}
+
+func isSecretKey(k string) bool {
+	k = strings.ToLower(k)
+	if k == "key" || strings.HasSuffix(k, "_key") && k != "sign_key" && k != "ts_key" && k != "nonce_key" {
+		return true
+	}
+	for _, s := range []string{"secret", "token", "password"} {
+		if strings.Contains(k, s) && !strings.HasSuffix(k, "_ref") && !strings.HasSuffix(k, "_path") {
+			return true
+		}
+	}
+	return false
+}
+
+// Redacted returns the effective conf as indented json with secrets hidden
+func (cf *Conf) Redacted() ([]byte, error) {
+	b, err := json.Marshal(cf)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // url中的&不转义
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(redact(m)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func redact(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range x {
+			if s, ok := sub.(string); ok && s != "" && isSecretKey(k) {
+				x[k] = redacted
+			} else {
+				x[k] = redact(sub)
+			}
+		}
+		return x
+	case []interface{}:
+		for i := range x {
+			x[i] = redact(x[i])
+		}
+		return x
+	case string:
+		return redactUrl(x)
+	}
+	return v
+}
+
+func redactUrl(s string) string {
+	if !strings.Contains(s, "://") || !strings.Contains(s, "?") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	q := u.Query()
+	changed := false
+	for k := range q {
+		if secretParams[strings.ToLower(k)] {
+			q.Set(k, redacted)
+			changed = true
+		}
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			changed = true
+		}
+	}
+	if !changed {
+		return s
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -1,14 +1,23 @@
 package cpt
 
 import (
+	"errors"
 	"time"
 
 	dnf "github.com/brg-liuwei/godnf"
 
 	"http_context"
+	"offer_cap"
+	"pacing"
 	"raw_ad"
 )
 
+/*
+CPT: 按媒体(slots)在[start_time, end_time]内售卖的offer，命中时只返回这些offer
+	CPT offer同样受offer_cap的日/月cap限制；daily_imps为每个offer每天的展示预算(需要开启offer_cap)，
+	按offer_cap的展示计数控制，开启budget_pacing时按流量曲线均匀花完
+*/
+
 type Conf []CptConfItem
 
 type CptConfItem struct {
@@ -16,6 +25,7 @@ type CptConfItem struct {
 	Slots     []CptSlotInfo `json:"slots"`
 	StartTime string        `json:"start_time"`
 	EndTime   string        `json:"end_time"`
+	DailyImps int           `json:"daily_imps"` // 每个offer每天的展示预算，0为不限
 }
 
 type CptSlotInfo struct {
@@ -29,6 +39,7 @@ type Media struct {
 	Slots     map[string]MediaSlot
 	StartTime time.Time
 	EndTime   time.Time
+	DailyImps int
 }
 
 type MediaSlot struct {
@@ -46,8 +57,9 @@ var endTimeMax time.Time
 
 func initMedia(ci *CptConfItem) error {
 	me := &Media{
-		Offers: make(map[string]bool, len(ci.Offers)),
-		Slots:  make(map[string]MediaSlot, len(ci.Slots)),
+		Offers:    make(map[string]bool, len(ci.Offers)),
+		Slots:     make(map[string]MediaSlot, len(ci.Slots)),
+		DailyImps: ci.DailyImps,
 	}
 
 	var err error
@@ -82,6 +94,34 @@ func initMedia(ci *CptConfItem) error {
 	return nil
 }
 
+// Validate checks time format and daily_imps of all items
+func (cf Conf) Validate() error {
+	for _, ci := range cf {
+		for _, t := range []string{ci.StartTime, ci.EndTime} {
+			if len(t) == 0 {
+				continue
+			}
+			if _, err := time.Parse("2006-01-02 15:00:00", t); err != nil {
+				return err
+			}
+		}
+		if ci.DailyImps < 0 {
+			return errors.New("daily_imps should not be negative")
+		}
+	}
+	return nil
+}
+
+// DailyImps reports whether any item has daily impression budget
+func (cf Conf) DailyImps() bool {
+	for _, ci := range cf {
+		if ci.DailyImps > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func Init(cf *Conf) {
 	gMediaMap = make(map[string]*Media)
 
@@ -118,6 +158,19 @@ func (media *Media) getCptDocs(conds []dnf.Cond, ctx *http_context.Context) (doc
 		if !raw.HasMatchedCreative(ctx) {
 			return false
 		}
+		// 广告主cap和CPT展示预算
+		if ok, state := offer_cap.Allow(raw); !ok {
+			ctx.Debug(raw.UniqId, "cpt offer cap "+state)
+			return false
+		}
+		if ok, state := offer_cap.AllowCPT(raw, media.DailyImps); !ok {
+			ctx.Debug(raw.UniqId, "cpt daily imps "+state)
+			return false
+		}
+		if !pacing.AllowCPTBudget(raw, media.DailyImps) {
+			ctx.Debug(raw.UniqId, "cpt budget pacing")
+			return false
+		}
 		return true
 	})
 
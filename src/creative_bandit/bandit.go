@@ -0,0 +1,360 @@
+package creative_bandit
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"metrics"
+)
+
+/*
+创意选择(Thompson sampling)：
+	key为(offer, slot format, 请求尺寸wxh)，每个创意是一个arm，后验为Beta(a0+click, b0+imp-click)
+	a0, b0由prior_ctr和prior_strength决定
+	每次从匹配的候选创意中按后验采样，取采样值最大的创意
+	key的总展示数不足min_imps时(冷启动)返回空，由调用方按原规则(最大尺寸)选择
+	下发的创意只登记为arm，不计展示；展示和点击都通过/creative/track上报(event=imp/click)，
+	tracker参数中只有offer, slot和creative_id，size为空时记到该offer和format下包含该创意的所有key
+	计数为每个arm的原子变量，只有新建key或arm以及清理时需要写锁
+
+只对slots中的slot生效("*"表示全部)，可通过SIGHUP热更新
+*/
+
+type Conf struct {
+	Slots         []string `json:"slots"`
+	MinImps       float64  `json:"min_imps"`       // 默认100
+	PriorCtr      float64  `json:"prior_ctr"`      // 默认0.01
+	PriorStrength float64  `json:"prior_strength"` // 默认10
+	IdleHours     int      `json:"idle_hours"`     // key超过该时间没有更新则丢弃，默认72
+}
+
+func (cf *Conf) Validate() error {
+	if cf.MinImps < 0 || cf.PriorStrength < 0 || cf.IdleHours < 0 {
+		return errors.New("min_imps, prior_strength and idle_hours should not be negative")
+	}
+	if cf.PriorCtr < 0 || cf.PriorCtr >= 1 {
+		return errors.New("prior_ctr should be 0~1")
+	}
+	return nil
+}
+
+func (cf *Conf) setDefault() {
+	if cf.MinImps == 0 {
+		cf.MinImps = 100
+	}
+	if cf.PriorCtr == 0 {
+		cf.PriorCtr = 0.01
+	}
+	if cf.PriorStrength == 0 {
+		cf.PriorStrength = 10
+	}
+	if cf.IdleHours == 0 {
+		cf.IdleHours = 72
+	}
+}
+
+type Key struct {
+	Offer  string `json:"offer"`
+	Format string `json:"format"`
+	Size   string `json:"size"`
+}
+
+type arm struct {
+	imp   int64 // atomic
+	click int64 // atomic
+}
+
+type armSet struct {
+	arms    map[string]*arm // creative id -> arm, 只在写锁下增加
+	imp     int64           // atomic
+	updated int64           // atomic
+}
+
+type settings struct {
+	all   bool
+	slots map[string]bool
+	conf  Conf
+}
+
+type Bandit struct {
+	sync.RWMutex
+	sets map[Key]*armSet
+
+	settings atomic.Value // *settings
+	now      func() time.Time
+}
+
+func New(cf *Conf) *Bandit {
+	b := &Bandit{
+		sets: make(map[Key]*armSet, 4096),
+		now:  time.Now,
+	}
+	b.Apply(cf)
+	return b
+}
+
+// Apply updates slot switch and priors, counters are kept
+func (b *Bandit) Apply(cf *Conf) {
+	st := &settings{slots: make(map[string]bool, len(cf.Slots)), conf: *cf}
+	st.conf.setDefault()
+	for _, slot := range cf.Slots {
+		if slot == "*" {
+			st.all = true
+		}
+		st.slots[slot] = true
+	}
+	b.settings.Store(st)
+}
+
+func (b *Bandit) loadSettings() *settings {
+	return b.settings.Load().(*settings)
+}
+
+// Enabled returns true if creative bandit is on for slot
+func (b *Bandit) Enabled(slot string) bool {
+	st := b.loadSettings()
+	return st.all || st.slots[slot]
+}
+
+var (
+	chooseTotal = metrics.NewCounterVec("offer_creative_choose_total",
+		"Creative choices, result is bandit or cold_start.", "result")
+	clickTotal = metrics.NewCounter("offer_creative_clicks_total",
+		"Creative clicks reported to bandit.")
+	impTotal = metrics.NewCounter("offer_creative_imps_total",
+		"Creative impressions reported to bandit.")
+)
+
+// Choose samples posterior of candidates, empty string returned on cold start
+func (b *Bandit) Choose(k Key, candidates []string) string {
+	if len(candidates) == 0 {
+		return ""
+	}
+	st := b.loadSettings()
+
+	b.RLock()
+	defer b.RUnlock()
+	set := b.sets[k]
+	if set == nil || float64(atomic.LoadInt64(&set.imp)) < st.conf.MinImps {
+		chooseTotal.With("cold_start").Inc()
+		return ""
+	}
+
+	best, bestScore := "", -1.0
+	for _, id := range candidates {
+		var imp, click float64
+		if a := set.arms[id]; a != nil {
+			imp, click = a.load()
+		}
+		alpha, beta := posterior(&st.conf, imp, click)
+		if score := sampleBeta(alpha, beta); score > bestScore {
+			best, bestScore = id, score
+		}
+	}
+	chooseTotal.With("bandit").Inc()
+	return best
+}
+
+func (a *arm) load() (imp, click float64) {
+	return float64(atomic.LoadInt64(&a.imp)), float64(atomic.LoadInt64(&a.click))
+}
+
+func posterior(cf *Conf, imp, click float64) (float64, float64) {
+	if click > imp {
+		click = imp
+	}
+	return cf.PriorCtr*cf.PriorStrength + click, (1-cf.PriorCtr)*cf.PriorStrength + imp - click
+}
+
+// Register adds creative as an arm of k without counting, impressions and clicks of unknown arms are ignored
+func (b *Bandit) Register(k Key, creative string) {
+	if k.Offer == "" || creative == "" {
+		return
+	}
+	b.RLock()
+	set := b.sets[k]
+	found := set != nil && set.arms[creative] != nil
+	b.RUnlock()
+	if found {
+		return
+	}
+
+	now := b.now().Unix()
+	b.Lock()
+	defer b.Unlock()
+	if set = b.sets[k]; set == nil {
+		set = &armSet{arms: make(map[string]*arm, 4), updated: now}
+		b.sets[k] = set
+	}
+	if set.arms[creative] == nil {
+		set.arms[creative] = &arm{}
+	}
+}
+
+// Imp records n impressions, empty size matches every size of (offer, format) having the creative
+func (b *Bandit) Imp(k Key, creative string, n int64) bool {
+	found := b.each(k, creative, func(set *armSet, a *arm) {
+		atomic.AddInt64(&a.imp, n)
+		atomic.AddInt64(&set.imp, n)
+	})
+	if found {
+		impTotal.Add(n)
+	}
+	return found
+}
+
+// Click records n clicks, empty size matches every size of (offer, format) having the creative
+func (b *Bandit) Click(k Key, creative string, n int64) bool {
+	found := b.each(k, creative, func(set *armSet, a *arm) {
+		atomic.AddInt64(&a.click, n)
+	})
+	if found {
+		clickTotal.Add(n)
+	}
+	return found
+}
+
+// each calls f on the arm of creative in every key matching k and touches the key
+func (b *Bandit) each(k Key, creative string, f func(set *armSet, a *arm)) bool {
+	now := b.now().Unix()
+	b.RLock()
+	defer b.RUnlock()
+
+	found := false
+	visit := func(set *armSet) {
+		if a := set.arms[creative]; a != nil {
+			f(set, a)
+			atomic.StoreInt64(&set.updated, now)
+			found = true
+		}
+	}
+	if k.Size != "" {
+		if set := b.sets[k]; set != nil {
+			visit(set)
+		}
+	} else {
+		for sk, set := range b.sets {
+			if sk.Offer == k.Offer && sk.Format == k.Format {
+				visit(set)
+			}
+		}
+	}
+	return found
+}
+
+// prune drops keys idle longer than idle_hours
+func (b *Bandit) prune() int {
+	deadline := b.now().Unix() - int64(b.loadSettings().conf.IdleHours)*3600
+	b.Lock()
+	defer b.Unlock()
+	n := 0
+	for k, set := range b.sets {
+		if atomic.LoadInt64(&set.updated) < deadline {
+			delete(b.sets, k)
+			n++
+		}
+	}
+	return n
+}
+
+// ArmReport is the posterior of one creative, p_best is estimated by sampling
+type ArmReport struct {
+	Creative string  `json:"creative_id"`
+	Imp      float64 `json:"imp"`
+	Click    float64 `json:"click"`
+	Ctr      float64 `json:"ctr"` // 后验均值
+	Std      float64 `json:"std"`
+	Lower    float64 `json:"lower"` // 95%区间(正态近似)
+	Upper    float64 `json:"upper"`
+	PBest    float64 `json:"p_best"`
+}
+
+type KeyReport struct {
+	Key
+	Imp       float64      `json:"imp"`
+	ColdStart bool         `json:"cold_start"`
+	Arms      []*ArmReport `json:"creatives"`
+}
+
+const pBestRounds = 1000
+
+// Report returns posteriors of keys matching offer and format (empty matches any)
+func (b *Bandit) Report(offer, format string) []*KeyReport {
+	st := b.loadSettings()
+	b.RLock()
+	defer b.RUnlock()
+
+	res := make([]*KeyReport, 0)
+	for k, set := range b.sets {
+		if (offer != "" && k.Offer != offer) || (format != "" && k.Format != format) {
+			continue
+		}
+		imp := float64(atomic.LoadInt64(&set.imp))
+		kr := &KeyReport{Key: k, Imp: imp, ColdStart: imp < st.conf.MinImps}
+		params := make([][2]float64, 0, len(set.arms))
+		for id, a := range set.arms {
+			aImp, aClick := a.load()
+			alpha, beta := posterior(&st.conf, aImp, aClick)
+			mean := alpha / (alpha + beta)
+			std := math.Sqrt(alpha * beta / ((alpha + beta) * (alpha + beta) * (alpha + beta + 1)))
+			kr.Arms = append(kr.Arms, &ArmReport{
+				Creative: id, Imp: aImp, Click: aClick,
+				Ctr: mean, Std: std,
+				Lower: math.Max(0, mean-1.96*std), Upper: math.Min(1, mean+1.96*std),
+			})
+			params = append(params, [2]float64{alpha, beta})
+		}
+		for i := 0; i < pBestRounds; i++ {
+			best, bestScore := 0, -1.0
+			for j, p := range params {
+				if s := sampleBeta(p[0], p[1]); s > bestScore {
+					best, bestScore = j, s
+				}
+			}
+			kr.Arms[best].PBest += 1.0 / pBestRounds
+		}
+		sort.Slice(kr.Arms, func(i, j int) bool { return kr.Arms[i].Ctr > kr.Arms[j].Ctr })
+		res = append(res, kr)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Imp > res[j].Imp })
+	return res
+}
+
+// sampleBeta draws from Beta(a, b) by two gamma samples
+func sampleBeta(a, b float64) float64 {
+	x := sampleGamma(a)
+	y := sampleGamma(b)
+	if x+y == 0 {
+		return 0
+	}
+	return x / (x + y)
+}
+
+// sampleGamma: Marsaglia and Tsang, shape < 1 is boosted by U^(1/shape)
+func sampleGamma(shape float64) float64 {
+	if shape <= 0 {
+		return 0
+	}
+	if shape < 1 {
+		return sampleGamma(shape+1) * math.Pow(rand.Float64(), 1/shape)
+	}
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rand.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rand.Float64()
+		if u < 1-0.0331*x*x*x*x || math.Log(u) < 0.5*x*x+d*(1-v+math.Log(v)) {
+			return d * v
+		}
+	}
+}
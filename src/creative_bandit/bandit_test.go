@@ -0,0 +1,228 @@
+package creative_bandit
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testKey = Key{Offer: "nym_1", Format: "2", Size: "300x250"}
+
+// serve registers creative and reports one impression like tracking does
+func serve(b *Bandit, k Key, creative string) {
+	b.Register(k, creative)
+	b.Imp(k, creative, 1)
+}
+
+func TestColdStart(t *testing.T) {
+	b := New(&Conf{Slots: []string{"335"}, MinImps: 10})
+	if !b.Enabled("335") || b.Enabled("415") {
+		t.Error("unexpected slot switch")
+	}
+	if New(&Conf{Slots: []string{"*"}}).Enabled("415") != true {
+		t.Error("* should enable every slot")
+	}
+
+	for i := 0; i < 9; i++ {
+		serve(b, testKey, "a")
+	}
+	if id := b.Choose(testKey, []string{"a", "b"}); id != "" {
+		t.Errorf("expect cold start, got %s", id)
+	}
+	serve(b, testKey, "b")
+	if id := b.Choose(testKey, []string{"a", "b"}); id == "" {
+		t.Error("expect bandit choice after min_imps")
+	}
+}
+
+func TestChooseWinner(t *testing.T) {
+	b := New(&Conf{MinImps: 1})
+	for i := 0; i < 1000; i++ {
+		serve(b, testKey, "a")
+		serve(b, testKey, "b")
+	}
+	b.Click(testKey, "a", 10)
+	b.Click(testKey, "b", 50)
+
+	wins := 0
+	for i := 0; i < 1000; i++ {
+		if b.Choose(testKey, []string{"a", "b"}) == "b" {
+			wins++
+		}
+	}
+	if wins < 950 {
+		t.Errorf("b should win most of the time, got %d/1000", wins)
+	}
+
+	// 新创意没有数据，按先验采样仍有机会被选中
+	seen := false
+	for i := 0; i < 2000 && !seen; i++ {
+		seen = b.Choose(testKey, []string{"b", "c"}) == "c"
+	}
+	if !seen {
+		t.Error("new creative should be explored")
+	}
+}
+
+func TestClickAnySize(t *testing.T) {
+	b := New(&Conf{})
+	other := testKey
+	other.Size = "320x50"
+	serve(b, testKey, "a")
+	serve(b, other, "a")
+	serve(b, other, "b")
+
+	if !b.Click(Key{Offer: "nym_1", Format: "2"}, "a", 1) {
+		t.Fatal("click should match")
+	}
+	if b.Click(Key{Offer: "nym_1", Format: "2"}, "x", 1) {
+		t.Error("unknown creative should not match")
+	}
+
+	for _, kr := range b.Report("nym_1", "") {
+		for _, a := range kr.Arms {
+			if a.Creative == "a" && a.Click != 1 {
+				t.Errorf("click not recorded for %+v", kr.Key)
+			}
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	b := New(&Conf{MinImps: 1})
+	for i := 0; i < 500; i++ {
+		serve(b, testKey, "a")
+		serve(b, testKey, "b")
+	}
+	b.Click(testKey, "a", 25)
+
+	rs := b.Report("nym_1", "2")
+	if len(rs) != 1 || len(rs[0].Arms) != 2 || rs[0].ColdStart {
+		t.Fatalf("unexpected report: %+v", rs)
+	}
+	a := rs[0].Arms[0]
+	if a.Creative != "a" || a.Lower >= a.Ctr || a.Upper <= a.Ctr || a.PBest < 0.95 {
+		t.Errorf("unexpected arm: %+v", a)
+	}
+	if math.Abs(rs[0].Arms[0].PBest+rs[0].Arms[1].PBest-1) > 1e-6 {
+		t.Errorf("p_best should sum to 1: %+v", rs[0].Arms)
+	}
+	if len(b.Report("other", "")) != 0 {
+		t.Error("report should be filtered by offer")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	b := New(&Conf{IdleHours: 1})
+	b.now = func() time.Time { return now }
+	serve(b, testKey, "a")
+	now = now.Add(2 * time.Hour)
+	if n := b.prune(); n != 1 {
+		t.Errorf("expect 1 key pruned, got %d", n)
+	}
+}
+
+func TestSampleBeta(t *testing.T) {
+	for _, p := range [][2]float64{{0.1, 9.9}, {2, 3}, {50, 950}} {
+		sum := 0.0
+		for i := 0; i < 20000; i++ {
+			sum += sampleBeta(p[0], p[1])
+		}
+		mean, want := sum/20000, p[0]/(p[0]+p[1])
+		if math.Abs(mean-want) > 0.1*want+0.005 {
+			t.Errorf("Beta(%v, %v) mean %v, expect %v", p[0], p[1], mean, want)
+		}
+	}
+}
+
+func TestTrackHandler(t *testing.T) {
+	std = New(&Conf{})
+	defer func() { std = New(&Conf{}) }()
+	std.Register(Key{Offer: "nym_1", Format: "0", Size: "300x250"}, "a")
+
+	track := func(remote, query string) (int, string) {
+		r := httptest.NewRequest("GET", "/creative/track?"+query, nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		TrackHandler(w, r)
+		return w.Code, w.Body.String()
+	}
+	if code, _ := track("8.8.8.8:1", "offer=nym_1&creative_id=a"); code != http.StatusForbidden {
+		t.Errorf("expect 403, got %d", code)
+	}
+	if code, _ := track("10.0.0.1:1", "offer=nym_1"); code != http.StatusBadRequest {
+		t.Errorf("expect 400, got %d", code)
+	}
+	// slot不存在时format为0
+	if _, body := track("10.0.0.1:1", "offer=nym_1&slot=335&creative_id=a"); body != "ok" {
+		t.Errorf("expect ok, got %s", body)
+	}
+	if _, body := track("10.0.0.1:1", "offer=nym_1&slot=335&creative_id=b"); body != "ignored" {
+		t.Errorf("expect ignored, got %s", body)
+	}
+	if _, body := track("10.0.0.1:1", "event=imp&offer=nym_1&slot=335&creative_id=a&n=3"); body != "ok" {
+		t.Errorf("expect ok, got %s", body)
+	}
+	if code, _ := track("10.0.0.1:1", "event=conv&offer=nym_1&slot=335&creative_id=a"); code != http.StatusBadRequest {
+		t.Errorf("expect 400, got %d", code)
+	}
+	rs := std.Report("nym_1", "0")
+	if len(rs) != 1 || rs[0].Imp != 3 || rs[0].Arms[0].Click != 1 {
+		t.Errorf("unexpected report: %+v", rs)
+	}
+}
+
+func TestPick(t *testing.T) {
+	std = New(&Conf{MinImps: 5})
+	defer func() { std = New(&Conf{}) }()
+
+	ids := []string{"a", "b"}
+	for i := 0; i < 5; i++ {
+		if id := Pick(testKey, ids, "b"); id != "b" {
+			t.Errorf("cold start should pick fallback, got %s", id)
+		}
+	}
+	// 下发不计展示
+	if rs := std.Report("nym_1", ""); len(rs) != 1 || rs[0].Imp != 0 || !rs[0].ColdStart {
+		t.Fatalf("pick should only register arms: %+v", rs)
+	}
+
+	std.Imp(testKey, "b", 5)
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		seen[Pick(testKey, ids, "b")] = true
+	}
+	if !seen["a"] {
+		t.Error("bandit should explore creative a after cold start")
+	}
+	if !std.Imp(testKey, "a", 1) {
+		t.Error("picked creative should be registered")
+	}
+	if id := Pick(testKey, []string{"a"}, "a"); id != "a" {
+		t.Errorf("single candidate should be picked, got %s", id)
+	}
+}
+
+func TestConcurrentTrack(t *testing.T) {
+	b := New(&Conf{})
+	b.Register(testKey, "a")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				b.Imp(testKey, "a", 1)
+				b.Choose(testKey, []string{"a", "b"})
+			}
+		}()
+	}
+	wg.Wait()
+	if rs := b.Report("nym_1", ""); rs[0].Imp != 8000 || rs[0].Arms[0].Imp != 8000 {
+		t.Errorf("lost impressions: %+v", rs[0])
+	}
+}
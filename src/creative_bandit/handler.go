@@ -0,0 +1,124 @@
+package creative_bandit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ssp"
+	"util"
+)
+
+/*
+只允许内网访问:
+	/creative/track?event=imp&offer=nym_123&slot=335&creative_id=c1&n=1   展示(imp)或点击(click, 默认)上报(offer为uniq_id)，
+	                                                                       也可以直接给format和size
+	/creative/report?offer=nym_123&format=2                      各创意后验(ctr, 95%区间, p_best)
+*/
+
+var std = New(&Conf{})
+
+// Init applies conf to default bandit and starts pruning idle keys
+func Init(cf *Conf) {
+	std.Apply(cf)
+	go func() {
+		for range time.Tick(time.Hour) {
+			std.prune()
+		}
+	}()
+}
+
+// Reload updates slot switch and priors
+func Reload(cf *Conf) {
+	std.Apply(cf)
+}
+
+func Enabled(slot string) bool {
+	return std.Enabled(slot)
+}
+
+func Choose(k Key, candidates []string) string {
+	return std.Choose(k, candidates)
+}
+
+// Pick chooses one of candidates for k, fallback is used on cold start, the picked creative is registered as arm of k
+func Pick(k Key, candidates []string, fallback string) string {
+	id := ""
+	if len(candidates) > 1 {
+		id = std.Choose(k, candidates)
+	}
+	if id == "" {
+		id = fallback
+	}
+	std.Register(k, id)
+	return id
+}
+
+// FormatOf returns format of slot, "0" for unknown slot
+func FormatOf(slot string) string {
+	if store := ssp.GetGlobalSlotStore(); store != nil {
+		if info := store.Get(slot); info != nil {
+			return strconv.Itoa(info.Format)
+		}
+	}
+	return "0"
+}
+
+func TrackHandler(w http.ResponseWriter, r *http.Request) {
+	if !util.IsPrivateAddr(r.RemoteAddr) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	r.ParseForm()
+
+	k := Key{Offer: r.Form.Get("offer"), Format: r.Form.Get("format"), Size: r.Form.Get("size")}
+	if k.Format == "" {
+		k.Format = FormatOf(r.Form.Get("slot"))
+	}
+	creative := r.Form.Get("creative_id")
+	if k.Offer == "" || creative == "" {
+		http.Error(w, "offer and creative_id are required", http.StatusBadRequest)
+		return
+	}
+	n := int64(1)
+	if s := r.Form.Get("n"); s != "" {
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v < 1 || v > 10000 {
+			http.Error(w, "n should be 1..10000", http.StatusBadRequest)
+			return
+		}
+		n = v
+	}
+
+	var found bool
+	switch r.Form.Get("event") {
+	case "imp":
+		found = std.Imp(k, creative, n)
+	case "", "click":
+		found = std.Click(k, creative, n)
+	default:
+		http.Error(w, "event should be imp or click", http.StatusBadRequest)
+		return
+	}
+	if !found {
+		// 创意没有经过bandit下发(slot未开启或已过期)，忽略
+		w.Write([]byte("ignored"))
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func ReportHandler(w http.ResponseWriter, r *http.Request) {
+	if !util.IsPrivateAddr(r.RemoteAddr) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("offer") == "" {
+		http.Error(w, "offer is required", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(std.Report(q.Get("offer"), q.Get("format")))
+}
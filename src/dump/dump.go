@@ -8,6 +8,8 @@ import (
 
 	dnf "github.com/brg-liuwei/godnf"
 
+	"offer_cap"
+	"pacing"
 	"raw_ad"
 )
 
@@ -47,6 +49,27 @@ func Serve(addr string) {
 
 		r.ParseForm()
 
+		// offer cap状态，按ratio从高到低
+		if r.Form.Get("caps") == "1" {
+			b, _ := json.Marshal(map[string]interface{}{
+				"enabled": offer_cap.Enabled(),
+				"data":    offer_cap.Report(),
+			})
+			w.Write(b)
+			return
+		}
+
+		// 预算pacing状态，按放行概率从低到高
+		if r.Form.Get("budget") == "1" {
+			offers, shape := pacing.BudgetReport()
+			b, _ := json.Marshal(map[string]interface{}{
+				"data":  offers,
+				"shape": shape,
+			})
+			w.Write(b)
+			return
+		}
+
 		country := r.Form.Get("country")
 		platform := r.Form.Get("platform")
 		channel := r.Form.Get("channel")
@@ -98,18 +121,25 @@ func Serve(addr string) {
 			}
 
 			list := make([]interface{}, 0, len(docs))
+			caps := make(map[string]*offer_cap.Status)
 			for _, doc := range docs {
+				attr, _ := h.DocId2Attr(doc)
 				if toMap == "1" {
 					raw := h.DocId2Map(doc)
 					list = append(list, raw)
 				} else {
-					raw, _ := h.DocId2Attr(doc)
-					list = append(list, raw)
+					list = append(list, attr)
+				}
+				if raw, ok := attr.(*raw_ad.RawAdObj); ok {
+					if st := offer_cap.Get(raw.UniqId); st != nil {
+						caps[raw.UniqId] = st
+					}
 				}
 			}
 			b, _ := json.Marshal(map[string]interface{}{
 				"data":          list,
 				"total_records": len(docs),
+				"caps":          caps,
 			})
 			w.Write(b)
 			return
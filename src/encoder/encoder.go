@@ -0,0 +1,127 @@
+package encoder
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/hex"
+	"io"
+	"net/http"
+
+	"aes"
+	"http_context"
+)
+
+// 标准压缩的最小body长度，太小的body压缩收益不大
+const MinCompressSize = 1000
+
+/*
+响应体编码流程：
+
+	v3协议(CT-Accept-Encoding: gzip): gzip -> CT-Content-Encoding: gzip -> aes加密 -> binary(默认)或hex(test_encode=hex)
+	其它: aes加密(hex) -> 标准Accept-Encoding压缩(gzip优先，其次deflate)
+
+get_sub_ad的旧客户端(见LegacyOptions): 超过MinCompressSize才CT gzip -> aes加密后总是设置CT-Encrypt ->
+	仍按Accept-Encoding做标准gzip
+*/
+type Options struct {
+	CTGzip  bool // CT-Accept-Encoding: gzip
+	Aes     bool // aes加密
+	HexOnly bool // v3协议下加密结果仍输出hex(test_encode=hex)
+
+	AcceptGzip    bool // Accept-Encoding: gzip
+	AcceptDeflate bool // Accept-Encoding: deflate
+
+	CTGzipMinSize int  // 只CT gzip长度超过该值的body，0表示不限制
+	CTEncrypt     bool // 没有CT gzip时aes结果也按CT-Encrypt输出(binary或hex)
+	GzipAfterCT   bool // CT编码之后仍做标准压缩
+}
+
+// NewOptions builds encoding options from request context, nil ctx means plain body
+func NewOptions(ctx *http_context.Context) Options {
+	if ctx == nil {
+		return Options{}
+	}
+	return Options{
+		CTGzip:        ctx.UseGzipCT,
+		Aes:           ctx.UseAes,
+		HexOnly:       ctx.TestEncode == "hex",
+		AcceptGzip:    ctx.UseGzip,
+		AcceptDeflate: ctx.UseDeflate,
+	}
+}
+
+// LegacyOptions is NewOptions with the encoding get_sub_ad clients depend on, deflate is not supported by them
+func LegacyOptions(ctx *http_context.Context) Options {
+	opt := NewOptions(ctx)
+	opt.AcceptDeflate = false
+	opt.CTGzipMinSize = MinCompressSize
+	opt.CTEncrypt = true
+	opt.GzipAfterCT = true
+	return opt
+}
+
+// Encode writes b to w according to opt, returns bytes written of the encoded body
+func Encode(w http.ResponseWriter, b []byte, opt Options) (int, error) {
+	if opt.CTGzip && (opt.CTGzipMinSize == 0 || len(b) > opt.CTGzipMinSize) {
+		var err error
+		if b, err = gzipBytes(b); err != nil {
+			return 0, err
+		}
+		w.Header().Set("CT-Content-Encoding", "gzip")
+	}
+
+	if opt.Aes { // 加密
+		b = aes.EncryptBytes(b)
+		if opt.CTGzip || opt.CTEncrypt {
+			if opt.HexOnly {
+				w.Header().Set("CT-Encrypt", "hex")
+			} else {
+				w.Header().Set("CT-Encrypt", "binary")
+				decodeBytes := make([]byte, hex.DecodedLen(len(b)))
+				hex.Decode(decodeBytes, b)
+				b = decodeBytes
+			}
+		}
+	}
+	if opt.CTGzip && !opt.GzipAfterCT {
+		return w.Write(b)
+	}
+
+	if len(b) > MinCompressSize {
+		if opt.AcceptGzip {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Add("Vary", "Accept-Encoding")
+			enc := gzip.NewWriter(w)
+			return writeAndClose(enc, b)
+		}
+		if opt.AcceptDeflate {
+			w.Header().Set("Content-Encoding", "deflate")
+			w.Header().Add("Vary", "Accept-Encoding")
+			enc, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return writeAndClose(enc, b)
+		}
+	}
+	return w.Write(b)
+}
+
+func writeAndClose(enc io.WriteCloser, b []byte) (int, error) {
+	n, err := enc.Write(b)
+	if cerr := enc.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gzip.NewWriter(&buf)
+	if _, err := enc.Write(b); err != nil {
+		enc.Close()
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
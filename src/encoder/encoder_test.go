@@ -0,0 +1,192 @@
+package encoder
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"aes"
+	"http_context"
+)
+
+func init() {
+	aes.Init(&aes.Conf{
+		Key: "1122334455667788112233445566778811223344556677881122334455667788",
+	})
+}
+
+func body(n int) []byte {
+	return []byte(`{"err_no":0,"data":"` + strings.Repeat("x", n) + `"}`)
+}
+
+func gunzip(t *testing.T, b []byte) []byte {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rc
+}
+
+func TestPlain(t *testing.T) {
+	b := body(2000)
+	w := httptest.NewRecorder()
+	if _, err := Encode(w, b, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.Body.Bytes(), b) {
+		t.Error("plain body changed")
+	}
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Error("unexpected Content-Encoding")
+	}
+}
+
+func TestSmallBodyNotCompressed(t *testing.T) {
+	b := body(10)
+	w := httptest.NewRecorder()
+	Encode(w, b, Options{AcceptGzip: true, AcceptDeflate: true})
+	if w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), b) {
+		t.Error("small body should not be compressed")
+	}
+}
+
+func TestGzip(t *testing.T) {
+	b := body(2000)
+	w := httptest.NewRecorder()
+	Encode(w, b, Options{AcceptGzip: true, AcceptDeflate: true})
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("gzip should be preferred")
+	}
+	if w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Error("Vary header missing")
+	}
+	if !bytes.Equal(gunzip(t, w.Body.Bytes()), b) {
+		t.Error("gzip round trip error")
+	}
+}
+
+func TestDeflate(t *testing.T) {
+	b := body(2000)
+	w := httptest.NewRecorder()
+	Encode(w, b, Options{AcceptDeflate: true})
+	if w.Header().Get("Content-Encoding") != "deflate" {
+		t.Fatal("Content-Encoding should be deflate")
+	}
+	rc, err := ioutil.ReadAll(flate.NewReader(w.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rc, b) {
+		t.Error("deflate round trip error")
+	}
+}
+
+func TestAesGzip(t *testing.T) {
+	b := body(2000)
+	w := httptest.NewRecorder()
+	Encode(w, b, Options{Aes: true, AcceptGzip: true})
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("Content-Encoding should be gzip")
+	}
+	if !bytes.Equal(aes.DecryptBytes(gunzip(t, w.Body.Bytes())), b) {
+		t.Error("aes + gzip round trip error")
+	}
+}
+
+func TestCTGzipBinary(t *testing.T) {
+	b := body(100)
+	w := httptest.NewRecorder()
+	Encode(w, b, Options{CTGzip: true, Aes: true, AcceptGzip: true})
+	if w.Header().Get("CT-Content-Encoding") != "gzip" || w.Header().Get("CT-Encrypt") != "binary" {
+		t.Fatal("CT headers error: ", w.Header())
+	}
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Error("CT body should not be compressed again")
+	}
+	cipher := []byte(hex.EncodeToString(w.Body.Bytes()))
+	if !bytes.Equal(gunzip(t, aes.DecryptBytes(cipher)), b) {
+		t.Error("CT binary round trip error")
+	}
+}
+
+func TestCTGzipHex(t *testing.T) {
+	b := body(100)
+	w := httptest.NewRecorder()
+	Encode(w, b, Options{CTGzip: true, Aes: true, HexOnly: true})
+	if w.Header().Get("CT-Encrypt") != "hex" {
+		t.Fatal("CT-Encrypt should be hex")
+	}
+	if !bytes.Equal(gunzip(t, aes.DecryptBytes(w.Body.Bytes())), b) {
+		t.Error("CT hex round trip error")
+	}
+}
+
+func TestCTGzipNoAes(t *testing.T) {
+	b := body(100)
+	w := httptest.NewRecorder()
+	Encode(w, b, Options{CTGzip: true})
+	if w.Header().Get("CT-Encrypt") != "" {
+		t.Error("unexpected CT-Encrypt")
+	}
+	if !bytes.Equal(gunzip(t, w.Body.Bytes()), b) {
+		t.Error("CT gzip round trip error")
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	if NewOptions(nil) != (Options{}) {
+		t.Error("nil ctx should be plain")
+	}
+
+	ctx := &http_context.Context{
+		UseGzipCT:  true,
+		UseAes:     true,
+		UseDeflate: true,
+		TestEncode: "hex",
+	}
+	opt := NewOptions(ctx)
+	if !opt.CTGzip || !opt.Aes || !opt.HexOnly || opt.AcceptGzip || !opt.AcceptDeflate {
+		t.Error("NewOptions error: ", opt)
+	}
+}
+
+func TestLegacyOptions(t *testing.T) {
+	ctx := &http_context.Context{UseGzipCT: true, UseAes: true, UseGzip: true, UseDeflate: true}
+	opt := LegacyOptions(ctx)
+	if opt.AcceptDeflate || !opt.CTEncrypt || !opt.GzipAfterCT || opt.CTGzipMinSize != MinCompressSize {
+		t.Fatal("LegacyOptions error: ", opt)
+	}
+
+	// 小body不做CT gzip，但仍设置CT-Encrypt
+	b := body(100)
+	w := httptest.NewRecorder()
+	Encode(w, b, opt)
+	if w.Header().Get("CT-Content-Encoding") != "" || w.Header().Get("CT-Encrypt") != "binary" {
+		t.Fatal("legacy small body headers error: ", w.Header())
+	}
+	if !bytes.Equal(aes.DecryptBytes([]byte(hex.EncodeToString(w.Body.Bytes()))), b) {
+		t.Error("legacy small body round trip error")
+	}
+
+	// CT编码之后仍做标准gzip
+	opt.CTGzip = false
+	b = body(2000)
+	w = httptest.NewRecorder()
+	Encode(w, b, opt)
+	if w.Header().Get("CT-Encrypt") != "binary" || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("legacy large body headers error: ", w.Header())
+	}
+	cipher := []byte(hex.EncodeToString(gunzip(t, w.Body.Bytes())))
+	if !bytes.Equal(aes.DecryptBytes(cipher), b) {
+		t.Error("legacy large body round trip error")
+	}
+}
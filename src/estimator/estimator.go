@@ -0,0 +1,254 @@
+package estimator
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"metrics"
+)
+
+/*
+在线CTR/CVR估计：
+	served: status.RecordReq中下发的offer(uniq_id)
+	imp, click, conv: 由/track上报
+按(offer, slot, country)和(offer)两级记录指数衰减计数(半衰期half_life_minutes)。
+
+估计采用Beta-Binomial平滑，先验强度为prior_strength次展示:
+	offer级: 以调用方给的先验(如localrank的prior)为均值
+	(offer, slot, country)级: 以offer级估计为均值
+没有imp上报时用served作为CTR的分母。
+*/
+
+type Conf struct {
+	HalfLifeMinutes  int     `json:"half_life_minutes"` // 默认1440
+	PriorStrength    float64 `json:"prior_strength"`    // 默认100
+	SnapshotPath     string  `json:"snapshot_path"`     // 为空时不做快照
+	SnapshotInterval int     `json:"snapshot_interval"` // 秒，默认300
+}
+
+// Validate checks conf, zero values mean defaults
+func (cf *Conf) Validate() error {
+	if cf.HalfLifeMinutes < 0 {
+		return errors.New("half_life_minutes should not be negative")
+	}
+	if cf.PriorStrength < 0 {
+		return errors.New("prior_strength should not be negative")
+	}
+	if cf.SnapshotInterval < 0 {
+		return errors.New("snapshot_interval should not be negative")
+	}
+	return nil
+}
+
+func (cf *Conf) setDefault() {
+	if cf.HalfLifeMinutes == 0 {
+		cf.HalfLifeMinutes = 1440
+	}
+	if cf.PriorStrength == 0 {
+		cf.PriorStrength = 100
+	}
+	if cf.SnapshotInterval == 0 {
+		cf.SnapshotInterval = 300
+	}
+}
+
+const (
+	Served = "served"
+	Imp    = "imp"
+	Click  = "click"
+	Conv   = "conv"
+)
+
+// 衰减后低于该值的计数在快照时丢弃
+const minCount = 0.01
+
+type key struct {
+	Offer   string `json:"offer"`
+	Slot    string `json:"slot,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+type counters struct {
+	Served float64 `json:"served"`
+	Imp    float64 `json:"imp"`
+	Click  float64 `json:"click"`
+	Conv   float64 `json:"conv"`
+	T      int64   `json:"t"` // 上次衰减的unix秒
+}
+
+func (c *counters) decay(now int64, halfLife float64) {
+	if now > c.T {
+		f := math.Exp2(-float64(now-c.T) / halfLife)
+		c.Served *= f
+		c.Imp *= f
+		c.Click *= f
+		c.Conv *= f
+	}
+	c.T = now
+}
+
+func validEvent(event string) bool {
+	return event == Served || event == Imp || event == Click || event == Conv
+}
+
+func (c *counters) add(event string, n float64) {
+	switch event {
+	case Served:
+		c.Served += n
+	case Imp:
+		c.Imp += n
+	case Click:
+		c.Click += n
+	case Conv:
+		c.Conv += n
+	}
+}
+
+const shardNum = 64
+
+type shard struct {
+	sync.Mutex
+	m map[key]*counters
+}
+
+type Estimator struct {
+	conf     Conf
+	halfLife float64 // 秒
+	shards   [shardNum]shard
+	now      func() time.Time
+}
+
+func New(cf *Conf) *Estimator {
+	conf := *cf
+	conf.setDefault()
+	e := &Estimator{
+		conf:     conf,
+		halfLife: float64(conf.HalfLifeMinutes * 60),
+		now:      time.Now,
+	}
+	for i := range e.shards {
+		e.shards[i].m = make(map[key]*counters, 1024)
+	}
+	return e
+}
+
+func (e *Estimator) shard(k key) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(k.Offer))
+	return &e.shards[h.Sum32()%shardNum]
+}
+
+var eventTotal = metrics.NewCounterVec("offer_estimator_events_total",
+	"Events ingested by ctr/cvr estimator.", "event")
+
+// Add records n events of offer, it returns false for unknown event or empty offer
+func (e *Estimator) Add(event, offer, slot, country string, n float64) bool {
+	if offer == "" || n <= 0 || !validEvent(event) {
+		return false
+	}
+	now := e.now().Unix()
+	keys := []key{{Offer: offer}}
+	if slot != "" || country != "" {
+		keys = append(keys, key{offer, slot, country})
+	}
+	for _, k := range keys {
+		s := e.shard(k) // 同一offer的两级key在同一个shard
+		s.Lock()
+		c := s.m[k]
+		if c == nil {
+			c = &counters{T: now}
+			s.m[k] = c
+		}
+		c.decay(now, e.halfLife)
+		c.add(event, n)
+		s.Unlock()
+	}
+	eventTotal.With(event).Add(int64(n))
+	return true
+}
+
+// AddServed records offers served by one request
+func (e *Estimator) AddServed(slot, country string, offers []string) {
+	for _, oid := range offers {
+		e.Add(Served, oid, slot, country, 1)
+	}
+}
+
+func (e *Estimator) get(k key, now int64) counters {
+	s := e.shard(k)
+	s.Lock()
+	defer s.Unlock()
+	c := s.m[k]
+	if c == nil {
+		return counters{}
+	}
+	c.decay(now, e.halfLife)
+	return *c
+}
+
+// Estimate is smoothed ctr and cvr with their posterior standard deviation,
+// confidence is the weight of observed data against the prior (0~1)
+type Estimate struct {
+	Ctr           float64 `json:"ctr"`
+	CtrStd        float64 `json:"ctr_std"`
+	CtrConfidence float64 `json:"ctr_confidence"`
+	Cvr           float64 `json:"cvr"`
+	CvrStd        float64 `json:"cvr_std"`
+	CvrConfidence float64 `json:"cvr_confidence"`
+
+	Served float64 `json:"served"`
+	Imp    float64 `json:"imp"`
+	Click  float64 `json:"click"`
+	Conv   float64 `json:"conv"`
+}
+
+// beta returns posterior mean, std and data weight of Beta(mean*k, (1-mean)*k) after hits/trials
+func beta(hits, trials, mean, k float64) (float64, float64, float64) {
+	if hits > trials {
+		hits = trials // 衰减或上报延迟可能导致点击数大于展示数
+	}
+	a := mean*k + hits
+	b := (1-mean)*k + trials - hits
+	if a+b <= 0 {
+		return mean, 0, 0
+	}
+	m := a / (a + b)
+	std := math.Sqrt(a * b / ((a + b) * (a + b) * (a + b + 1)))
+	return m, std, trials / (trials + k)
+}
+
+func (e *Estimator) smooth(c counters, priorCtr, priorCvr float64) Estimate {
+	trials := c.Imp
+	if trials == 0 {
+		trials = c.Served
+	}
+	est := Estimate{Served: c.Served, Imp: c.Imp, Click: c.Click, Conv: c.Conv}
+	est.Ctr, est.CtrStd, est.CtrConfidence = beta(c.Click, trials, priorCtr, e.conf.PriorStrength)
+	est.Cvr, est.CvrStd, est.CvrConfidence = beta(c.Conv, c.Click, priorCvr, e.conf.PriorStrength)
+	return est
+}
+
+// Estimate returns smoothed ctr and cvr of offer on (slot, country), priors are used without data
+func (e *Estimator) Estimate(offer, slot, country string, priorCtr, priorCvr float64) Estimate {
+	now := e.now().Unix()
+	est := e.smooth(e.get(key{Offer: offer}, now), priorCtr, priorCvr)
+	if slot == "" && country == "" {
+		return est
+	}
+	return e.smooth(e.get(key{offer, slot, country}, now), est.Ctr, est.Cvr)
+}
+
+// Len returns the number of keys
+func (e *Estimator) Len() int {
+	n := 0
+	for i := range e.shards {
+		s := &e.shards[i]
+		s.Lock()
+		n += len(s.m)
+		s.Unlock()
+	}
+	return n
+}
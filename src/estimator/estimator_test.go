@@ -0,0 +1,158 @@
+package estimator
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestEstimator(now *time.Time) *Estimator {
+	e := New(&Conf{HalfLifeMinutes: 60, PriorStrength: 100})
+	e.now = func() time.Time { return *now }
+	return e
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestEstimatePrior(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	e := newTestEstimator(&now)
+
+	est := e.Estimate("nym_1", "335", "US", 0.01, 0.02)
+	if !near(est.Ctr, 0.01) || !near(est.Cvr, 0.02) || est.CtrConfidence != 0 {
+		t.Errorf("no data should return prior, got %+v", est)
+	}
+	if e.Add("view", "nym_1", "335", "US", 1) || e.Add(Click, "", "335", "US", 1) {
+		t.Error("invalid event or empty offer should be rejected")
+	}
+}
+
+func TestEstimateSmooth(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	e := newTestEstimator(&now)
+
+	e.AddServed("335", "US", []string{"nym_1", ""})
+	e.Add(Imp, "nym_1", "335", "US", 900)
+	e.Add(Imp, "nym_1", "415", "CN", 100)
+	e.Add(Click, "nym_1", "335", "US", 90)
+	e.Add(Conv, "nym_1", "335", "US", 9)
+
+	// offer级: (0.01*100+90)/(100+1000) = 91/1100
+	offer := e.Estimate("nym_1", "", "", 0.01, 0.02)
+	if !near(offer.Ctr, 91.0/1100) || offer.Imp != 1000 || offer.Served != 1 {
+		t.Errorf("unexpected offer estimate: %+v", offer)
+	}
+	if !near(offer.CtrConfidence, 1000.0/1100) || offer.CtrStd <= 0 {
+		t.Errorf("unexpected confidence: %+v", offer)
+	}
+
+	// slot级以offer级为先验
+	slot := e.Estimate("nym_1", "335", "US", 0.01, 0.02)
+	if !near(slot.Ctr, (offer.Ctr*100+90)/1000) {
+		t.Errorf("unexpected slot estimate: %+v", slot)
+	}
+	cn := e.Estimate("nym_1", "415", "CN", 0.01, 0.02)
+	if !(cn.Ctr < offer.Ctr) || cn.Click != 0 {
+		t.Errorf("CN without clicks should be below offer ctr: %+v", cn)
+	}
+	if !near(slot.Cvr, (offer.Cvr*100+9)/190) {
+		t.Errorf("unexpected cvr: %+v", slot)
+	}
+}
+
+func TestDecay(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	e := newTestEstimator(&now)
+	e.Add(Imp, "nym_1", "", "", 100)
+	e.Add(Click, "nym_1", "", "", 10)
+
+	now = now.Add(time.Hour)
+	est := e.Estimate("nym_1", "", "", 0.01, 0.02)
+	if !near(est.Imp, 50) || !near(est.Click, 5) {
+		t.Errorf("counters should be halved after one half life: %+v", est)
+	}
+	if e.Len() != 1 {
+		t.Errorf("empty slot and country should be recorded once, got %d keys", e.Len())
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "estimator_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "estimator.snap")
+
+	now := time.Unix(1500000000, 0)
+	e := newTestEstimator(&now)
+	e.Add(Imp, "nym_1", "335", "US", 100)
+	e.Add(Click, "nym_1", "335", "US", 10)
+	e.Add(Imp, "old_1", "335", "US", 0.02)
+	now = now.Add(2 * time.Hour)
+	if err := e.Snapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestEstimator(&now)
+	n, err := r.Restore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expect 2 entries (decayed old_1 skipped), got %d", n)
+	}
+	if files, _ := filepath.Glob(path + ".tmp*"); len(files) != 0 {
+		t.Error("temp files left: ", files)
+	}
+
+	// 没有快照时也按pruneInterval清理
+	if dropped := e.Prune(); dropped == 0 || e.Len() != n {
+		t.Errorf("expect decayed old_1 pruned, dropped %d, %d keys left", dropped, e.Len())
+	}
+	want := e.Estimate("nym_1", "335", "US", 0.01, 0.02)
+	if got := r.Estimate("nym_1", "335", "US", 0.01, 0.02); got != want {
+		t.Errorf("restored estimate %+v, expect %+v", got, want)
+	}
+
+	ioutil.WriteFile(path, []byte("broken"), 0644)
+	if _, err := r.Restore(path); err == nil {
+		t.Error("broken snapshot should fail")
+	}
+}
+
+func TestTrackHandler(t *testing.T) {
+	std = New(&Conf{})
+	defer func() { std = New(&Conf{}) }()
+
+	track := func(remote, query string) int {
+		r := httptest.NewRequest("GET", "/track?"+query, nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		TrackHandler(w, r)
+		return w.Code
+	}
+
+	if code := track("8.8.8.8:1000", "event=click&offer=nym_1"); code != http.StatusForbidden {
+		t.Errorf("public address should be forbidden, got %d", code)
+	}
+	if code := track("10.0.0.1:1000", "event=view&offer=nym_1"); code != http.StatusBadRequest {
+		t.Errorf("unknown event should be 400, got %d", code)
+	}
+	if code := track("10.0.0.1:1000", "event=click&offer=nym_1&n=0"); code != http.StatusBadRequest {
+		t.Errorf("bad n should be 400, got %d", code)
+	}
+	if code := track("10.0.0.1:1000", "event=click&offer=nym_1&slot=335&country=US&n=3"); code != http.StatusOK {
+		t.Errorf("expect 200, got %d", code)
+	}
+	if est := Get("nym_1", "335", "US", 0.01, 0.02); est.Click != 3 {
+		t.Errorf("click not recorded: %+v", est)
+	}
+}
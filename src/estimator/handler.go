@@ -0,0 +1,74 @@
+package estimator
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"util"
+)
+
+/*
+只允许内网访问:
+	/track?event=click&offer=nym_123&slot=335&country=US&n=1   上报imp, click, conv(served也可以，但通常由进程内记录)
+	/estimator?offer=nym_123&slot=335&country=US&ctr=0.01&cvr=0.02   查询估计值，ctr和cvr为先验
+*/
+
+const maxTrackNum = 10000
+
+var trackHooks []func(event, offer string, n float64)
+
+// OnTrack registers f called on every accepted /track event, it should be called before serving
+func OnTrack(f func(event, offer string, n float64)) {
+	trackHooks = append(trackHooks, f)
+}
+
+func TrackHandler(w http.ResponseWriter, r *http.Request) {
+	if !util.IsPrivateAddr(r.RemoteAddr) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	r.ParseForm()
+
+	n := 1.0
+	if s := r.Form.Get("n"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 1 || v > maxTrackNum {
+			http.Error(w, "n should be 1..10000", http.StatusBadRequest)
+			return
+		}
+		n = float64(v)
+	}
+	if !Add(r.Form.Get("event"), r.Form.Get("offer"), r.Form.Get("slot"), r.Form.Get("country"), n) {
+		http.Error(w, "event should be served, imp, click or conv and offer is required", http.StatusBadRequest)
+		return
+	}
+	for _, f := range trackHooks {
+		f(r.Form.Get("event"), r.Form.Get("offer"), n)
+	}
+	w.Write([]byte("ok"))
+}
+
+func EstimateHandler(w http.ResponseWriter, r *http.Request) {
+	if !util.IsPrivateAddr(r.RemoteAddr) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	q := r.URL.Query()
+	offer := q.Get("offer")
+	if offer == "" {
+		http.Error(w, "offer is required", http.StatusBadRequest)
+		return
+	}
+	priorCtr, _ := strconv.ParseFloat(q.Get("ctr"), 64)
+	priorCvr, _ := strconv.ParseFloat(q.Get("cvr"), 64)
+	if priorCtr <= 0 || priorCtr >= 1 {
+		priorCtr = 0.01
+	}
+	if priorCvr <= 0 || priorCvr >= 1 {
+		priorCvr = 0.02
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Get(offer, q.Get("slot"), q.Get("country"), priorCtr, priorCvr))
+}
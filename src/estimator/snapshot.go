@@ -0,0 +1,194 @@
+package estimator
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"logger"
+	"metrics"
+)
+
+// 快照格式: gzip(json)，先写同目录下唯一的临时文件再rename，避免写一半时进程退出，
+// graceful handoff时新旧进程同时写快照也不会互相覆盖临时文件
+type snapshot struct {
+	Time    int64    `json:"time"`
+	Entries []*entry `json:"entries"`
+}
+
+type entry struct {
+	key
+	counters
+}
+
+var snapshotTime = metrics.NewGauge("offer_estimator_snapshot_timestamp_seconds",
+	"Unix time of the latest estimator snapshot.")
+
+// pruneInterval of decayed counters, independent of snapshot
+const pruneInterval = 5 * time.Minute
+
+func (c *counters) negligible() bool {
+	return c.Served < minCount && c.Imp < minCount && c.Click < minCount && c.Conv < minCount
+}
+
+// Prune drops counters decayed below minCount, it returns the number of keys dropped
+func (e *Estimator) Prune() int {
+	now := e.now().Unix()
+	n := 0
+	for i := range e.shards {
+		s := &e.shards[i]
+		s.Lock()
+		for k, c := range s.m {
+			c.decay(now, e.halfLife)
+			if c.negligible() {
+				delete(s.m, k)
+				n++
+			}
+		}
+		s.Unlock()
+	}
+	return n
+}
+
+// Snapshot writes all counters to path, decayed counters below minCount are skipped
+func (e *Estimator) Snapshot(path string) error {
+	now := e.now().Unix()
+	snap := &snapshot{Time: now}
+	for i := range e.shards {
+		s := &e.shards[i]
+		s.Lock()
+		for k, c := range s.m {
+			c.decay(now, e.halfLife)
+			if c.negligible() {
+				continue
+			}
+			snap.Entries = append(snap.Entries, &entry{key: k, counters: *c})
+		}
+		s.Unlock()
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	zw := gzip.NewWriter(f)
+	err = json.NewEncoder(zw).Encode(snap)
+	if e := zw.Close(); err == nil {
+		err = e
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	snapshotTime.Set(float64(now))
+	return nil
+}
+
+// Restore loads counters from snapshot, it returns the number of entries restored
+func (e *Estimator) Restore(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	var snap snapshot
+	if err := json.NewDecoder(zr).Decode(&snap); err != nil {
+		return 0, fmt.Errorf("decode snapshot %s error: %v", path, err)
+	}
+
+	for _, ent := range snap.Entries {
+		c := ent.counters
+		s := e.shard(ent.key)
+		s.Lock()
+		s.m[ent.key] = &c
+		s.Unlock()
+	}
+	return len(snap.Entries), nil
+}
+
+var (
+	std       = New(&Conf{})
+	flushOnce sync.Once
+)
+
+// Init creates default estimator, restores it from snapshot and starts prune and snapshot loops
+func Init(cf *Conf) {
+	std = New(cf)
+	go func(e *Estimator) {
+		for range time.Tick(pruneInterval) {
+			e.Prune()
+		}
+	}(std)
+	if cf.SnapshotPath == "" {
+		return
+	}
+
+	if n, err := std.Restore(cf.SnapshotPath); err != nil {
+		if !os.IsNotExist(err) {
+			// 快照损坏不影响启动，从零开始学习
+			logger.Default().Warn("estimator restore error", logger.Fields{"path": cf.SnapshotPath, "err": err})
+		}
+	} else {
+		logger.Default().Info("estimator restored", logger.Fields{"path": cf.SnapshotPath, "entries": n})
+	}
+
+	if dir := filepath.Dir(cf.SnapshotPath); dir != "" {
+		os.MkdirAll(dir, 0755)
+	}
+	go func(e *Estimator) {
+		ticker := time.NewTicker(time.Duration(e.conf.SnapshotInterval) * time.Second)
+		for range ticker.C {
+			if err := e.Snapshot(e.conf.SnapshotPath); err != nil {
+				logger.Default().Error("estimator snapshot error", logger.Fields{"path": e.conf.SnapshotPath, "err": err})
+			}
+		}
+	}(std)
+}
+
+// Flush writes the last snapshot, it is called before process exit
+func Flush() {
+	flushOnce.Do(func() {
+		if std.conf.SnapshotPath == "" {
+			return
+		}
+		if err := std.Snapshot(std.conf.SnapshotPath); err != nil {
+			logger.Default().Error("estimator snapshot error", logger.Fields{"path": std.conf.SnapshotPath, "err": err})
+		}
+	})
+}
+
+func Add(event, offer, slot, country string, n float64) bool {
+	return std.Add(event, offer, slot, country, n)
+}
+
+func AddServed(slot, country string, offers []string) {
+	std.AddServed(slot, country, offers)
+}
+
+func Get(offer, slot, country string, priorCtr, priorCvr float64) Estimate {
+	return std.Estimate(offer, slot, country, priorCtr, priorCvr)
+}
+
+func init() {
+	metrics.NewGaugeFunc("offer_estimator_keys", "Number of (offer, slot, country) keys in estimator.",
+		func(emit metrics.Emit) {
+			emit(float64(std.Len()))
+		})
+}
@@ -0,0 +1,225 @@
+package experiment
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+
+	"metrics"
+)
+
+/*
+分层实验：
+	每个layer相互正交，用户在layer中的桶号为 fnv(layer_id:user_hash) % 1000
+	layer中的实验按桶区间[from, to)划分流量，同一layer的区间不能重叠，一个用户在每个layer中最多命中一个实验
+	实验可以限制slot和country(为空表示不限)，不满足条件的用户在该layer不进入任何实验(也不会落入其它实验)
+	命中实验的params覆盖默认策略，多个layer的params按layer顺序合并，后面的非零值覆盖前面的
+
+命中的实验id以 exp=id1,id2 追加到tracker参数中(ctx.PossiableArgs)，下游按arm拆分报表
+
+配置可通过SIGHUP热更新，修改桶区间会让用户换组，调整流量时尽量只扩展区间
+*/
+
+const Buckets = 1000
+
+type Params struct {
+	Ranker      string  `json:"ranker"`       // remote: 请求远程rank; local: 使用localrank
+	FloorFactor float64 `json:"floor_factor"` // slot底价乘数，0表示不调整
+	Creative    string  `json:"creative"`     // bandit: Thompson sampling选择创意; max: 原规则(最大尺寸)
+	NoRealApi   bool    `json:"no_real_api"`  // 视频请求不混入实时api广告
+	CplFirst    bool    `json:"cpl_first"`    // 优先出CPL广告
+}
+
+// merge overrides p by non-zero fields of o
+func (p *Params) merge(o *Params) {
+	if o.Ranker != "" {
+		p.Ranker = o.Ranker
+	}
+	if o.FloorFactor != 0 {
+		p.FloorFactor = o.FloorFactor
+	}
+	if o.Creative != "" {
+		p.Creative = o.Creative
+	}
+	if o.NoRealApi {
+		p.NoRealApi = true
+	}
+	if o.CplFirst {
+		p.CplFirst = true
+	}
+}
+
+func (p *Params) validate() error {
+	if p.Ranker != "" && p.Ranker != "remote" && p.Ranker != "local" {
+		return fmt.Errorf("unknown ranker %q", p.Ranker)
+	}
+	if p.FloorFactor < 0 || p.FloorFactor > 10 {
+		return fmt.Errorf("floor_factor %v out of range 0~10", p.FloorFactor)
+	}
+	if p.Creative != "" && p.Creative != "bandit" && p.Creative != "max" {
+		return fmt.Errorf("unknown creative %q", p.Creative)
+	}
+	return nil
+}
+
+type Experiment struct {
+	Id        string   `json:"id"`
+	From      int      `json:"from"` // 桶区间[from, to)，0~1000
+	To        int      `json:"to"`
+	Slots     []string `json:"slots"`
+	Countries []string `json:"countries"`
+	Params    Params   `json:"params"`
+
+	slots     map[string]bool
+	countries map[string]bool
+}
+
+type Layer struct {
+	Id          string        `json:"id"`
+	Experiments []*Experiment `json:"experiments"`
+}
+
+type Conf struct {
+	Layers []*Layer `json:"layers"`
+}
+
+var idReg = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// Validate checks ids and bucket ranges, experiment ids are unique among all layers
+func (cf *Conf) Validate() error {
+	_, err := newSet(cf)
+	return err
+}
+
+// Assignment is the result of one request
+type Assignment struct {
+	Ids    []string
+	Params Params
+}
+
+type layer struct {
+	id          string
+	experiments []*Experiment
+}
+
+type set struct {
+	layers []*layer
+}
+
+func toMap(ss []string) map[string]bool {
+	if len(ss) == 0 {
+		return nil
+	}
+	m := make(map[string]bool, len(ss))
+	for _, s := range ss {
+		m[s] = true
+	}
+	return m
+}
+
+func newSet(cf *Conf) (*set, error) {
+	s := &set{layers: make([]*layer, 0, len(cf.Layers))}
+	layerIds := make(map[string]bool, len(cf.Layers))
+	expIds := make(map[string]bool)
+	for _, l := range cf.Layers {
+		if !idReg.MatchString(l.Id) {
+			return nil, fmt.Errorf("layer id %q should match %s", l.Id, idReg)
+		}
+		if layerIds[l.Id] {
+			return nil, fmt.Errorf("duplicate layer %q", l.Id)
+		}
+		layerIds[l.Id] = true
+
+		nl := &layer{id: l.Id, experiments: make([]*Experiment, 0, len(l.Experiments))}
+		for _, e := range l.Experiments {
+			if !idReg.MatchString(e.Id) {
+				return nil, fmt.Errorf("layer %s: experiment id %q should match %s", l.Id, e.Id, idReg)
+			}
+			if expIds[e.Id] {
+				return nil, fmt.Errorf("layer %s: duplicate experiment %q", l.Id, e.Id)
+			}
+			expIds[e.Id] = true
+			if e.From < 0 || e.To > Buckets || e.From >= e.To {
+				return nil, fmt.Errorf("experiment %s: bucket [%d, %d) should be within [0, %d)", e.Id, e.From, e.To, Buckets)
+			}
+			for _, o := range nl.experiments {
+				if e.From < o.To && o.From < e.To {
+					return nil, fmt.Errorf("experiment %s: bucket [%d, %d) overlaps %s [%d, %d)",
+						e.Id, e.From, e.To, o.Id, o.From, o.To)
+				}
+			}
+			if err := e.Params.validate(); err != nil {
+				return nil, fmt.Errorf("experiment %s: %v", e.Id, err)
+			}
+			ne := *e
+			ne.slots, ne.countries = toMap(e.Slots), toMap(e.Countries)
+			nl.experiments = append(nl.experiments, &ne)
+		}
+		s.layers = append(s.layers, nl)
+	}
+	return s, nil
+}
+
+// Bucket returns bucket of userHash in layer
+func Bucket(layerId string, userHash int) int {
+	h := fnv.New32a()
+	h.Write([]byte(layerId + ":" + strconv.Itoa(userHash)))
+	return int(h.Sum32() % Buckets)
+}
+
+func (e *Experiment) eligible(slot, country string) bool {
+	return (e.slots == nil || e.slots[slot]) && (e.countries == nil || e.countries[country])
+}
+
+func (s *set) assign(userHash int, slot, country string) *Assignment {
+	a := &Assignment{}
+	for _, l := range s.layers {
+		b := Bucket(l.id, userHash)
+		for _, e := range l.experiments {
+			if b >= e.From && b < e.To {
+				if e.eligible(slot, country) {
+					a.Ids = append(a.Ids, e.Id)
+					a.Params.merge(&e.Params)
+					assignTotal.With(e.Id).Inc()
+				}
+				break
+			}
+		}
+	}
+	return a
+}
+
+var (
+	current atomic.Value // *set
+
+	assignTotal = metrics.NewCounterVec("offer_experiment_assign_total",
+		"Requests assigned to experiment.", "experiment")
+)
+
+func init() {
+	current.Store(&set{})
+}
+
+// Reload replaces experiments, old ones are kept on error
+func Reload(cf *Conf) error {
+	s, err := newSet(cf)
+	if err != nil {
+		return err
+	}
+	current.Store(s)
+	return nil
+}
+
+// Init panics on bad conf
+func Init(cf *Conf) {
+	if err := Reload(cf); err != nil {
+		panic(err)
+	}
+}
+
+// Assign returns experiments of request, Ids is nil if no experiment hit
+func Assign(userHash int, slot, country string) *Assignment {
+	return current.Load().(*set).assign(userHash, slot, country)
+}
@@ -0,0 +1,117 @@
+package experiment
+
+import (
+	"strings"
+	"testing"
+)
+
+func testConf() *Conf {
+	return &Conf{Layers: []*Layer{
+		{Id: "rank", Experiments: []*Experiment{
+			{Id: "rank_local", From: 0, To: 500, Params: Params{Ranker: "local", FloorFactor: 1.2}},
+			{Id: "rank_us", From: 500, To: 1000, Countries: []string{"US"}, Params: Params{Ranker: "remote"}},
+		}},
+		{Id: "creative", Experiments: []*Experiment{
+			{Id: "cr_bandit", From: 0, To: 1000, Slots: []string{"335"}, Params: Params{Creative: "bandit", FloorFactor: 0.8}},
+		}},
+	}}
+}
+
+func TestValidate(t *testing.T) {
+	if err := testConf().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		layers []*Layer
+		err    string
+	}{
+		{[]*Layer{{Id: "a b"}}, "layer id"},
+		{[]*Layer{{Id: "a"}, {Id: "a"}}, "duplicate layer"},
+		{[]*Layer{{Id: "a", Experiments: []*Experiment{{Id: "e", From: 0, To: 1001}}}}, "bucket"},
+		{[]*Layer{{Id: "a", Experiments: []*Experiment{{Id: "e", From: 5, To: 5}}}}, "bucket"},
+		{[]*Layer{{Id: "a", Experiments: []*Experiment{{Id: "e1", From: 0, To: 100}, {Id: "e2", From: 99, To: 200}}}}, "overlaps"},
+		{[]*Layer{{Id: "a", Experiments: []*Experiment{{Id: "e", From: 0, To: 1}}}, {Id: "b", Experiments: []*Experiment{{Id: "e", From: 0, To: 1}}}}, "duplicate experiment"},
+		{[]*Layer{{Id: "a", Experiments: []*Experiment{{Id: "e", From: 0, To: 1, Params: Params{Ranker: "x"}}}}}, "ranker"},
+		{[]*Layer{{Id: "a", Experiments: []*Experiment{{Id: "e", From: 0, To: 1, Params: Params{FloorFactor: -1}}}}}, "floor_factor"},
+		{[]*Layer{{Id: "a", Experiments: []*Experiment{{Id: "e", From: 0, To: 1, Params: Params{Creative: "min"}}}}}, "creative"},
+	}
+	for _, c := range cases {
+		err := (&Conf{Layers: c.layers}).Validate()
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("expect error containing %q, got %v", c.err, err)
+		}
+	}
+}
+
+func TestAssign(t *testing.T) {
+	s, err := newSet(testConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := 0, 0
+	for h := 0; h < Buckets; h++ {
+		a := s.assign(h, "335", "US")
+		if len(a.Ids) != 2 || a.Ids[1] != "cr_bandit" || a.Params.Creative != "bandit" {
+			t.Fatalf("user %d: unexpected assignment %+v", h, a)
+		}
+		// 后面layer的非零值覆盖前面的
+		if a.Params.FloorFactor != 0.8 {
+			t.Errorf("user %d: floor_factor should be overridden, got %v", h, a.Params.FloorFactor)
+		}
+		switch a.Params.Ranker {
+		case "local":
+			local++
+		case "remote":
+			remote++
+		}
+
+		// 同一用户总是分到相同的组
+		if b := s.assign(h, "335", "US"); b.Ids[0] != a.Ids[0] {
+			t.Errorf("user %d: assignment is not stable", h)
+		}
+	}
+	if local+remote != Buckets || local < 400 || local > 600 {
+		t.Errorf("unexpected split local %d, remote %d", local, remote)
+	}
+
+	for h := 0; h < Buckets; h++ {
+		a := s.assign(h, "415", "CN")
+		if Bucket("rank", h) >= 500 && len(a.Ids) != 0 {
+			t.Errorf("user %d: not eligible for rank_us or cr_bandit, got %v", h, a.Ids)
+		}
+		if Bucket("rank", h) < 500 && (len(a.Ids) != 1 || a.Ids[0] != "rank_local") {
+			t.Errorf("user %d: expect rank_local only, got %v", h, a.Ids)
+		}
+	}
+}
+
+func TestLayerOrthogonal(t *testing.T) {
+	// 不同layer的桶号相互独立: rank层前一半用户在另一层中也应该大约各占一半
+	n := 0
+	for h := 0; h < Buckets; h++ {
+		if Bucket("rank", h) < 500 && Bucket("creative", h) < 500 {
+			n++
+		}
+	}
+	if n < 200 || n > 300 {
+		t.Errorf("layers should be independent, got %d/1000 in both halves", n)
+	}
+}
+
+func TestReload(t *testing.T) {
+	defer Reload(&Conf{})
+	if err := Reload(testConf()); err != nil {
+		t.Fatal(err)
+	}
+	if a := Assign(1, "335", "US"); len(a.Ids) != 2 {
+		t.Errorf("unexpected assignment %+v", a)
+	}
+	bad := &Conf{Layers: []*Layer{{Id: "a"}, {Id: "a"}}}
+	if Reload(bad) == nil {
+		t.Fatal("bad conf should fail")
+	}
+	if a := Assign(1, "335", "US"); len(a.Ids) != 2 {
+		t.Error("old conf should be kept on error")
+	}
+}
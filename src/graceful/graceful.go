@@ -0,0 +1,285 @@
+package graceful
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+进程信号处理：
+
+	SIGTERM/SIGINT: 停止accept，在shutdown_timeout内处理完in-flight请求，执行退出hook后退出
+	SIGHUP: 执行reload hook(重新读取配置)，不中断服务
+	SIGUSR2: handoff=true时平滑重启：启动新进程并把监听socket传给它，新进程ready后本进程drain退出，
+	         整个过程监听socket一直打开，不会拒绝连接
+
+新进程通过环境变量TWORKER_LISTEN_FDS得知继承的socket个数(从fd 3开始，顺序与Add一致)，
+通过TWORKER_READY_FD通知父进程已经开始服务。
+*/
+
+const (
+	envListenFds = "TWORKER_LISTEN_FDS"
+	envReadyFd   = "TWORKER_READY_FD"
+)
+
+type Conf struct {
+	ShutdownTimeout int    `json:"shutdown_timeout"` // 秒，默认10
+	Handoff         bool   `json:"handoff"`          // 是否允许SIGUSR2平滑重启
+	HandoffTimeout  int    `json:"handoff_timeout"`  // 秒，等待新进程ready的时间，默认120
+	PidFile         string `json:"pid_file"`         // 当前服务进程的pid，handoff后由新进程覆盖
+}
+
+type server struct {
+	addr     string
+	serve    func(net.Listener) error
+	shutdown func(context.Context) error
+	ln       net.Listener
+}
+
+type Manager struct {
+	conf     Conf
+	servers  []*server
+	reload   []func() error
+	onExit   []func()
+	serveErr chan error
+}
+
+func New(conf *Conf) *Manager {
+	m := &Manager{
+		conf:     *conf,
+		serveErr: make(chan error, 1),
+	}
+	if m.conf.ShutdownTimeout <= 0 {
+		m.conf.ShutdownTimeout = 10
+	}
+	if m.conf.HandoffTimeout <= 0 {
+		m.conf.HandoffTimeout = 120
+	}
+	return m
+}
+
+// Add registers a server listening on addr, serve must return http.ErrServerClosed after shutdown
+func (m *Manager) Add(addr string, serve func(net.Listener) error, shutdown func(context.Context) error) {
+	m.servers = append(m.servers, &server{addr: addr, serve: serve, shutdown: shutdown})
+}
+
+// OnReload registers hook called on SIGHUP
+func (m *Manager) OnReload(f func() error) {
+	m.reload = append(m.reload, f)
+}
+
+// OnExit registers hook called after all servers drained, such as flushing counters
+func (m *Manager) OnExit(f func()) {
+	m.onExit = append(m.onExit, f)
+}
+
+// Run listens (or inherits listeners), serves and handles signals until process should exit
+func (m *Manager) Run() error {
+	if err := m.listen(); err != nil {
+		return err
+	}
+
+	for _, srv := range m.servers {
+		go func(srv *server) {
+			if err := srv.serve(srv.ln); err != nil && err != http.ErrServerClosed {
+				select {
+				case m.serveErr <- fmt.Errorf("serve %s error: %v", srv.addr, err):
+				default:
+				}
+			}
+		}(srv)
+	}
+
+	m.writePid() // 先写pid文件，旧进程收到ready后才会退出
+	notifyReady()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR2)
+	defer signal.Stop(sigCh)
+
+	for {
+		select {
+		case err := <-m.serveErr:
+			return err
+		case sig := <-sigCh:
+			log.Println("[graceful] receive signal: ", sig)
+			switch sig {
+			case syscall.SIGHUP:
+				for _, f := range m.reload {
+					if err := f(); err != nil {
+						log.Println("[graceful] reload error: ", err)
+					}
+				}
+			case syscall.SIGUSR2:
+				if !m.conf.Handoff {
+					log.Println("[graceful] handoff disabled, ignore SIGUSR2")
+					continue
+				}
+				if err := m.handoff(); err != nil {
+					log.Println("[graceful] handoff error: ", err)
+					continue
+				}
+				m.shutdown()
+				return nil
+			default:
+				m.shutdown()
+				return nil
+			}
+		}
+	}
+}
+
+func (m *Manager) listen() error {
+	inherited, _ := strconv.Atoi(os.Getenv(envListenFds))
+	os.Unsetenv(envListenFds)
+	if inherited > 0 && inherited != len(m.servers) {
+		log.Println("[graceful] inherited ", inherited, " listeners, expect ", len(m.servers), ", listen again")
+		inherited = 0
+	}
+
+	for i, srv := range m.servers {
+		var err error
+		if inherited > 0 {
+			f := os.NewFile(uintptr(3+i), "listener-"+srv.addr)
+			srv.ln, err = net.FileListener(f)
+			f.Close()
+		} else {
+			srv.ln, err = net.Listen("tcp", srv.addr)
+		}
+		if err != nil {
+			return fmt.Errorf("listen %s error: %v", srv.addr, err)
+		}
+	}
+	return nil
+}
+
+// shutdown drains all servers concurrently, then calls exit hooks
+func (m *Manager) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.conf.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range m.servers {
+		wg.Add(1)
+		go func(srv *server) {
+			defer wg.Done()
+			if err := srv.shutdown(ctx); err != nil {
+				log.Println("[graceful] shutdown ", srv.addr, " error: ", err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	for _, f := range m.onExit {
+		f()
+	}
+	m.removePid()
+	log.Println("[graceful] process ", os.Getpid(), " exit")
+}
+
+// handoff starts a new process with current listeners and waits until it is ready
+func (m *Manager) handoff() error {
+	files := make([]*os.File, 0, len(m.servers)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, srv := range m.servers {
+		tl, ok := srv.ln.(*net.TCPListener)
+		if !ok {
+			return errors.New("listener of " + srv.addr + " is not tcp")
+		}
+		f, err := tl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		envListenFds+"="+strconv.Itoa(len(m.servers)),
+		envReadyFd+"="+strconv.Itoa(3+len(m.servers)))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	w.Close()
+	files = files[:len(files)-1]
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := r.Read(b) // 新进程没有ready就退出时返回EOF
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Wait()
+			return fmt.Errorf("new process exit before ready: %v", err)
+		}
+	case <-time.After(time.Duration(m.conf.HandoffTimeout) * time.Second):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errors.New("wait new process ready timeout")
+	}
+
+	log.Println("[graceful] handoff to process ", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+func notifyReady() {
+	fd, err := strconv.Atoi(os.Getenv(envReadyFd))
+	os.Unsetenv(envReadyFd)
+	if err != nil || fd < 3 {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+func (m *Manager) writePid() {
+	if m.conf.PidFile == "" {
+		return
+	}
+	if err := ioutil.WriteFile(m.conf.PidFile, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		log.Println("[graceful] write pid file error: ", err)
+	}
+}
+
+// handoff后pid文件已属于新进程，不能删除
+func (m *Manager) removePid() {
+	if m.conf.PidFile == "" {
+		return
+	}
+	if b, err := ioutil.ReadFile(m.conf.PidFile); err == nil &&
+		strings.TrimSpace(string(b)) == strconv.Itoa(os.Getpid()) {
+		os.Remove(m.conf.PidFile)
+	}
+}
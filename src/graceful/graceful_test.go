@@ -0,0 +1,85 @@
+package graceful
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrain(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "graceful")
+	defer os.RemoveAll(dir)
+
+	m := New(&Conf{ShutdownTimeout: 2, PidFile: filepath.Join(dir, "tworker.pid")})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("ok"))
+	})
+	srv := &http.Server{Handler: mux}
+	m.Add("127.0.0.1:0", srv.Serve, srv.Shutdown)
+
+	flushed := false
+	m.OnExit(func() { flushed = true })
+
+	if err := m.listen(); err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(m.servers[0].ln)
+	m.writePid()
+
+	if b, _ := ioutil.ReadFile(m.conf.PidFile); string(b) != strconv.Itoa(os.Getpid()) {
+		t.Error("pid file error: ", string(b))
+	}
+
+	done := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + m.servers[0].ln.Addr().String() + "/slow")
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		done <- string(b)
+	}()
+
+	time.Sleep(50 * time.Millisecond) // in-flight
+	m.shutdown()
+
+	select {
+	case rc := <-done:
+		if rc != "ok" {
+			t.Error("in-flight request should be finished, got: ", rc)
+		}
+	default:
+		t.Error("shutdown returned before in-flight request finished")
+	}
+
+	if !flushed {
+		t.Error("exit hook not called")
+	}
+	if _, err := os.Stat(m.conf.PidFile); !os.IsNotExist(err) {
+		t.Error("pid file should be removed")
+	}
+	if _, err := http.Get("http://" + m.servers[0].ln.Addr().String() + "/slow"); err == nil {
+		t.Error("should not accept after shutdown")
+	}
+}
+
+func TestRemovePidOfOther(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "graceful")
+	defer os.RemoveAll(dir)
+
+	m := New(&Conf{PidFile: filepath.Join(dir, "tworker.pid")})
+	ioutil.WriteFile(m.conf.PidFile, []byte("1"), 0644) // 已handoff给其它进程
+	m.removePid()
+	if _, err := os.Stat(m.conf.PidFile); err != nil {
+		t.Error("pid file of new process should be kept")
+	}
+}
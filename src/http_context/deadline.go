@@ -0,0 +1,88 @@
+package http_context
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"ssp"
+)
+
+/*
+请求超时：每个请求在NewContext时确定deadline，所有对外调用(rank, real_api, redis, vast)都受它约束，
+超时后走各自的降级逻辑(randcp等)，而不是让请求goroutine一直挂着。
+
+优先级: header(X-Request-Timeout, 毫秒) > slot配置(timeout_ms) > 全局配置(request_timeout_ms)
+header和slot配置都不能超过max_request_timeout_ms
+*/
+
+const TimeoutHeader = "X-Request-Timeout"
+
+var (
+	defaultTimeout int64 = int64(300 * time.Millisecond)
+	maxTimeout     int64 = int64(2 * time.Second)
+)
+
+// SetRequestTimeout sets default and max request timeout, zero value keeps current setting
+func SetRequestTimeout(def, max time.Duration) {
+	if def > 0 {
+		atomic.StoreInt64(&defaultTimeout, int64(def))
+	}
+	if max > 0 {
+		atomic.StoreInt64(&maxTimeout, int64(max))
+	}
+}
+
+func requestTimeout(r *http.Request, slotId string) time.Duration {
+	max := time.Duration(atomic.LoadInt64(&maxTimeout))
+	timeout := time.Duration(atomic.LoadInt64(&defaultTimeout))
+
+	if slotStore := ssp.GetGlobalSlotStore(); slotStore != nil {
+		if slot := slotStore.Get(slotId); slot != nil && slot.TimeoutMs > 0 {
+			timeout = time.Duration(slot.TimeoutMs) * time.Millisecond
+		}
+	}
+
+	if ms, err := strconv.Atoi(r.Header.Get(TimeoutHeader)); err == nil && ms > 0 {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	if timeout > max {
+		timeout = max
+	}
+	return timeout
+}
+
+func (ctx *Context) initDeadline() {
+	ctx.std, ctx.cancel = context.WithTimeout(ctx.r.Context(), requestTimeout(ctx.r, ctx.SlotId))
+}
+
+// Cancel releases the request deadline, handlers defer it once NewContext succeeds
+func (ctx *Context) Cancel() {
+	if ctx.cancel != nil {
+		ctx.cancel()
+	}
+}
+
+// StdContext returns context.Context carrying request deadline, used by outbound calls
+func (ctx *Context) StdContext() context.Context {
+	if ctx.std == nil {
+		return context.Background()
+	}
+	return ctx.std
+}
+
+// Remaining returns time left before request deadline
+func (ctx *Context) Remaining() time.Duration {
+	if deadline, ok := ctx.StdContext().Deadline(); ok {
+		return time.Until(deadline)
+	}
+	return time.Duration(atomic.LoadInt64(&defaultTimeout))
+}
+
+// Expired reports whether request deadline is exceeded
+func (ctx *Context) Expired() bool {
+	return ctx.StdContext().Err() != nil
+}
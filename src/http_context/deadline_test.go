@@ -0,0 +1,60 @@
+package http_context
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	SetRequestTimeout(200*time.Millisecond, time.Second)
+
+	r, _ := http.NewRequest("GET", "http://127.0.0.1/getad?slot_id=1024", nil)
+	if d := requestTimeout(r, "1024"); d != 200*time.Millisecond {
+		t.Error("default timeout error: ", d)
+	}
+
+	r.Header.Set(TimeoutHeader, "50")
+	if d := requestTimeout(r, "1024"); d != 50*time.Millisecond {
+		t.Error("header timeout error: ", d)
+	}
+
+	r.Header.Set(TimeoutHeader, "5000")
+	if d := requestTimeout(r, "1024"); d != time.Second {
+		t.Error("timeout should be capped by max: ", d)
+	}
+
+	r.Header.Set(TimeoutHeader, "abc")
+	if d := requestTimeout(r, "1024"); d != 200*time.Millisecond {
+		t.Error("invalid header should be ignored: ", d)
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	SetRequestTimeout(20*time.Millisecond, time.Second)
+
+	ctx := &Context{r: &http.Request{Header: http.Header{}}}
+	if ctx.Expired() {
+		t.Fatal("context without deadline should not expire")
+	}
+
+	ctx.r, _ = http.NewRequest("GET", "http://127.0.0.1/getad", nil)
+	ctx.initDeadline()
+	if _, ok := ctx.StdContext().Deadline(); !ok {
+		t.Fatal("deadline not set")
+	}
+	if ctx.Expired() || ctx.Remaining() <= 0 {
+		t.Error("context should not expire yet")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !ctx.Expired() {
+		t.Error("context should expire")
+	}
+
+	ctx.initDeadline()
+	ctx.Cancel()
+	if !ctx.Expired() {
+		t.Error("canceled context should expire")
+	}
+}
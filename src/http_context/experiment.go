@@ -0,0 +1,26 @@
+package http_context
+
+import (
+	"net/url"
+	"strings"
+
+	"experiment"
+)
+
+// initExperiment assigns experiments by UserHash after all params are parsed,
+// exp=id1,id2 is appended to PossiableArgs so that every tracker carries it
+func (ctx *Context) initExperiment() {
+	a := experiment.Assign(ctx.UserHash, ctx.SlotId, ctx.Country)
+	if len(a.Ids) == 0 {
+		return
+	}
+	ctx.Experiments = a.Ids
+	ctx.ExpParams = a.Params
+
+	arg := "exp=" + url.QueryEscape(strings.Join(a.Ids, ","))
+	if ctx.PossiableArgs == "" {
+		ctx.PossiableArgs = arg
+	} else {
+		ctx.PossiableArgs += "&" + arg
+	}
+}
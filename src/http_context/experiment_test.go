@@ -0,0 +1,37 @@
+package http_context
+
+import (
+	"testing"
+
+	"experiment"
+)
+
+func TestInitExperiment(t *testing.T) {
+	defer experiment.Reload(&experiment.Conf{})
+	err := experiment.Reload(&experiment.Conf{Layers: []*experiment.Layer{
+		{Id: "a", Experiments: []*experiment.Experiment{{Id: "a1", From: 0, To: 1000, Params: experiment.Params{Ranker: "local"}}}},
+		{Id: "b", Experiments: []*experiment.Experiment{{Id: "b1", From: 0, To: 1000, Slots: []string{"335"}}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &Context{SlotId: "335", UserHash: 7, PossiableArgs: "pn=a"}
+	ctx.initExperiment()
+	if ctx.PossiableArgs != "pn=a&exp=a1%2Cb1" || ctx.ExpParams.Ranker != "local" {
+		t.Errorf("unexpected experiment args: %s, %+v", ctx.PossiableArgs, ctx.ExpParams)
+	}
+
+	ctx = &Context{SlotId: "415", UserHash: 7}
+	ctx.initExperiment()
+	if ctx.PossiableArgs != "exp=a1" || len(ctx.Experiments) != 1 {
+		t.Errorf("unexpected experiment args: %s", ctx.PossiableArgs)
+	}
+
+	experiment.Reload(&experiment.Conf{})
+	ctx = &Context{SlotId: "335", PossiableArgs: "pn=a"}
+	ctx.initExperiment()
+	if ctx.PossiableArgs != "pn=a" || ctx.Experiments != nil {
+		t.Errorf("no experiment should keep args: %s", ctx.PossiableArgs)
+	}
+}
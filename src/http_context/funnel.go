@@ -0,0 +1,60 @@
+package http_context
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+/*
+过滤原因漏斗：adSearch的每个候选offer按channel记录通过或被过滤的原因，
+请求结束时由status汇总到slot和channel两个维度。
+按1/sample采样，Funnel为nil表示本请求不记录。
+*/
+
+var funnelSample int64 = 1
+
+// SetFunnelSample records 1 of every n requests, 0 for every request, negative disables funnel
+func SetFunnelSample(n int) {
+	if n == 0 {
+		n = 1
+	}
+	atomic.StoreInt64(&funnelSample, int64(n))
+}
+
+type Funnel struct {
+	Sample     int                       // 汇总时乘以Sample还原
+	Candidates map[string]int            // channel -> 候选数
+	Rejects    map[string]map[string]int // channel -> reason -> 过滤数
+}
+
+func newFunnel() *Funnel {
+	n := int(atomic.LoadInt64(&funnelSample))
+	if n <= 0 || (n > 1 && rand.Intn(n) != 0) {
+		return nil
+	}
+	return &Funnel{
+		Sample:     n,
+		Candidates: make(map[string]int, 8),
+		Rejects:    make(map[string]map[string]int, 8),
+	}
+}
+
+// Record records a candidate of channel, reason is ignored if passed
+func (f *Funnel) Record(channel, reason string, passed bool) {
+	if f == nil {
+		return
+	}
+	f.Candidates[channel]++
+	if passed {
+		return
+	}
+	if reason == "" {
+		reason = "debug filter"
+	}
+	m := f.Rejects[channel]
+	if m == nil {
+		m = make(map[string]int, 4)
+		f.Rejects[channel] = m
+	}
+	m[reason]++
+}
@@ -0,0 +1,41 @@
+package http_context
+
+import "testing"
+
+func TestFunnelSample(t *testing.T) {
+	defer SetFunnelSample(0)
+
+	var f *Funnel
+	f.Record("nym", "black channel", false) // nil不记录
+
+	SetFunnelSample(0)
+	if f = newFunnel(); f == nil || f.Sample != 1 {
+		t.Fatalf("every request: %+v", f)
+	}
+	f.Record("nym", "black channel", false)
+	f.Record("nym", "", false)
+	f.Record("nym", "ignored", true)
+	if f.Candidates["nym"] != 3 || f.Rejects["nym"]["black channel"] != 1 ||
+		f.Rejects["nym"]["debug filter"] != 1 || len(f.Rejects["nym"]) != 2 {
+		t.Errorf("record: %+v", f)
+	}
+
+	SetFunnelSample(-1)
+	if newFunnel() != nil {
+		t.Error("funnel should be disabled")
+	}
+
+	SetFunnelSample(4)
+	n := 0
+	for i := 0; i < 4000; i++ {
+		if f := newFunnel(); f != nil {
+			n++
+			if f.Sample != 4 {
+				t.Fatal("sample: ", f.Sample)
+			}
+		}
+	}
+	if n < 800 || n > 1200 {
+		t.Error("sampled ", n, " of 4000")
+	}
+}
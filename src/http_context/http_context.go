@@ -1,6 +1,7 @@
 package http_context
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"encoding/base64"
@@ -17,11 +18,11 @@ import (
 	"strings"
 	"time"
 
-	"github.com/brg-liuwei/gotools"
-
 	"aes"
 	"cache"
 	"ct_bloom"
+	"experiment"
+	"logger"
 	"set"
 	"ssp"
 	"util"
@@ -89,19 +90,25 @@ func init() {
 type Context struct {
 	r    *http.Request
 	L    printer
-	es   *gotools.Estimate
+	es   *estimate // 千分之一采样(或debug slot)请求的各阶段耗时
 	form *url.Values
 
+	std    context.Context // 携带请求deadline
+	cancel context.CancelFunc
+
 	Now                time.Time
 	UseAes             bool
 	UseGzip            bool
+	UseDeflate         bool
 	UseGzipCT          bool
 	RankUseGzip        bool
 	TestEncode         string
-	FreqDaysInRedis    float32 // 广告频次周期
-	PreFreqDaysInRedis float32 // 预加载频次周期
-	Phase              string  // 当前req阶段
-	FuyuPhase          string  // fuyu req phase
+	FreqDaysInRedis    float32       // 广告频次周期
+	PreFreqDaysInRedis float32       // 预加载频次周期
+	Phase              string        // 当前req阶段
+	FuyuPhase          string        // fuyu req phase
+	Funnel             *Funnel       // 过滤原因漏斗，不采样时为nil
+	Log                *logger.Entry // 结构化请求日志，非retrieval handler时为nil(方法可安全调用)
 
 	// get from url parameter
 	IsDebug        bool
@@ -193,6 +200,9 @@ type Context struct {
 
 	PossiableArgs string
 
+	Experiments []string          // 命中的实验id，已追加到PossiableArgs
+	ExpParams   experiment.Params // 实验参数覆盖
+
 	CtBF *ct_bloom.BloomFilter
 	NgBF *ct_bloom.BloomFilter
 
@@ -301,7 +311,11 @@ type ctxParamHandler func(ctx *Context) error
 
 var ctxInitHelper map[string]ctxParamHandler = map[string]ctxParamHandler{
 	"req_id": func(ctx *Context) error {
-		ctx.ReqId = util.Rand8Bytes()
+		if e := logger.FromContext(ctx.r.Context()); e != nil {
+			ctx.ReqId = e.ReqId // entry的ReqId也由util.Rand8Bytes生成，日志和ImpId一致
+		} else {
+			ctx.ReqId = util.Rand8Bytes()
+		}
 		return nil
 	},
 	"auto_tks": func(ctx *Context) error {
@@ -377,6 +391,9 @@ var ctxInitHelper map[string]ctxParamHandler = map[string]ctxParamHandler{
 		if strings.Contains(ctx.r.Header.Get("Accept-Encoding"), "gzip") {
 			ctx.UseGzip = true
 		}
+		if strings.Contains(ctx.r.Header.Get("Accept-Encoding"), "deflate") {
+			ctx.UseDeflate = true
+		}
 		if ctx.r.Header.Get("CT-Accept-Encoding") == "gzip" { // v3 gzip
 			ctx.UseGzipCT = true
 		}
@@ -629,13 +646,24 @@ var ctxInitHelper map[string]ctxParamHandler = map[string]ctxParamHandler{
 
 func NewContext(r *http.Request, pr printer) (*Context, error) {
 	var form *url.Values
-	r.ParseForm()
-	if r.Method == "GET" {
-		form = &r.Form
-	} else if r.Method == "POST" {
-		form = &r.PostForm
+	if err := prepareBody(r); err != nil {
+		return nil, err
+	}
+	if isJsonBody(r) {
+		values, err := parseJsonBody(r)
+		if err != nil {
+			return nil, err
+		}
+		form = &values
 	} else {
-		return nil, errors.New("unexpected method: " + r.Method)
+		r.ParseForm()
+		if r.Method == "GET" {
+			form = &r.Form
+		} else if r.Method == "POST" {
+			form = &r.PostForm
+		} else {
+			return nil, errors.New("unexpected method: " + r.Method)
+		}
 	}
 
 	ctx := &Context{
@@ -655,6 +683,10 @@ func NewContext(r *http.Request, pr printer) (*Context, error) {
 	}
 
 	ctx.initByReflectString(refHelperSlice)
+	ctx.initDeadline()
+	ctx.Funnel = newFunnel()
+	ctx.initExperiment()
+	ctx.initLog()
 
 	if len(ctx.Aid) != 0 {
 		ctx.AidMd5 = fmt.Sprintf("%x", md5.Sum([]byte(ctx.Aid)))
@@ -671,9 +703,8 @@ func NewContext(r *http.Request, pr printer) (*Context, error) {
 		ctx.GaidSha1 = fmt.Sprintf("%x", sha1.Sum([]byte(ctx.Gaid)))
 	}
 
-	if rand.Intn(1000) < 1 {
-		ctx.es = gotools.NewEstimate("[" + ctx.SlotId + "]")
-		ctx.es.SetLogger(pr)
+	if rand.Intn(1000) < 1 || logger.SlotDebug(ctx.SlotId) {
+		ctx.es = newEstimate()
 	}
 
 	if ctx.Platform == "iOS" {
@@ -705,18 +736,6 @@ func (ctx *Context) GetRawPath() string {
 	return "/get_subs_ad?" + ctx.form.Encode() + "&subChannel=" + ctx.SubChannel
 }
 
-func (ctx *Context) Estimate(phase string) {
-	if ctx.es != nil {
-		ctx.es.Add(phase)
-	}
-}
-
-func (ctx *Context) LogEstimate() {
-	if ctx.es != nil {
-		ctx.es.Write()
-	}
-}
-
 // 用户总曝光频控
 func (ctx *Context) UserFreqCap(limit int) bool {
 	if ctx.IntegralWall {
@@ -793,7 +812,7 @@ func (ctx *Context) IncrPreClickFreq() error {
 	} else {
 		expire = 86400 - time.Now().Unix()%86400
 	}
-	return cache.IncrFreq(ctx.UserHash, ctx.FreqInfo.PFreqKey, ctx.FreqInfo.PFreqFields, expire)
+	return cache.IncrFreq(ctx.StdContext(), ctx.UserHash, ctx.FreqInfo.PFreqKey, ctx.FreqInfo.PFreqFields, expire)
 }
 
 func (ctx *Context) GetFreq() error {
@@ -802,11 +821,11 @@ func (ctx *Context) GetFreq() error {
 	ctx.FreqInfo.FreqKey = util.StrJoinUnderline("freq", ctx.UserId, ctx.AdType)
 
 	if ctx.IsWugan() {
-		ctx.FreqInfo.PFreqMap, err = cache.HGetAllFreq(ctx.UserHash, ctx.FreqInfo.PFreqKey)
+		ctx.FreqInfo.PFreqMap, err = cache.HGetAllFreq(ctx.StdContext(), ctx.UserHash, ctx.FreqInfo.PFreqKey)
 	} else if ctx.IsRewardedVideo() {
-		ctx.ServerCidMap, ctx.ConvPkgSet, ctx.FreqInfo.VCompletes, ctx.FreqInfo.VRequests, err = cache.GetAndSetVideoCtrlInfos(ctx.UserHash, ctx.ServerCidKey, ctx.IosConvKey, ctx.FreqInfo.VCompleteKey, ctx.FreqInfo.VRequestKey, ctx.FreqInfo.VFreqField)
+		ctx.ServerCidMap, ctx.ConvPkgSet, ctx.FreqInfo.VCompletes, ctx.FreqInfo.VRequests, err = cache.GetAndSetVideoCtrlInfos(ctx.StdContext(), ctx.UserHash, ctx.ServerCidKey, ctx.IosConvKey, ctx.FreqInfo.VCompleteKey, ctx.FreqInfo.VRequestKey, ctx.FreqInfo.VFreqField)
 	} else {
-		ctx.FreqInfo.FreqMap, err = cache.HGetAllFreq(ctx.UserHash, ctx.FreqInfo.FreqKey)
+		ctx.FreqInfo.FreqMap, err = cache.HGetAllFreq(ctx.StdContext(), ctx.UserHash, ctx.FreqInfo.FreqKey)
 	}
 	return err
 }
@@ -858,6 +877,22 @@ func (ctx *Context) ImpRank() bool {
 		ctx.AdType == "6" || ctx.AdType == "16" || ctx.AdType == "17"
 }
 
+// 当前请求slot的底价(eCPM, USD)，0表示不限制
+func (ctx *Context) FloorPrice() float64 {
+	slotStore := ssp.GetGlobalSlotStore()
+	if slotStore == nil {
+		return 0
+	}
+	slot := slotStore.Get(ctx.SlotId)
+	if slot == nil {
+		return 0
+	}
+	if ctx.ExpParams.FloorFactor > 0 {
+		return slot.GetFloorPrice(ctx.Country) * ctx.ExpParams.FloorFactor
+	}
+	return slot.GetFloorPrice(ctx.Country)
+}
+
 // interstitial 插屏广告
 func (ctx *Context) IsVideoTpl() bool {
 	if ctx.Template == nil {
@@ -0,0 +1,137 @@
+package http_context
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+POST请求支持json body(Content-Type: application/json)，请求体可以gzip压缩(Content-Encoding: gzip)
+
+json body会被展开成与url参数相同的key，因此Context字段和Params()的取值与form请求一致：
+
+	{
+	    "slot_id": "1024",                 // 顶层字段即url参数
+	    "adnum": 2,
+	    "device": {                        // 以下嵌套对象只用于分组，key仍是url参数名
+	        "platform": "Android", "osv": "8.0", "dt": "phone", "ua": "...", "ip": "1.2.3.4",
+	        "gaid": "...", "aid": "...", "idfa": "...", "nt": "1", "carrier": "...", "mcc": "460", "mnc": "01"
+	    },
+	    "app": {"pn": "com.example", "sv": "a-3.0.0", "msv": "1.0"},
+	    "user": {"user_id": "...", "country": "US", "lang": "en"},
+	    "imp": {"adtype": "6", "imgw": 1200, "imgh": 627, "img_rule": 2},
+	    "ext": {"cids": ["c1", 3, "c2", 1]} // 其它参数
+	}
+
+取值规则：
+  - 数字转为字符串，bool转为"1"/"0"，null忽略
+  - 数组元素用逗号拼接
+  - 顶层字段优先于嵌套对象，json body优先于url query
+*/
+
+const maxBodySize = 1 << 20
+
+var jsonBodyGroups = []string{"device", "app", "user", "imp", "ext"}
+
+func isJsonBody(r *http.Request) bool {
+	return r.Method == "POST" &&
+		strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+}
+
+// LimitBody limits json and gzip request bodies to 1MB, it should be called with the ResponseWriter
+// of the server before NewContext; other POST forms keep the 10MB limit of ParseForm
+func LimitBody(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil && (isJsonBody(r) || (r.Method == "POST" && r.Header.Get("Content-Encoding") == "gzip")) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	}
+}
+
+// gzip压缩的请求体，在ParseForm或json解析之前解压
+func prepareBody(r *http.Request) error {
+	if r.Body == nil || r.Method != "POST" {
+		return nil
+	}
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return errors.New("gzip body error: " + err.Error())
+		}
+		r.Body = &gzipBody{Reader: io.LimitReader(gr, maxBodySize), gz: gr, raw: r.Body}
+		r.Header.Del("Content-Encoding")
+	}
+	return nil
+}
+
+type gzipBody struct {
+	io.Reader
+	gz  *gzip.Reader
+	raw io.Closer
+}
+
+func (b *gzipBody) Close() error {
+	b.gz.Close()
+	return b.raw.Close()
+}
+
+func parseJsonBody(r *http.Request) (url.Values, error) {
+	var body map[string]interface{}
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		return nil, errors.New("json body error: " + err.Error())
+	}
+
+	values := make(url.Values)
+	for _, group := range jsonBodyGroups {
+		if sub, ok := body[group].(map[string]interface{}); ok {
+			for k, v := range sub {
+				setJsonValue(values, k, v)
+			}
+			delete(body, group)
+		}
+	}
+	for k, v := range body {
+		setJsonValue(values, k, v) // 顶层字段覆盖嵌套对象
+	}
+
+	for k, vs := range r.URL.Query() {
+		if _, ok := values[k]; !ok {
+			values[k] = vs
+		}
+	}
+	return values, nil
+}
+
+func setJsonValue(values url.Values, key string, v interface{}) {
+	if s, ok := jsonValueString(v); ok {
+		values.Set(key, s)
+	}
+}
+
+func jsonValueString(v interface{}) (string, bool) {
+	switch val := v.(type) {
+	case string:
+		return val, true
+	case json.Number:
+		return val.String(), true
+	case bool:
+		if val {
+			return "1", true
+		}
+		return "0", true
+	case []interface{}:
+		arr := make([]string, 0, len(val))
+		for _, elem := range val {
+			if s, ok := jsonValueString(elem); ok {
+				arr = append(arr, s)
+			}
+		}
+		return strings.Join(arr, ","), true
+	}
+	return "", false // null or object
+}
@@ -0,0 +1,131 @@
+package http_context
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testJsonBody = `{
+	"slot_id": "1024",
+	"adnum": 2,
+	"subs": true,
+	"note": null,
+	"device": {"platform": "Android", "gaid": "g-1", "nt": 1},
+	"app": {"pn": "com.example"},
+	"user": {"country": "US"},
+	"imp": {"imgw": 1200, "imgh": 627, "adnum": 5},
+	"ext": {"cids": ["c1", 3, "c2", 1]}
+}`
+
+func newJsonRequest(body []byte, gz bool) *http.Request {
+	if gz {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(body)
+		w.Close()
+		body = buf.Bytes()
+	}
+	r, _ := http.NewRequest("POST", "http://127.0.0.1/get_native_ad?country=CN&lang=en", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if gz {
+		r.Header.Set("Content-Encoding", "gzip")
+	}
+	return r
+}
+
+func TestParseJsonBody(t *testing.T) {
+	for _, gz := range []bool{false, true} {
+		r := newJsonRequest([]byte(testJsonBody), gz)
+		if !isJsonBody(r) {
+			t.Fatal("expect json body")
+		}
+		if err := prepareBody(r); err != nil {
+			t.Fatal("prepare body err: ", err)
+		}
+		values, err := parseJsonBody(r)
+		if err != nil {
+			t.Fatal("parse json body err: ", err)
+		}
+
+		expect := map[string]string{
+			"slot_id":  "1024",
+			"adnum":    "2", // 顶层优先
+			"subs":     "1",
+			"platform": "Android",
+			"gaid":     "g-1",
+			"nt":       "1",
+			"pn":       "com.example",
+			"country":  "US", // body优先于query
+			"lang":     "en", // query补充
+			"imgw":     "1200",
+			"imgh":     "627",
+			"cids":     "c1,3,c2,1",
+		}
+		for k, v := range expect {
+			if got := values.Get(k); got != v {
+				t.Error("gzip: ", gz, ", key: ", k, ", got: ", got, ", expect: ", v)
+			}
+		}
+		if _, ok := values["note"]; ok {
+			t.Error("null value should be ignored")
+		}
+	}
+}
+
+func TestParseJsonBodyErr(t *testing.T) {
+	r := newJsonRequest([]byte(`{"slot_id": `), false)
+	prepareBody(r)
+	if _, err := parseJsonBody(r); err == nil {
+		t.Error("expect json error")
+	}
+
+	r = newJsonRequest([]byte(testJsonBody), false)
+	r.Header.Set("Content-Encoding", "gzip")
+	if err := prepareBody(r); err == nil {
+		t.Error("expect gzip error")
+	}
+}
+
+func TestGzipFormBody(t *testing.T) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte("slot_id=1024&platform=iOS"))
+	w.Close()
+
+	r, _ := http.NewRequest("POST", "http://127.0.0.1/getad", &buf)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Content-Encoding", "gzip")
+	if isJsonBody(r) {
+		t.Fatal("form body should not be json")
+	}
+	if err := prepareBody(r); err != nil {
+		t.Fatal("prepare body err: ", err)
+	}
+	r.ParseForm()
+	if r.PostForm.Get("slot_id") != "1024" || r.PostForm.Get("platform") != "iOS" {
+		t.Error("post form: ", r.PostForm)
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	big := "slot_id=1024&pad=" + strings.Repeat("x", maxBodySize)
+
+	r := newJsonRequest([]byte(big), false)
+	LimitBody(httptest.NewRecorder(), r)
+	if _, err := ioutil.ReadAll(r.Body); err == nil {
+		t.Error("json body over 1MB should fail")
+	}
+
+	// 普通form仍由ParseForm限制(10MB)
+	r, _ = http.NewRequest("POST", "http://127.0.0.1/getad", strings.NewReader(big))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	LimitBody(httptest.NewRecorder(), r)
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("slot_id") != "1024" {
+		t.Error("form body over 1MB should be parsed: ", err)
+	}
+}
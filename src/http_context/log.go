@@ -0,0 +1,67 @@
+package http_context
+
+import (
+	"time"
+
+	"logger"
+)
+
+// initLog binds request fields to the access log entry created by retrieval handler,
+// phase is read when a line is written so the access line has the final phase
+func (ctx *Context) initLog() {
+	ctx.Log = logger.FromContext(ctx.r.Context())
+	ctx.Log.Bind(func(f logger.Fields) {
+		f["slot"] = ctx.SlotId
+		f["adtype"] = ctx.AdType
+		f["platform"] = ctx.Platform
+		f["country"] = ctx.Country
+		f["phase"] = ctx.Phase
+		if len(ctx.Experiments) > 0 {
+			f["exp"] = ctx.Experiments
+		}
+	})
+}
+
+type phaseCost struct {
+	Phase string  `json:"phase"`
+	Ms    float64 `json:"ms"`
+}
+
+// estimate records the cost of each phase since the previous one
+type estimate struct {
+	start  time.Time
+	last   time.Time
+	phases []phaseCost
+}
+
+func newEstimate() *estimate {
+	now := time.Now()
+	return &estimate{start: now, last: now}
+}
+
+func (es *estimate) add(phase string) {
+	now := time.Now()
+	es.phases = append(es.phases, phaseCost{phase, msSince(es.last, now)})
+	es.last = now
+}
+
+func msSince(from, to time.Time) float64 {
+	return float64(to.Sub(from).Nanoseconds()/1000) / 1000
+}
+
+func (ctx *Context) Estimate(phase string) {
+	if ctx.es != nil {
+		ctx.es.add(phase)
+	}
+}
+
+// LogEstimate writes phase costs of a sampled request as one line of ctx.Log
+func (ctx *Context) LogEstimate() {
+	if ctx.es == nil {
+		return
+	}
+	ctx.Log.Info("phase timings", logger.Fields{
+		"phases":   ctx.es.phases,
+		"total_ms": msSince(ctx.es.start, time.Now()),
+	})
+}
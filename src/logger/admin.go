@@ -0,0 +1,97 @@
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"util"
+)
+
+/*
+/admin/log 运行时调整日志，只允许内网和本机访问:
+	GET                              当前level, sample, debug slot
+	POST level=debug                 修改级别
+	POST level=info&sample=0.1       修改该级别的采样率
+	POST slot=335&debug=10m          打开slot debug，debug=off关闭，最长24h
+*/
+
+const maxSlotDebug = 24 * time.Hour
+
+type adminStatus struct {
+	Level      string               `json:"level"`
+	Sample     map[string]float64   `json:"sample"`
+	DebugSlots map[string]time.Time `json:"debug_slots"`
+}
+
+func AdminHandler(w http.ResponseWriter, r *http.Request) {
+	if !util.IsPrivateAddr(r.RemoteAddr) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	l := std
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if err := adminUpdate(l, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	st := adminStatus{
+		Level:      l.Level().String(),
+		Sample:     make(map[string]float64, len(levelNames)),
+		DebugSlots: l.DebugSlots(),
+	}
+	for i, name := range levelNames {
+		st.Sample[name] = l.Sample(Level(i))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&st)
+}
+
+func adminUpdate(l *Logger, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	if slot := r.Form.Get("slot"); slot != "" {
+		d := r.Form.Get("debug")
+		if d == "off" {
+			l.SetSlotDebug(slot, 0)
+			return nil
+		}
+		ttl, err := time.ParseDuration(d)
+		if err != nil || ttl <= 0 || ttl > maxSlotDebug {
+			return errors.New("debug should be a duration in (0, 24h] or off")
+		}
+		l.SetSlotDebug(slot, ttl)
+		return nil
+	}
+
+	s := r.Form.Get("level")
+	if s == "" {
+		return errors.New("level or slot is required")
+	}
+	level, err := ParseLevel(s)
+	if err != nil {
+		return err
+	}
+	if rs := r.Form.Get("sample"); rs != "" {
+		rate, err := strconv.ParseFloat(rs, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return errors.New("sample should be 0~1")
+		}
+		l.SetSample(level, rate)
+		return nil
+	}
+	l.SetLevel(level)
+	return nil
+}
@@ -0,0 +1,139 @@
+package logger
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"util"
+)
+
+// ReqIdHeader carries client request id in request, and our request id in response
+const ReqIdHeader = "X-Request-Id"
+
+const maxReqIdLen = 64
+
+// Entry is a request scoped logger, every line has req_id and handler,
+// fields bound by Bind are evaluated at log time (phase changes during a request)
+type Entry struct {
+	ReqId       string
+	ClientReqId string // 请求头中的X-Request-Id，只用于日志关联
+	Handler     string
+
+	l     *Logger
+	start time.Time
+
+	lock  sync.Mutex
+	binds []func(Fields)
+}
+
+// NewEntry always generates request id (ctx.ReqId is part of ImpId and must not be chosen by clients),
+// a valid request id from header is kept as client_req_id
+func NewEntry(handler string, r *http.Request) *Entry {
+	e := &Entry{
+		ReqId:   util.Rand8Bytes(),
+		Handler: handler,
+		l:       std,
+		start:   time.Now(),
+	}
+	if id := r.Header.Get(ReqIdHeader); validReqId(id) {
+		e.ClientReqId = id
+	}
+	return e
+}
+
+func validReqId(id string) bool {
+	if id == "" || len(id) > maxReqIdLen {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Bind adds a callback filling fields of every line
+func (e *Entry) Bind(f func(Fields)) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	e.binds = append(e.binds, f)
+	e.lock.Unlock()
+}
+
+func (e *Entry) fields(extra Fields) Fields {
+	m := make(Fields, len(extra)+8)
+	e.lock.Lock()
+	for _, f := range e.binds {
+		f(m)
+	}
+	e.lock.Unlock()
+	for k, v := range extra {
+		m[k] = v
+	}
+	m["req_id"] = e.ReqId
+	if e.ClientReqId != "" {
+		m["client_req_id"] = e.ClientReqId
+	}
+	m["handler"] = e.Handler
+	return m
+}
+
+// Enabled is used to skip building fields of verbose lines
+func (e *Entry) Enabled(level Level) bool {
+	if e == nil {
+		return false
+	}
+	if level >= e.l.Level() {
+		return true
+	}
+	if atomic.LoadInt32(&e.l.debugNum) == 0 {
+		return false
+	}
+	slot, _ := e.fields(nil)["slot"].(string)
+	return e.l.SlotDebug(slot)
+}
+
+func (e *Entry) Log(level Level, msg string, extra Fields) {
+	if e == nil {
+		return
+	}
+	e.l.Log(level, msg, e.fields(extra))
+}
+
+func (e *Entry) Debug(msg string, fields Fields) { e.Log(Debug, msg, fields) }
+func (e *Entry) Info(msg string, fields Fields)  { e.Log(Info, msg, fields) }
+func (e *Entry) Warn(msg string, fields Fields)  { e.Log(Warn, msg, fields) }
+func (e *Entry) Error(msg string, fields Fields) { e.Log(Error, msg, fields) }
+
+// Finish writes the access line at info level (volume is controlled by sample of info), 5xx is logged as error
+func (e *Entry) Finish(code int) {
+	if e == nil {
+		return
+	}
+	level := Info
+	if code >= 500 {
+		level = Error
+	}
+	e.Log(level, "access", Fields{
+		"status":     code,
+		"latency_ms": float64(time.Since(e.start).Nanoseconds()/1000) / 1000,
+	})
+}
+
+type entryKey struct{}
+
+func WithEntry(ctx context.Context, e *Entry) context.Context {
+	return context.WithValue(ctx, entryKey{}, e)
+}
+
+// FromContext returns nil if there is no entry, methods of nil entry do nothing
+func FromContext(ctx context.Context) *Entry {
+	e, _ := ctx.Value(entryKey{}).(*Entry)
+	return e
+}
@@ -0,0 +1,251 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brg-liuwei/gotools"
+)
+
+/*
+结构化日志：每行一个json对象，固定字段 ts, level, msg, 请求相关日志还有 req_id, slot。
+	level: 低于配置级别的日志丢弃
+	sample: 按级别采样，如 {"debug": 0.01, "info": 0.1}，未配置的级别全部输出
+	slot debug: 通过admin接口对指定slot临时打开debug，该slot的日志不受级别和采样限制
+*/
+
+type Level int32
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level: %q", s)
+}
+
+type Conf struct {
+	Path        string             `json:"log_path"` // 空: 输出到标准输出
+	RotateNum   int                `json:"log_rotate_backup"`
+	RotateLines int                `json:"log_rotate_lines"`
+	Level       string             `json:"level"`  // debug, info(默认), warn, error
+	Sample      map[string]float64 `json:"sample"` // level -> 采样率 0~1
+}
+
+// Validate checks level and sample rates
+func (conf *Conf) Validate() error {
+	if conf.Level != "" {
+		if _, err := ParseLevel(conf.Level); err != nil {
+			return err
+		}
+	}
+	for name, rate := range conf.Sample {
+		if _, err := ParseLevel(name); err != nil {
+			return fmt.Errorf("sample: %v", err)
+		}
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("sample rate of %s should be 0~1: %v", name, rate)
+		}
+	}
+	return nil
+}
+
+type printer interface {
+	Println(...interface{})
+}
+
+// Fields are extra key-values of a log line
+type Fields map[string]interface{}
+
+type Logger struct {
+	out    printer
+	level  int32
+	sample [4]uint64 // float64 bits
+
+	debugLock  sync.RWMutex
+	debugSlots map[string]time.Time // slot -> 过期时间
+	debugNum   int32
+}
+
+func New(out printer) *Logger {
+	l := &Logger{
+		out:        out,
+		level:      int32(Info),
+		debugSlots: make(map[string]time.Time),
+	}
+	for i := range l.sample {
+		l.sample[i] = math.Float64bits(1)
+	}
+	return l
+}
+
+var std = New(log.New(os.Stdout, "", 0))
+
+// Init replaces the default logger, it returns error on invalid conf or log path
+func Init(conf *Conf) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+
+	var out printer = log.New(os.Stdout, "", 0)
+	if conf.Path != "" {
+		rl, err := gotools.NewRotateLogger(conf.Path, "", 0, conf.RotateNum)
+		if err != nil {
+			return err
+		}
+		rl.SetLineRotate(conf.RotateLines)
+		out = rl
+	}
+
+	l := New(out)
+	l.Apply(conf)
+	std = l
+	return nil
+}
+
+func Default() *Logger {
+	return std
+}
+
+// Apply sets level and sample rates from conf, it is used by SIGHUP reload
+func (l *Logger) Apply(conf *Conf) {
+	level := Info
+	if conf.Level != "" {
+		level, _ = ParseLevel(conf.Level)
+	}
+	l.SetLevel(level)
+	for i := range levelNames {
+		rate := 1.0
+		if r, ok := conf.Sample[levelNames[i]]; ok {
+			rate = r
+		}
+		l.SetSample(Level(i), rate)
+	}
+}
+
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.level))
+}
+
+func (l *Logger) SetSample(level Level, rate float64) {
+	atomic.StoreUint64(&l.sample[level], math.Float64bits(rate))
+}
+
+func (l *Logger) Sample(level Level) float64 {
+	return math.Float64frombits(atomic.LoadUint64(&l.sample[level]))
+}
+
+// SetSlotDebug enables all logs of slot for ttl, ttl <= 0 disables it
+func (l *Logger) SetSlotDebug(slot string, ttl time.Duration) {
+	l.debugLock.Lock()
+	defer l.debugLock.Unlock()
+	if ttl > 0 {
+		l.debugSlots[slot] = time.Now().Add(ttl)
+	} else {
+		delete(l.debugSlots, slot)
+	}
+	atomic.StoreInt32(&l.debugNum, int32(len(l.debugSlots)))
+}
+
+// DebugSlots returns slots in debug mode with their expire time
+func (l *Logger) DebugSlots() map[string]time.Time {
+	l.debugLock.RLock()
+	defer l.debugLock.RUnlock()
+	m := make(map[string]time.Time, len(l.debugSlots))
+	now := time.Now()
+	for slot, expire := range l.debugSlots {
+		if expire.After(now) {
+			m[slot] = expire
+		}
+	}
+	return m
+}
+
+// SlotDebug returns true if slot is in debug mode
+func (l *Logger) SlotDebug(slot string) bool {
+	if slot == "" || atomic.LoadInt32(&l.debugNum) == 0 {
+		return false // 绝大多数时间没有debug slot，不加锁
+	}
+	l.debugLock.RLock()
+	expire, ok := l.debugSlots[slot]
+	l.debugLock.RUnlock()
+	return ok && time.Now().Before(expire)
+}
+
+func (l *Logger) enabled(level Level, slot string) bool {
+	if l.SlotDebug(slot) {
+		return true
+	}
+	if level < l.Level() {
+		return false
+	}
+	rate := l.Sample(level)
+	return rate >= 1 || rand.Float64() < rate
+}
+
+// Log writes a json line if level is enabled and sampled
+func (l *Logger) Log(level Level, msg string, fields Fields) {
+	slot, _ := fields["slot"].(string)
+	if !l.enabled(level, slot) {
+		return
+	}
+	l.write(level, msg, fields)
+}
+
+func (l *Logger) write(level Level, msg string, fields Fields) {
+	line := make(Fields, len(fields)+3)
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error() // error默认序列化为{}
+		}
+		line[k] = v
+	}
+	line["ts"] = time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	line["level"] = level.String()
+	line["msg"] = msg
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		b, _ = json.Marshal(Fields{"ts": line["ts"], "level": "error", "msg": "marshal log error: " + err.Error()})
+	}
+	l.out.Println(string(b))
+}
+
+func (l *Logger) Debug(msg string, fields Fields) { l.Log(Debug, msg, fields) }
+func (l *Logger) Info(msg string, fields Fields)  { l.Log(Info, msg, fields) }
+func (l *Logger) Warn(msg string, fields Fields)  { l.Log(Warn, msg, fields) }
+func (l *Logger) Error(msg string, fields Fields) { l.Log(Error, msg, fields) }
+
+// SlotDebug of default logger
+func SlotDebug(slot string) bool {
+	return std.SlotDebug(slot)
+}
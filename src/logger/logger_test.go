@@ -0,0 +1,194 @@
+package logger
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type bufPrinter struct {
+	sync.Mutex
+	lines []string
+}
+
+func (b *bufPrinter) Println(v ...interface{}) {
+	b.Lock()
+	defer b.Unlock()
+	b.lines = append(b.lines, v[0].(string))
+}
+
+func (b *bufPrinter) decode(t *testing.T) []Fields {
+	b.Lock()
+	defer b.Unlock()
+	var res []Fields
+	for _, line := range b.lines {
+		var f Fields
+		if err := json.Unmarshal([]byte(line), &f); err != nil {
+			t.Fatalf("invalid json line %q: %v", line, err)
+		}
+		res = append(res, f)
+	}
+	return res
+}
+
+func TestLevelAndSample(t *testing.T) {
+	out := &bufPrinter{}
+	l := New(out)
+	l.Apply(&Conf{Level: "info", Sample: map[string]float64{"warn": 0}})
+
+	l.Debug("dropped by level", nil)
+	l.Info("kept", Fields{"slot": "335", "err": errTest("boom")})
+	l.Warn("dropped by sample", nil)
+	l.Error("kept", nil)
+
+	lines := out.decode(t)
+	if len(lines) != 2 {
+		t.Fatalf("expect 2 lines, got %v", lines)
+	}
+	if lines[0]["level"] != "info" || lines[0]["slot"] != "335" || lines[0]["err"] != "boom" {
+		t.Errorf("unexpected line: %v", lines[0])
+	}
+	if lines[1]["level"] != "error" || lines[1]["ts"] == nil {
+		t.Errorf("unexpected line: %v", lines[1])
+	}
+}
+
+type errTest string
+
+func (e errTest) Error() string { return string(e) }
+
+func TestSlotDebug(t *testing.T) {
+	out := &bufPrinter{}
+	l := New(out)
+	l.SetLevel(Error)
+
+	l.SetSlotDebug("335", time.Minute)
+	l.Debug("debug slot", Fields{"slot": "335"})
+	l.Debug("other slot", Fields{"slot": "415"})
+	l.SetSlotDebug("335", 0)
+	l.Debug("debug off", Fields{"slot": "335"})
+
+	l.SetSlotDebug("415", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if l.SlotDebug("415") {
+		t.Error("slot debug should expire")
+	}
+
+	lines := out.decode(t)
+	if len(lines) != 1 || lines[0]["msg"] != "debug slot" {
+		t.Errorf("expect only debug slot line, got %v", lines)
+	}
+}
+
+func TestEntry(t *testing.T) {
+	out := &bufPrinter{}
+	std = New(out)
+	defer func() { std = New(out) }()
+
+	r := httptest.NewRequest("GET", "/get", nil)
+	r.Header.Set(ReqIdHeader, "abc-123")
+	e := NewEntry("get", r)
+	if e.ReqId == "abc-123" || len(e.ReqId) != 8 || e.ClientReqId != "abc-123" {
+		t.Errorf("req id should be generated and header kept as client req id, got %s, %s", e.ReqId, e.ClientReqId)
+	}
+	if FromContext(WithEntry(r.Context(), e)) != e {
+		t.Error("entry not found in context")
+	}
+
+	phase := "Un-inited"
+	e.Bind(func(f Fields) {
+		f["slot"] = "335"
+		f["phase"] = phase
+	})
+	phase = "Done"
+	e.Finish(200)
+	std.SetSample(Info, 0) // access行由info采样率控制量，5xx不受影响
+	e.Finish(200)
+	e.Finish(503)
+
+	lines := out.decode(t)
+	if len(lines) != 2 || lines[0]["level"] != "info" || lines[1]["level"] != "error" {
+		t.Fatalf("expect info and error access lines, got %v", lines)
+	}
+	f := lines[0]
+	if f["msg"] != "access" || f["req_id"] != e.ReqId || f["client_req_id"] != "abc-123" || f["handler"] != "get" ||
+		f["phase"] != "Done" || f["status"] != float64(200) || f["latency_ms"] == nil {
+		t.Errorf("unexpected access line: %v", f)
+	}
+
+	for _, bad := range []string{"", "a b", strings.Repeat("x", 65), "<script>"} {
+		r.Header.Set(ReqIdHeader, bad)
+		if e := NewEntry("get", r); e.ClientReqId != "" || len(e.ReqId) != 8 {
+			t.Errorf("invalid header %q should be dropped, got %q, %q", bad, e.ReqId, e.ClientReqId)
+		}
+	}
+
+	var nilEntry *Entry
+	nilEntry.Info("nil entry", nil)
+	nilEntry.Finish(200)
+	if nilEntry.Enabled(Error) {
+		t.Error("nil entry should not be enabled")
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	std = New(&bufPrinter{})
+	defer func() { std = New(&bufPrinter{}) }()
+
+	post := func(remote string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/admin/log", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		AdminHandler(w, r)
+		return w
+	}
+
+	if w := post("8.8.8.8:1234", url.Values{"level": {"debug"}}); w.Code != http.StatusForbidden {
+		t.Errorf("public address should be forbidden, got %d", w.Code)
+	}
+	if w := post("10.1.2.3:1234", url.Values{"level": {"verbose"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("bad level should be 400, got %d", w.Code)
+	}
+	if w := post("127.0.0.1:1234", url.Values{"slot": {"335"}, "debug": {"48h"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("too long debug should be 400, got %d", w.Code)
+	}
+
+	post("127.0.0.1:1234", url.Values{"level": {"warn"}})
+	post("127.0.0.1:1234", url.Values{"level": {"info"}, "sample": {"0.5"}})
+	w := post("192.168.0.1:1234", url.Values{"slot": {"335"}, "debug": {"10m"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expect 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var st adminStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Level != "warn" || st.Sample["info"] != 0.5 || st.DebugSlots["335"].IsZero() {
+		t.Errorf("unexpected status: %+v", st)
+	}
+	if !SlotDebug("335") {
+		t.Error("slot 335 should be in debug mode")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, conf := range []Conf{
+		{Level: "verbose"},
+		{Sample: map[string]float64{"info": 2}},
+		{Sample: map[string]float64{"trace": 0.1}},
+	} {
+		if conf.Validate() == nil {
+			t.Errorf("expect error for %+v", conf)
+		}
+	}
+	if err := (&Conf{Level: "DEBUG", Sample: map[string]float64{"debug": 0.01}}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
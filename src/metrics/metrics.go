@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Prometheus text格式(0.0.4)的指标导出，不依赖client_golang：
+	Counter/CounterVec: 只增不减的计数
+	Gauge: 可增减的值
+	Histogram/HistogramVec: 延迟分布
+	Func: 抓取时回调取值，用于导出已有的atomic计数器，避免重复计数
+所有New*函数都注册到默认registry，同名指标后注册的覆盖先注册的(测试中会多次创建Service)
+*/
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets 秒，覆盖请求从1ms到2.5s的延迟
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+type registry struct {
+	sync.RWMutex
+	metrics map[string]metric
+}
+
+var defaultRegistry = &registry{metrics: make(map[string]metric)}
+
+func register(m metric) {
+	defaultRegistry.Lock()
+	defaultRegistry.metrics[m.name()] = m
+	defaultRegistry.Unlock()
+}
+
+// WriteTo writes all registered metrics sorted by name
+func WriteTo(out io.Writer) error {
+	defaultRegistry.RLock()
+	ms := make([]metric, 0, len(defaultRegistry.metrics))
+	for _, m := range defaultRegistry.metrics {
+		ms = append(ms, m)
+	}
+	defaultRegistry.RUnlock()
+	sort.Slice(ms, func(i, j int) bool { return ms[i].name() < ms[j].name() })
+
+	w := bufio.NewWriter(out)
+	for _, m := range ms {
+		m.write(w)
+	}
+	return w.Flush()
+}
+
+// Handler serves /metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		WriteTo(w)
+	})
+}
+
+// Since returns seconds elapsed from start, used with Histogram.Observe
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+type desc struct {
+	n, help, typ string
+	labels       []string
+}
+
+func (d *desc) name() string {
+	return d.n
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.n, escapeHelp(d.help), d.n, d.typ)
+}
+
+func (d *desc) checkLabels(values []string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s: expect %d label values, got %d", d.n, len(d.labels), len(values)))
+	}
+}
+
+// labelPairs formats {k1="v1",k2="v2"}, extra pair(such as le) appended
+func labelPairs(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(names[i])
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabel(values[i]))
+		sb.WriteByte('"')
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if sb.Len() > 1 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(extra[i])
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabel(extra[i+1]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// 标签值用\xff连接作为子指标的key
+func joinValues(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		n := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&f.bits, old, n) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) set(v float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T) string {
+	var buf bytes.Buffer
+	if err := WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func expectLines(t *testing.T, out string, lines ...string) {
+	for _, line := range lines {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing line %q in:\n%s", line, out)
+		}
+	}
+}
+
+func TestCounterAndGauge(t *testing.T) {
+	c := NewCounter("test_counter_total", "A counter.")
+	c.Inc()
+	c.Add(2)
+
+	g := NewGauge("test_gauge", "A gauge.")
+	g.Set(1.5)
+	g.Add(-0.5)
+
+	expectLines(t, scrape(t),
+		"# HELP test_counter_total A counter.",
+		"# TYPE test_counter_total counter",
+		"test_counter_total 3",
+		"# TYPE test_gauge gauge",
+		"test_gauge 1",
+	)
+}
+
+func TestCounterVecLabels(t *testing.T) {
+	v := NewCounterVec("test_vec_total", "Escaped \\ help\nline.", "path", "code")
+	v.With("/get", "200").Inc()
+	v.With("/get", "200").Inc()
+	v.With(`a"b\c`+"\n", "500").Inc()
+
+	expectLines(t, scrape(t),
+		`# HELP test_vec_total Escaped \\ help\nline.`,
+		`test_vec_total{path="/get",code="200"} 2`,
+		`test_vec_total{path="a\"b\\c\n",code="500"} 1`,
+	)
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expect panic on wrong label count")
+		}
+	}()
+	v.With("/get")
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 0.5, 1}, "handler")
+	for _, v := range []float64{0.05, 0.1, 0.3, 2} {
+		h.With("get").Observe(v)
+	}
+
+	expectLines(t, scrape(t),
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{handler="get",le="0.1"} 2`,
+		`test_latency_seconds_bucket{handler="get",le="0.5"} 3`,
+		`test_latency_seconds_bucket{handler="get",le="1"} 3`,
+		`test_latency_seconds_bucket{handler="get",le="+Inf"} 4`,
+		`test_latency_seconds_sum{handler="get"} 2.45`,
+		`test_latency_seconds_count{handler="get"} 4`,
+	)
+}
+
+func TestFunc(t *testing.T) {
+	n := 0
+	NewGaugeFunc("test_func", "Func gauge.", func(emit Emit) {
+		n++
+		emit(float64(n), "a")
+		emit(0.25, "b")
+	}, "k")
+
+	expectLines(t, scrape(t), `test_func{k="a"} 1`, `test_func{k="b"} 0.25`)
+	expectLines(t, scrape(t), `test_func{k="a"} 2`)
+
+	// 同名重新注册覆盖
+	NewGaugeFunc("test_func", "Func gauge.", func(emit Emit) { emit(7, "c") }, "k")
+	out := scrape(t)
+	expectLines(t, out, `test_func{k="c"} 7`)
+	if strings.Contains(out, `test_func{k="a"}`) {
+		t.Error("old func metric should be replaced")
+	}
+}
+
+func TestObserveUpstream(t *testing.T) {
+	start := time.Now()
+	ObserveUpstream("test_up", start, nil)
+	ObserveUpstream("test_up", start, errors.New("500"))
+	ObserveUpstream("test_up", start, fmt.Errorf("get: %w", context.DeadlineExceeded))
+
+	expectLines(t, scrape(t),
+		`offer_upstream_requests_total{upstream="test_up",result="ok"} 1`,
+		`offer_upstream_requests_total{upstream="test_up",result="error"} 1`,
+		`offer_upstream_requests_total{upstream="test_up",result="deadline"} 1`,
+		`offer_upstream_duration_seconds_count{upstream="test_up"} 3`,
+	)
+}
+
+func TestConcurrent(t *testing.T) {
+	v := NewCounterVec("test_concurrent_total", "Concurrent.", "k")
+	h := NewHistogram("test_concurrent_seconds", "Concurrent.", nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				v.With(fmt.Sprint(j % 4)).Inc()
+				h.Observe(0.01)
+				if j%100 == 0 {
+					WriteTo(&bytes.Buffer{})
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	expectLines(t, scrape(t),
+		`test_concurrent_total{k="0"} 2000`,
+		`test_concurrent_seconds_count 8000`,
+	)
+}
+
+func TestHandler(t *testing.T) {
+	NewCounter("test_handler_total", "Handler.").Inc()
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Error("content type: ", ct)
+	}
+	expectLines(t, rec.Body.String(), "test_handler_total 1")
+}
@@ -0,0 +1,262 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+type Counter struct {
+	v int64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.v, 1)
+}
+
+func (c *Counter) Add(n int64) {
+	if n < 0 {
+		panic("counter cannot decrease")
+	}
+	atomic.AddInt64(&c.v, n)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+type Gauge struct {
+	v atomicFloat
+}
+
+func (g *Gauge) Set(v float64) {
+	g.v.set(v)
+}
+
+func (g *Gauge) Add(v float64) {
+	g.v.add(v)
+}
+
+func (g *Gauge) Value() float64 {
+	return g.v.load()
+}
+
+type Histogram struct {
+	upper  []float64
+	counts []uint64 // 非累计，输出时累加
+	count  uint64
+	sum    atomicFloat
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{upper: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v)
+	if i < len(h.upper) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	h.sum.add(v)
+}
+
+func (h *Histogram) write(w *bufio.Writer, n string, names, values []string) {
+	var cum uint64
+	for i, upper := range h.upper {
+		cum += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket%s %d\n", n, labelPairs(names, values, "le", formatFloat(upper)), cum)
+	}
+	count := atomic.LoadUint64(&h.count)
+	fmt.Fprintf(w, "%s_bucket%s %d\n", n, labelPairs(names, values, "le", "+Inf"), count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", n, labelPairs(names, values), formatFloat(h.sum.load()))
+	fmt.Fprintf(w, "%s_count%s %d\n", n, labelPairs(names, values), count)
+}
+
+// vec keeps children(*Counter or *Histogram) by label values
+type vec struct {
+	desc
+	sync.RWMutex
+	children map[string]interface{}
+	values   map[string][]string
+	newChild func() interface{}
+}
+
+func newVec(d desc, newChild func() interface{}) *vec {
+	return &vec{
+		desc:     d,
+		children: make(map[string]interface{}),
+		values:   make(map[string][]string),
+		newChild: newChild,
+	}
+}
+
+func (v *vec) with(values []string) interface{} {
+	v.checkLabels(values)
+	key := joinValues(values)
+
+	v.RLock()
+	c, ok := v.children[key]
+	v.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	if c, ok = v.children[key]; !ok {
+		c = v.newChild()
+		v.children[key] = c
+		v.values[key] = append([]string(nil), values...)
+	}
+	return c
+}
+
+func (v *vec) each(f func(values []string, child interface{})) {
+	v.RLock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	type pair struct {
+		values []string
+		child  interface{}
+	}
+	pairs := make([]pair, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, pair{v.values[k], v.children[k]})
+	}
+	v.RUnlock()
+
+	for _, p := range pairs {
+		f(p.values, p.child)
+	}
+}
+
+type counterMetric struct {
+	desc
+	c *Counter
+}
+
+func (m *counterMetric) write(w *bufio.Writer) {
+	m.writeHeader(w)
+	fmt.Fprintf(w, "%s %d\n", m.n, m.c.Value())
+}
+
+func NewCounter(name, help string) *Counter {
+	m := &counterMetric{desc: desc{n: name, help: help, typ: "counter"}, c: &Counter{}}
+	register(m)
+	return m.c
+}
+
+type CounterVec struct {
+	*vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{newVec(desc{n: name, help: help, typ: "counter", labels: labels},
+		func() interface{} { return &Counter{} })}
+	register(v)
+	return v
+}
+
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.with(values).(*Counter)
+}
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	v.each(func(values []string, c interface{}) {
+		fmt.Fprintf(w, "%s%s %d\n", v.n, labelPairs(v.labels, values), c.(*Counter).Value())
+	})
+}
+
+type gaugeMetric struct {
+	desc
+	g *Gauge
+}
+
+func (m *gaugeMetric) write(w *bufio.Writer) {
+	m.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", m.n, formatFloat(m.g.Value()))
+}
+
+func NewGauge(name, help string) *Gauge {
+	m := &gaugeMetric{desc: desc{n: name, help: help, typ: "gauge"}, g: &Gauge{}}
+	register(m)
+	return m.g
+}
+
+type histogramMetric struct {
+	desc
+	h *Histogram
+}
+
+func (m *histogramMetric) write(w *bufio.Writer) {
+	m.writeHeader(w)
+	m.h.write(w, m.n, nil, nil)
+}
+
+// NewHistogram creates a histogram, buckets must be sorted, nil for DefBuckets
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	m := &histogramMetric{desc: desc{n: name, help: help, typ: "histogram"}, h: newHistogram(buckets)}
+	register(m)
+	return m.h
+}
+
+type HistogramVec struct {
+	*vec
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	v := &HistogramVec{newVec(desc{n: name, help: help, typ: "histogram", labels: labels},
+		func() interface{} { return newHistogram(buckets) })}
+	register(v)
+	return v
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.with(values).(*Histogram)
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	v.each(func(values []string, h interface{}) {
+		h.(*Histogram).write(w, v.n, v.labels, values)
+	})
+}
+
+// Emit reports one sample of a Func metric
+type Emit func(v float64, labelValues ...string)
+
+type funcMetric struct {
+	desc
+	collect func(emit Emit)
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.writeHeader(w)
+	m.collect(func(v float64, values ...string) {
+		m.checkLabels(values)
+		fmt.Fprintf(w, "%s%s %s\n", m.n, labelPairs(m.labels, values), formatFloat(v))
+	})
+}
+
+// NewCounterFunc exports counters kept elsewhere, collect is called on every scrape
+func NewCounterFunc(name, help string, collect func(emit Emit), labels ...string) {
+	register(&funcMetric{desc: desc{n: name, help: help, typ: "counter", labels: labels}, collect: collect})
+}
+
+// NewGaugeFunc exports values computed on every scrape, such as index size
+func NewGaugeFunc(name, help string, collect func(emit Emit), labels ...string) {
+	register(&funcMetric{desc: desc{n: name, help: help, typ: "gauge", labels: labels}, collect: collect})
+}
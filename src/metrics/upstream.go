@@ -0,0 +1,28 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// 上游(rank、实时api、vast等)调用统计，所有adapter共用一组指标，用upstream标签区分
+var (
+	upstreamDuration = NewHistogramVec("offer_upstream_duration_seconds",
+		"Latency of upstream adapter calls.", nil, "upstream")
+	upstreamRequests = NewCounterVec("offer_upstream_requests_total",
+		"Upstream adapter calls by result: ok, error, deadline.", "upstream", "result")
+)
+
+// ObserveUpstream records an upstream call started at start, err is the call result
+func ObserveUpstream(upstream string, start time.Time, err error) {
+	upstreamDuration.With(upstream).Observe(Since(start))
+
+	result := "ok"
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		result = "deadline"
+	} else if err != nil {
+		result = "error"
+	}
+	upstreamRequests.With(upstream, result).Inc()
+}
@@ -0,0 +1,71 @@
+package offer_cap
+
+import (
+	"time"
+
+	"logger"
+	"raw_ad"
+)
+
+// std为nil时(未开启)不做cap控制
+var std *Capper
+
+// Init starts refreshing counters from redis, cache must be initialized before
+func Init(cf *Conf) {
+	if !cf.Enabled {
+		return
+	}
+	std = newCapper(cf, redisStore{})
+	go func() {
+		for range time.Tick(time.Duration(std.conf.RefreshSeconds) * time.Second) {
+			if err := std.refresh(); err != nil {
+				logger.Default().Error("offer_cap refresh error", logger.Fields{"err": err})
+			}
+		}
+	}()
+}
+
+func Enabled() bool {
+	return std != nil
+}
+
+// Allow returns false and state if offer is capped or throttled
+func Allow(raw *raw_ad.RawAdObj) (bool, string) {
+	if std == nil {
+		return true, StateOk
+	}
+	return std.Allow(raw)
+}
+
+// AllowCPT returns false and state if impressions of CPT offer reach dailyImps
+func AllowCPT(raw *raw_ad.RawAdObj, dailyImps int) (bool, string) {
+	if std == nil {
+		return true, StateOk
+	}
+	return std.AllowCPT(raw, dailyImps)
+}
+
+// Track is registered to estimator.OnTrack
+func Track(event, offer string, n float64) {
+	if std == nil {
+		return
+	}
+	if err := std.Track(event, offer, n); err != nil {
+		logger.Default().Warn("offer_cap track error", logger.Fields{"offer": offer, "event": event, "err": err})
+	}
+}
+
+// Get returns status of offer, nil if cap is disabled or offer is not tracked
+func Get(offer string) *Status {
+	if std == nil {
+		return nil
+	}
+	return std.Get(offer)
+}
+
+func Report() []*Status {
+	if std == nil {
+		return nil
+	}
+	return std.Report()
+}
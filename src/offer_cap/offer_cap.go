@@ -0,0 +1,301 @@
+package offer_cap
+
+import (
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"metrics"
+	"raw_ad"
+)
+
+/*
+offer日/月cap(raw.CapDaily, raw.CapMonthly)：
+	展示、点击和转化由/track上报(见estimator.OnTrack)，按offer(uniq_id)写入redis，所有实例共享：
+		ocap:d:<yyyymmdd>:<uniq_id>:<imp|click|conv>   保留2天
+		ocap:m:<yyyymm>:<uniq_id>:<imp|click|conv>     保留32天
+	日期按UTC；payout_type在click_types中的offer按点击计，在imp_types中的(如CPT)按展示计，其它按转化计
+	检索时不访问redis: 带cap的offer第一次被检索时加入跟踪列表，每refresh_seconds批量读取一次计数
+	ratio = max(日计数/日cap, 月计数/月cap):
+		ratio >= 1               capped，从检索结果中去掉
+		ratio >= soft_ratio      throttled，只有soft_pass的概率放行(同SlotImpInCap的80%规则)
+	超过一天没有被检索的offer不再跟踪
+CPT(cpt_config中按媒体售卖的offer)另外按日展示预算(daily_imps)跟踪，id为CPTKey(uniq_id)，计数与该offer的展示计数相同
+*/
+
+type Conf struct {
+	Enabled        bool     `json:"enabled"`
+	RefreshSeconds int      `json:"refresh_seconds"` // 默认30
+	SoftRatio      float64  `json:"soft_ratio"`      // 默认0.8
+	SoftPass       float64  `json:"soft_pass"`       // 默认0.2
+	ClickTypes     []string `json:"click_types"`     // 按点击计cap的payout_type，默认["CPC"]
+	ImpTypes       []string `json:"imp_types"`       // 按展示计cap的payout_type，如["CPT"]，默认没有
+}
+
+func (cf *Conf) Validate() error {
+	if cf.RefreshSeconds < 0 {
+		return errors.New("refresh_seconds should not be negative")
+	}
+	if cf.SoftRatio < 0 || cf.SoftRatio > 1 || cf.SoftPass < 0 || cf.SoftPass > 1 {
+		return errors.New("soft_ratio and soft_pass should be 0~1")
+	}
+	return nil
+}
+
+func (cf *Conf) setDefault() {
+	if cf.RefreshSeconds == 0 {
+		cf.RefreshSeconds = 30
+	}
+	if cf.SoftRatio == 0 {
+		cf.SoftRatio = 0.8
+	}
+	if cf.SoftPass == 0 {
+		cf.SoftPass = 0.2
+	}
+	if cf.ClickTypes == nil {
+		cf.ClickTypes = []string{"CPC"}
+	}
+}
+
+const (
+	Imp   = "imp"
+	Click = "click"
+	Conv  = "conv"
+
+	StateOk        = "ok"
+	StateThrottled = "throttled"
+	StateCapped    = "capped"
+)
+
+// Status is the cap state of one offer, it is refreshed from redis periodically
+type Status struct {
+	Offer      string  `json:"offer"`
+	Event      string  `json:"event"`
+	CapDaily   int     `json:"cap_daily"`
+	CapMonthly int     `json:"cap_monthly"`
+	Daily      int64   `json:"daily"`
+	Monthly    int64   `json:"monthly"`
+	Ratio      float64 `json:"ratio"`
+	State      string  `json:"state"`
+	Updated    int64   `json:"updated"`
+}
+
+// store keeps counters shared by all instances
+type store interface {
+	incr(offer, event string, day, month string, n int64) error
+	// get returns (daily, monthly) of each key, missing counters are 0
+	get(keys []countKey, day, month string) ([][2]int64, error)
+}
+
+type countKey struct {
+	offer, event string
+}
+
+type tracked struct {
+	countKey
+	id         string // uniq_id，CPT为CPTKey(uniq_id)
+	capDaily   int
+	capMonthly int
+	seen       int64 // unix, atomic
+}
+
+type Capper struct {
+	conf  Conf
+	click map[string]bool
+	imp   map[string]bool
+	store store
+	now   func() time.Time
+
+	offers sync.Map     // uniq_id -> *tracked
+	status atomic.Value // map[string]*Status
+}
+
+var (
+	filteredTotal = metrics.NewCounterVec("offer_cap_filtered_total",
+		"Offers dropped by daily/monthly cap, state is capped or throttled.", "state")
+	refreshErrors = metrics.NewCounter("offer_cap_refresh_errors_total",
+		"Failed cap refreshes from redis.")
+)
+
+func newCapper(cf *Conf, st store) *Capper {
+	c := &Capper{conf: *cf, store: st, now: time.Now}
+	c.conf.setDefault()
+	c.click = make(map[string]bool, len(c.conf.ClickTypes))
+	for _, t := range c.conf.ClickTypes {
+		c.click[t] = true
+	}
+	c.imp = make(map[string]bool, len(c.conf.ImpTypes))
+	for _, t := range c.conf.ImpTypes {
+		c.imp[t] = true
+	}
+	c.status.Store(map[string]*Status{})
+	return c
+}
+
+func period(t time.Time) (day, month string) {
+	t = t.UTC()
+	return t.Format("20060102"), t.Format("200601")
+}
+
+func (c *Capper) eventOf(raw *raw_ad.RawAdObj) string {
+	if c.click[raw.PayoutType] {
+		return Click
+	}
+	if c.imp[raw.PayoutType] {
+		return Imp
+	}
+	return Conv
+}
+
+// CPTKey is the tracking id of CPT budget of offer, used by Get and budget pacing
+func CPTKey(uniqId string) string {
+	return "cpt:" + uniqId
+}
+
+// Allow returns false if offer is capped or throttled, state is returned for funnel
+func (c *Capper) Allow(raw *raw_ad.RawAdObj) (bool, string) {
+	return c.allow(&tracked{
+		countKey:   countKey{offer: raw.UniqId, event: c.eventOf(raw)},
+		id:         raw.UniqId,
+		capDaily:   raw.CapDaily,
+		capMonthly: raw.CapMonthly,
+	})
+}
+
+// AllowCPT caps impressions of CPT offer by dailyImps, 0 means no limit
+func (c *Capper) AllowCPT(raw *raw_ad.RawAdObj, dailyImps int) (bool, string) {
+	return c.allow(&tracked{
+		countKey: countKey{offer: raw.UniqId, event: Imp},
+		id:       CPTKey(raw.UniqId),
+		capDaily: dailyImps,
+	})
+}
+
+func (c *Capper) allow(t *tracked) (bool, string) {
+	if t.capDaily <= 0 && t.capMonthly <= 0 {
+		return true, StateOk
+	}
+
+	now := c.now().Unix()
+	if v, ok := c.offers.Load(t.id); ok {
+		old := v.(*tracked)
+		if atomic.LoadInt64(&old.seen) < now {
+			atomic.StoreInt64(&old.seen, now)
+		}
+		if old.capDaily != t.capDaily || old.capMonthly != t.capMonthly {
+			// offer更新了cap，下次刷新生效
+			t.seen = now
+			c.offers.Store(t.id, t)
+		}
+	} else {
+		t.seen = now
+		c.offers.Store(t.id, t)
+	}
+
+	st := c.status.Load().(map[string]*Status)[t.id]
+	if st == nil {
+		return true, StateOk
+	}
+	switch st.State {
+	case StateCapped:
+		filteredTotal.With(StateCapped).Inc()
+		return false, StateCapped
+	case StateThrottled:
+		if rand.Float64() < c.conf.SoftPass {
+			return true, StateThrottled
+		}
+		filteredTotal.With(StateThrottled).Inc()
+		return false, StateThrottled
+	}
+	return true, StateOk
+}
+
+// Track records n events of offer, event other than imp, click and conv is ignored
+func (c *Capper) Track(event, offer string, n float64) error {
+	if (event != Imp && event != Click && event != Conv) || offer == "" || n < 1 {
+		return nil
+	}
+	day, month := period(c.now())
+	return c.store.incr(offer, event, day, month, int64(n))
+}
+
+// refresh reads counters of tracked offers and rebuilds status, offers not seen for a day are dropped
+func (c *Capper) refresh() error {
+	now := c.now()
+	expire := now.Unix() - 86400
+	offers := make([]*tracked, 0, 256)
+	c.offers.Range(func(k, v interface{}) bool {
+		t := v.(*tracked)
+		if atomic.LoadInt64(&t.seen) < expire {
+			c.offers.Delete(k)
+		} else {
+			offers = append(offers, t)
+		}
+		return true
+	})
+
+	keys := make([]countKey, 0, len(offers))
+	for _, t := range offers {
+		keys = append(keys, t.countKey)
+	}
+	day, month := period(now)
+	counts, err := c.store.get(keys, day, month)
+	if err != nil {
+		refreshErrors.Inc()
+		return err // 保留上次的状态
+	}
+
+	status := make(map[string]*Status, len(offers))
+	for i, t := range offers {
+		st := &Status{
+			Offer: t.id, Event: t.event,
+			CapDaily: t.capDaily, CapMonthly: t.capMonthly,
+			Daily: counts[i][0], Monthly: counts[i][1],
+			Updated: now.Unix(),
+		}
+		if t.capDaily > 0 {
+			st.Ratio = float64(st.Daily) / float64(t.capDaily)
+		}
+		if t.capMonthly > 0 {
+			if r := float64(st.Monthly) / float64(t.capMonthly); r > st.Ratio {
+				st.Ratio = r
+			}
+		}
+		switch {
+		case st.Ratio >= 1:
+			st.State = StateCapped
+		case st.Ratio >= c.conf.SoftRatio:
+			st.State = StateThrottled
+		default:
+			st.State = StateOk
+		}
+		status[t.id] = st
+	}
+	c.status.Store(status)
+	return nil
+}
+
+// Get returns status of offer (uniq_id or CPTKey), nil if offer is not tracked yet
+func (c *Capper) Get(offer string) *Status {
+	return c.status.Load().(map[string]*Status)[offer]
+}
+
+// Report returns status of all tracked offers, capped first
+func (c *Capper) Report() []*Status {
+	status := c.status.Load().(map[string]*Status)
+	res := make([]*Status, 0, len(status))
+	for _, st := range status {
+		res = append(res, st)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Ratio > res[j].Ratio })
+	return res
+}
+
+// shard maps offer to a redis pool like user_hash
+func shard(offer string) int {
+	return int(crc32.ChecksumIEEE([]byte(offer)) % 1000)
+}
@@ -0,0 +1,208 @@
+package offer_cap
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"raw_ad"
+)
+
+type memStore struct {
+	sync.Mutex
+	counts map[string]int64
+	fail   bool
+}
+
+func newMemStore() *memStore {
+	return &memStore{counts: make(map[string]int64)}
+}
+
+func (m *memStore) incr(offer, event string, day, month string, n int64) error {
+	m.Lock()
+	defer m.Unlock()
+	m.counts[dailyKey(day, offer, event)] += n
+	m.counts[monthlyKey(month, offer, event)] += n
+	return nil
+}
+
+func (m *memStore) get(keys []countKey, day, month string) ([][2]int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.fail {
+		return nil, errors.New("redis down")
+	}
+	res := make([][2]int64, len(keys))
+	for i, k := range keys {
+		res[i] = [2]int64{m.counts[dailyKey(day, k.offer, k.event)], m.counts[monthlyKey(month, k.offer, k.event)]}
+	}
+	return res, nil
+}
+
+func testCapper(st store, now time.Time) *Capper {
+	c := newCapper(&Conf{Enabled: true, SoftPass: 0.000001, ImpTypes: []string{"CPT"}}, st)
+	c.now = func() time.Time { return now }
+	return c
+}
+
+func rawOf(id, payoutType string, daily, monthly int) *raw_ad.RawAdObj {
+	return &raw_ad.RawAdObj{UniqId: id, PayoutType: payoutType, CapDaily: daily, CapMonthly: monthly}
+}
+
+func TestAllow(t *testing.T) {
+	st := newMemStore()
+	now := time.Date(2024, 3, 31, 23, 0, 0, 0, time.UTC)
+	c := testCapper(st, now)
+
+	noCap := rawOf("ym_1", "CPI", 0, 0)
+	daily := rawOf("ym_2", "CPI", 10, 0)
+	monthly := rawOf("ym_3", "CPC", 0, 100)
+	throttled := rawOf("ym_4", "CPI", 10, 0)
+	cpt := rawOf("ym_5", "CPT", 1000, 0)
+	for _, raw := range []*raw_ad.RawAdObj{noCap, daily, monthly, throttled, cpt} {
+		if ok, _ := c.Allow(raw); !ok {
+			t.Fatal("untracked offer should pass: ", raw.UniqId)
+		}
+	}
+
+	c.Track(Conv, "ym_2", 10)
+	c.Track(Click, "ym_2", 100) // CPI按转化计
+	c.Track(Click, "ym_3", 100)
+	c.Track(Conv, "ym_4", 8)
+	c.Track("served", "ym_4", 100)
+	c.Track(Imp, "ym_5", 1000)
+	if err := c.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		raw   *raw_ad.RawAdObj
+		ok    bool
+		state string
+	}{
+		{noCap, true, StateOk},
+		{daily, false, StateCapped},
+		{monthly, false, StateCapped},
+		{throttled, false, StateThrottled},
+		{cpt, false, StateCapped},
+	}
+	for _, cs := range cases {
+		if ok, state := c.Allow(cs.raw); ok != cs.ok || state != cs.state {
+			t.Errorf("%s: expect %v %s, got %v %s", cs.raw.UniqId, cs.ok, cs.state, ok, state)
+		}
+	}
+
+	if st := c.Get("ym_4"); st == nil || st.Daily != 8 || st.Event != Conv || st.Ratio != 0.8 {
+		t.Errorf("status of ym_4: %+v", st)
+	}
+	if c.Get("ym_1") != nil {
+		t.Error("offer without cap should not be tracked")
+	}
+	report := c.Report()
+	if len(report) != 4 || report[len(report)-1].Offer != "ym_4" {
+		t.Errorf("report should be sorted by ratio: %+v", report)
+	}
+}
+
+func TestRefreshPeriod(t *testing.T) {
+	st := newMemStore()
+	now := time.Date(2024, 3, 31, 23, 0, 0, 0, time.UTC)
+	c := testCapper(st, now)
+	raw := rawOf("ym_1", "CPI", 10, 15)
+	c.Allow(raw)
+	c.Track(Conv, "ym_1", 10)
+	c.refresh()
+	if ok, _ := c.Allow(raw); ok {
+		t.Fatal("daily cap should be reached")
+	}
+
+	// 第二天日计数清零，月计数保留
+	now = now.Add(2 * time.Hour)
+	c.now = func() time.Time { return now }
+	c.Track(Conv, "ym_1", 2)
+	c.refresh()
+	if s := c.Get("ym_1"); s.Daily != 2 || s.Monthly != 2 || s.State != StateOk {
+		t.Errorf("new day and month: %+v", s)
+	}
+
+	// cap变化后按新的cap计算
+	raw.CapDaily = 2
+	c.Allow(raw)
+	c.refresh()
+	if s := c.Get("ym_1"); s.CapDaily != 2 || s.State != StateCapped {
+		t.Errorf("cap changed: %+v", s)
+	}
+}
+
+func TestAllowCPT(t *testing.T) {
+	st := newMemStore()
+	now := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	c := testCapper(st, now)
+	raw := rawOf("ym_1", "CPI", 10, 0)
+	c.Allow(raw)
+	if ok, _ := c.AllowCPT(raw, 100); !ok {
+		t.Fatal("untracked offer should pass")
+	}
+	if ok, _ := c.AllowCPT(raw, 0); !ok {
+		t.Fatal("CPT without daily_imps should pass")
+	}
+
+	// CPT按展示计预算，和offer自己的cap分开跟踪
+	c.AllowCPT(raw, 100)
+	c.Track(Imp, "ym_1", 100)
+	c.Track(Conv, "ym_1", 1)
+	c.refresh()
+	if ok, state := c.AllowCPT(raw, 100); ok || state != StateCapped {
+		t.Errorf("CPT budget should be reached, got %v %s", ok, state)
+	}
+	if ok, _ := c.Allow(raw); !ok {
+		t.Error("cap of offer should not be affected by CPT budget")
+	}
+	if s := c.Get(CPTKey("ym_1")); s == nil || s.Event != Imp || s.Daily != 100 || s.CapDaily != 100 {
+		t.Errorf("CPT status: %+v", s)
+	}
+	if s := c.Get("ym_1"); s == nil || s.Event != Conv || s.Daily != 1 {
+		t.Errorf("offer status: %+v", s)
+	}
+}
+
+func TestRefreshErrorAndPrune(t *testing.T) {
+	st := newMemStore()
+	now := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	c := testCapper(st, now)
+	raw := rawOf("ym_1", "CPI", 1, 0)
+	c.Allow(raw)
+	c.Track(Conv, "ym_1", 1)
+	c.refresh()
+
+	st.fail = true
+	if err := c.refresh(); err == nil {
+		t.Fatal("expect error")
+	}
+	if ok, _ := c.Allow(raw); ok {
+		t.Error("status should be kept on refresh error")
+	}
+	st.fail = false
+
+	now = now.Add(25 * time.Hour)
+	c.now = func() time.Time { return now }
+	c.refresh()
+	if c.Get("ym_1") != nil {
+		t.Error("offer not seen for a day should be dropped")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	if Enabled() {
+		t.Fatal("should be disabled before Init")
+	}
+	Init(&Conf{})
+	if ok, state := Allow(rawOf("ym_1", "CPI", 1, 1)); !ok || state != StateOk {
+		t.Error("disabled cap should pass all offers")
+	}
+	Track(Conv, "ym_1", 1)
+	if Get("ym_1") != nil || Report() != nil {
+		t.Error("disabled cap has no status")
+	}
+}
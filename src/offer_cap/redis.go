@@ -0,0 +1,72 @@
+package offer_cap
+
+import (
+	"errors"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"cache"
+)
+
+const (
+	dailyTTL   = 2 * 86400
+	monthlyTTL = 32 * 86400
+)
+
+func dailyKey(day, offer, event string) string {
+	return "ocap:d:" + day + ":" + offer + ":" + event
+}
+
+func monthlyKey(month, offer, event string) string {
+	return "ocap:m:" + month + ":" + offer + ":" + event
+}
+
+type redisStore struct{}
+
+func (redisStore) incr(offer, event string, day, month string, n int64) error {
+	conn := cache.GetConn(shard(offer))
+	defer conn.Close()
+
+	dk, mk := dailyKey(day, offer, event), monthlyKey(month, offer, event)
+	conn.Send("INCRBY", dk, n)
+	conn.Send("EXPIRE", dk, dailyTTL)
+	conn.Send("INCRBY", mk, n)
+	conn.Send("EXPIRE", mk, monthlyTTL)
+	_, err := conn.Do("")
+	return err
+}
+
+// get reads counters by MGET, one round trip per redis pool
+func (redisStore) get(keys []countKey, day, month string) ([][2]int64, error) {
+	res := make([][2]int64, len(keys))
+	n := cache.PoolNum()
+	if n == 0 {
+		return nil, errors.New("redis pools not initialized")
+	}
+
+	groups := make(map[int][]int, n) // pool -> index of keys
+	for i, k := range keys {
+		p := shard(k.offer) % n
+		groups[p] = append(groups[p], i)
+	}
+	for p, idx := range groups {
+		args := make([]interface{}, 0, 2*len(idx))
+		for _, i := range idx {
+			args = append(args, dailyKey(day, keys[i].offer, keys[i].event),
+				monthlyKey(month, keys[i].offer, keys[i].event))
+		}
+		conn := cache.GetConn(p)
+		vals, err := redis.Int64s(redis.DoWithTimeout(conn, time.Second, "MGET", args...))
+		conn.Close()
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+		for j, i := range idx {
+			if 2*j+1 < len(vals) {
+				res[i] = [2]int64{vals[2*j], vals[2*j+1]}
+			}
+		}
+	}
+	return res, nil
+}
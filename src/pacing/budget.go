@@ -0,0 +1,379 @@
+package pacing
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"logger"
+	"metrics"
+	"offer_cap"
+	"raw_ad"
+)
+
+/*
+预算pacing(带日cap的offer和CPT offer)：
+	把offer的日预算(cap_daily，计数口径同offer_cap: 点击、转化，CPT为展示)按流量曲线花到一天结束，避免上午就把预算花完、剩下的时间没有量
+	每interval_seconds对每个offer做一次反馈控制，已花费为offer_cap从redis读取的全集群计数:
+		剩余预算 R = cap_daily - 今日已花费
+		下个周期的目标 target = R * 下个周期的流量占比 / 今天剩余时间的流量占比
+		全量放行时单位流量占比的花费 rate = 上个周期的花费 / 上个周期的放行概率 / 上个周期的流量占比，按EWMA平滑(点击、转化稀疏时单个周期经常为0)
+		p += gain * (target / (rate * 下个周期的流量占比) - p)，限制在[min_prob, 1]；还没有花费时p为1；预算花完时p为0
+	检索时offer以概率p放行，没有cap状态的offer不限制
+	CPT offer(cpt_config)的预算为daily_imps，按展示计，状态为offer_cap中CPTKey(uniq_id)的计数；没有配置daily_imps时按offer自己的cap_daily
+	流量曲线: 24个UTC小时的权重，初始为shape(默认均匀)，每小时结束时用该小时的检索请求数/最近24小时的平均请求数按shape_learning_rate平滑更新
+	日期按UTC，与offer_cap一致；rate跨天保留，新的一天开始时不会集中花费
+*/
+
+type BudgetConf struct {
+	Enabled           bool      `json:"enabled"`             // 需要开启offer_cap
+	IntervalSeconds   int       `json:"interval_seconds"`    // 控制周期，默认60
+	Gain              float64   `json:"gain"`                // 0~1，默认0.5
+	MinProb           float64   `json:"min_prob"`            // 默认0.01
+	Shape             []float64 `json:"shape"`               // 24个UTC小时的流量权重，默认均匀
+	ShapeLearningRate float64   `json:"shape_learning_rate"` // 0~1，默认0.1
+}
+
+func (cf *BudgetConf) Validate() error {
+	if cf.IntervalSeconds < 0 {
+		return errors.New("interval_seconds should not be negative")
+	}
+	if cf.Gain < 0 || cf.Gain > 1 || cf.MinProb < 0 || cf.MinProb > 1 ||
+		cf.ShapeLearningRate < 0 || cf.ShapeLearningRate > 1 {
+		return errors.New("gain, min_prob and shape_learning_rate should be 0~1")
+	}
+	if len(cf.Shape) != 0 && len(cf.Shape) != 24 {
+		return errors.New("shape should have 24 hourly weights")
+	}
+	for _, w := range cf.Shape {
+		if w <= 0 {
+			return errors.New("shape weights should be positive")
+		}
+	}
+	return nil
+}
+
+func (cf *BudgetConf) setDefault() {
+	if cf.IntervalSeconds == 0 {
+		cf.IntervalSeconds = 60
+	}
+	if cf.Gain == 0 {
+		cf.Gain = 0.5
+	}
+	if cf.MinProb == 0 {
+		cf.MinProb = 0.01
+	}
+	if cf.ShapeLearningRate == 0 {
+		cf.ShapeLearningRate = 0.1
+	}
+}
+
+type budgetOffer struct {
+	prob   uint64 // math.Float64bits, atomic
+	target uint64 // 下个周期的目标花费，math.Float64bits, atomic
+	seen   int64  // unix, atomic
+
+	// 以下只在控制周期中访问
+	day       string
+	lastSpent int64
+	lastProb  float64
+	lastShare float64 // 上个周期的流量占比
+	rate      float64 // 全量放行时单位流量占比的花费
+}
+
+const rateSmoothing = 0.2
+
+func (o *budgetOffer) loadProb() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&o.prob))
+}
+
+func (o *budgetOffer) storeProb(p float64) {
+	atomic.StoreUint64(&o.prob, math.Float64bits(p))
+}
+
+type BudgetPacer struct {
+	conf   BudgetConf
+	status func(offer string) *offer_cap.Status
+	now    func() time.Time
+
+	offers   sync.Map // uniq_id或CPTKey(uniq_id) -> *budgetOffer
+	requests int64    // 当前小时的检索请求数，atomic
+
+	mu       sync.Mutex
+	shape    [24]float64 // 均值为1
+	hist     [24]float64 // 最近24小时各小时的检索量
+	hour     int         // 当前小时
+	fullHour bool        // 当前小时是否从头开始统计
+}
+
+var budgetFiltered = metrics.NewCounter("offer_budget_pacing_filtered_total",
+	"Offers dropped by budget pacing.")
+
+func init() {
+	metrics.NewGaugeFunc("offer_budget_pacing_offers", "Offers under budget pacing.",
+		func(emit metrics.Emit) {
+			if budget == nil {
+				return
+			}
+			n := 0
+			budget.offers.Range(func(k, v interface{}) bool { n++; return true })
+			emit(float64(n))
+		})
+}
+
+func newBudgetPacer(cf *BudgetConf, status func(offer string) *offer_cap.Status) *BudgetPacer {
+	p := &BudgetPacer{conf: *cf, status: status, now: time.Now}
+	p.conf.setDefault()
+
+	sum := 0.0
+	for h := range p.shape {
+		p.shape[h] = 1
+		if len(p.conf.Shape) == 24 {
+			p.shape[h] = p.conf.Shape[h]
+		}
+		sum += p.shape[h]
+	}
+	for h := range p.shape {
+		p.shape[h] *= 24 / sum
+	}
+
+	p.hour = p.now().UTC().Hour()
+	return p
+}
+
+// Request counts one retrieval request for learning traffic shape
+func (p *BudgetPacer) Request() {
+	atomic.AddInt64(&p.requests, 1)
+}
+
+// Allow returns false if offer is dropped by pacing, offers without daily cap always pass
+func (p *BudgetPacer) Allow(raw *raw_ad.RawAdObj) bool {
+	return p.allow(raw.UniqId, raw.CapDaily)
+}
+
+// AllowCPT paces CPT offer by its daily impression budget, offer cap_daily is used if dailyImps is 0
+func (p *BudgetPacer) AllowCPT(raw *raw_ad.RawAdObj, dailyImps int) bool {
+	if dailyImps <= 0 {
+		return p.Allow(raw)
+	}
+	return p.allow(offer_cap.CPTKey(raw.UniqId), dailyImps)
+}
+
+func (p *BudgetPacer) allow(id string, capDaily int) bool {
+	if capDaily <= 0 {
+		return true
+	}
+
+	now := p.now().Unix()
+	v, ok := p.offers.Load(id)
+	if !ok {
+		o := &budgetOffer{seen: now}
+		o.storeProb(1)
+		v, _ = p.offers.LoadOrStore(id, o)
+	}
+	o := v.(*budgetOffer)
+	if atomic.LoadInt64(&o.seen) < now {
+		atomic.StoreInt64(&o.seen, now)
+	}
+
+	prob := o.loadProb()
+	if prob >= 1 || rand.Float64() < prob {
+		return true
+	}
+	budgetFiltered.Inc()
+	return false
+}
+
+func endOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+// share returns traffic share of [from, to) by hourly shape, from and to are in the same UTC day
+func (p *BudgetPacer) share(from, to time.Time) float64 {
+	s := 0.0
+	for t := from; t.Before(to); {
+		next := t.Truncate(time.Hour).Add(time.Hour)
+		if next.After(to) {
+			next = to
+		}
+		s += p.shape[t.Hour()] * next.Sub(t).Hours()
+		t = next
+	}
+	return s / 24
+}
+
+// learnShape updates weight of the finished hour, partially observed hours and hours without requests are skipped
+func (p *BudgetPacer) learnShape(now time.Time) {
+	if now.Hour() == p.hour {
+		return
+	}
+	n := float64(atomic.SwapInt64(&p.requests, 0))
+	prev := p.hour
+	p.hist[prev] = n
+	if p.fullHour && n > 0 {
+		avg, hours := 0.0, 0
+		for _, c := range p.hist {
+			if c > 0 {
+				avg += c
+				hours++
+			}
+		}
+		if avg > 0 {
+			avg /= float64(hours)
+			lr := p.conf.ShapeLearningRate
+			p.shape[prev] = (1-lr)*p.shape[prev] + lr*n/avg
+		}
+	}
+	p.hour, p.fullHour = now.Hour(), true
+}
+
+func (p *BudgetPacer) tick() {
+	now := p.now().UTC()
+	p.mu.Lock()
+	p.learnShape(now)
+	eod := endOfDay(now)
+	to := now.Add(time.Duration(p.conf.IntervalSeconds) * time.Second)
+	if to.After(eod) {
+		to = eod
+	}
+	next, left := p.share(now, to), p.share(now, eod)
+	p.mu.Unlock()
+
+	day := now.Format("20060102")
+	expire := now.Unix() - 86400
+	p.offers.Range(func(k, v interface{}) bool {
+		o := v.(*budgetOffer)
+		if atomic.LoadInt64(&o.seen) < expire {
+			p.offers.Delete(k)
+			return true
+		}
+		st := p.status(k.(string))
+		if st == nil || st.CapDaily <= 0 || time.Unix(st.Updated, 0).UTC().Format("20060102") != day {
+			// 还没有今天的计数
+			o.storeProb(1)
+			return true
+		}
+		o.update(&p.conf, st, day, next, left)
+		return true
+	})
+}
+
+func (o *budgetOffer) update(cf *BudgetConf, st *offer_cap.Status, day string, next, left float64) {
+	prob := o.loadProb()
+	if day != o.day {
+		o.day, o.lastSpent = day, 0
+	}
+	spent := st.Daily
+	delivered := float64(spent - o.lastSpent)
+	remain := float64(int64(st.CapDaily) - spent)
+	target := 0.0
+	if left > 0 && remain > 0 {
+		target = remain * next / left
+	}
+	atomic.StoreUint64(&o.target, math.Float64bits(target))
+
+	if o.lastShare > 0 && o.lastProb > 0 && delivered >= 0 {
+		obs := delivered / o.lastProb / o.lastShare
+		if o.rate == 0 {
+			o.rate = obs
+		} else {
+			o.rate += rateSmoothing * (obs - o.rate)
+		}
+	}
+
+	switch {
+	case remain <= 0:
+		prob = 0
+	case o.rate <= 0 || next <= 0:
+		prob = 1
+	default:
+		prob += cf.Gain * (target/(o.rate*next) - prob)
+		prob = math.Max(cf.MinProb, math.Min(1, prob))
+	}
+
+	o.lastSpent, o.lastShare, o.lastProb = spent, next, prob
+	o.storeProb(prob)
+}
+
+// BudgetStatus is the pacing state of one offer
+type BudgetStatus struct {
+	Offer    string  `json:"offer"`
+	Prob     float64 `json:"prob"`
+	CapDaily int     `json:"cap_daily"`
+	Spent    int64   `json:"spent"`
+	Target   float64 `json:"target"` // 下个周期的目标花费
+}
+
+// Report returns pacing state of offers sorted by prob, and the current traffic shape
+func (p *BudgetPacer) Report() ([]*BudgetStatus, []float64) {
+	res := make([]*BudgetStatus, 0, 256)
+	p.offers.Range(func(k, v interface{}) bool {
+		o := v.(*budgetOffer)
+		bs := &BudgetStatus{Offer: k.(string), Prob: o.loadProb(),
+			Target: math.Float64frombits(atomic.LoadUint64(&o.target))}
+		if st := p.status(bs.Offer); st != nil {
+			bs.CapDaily, bs.Spent = st.CapDaily, st.Daily
+		}
+		res = append(res, bs)
+		return true
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].Prob < res[j].Prob })
+
+	p.mu.Lock()
+	shape := append([]float64(nil), p.shape[:]...)
+	p.mu.Unlock()
+	return res, shape
+}
+
+// budget为nil时(未开启)不做预算pacing
+var budget *BudgetPacer
+
+// InitBudget starts the control loop, offer_cap must be initialized before
+func InitBudget(cf *BudgetConf) {
+	if !cf.Enabled {
+		return
+	}
+	budget = newBudgetPacer(cf, offer_cap.Get)
+	go func() {
+		for range time.Tick(time.Duration(budget.conf.IntervalSeconds) * time.Second) {
+			budget.tick()
+		}
+	}()
+	logger.Default().Info("budget pacing enabled", logger.Fields{"interval_seconds": budget.conf.IntervalSeconds})
+}
+
+// BudgetRequest is called once per retrieval request
+func BudgetRequest() {
+	if budget != nil {
+		budget.Request()
+	}
+}
+
+// AllowBudget returns false if offer is dropped by budget pacing
+func AllowBudget(raw *raw_ad.RawAdObj) bool {
+	if budget == nil {
+		return true
+	}
+	return budget.Allow(raw)
+}
+
+// AllowCPTBudget returns false if CPT offer is dropped by budget pacing, offer_cap.AllowCPT must be called before
+func AllowCPTBudget(raw *raw_ad.RawAdObj, dailyImps int) bool {
+	if budget == nil {
+		return true
+	}
+	return budget.AllowCPT(raw, dailyImps)
+}
+
+// BudgetReport returns nil if budget pacing is disabled
+func BudgetReport() ([]*BudgetStatus, []float64) {
+	if budget == nil {
+		return nil, nil
+	}
+	return budget.Report()
+}
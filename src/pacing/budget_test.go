@@ -0,0 +1,190 @@
+package pacing
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"offer_cap"
+	"raw_ad"
+)
+
+// simulate runs one day of ticks every minute, full is the spend per minute when prob is 1
+func simulate(t *testing.T, shape []float64, full func(hour int) float64) (spentAt9, spent float64) {
+	start := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	raw := &raw_ad.RawAdObj{UniqId: "ym_1", CapDaily: 1440}
+	p := newBudgetPacer(&BudgetConf{Enabled: true, Shape: shape}, func(offer string) *offer_cap.Status {
+		return &offer_cap.Status{Offer: offer, CapDaily: raw.CapDaily, Daily: int64(spent), Updated: now.Unix()}
+	})
+	p.now = func() time.Time { return now }
+	for i := 0; i < 1440; i++ {
+		// 检索量与流量成正比
+		for j := 0; j < int(full(now.Hour())); j++ {
+			p.Request()
+			p.Allow(raw)
+		}
+		p.tick()
+		v, _ := p.offers.Load("ym_1")
+		prob := v.(*budgetOffer).loadProb()
+		spent = math.Min(spent+full(now.Hour())*prob, float64(raw.CapDaily))
+		if now.Hour() == 9 && now.Minute() == 0 {
+			spentAt9 = spent
+		}
+		now = now.Add(time.Minute)
+	}
+	return
+}
+
+func TestBudgetUniform(t *testing.T) {
+	// 全量放行时2.4小时花完
+	at9, spent := simulate(t, nil, func(int) float64 { return 10 })
+	if at9 < 540*0.8 || at9 > 540*1.2 {
+		t.Errorf("spent at 9am should be about 540, got %.0f", at9)
+	}
+	if spent < 1440*0.95 {
+		t.Errorf("budget should be spent by end of day, got %.0f", spent)
+	}
+}
+
+func TestBudgetShape(t *testing.T) {
+	// 白天流量是夜里的3倍
+	shape := make([]float64, 24)
+	for h := range shape {
+		shape[h] = 1
+		if h >= 8 && h < 20 {
+			shape[h] = 3
+		}
+	}
+	at9, spent := simulate(t, shape, func(h int) float64 { return shape[h] * 5 })
+	// 0~9点的流量占比为 (8 + 3) / 48
+	want := 1440 * 11.0 / 48
+	if at9 < want*0.8 || at9 > want*1.2 {
+		t.Errorf("spent at 9am should be about %.0f, got %.0f", want, at9)
+	}
+	if spent < 1440*0.95 {
+		t.Errorf("budget should be spent by end of day, got %.0f", spent)
+	}
+}
+
+func TestBudgetAllow(t *testing.T) {
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	status := &offer_cap.Status{CapDaily: 10, Daily: 10, Updated: now.Unix()}
+	p := newBudgetPacer(&BudgetConf{Enabled: true}, func(offer string) *offer_cap.Status {
+		if offer == "ym_1" {
+			return status
+		}
+		return nil
+	})
+	p.now = func() time.Time { return now }
+
+	capped := &raw_ad.RawAdObj{UniqId: "ym_1", CapDaily: 10}
+	noStatus := &raw_ad.RawAdObj{UniqId: "ym_2", CapDaily: 10}
+	noCap := &raw_ad.RawAdObj{UniqId: "ym_3"}
+	for _, raw := range []*raw_ad.RawAdObj{capped, noStatus, noCap} {
+		if !p.Allow(raw) {
+			t.Fatal("offer should pass before first tick: ", raw.UniqId)
+		}
+	}
+
+	p.tick()
+	if p.Allow(capped) {
+		t.Error("offer without remaining budget should be dropped")
+	}
+	if !p.Allow(noStatus) || !p.Allow(noCap) {
+		t.Error("offer without cap status should pass")
+	}
+
+	// 新的一天
+	now = now.Add(13 * time.Hour)
+	p.tick()
+	if !p.Allow(capped) {
+		t.Error("stale status of yesterday should not be paced")
+	}
+
+	offers, shape := p.Report()
+	if len(offers) != 2 || len(shape) != 24 {
+		t.Errorf("report: %+v %v", offers, shape)
+	}
+
+	now = now.Add(25 * time.Hour)
+	p.tick()
+	if offers, _ := p.Report(); len(offers) != 0 {
+		t.Error("offers not seen for a day should be dropped")
+	}
+}
+
+func TestBudgetAllowCPT(t *testing.T) {
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	p := newBudgetPacer(&BudgetConf{Enabled: true}, func(offer string) *offer_cap.Status {
+		if offer == offer_cap.CPTKey("ym_1") {
+			return &offer_cap.Status{Event: offer_cap.Imp, CapDaily: 1000, Daily: 1000, Updated: now.Unix()}
+		}
+		return nil
+	})
+	p.now = func() time.Time { return now }
+
+	raw := &raw_ad.RawAdObj{UniqId: "ym_1"}
+	if !p.AllowCPT(raw, 1000) || !p.AllowCPT(raw, 0) {
+		t.Fatal("CPT offer should pass before first tick")
+	}
+	p.tick()
+	if p.AllowCPT(raw, 1000) {
+		t.Error("CPT offer without remaining impressions should be dropped")
+	}
+	if !p.Allow(raw) || !p.AllowCPT(raw, 0) {
+		t.Error("offer without cap_daily should not be paced by CPT budget")
+	}
+	if offers, _ := p.Report(); len(offers) != 1 || offers[0].Offer != offer_cap.CPTKey("ym_1") {
+		t.Errorf("report: %+v", offers)
+	}
+}
+
+func TestLearnShape(t *testing.T) {
+	now := time.Date(2024, 4, 1, 0, 30, 0, 0, time.UTC)
+	p := newBudgetPacer(&BudgetConf{Enabled: true, ShapeLearningRate: 0.5}, func(string) *offer_cap.Status { return nil })
+	p.now = func() time.Time { return now }
+
+	raw := &raw_ad.RawAdObj{UniqId: "ym_1"}
+	for h := 0; h < 3; h++ {
+		n := 100
+		if h == 2 {
+			n = 300
+		}
+		for i := 0; i < n; i++ {
+			p.Request()
+			p.Allow(raw)
+			p.Allow(raw) // 一个请求中多次评估同一个offer不影响流量曲线
+		}
+		now = now.Add(time.Hour)
+		p.tick()
+	}
+	// 0点只统计了半小时，不学习；1点与平均一致；2点是平均的1.5倍
+	if p.shape[0] != 1 || p.shape[1] != 1 {
+		t.Errorf("shape of hour 0 and 1: %v", p.shape[:2])
+	}
+	if w := 0.5 + 0.5*300/((100+100+300)/3.0); math.Abs(p.shape[2]-w) > 1e-9 {
+		t.Errorf("shape of hour 2 should be %v, got %v", w, p.shape[2])
+	}
+
+	if s := p.share(now.Truncate(24*time.Hour), endOfDay(now)); math.Abs(s-(24-1+p.shape[2])/24) > 1e-9 {
+		t.Errorf("share of whole day: %v", s)
+	}
+}
+
+func TestBudgetConf(t *testing.T) {
+	for _, cf := range []*BudgetConf{
+		{Gain: 1.5},
+		{MinProb: -1},
+		{Shape: []float64{1, 2}},
+		{Shape: make([]float64, 24)},
+		{IntervalSeconds: -1},
+	} {
+		if cf.Validate() == nil {
+			t.Errorf("expect error: %+v", cf)
+		}
+	}
+	if err := (&BudgetConf{Shape: make([]float64, 0)}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
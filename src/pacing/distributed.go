@@ -0,0 +1,284 @@
+package pacing
+
+import (
+	"errors"
+	"hash/crc32"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"cache"
+	"logger"
+	"metrics"
+)
+
+/*
+集群pacing(distributed_pacing)：
+	本地pacing每个实例按 上限/实例数 各自限速，负载不均时热的实例提前限速、冷的实例跑不满
+	开启后每个offer每分钟的上限(manual pacing或全局pacing，CN翻倍)由所有实例共享，redis中按分钟计数：
+		pacing:<name>:<uniq_id>:<unix分钟>   保留3分钟
+	实例不直接按次访问redis，而是从计数中领取一批token(lease，默认 上限/实例数/4，至少1)在本地消耗:
+		剩余token不足半个lease时异步补充，每refill_ms把所有待补充的offer按redis分片批量INCRBY
+		INCRBY后的计数超过上限时只拿到上限内的部分，之后这一分钟该offer在所有实例都限速
+		还没有拿到token时最多先透支一个lease，透支的部分在下次领取时补记
+	领取失败(redis不可用)后fallback_seconds内使用本地pacing，计数两边都一直在记
+	已领取但没有用完的token不归还，一分钟结束时浪费的量不超过 实例数*lease
+*/
+
+type DistConf struct {
+	Enabled         bool `json:"enabled"`
+	RefillMs        int  `json:"refill_ms"`        // 默认50
+	Lease           int  `json:"lease"`            // 每次领取的token数，0为 上限/实例数/4
+	FallbackSeconds int  `json:"fallback_seconds"` // 默认10
+}
+
+func (cf *DistConf) Validate() error {
+	if cf.RefillMs < 0 || cf.Lease < 0 || cf.FallbackSeconds < 0 {
+		return errors.New("refill_ms, lease and fallback_seconds should not be negative")
+	}
+	return nil
+}
+
+func (cf *DistConf) setDefault() {
+	if cf.RefillMs == 0 {
+		cf.RefillMs = 50
+	}
+	if cf.FallbackSeconds == 0 {
+		cf.FallbackSeconds = 10
+	}
+}
+
+// lease is the local token state of one offer in one minute
+type lease struct {
+	key       string
+	minute    int64
+	limit     int64 // 这一分钟全集群的上限
+	granted   int64 // 已领取的token
+	used      int64
+	exhausted bool // 全集群已到上限
+	pending   bool // 等待补充
+}
+
+type tokenStore interface {
+	// take adds n of each req to its counter and sets total and ok of the req after adding,
+	// it returns an error if any req fails, reqs with ok set are added even so
+	take(reqs []*refillReq) error
+}
+
+type refillReq struct {
+	key   string
+	n     int64
+	total int64 // 领取后的计数
+	ok    bool  // 已加到计数中
+}
+
+type distPacer struct {
+	conf      DistConf
+	name      string
+	instances func() int
+	store     tokenStore
+
+	mu      sync.Mutex
+	leases  map[string]*lease
+	pending []*lease
+
+	fallbackUntil int64 // unix nano, atomic
+}
+
+var (
+	distRefills = metrics.NewCounterVec("offer_pacing_refills_total",
+		"Token refills of distributed pacing by result: ok, error.", "result")
+	distFallbacks = metrics.NewCounter("offer_pacing_fallbacks_total",
+		"Times distributed pacing fell back to local pacing.")
+)
+
+func newDistPacer(name string, cf *DistConf, instances func() int, store tokenStore) *distPacer {
+	d := &distPacer{
+		conf:      *cf,
+		name:      name,
+		instances: instances,
+		store:     store,
+		leases:    make(map[string]*lease),
+	}
+	d.conf.setDefault()
+	return d
+}
+
+func (d *distPacer) healthy(now time.Time) bool {
+	return now.UnixNano() >= atomic.LoadInt64(&d.fallbackUntil)
+}
+
+func (d *distPacer) leaseSize(limit int64) int64 {
+	if d.conf.Lease > 0 {
+		return int64(d.conf.Lease)
+	}
+	n := limit / int64(d.instances()) / 4
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// get returns lease of offer in minute of now, d.mu must be held
+func (d *distPacer) get(uniqId string, now time.Time) *lease {
+	minute := now.Unix() / 60
+	key := "pacing:" + d.name + ":" + uniqId + ":" + strconv.FormatInt(minute, 10)
+	l := d.leases[key]
+	if l == nil {
+		l = &lease{key: key, minute: minute}
+		d.leases[key] = l
+	}
+	return l
+}
+
+// maybeRefill queues l if its tokens are running out, d.mu must be held
+func (d *distPacer) maybeRefill(l *lease) {
+	if l.pending || l.exhausted || l.limit <= 0 {
+		return
+	}
+	if l.granted-l.used <= d.leaseSize(l.limit)/2 {
+		l.pending = true
+		d.pending = append(d.pending, l)
+	}
+}
+
+func (d *distPacer) add(uniqId string, now time.Time, count int) {
+	d.mu.Lock()
+	l := d.get(uniqId, now)
+	l.used += int64(count)
+	d.maybeRefill(l)
+	d.mu.Unlock()
+}
+
+func (d *distPacer) overCap(uniqId string, limit int, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	l := d.get(uniqId, now)
+	l.limit = int64(limit)
+	if l.used < l.granted {
+		d.maybeRefill(l)
+		return false
+	}
+	if l.exhausted {
+		return true
+	}
+	d.maybeRefill(l)
+	// 还没有领到token时最多透支一个lease
+	return l.used-l.granted >= d.leaseSize(l.limit)
+}
+
+// refill takes tokens for pending leases in one batch
+func (d *distPacer) refill(now time.Time) {
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = nil
+	reqs := make([]*refillReq, len(pending))
+	for i, l := range pending {
+		n := d.leaseSize(l.limit)
+		if debt := l.used - l.granted; debt > 0 {
+			n += debt
+		}
+		reqs[i] = &refillReq{key: l.key, n: n}
+	}
+	// 清理两分钟前的lease
+	expire := now.Unix()/60 - 2
+	for key, l := range d.leases {
+		if l.minute < expire {
+			delete(d.leases, key)
+		}
+	}
+	d.mu.Unlock()
+
+	if len(reqs) == 0 {
+		return
+	}
+	err := d.store.take(reqs)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, l := range pending {
+		l.pending = false
+		r := reqs[i]
+		if !r.ok {
+			// 没有加到计数中，透支的部分下次补记
+			continue
+		}
+		got := r.n
+		if r.total > l.limit {
+			// 只拿到上限内的部分
+			got -= r.total - l.limit
+			if got < 0 {
+				got = 0
+			}
+		}
+		l.granted += got
+		l.exhausted = r.total >= l.limit
+	}
+
+	if err != nil {
+		distRefills.With("error").Inc()
+		if d.healthy(now) {
+			distFallbacks.Inc()
+			logger.Default().Warn("distributed pacing falls back to local pacing", logger.Fields{"name": d.name, "err": err})
+		}
+		atomic.StoreInt64(&d.fallbackUntil, now.Add(time.Duration(d.conf.FallbackSeconds)*time.Second).UnixNano())
+		return
+	}
+	distRefills.With("ok").Inc()
+}
+
+func (d *distPacer) run() {
+	for range time.Tick(time.Duration(d.conf.RefillMs) * time.Millisecond) {
+		d.refill(time.Now())
+	}
+}
+
+type redisTokens struct{}
+
+// take sends INCRBY and EXPIRE of keys in one pipeline per redis pool,
+// a failed pool does not affect reqs of the others
+func (redisTokens) take(reqs []*refillReq) error {
+	n := cache.PoolNum()
+	if n == 0 {
+		return errors.New("redis pools not initialized")
+	}
+	groups := make(map[int][]*refillReq, n)
+	for _, r := range reqs {
+		p := int(crc32.ChecksumIEEE([]byte(r.key)) % uint32(n))
+		groups[p] = append(groups[p], r)
+	}
+	var firstErr error
+	for p, rs := range groups {
+		if err := takePool(p, rs); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func takePool(p int, rs []*refillReq) error {
+	conn := cache.GetConn(p)
+	defer conn.Close()
+	for _, r := range rs {
+		conn.Send("INCRBY", r.key, r.n)
+		conn.Send("EXPIRE", r.key, 180)
+	}
+	vals, err := redis.Values(redis.DoWithTimeout(conn, 100*time.Millisecond, ""))
+	if err != nil {
+		// 超时等情况下INCRBY可能已经执行，多算的计数只会让这一分钟少放一点
+		return err
+	}
+	if len(vals) != 2*len(rs) {
+		return errors.New("unexpected replies of pipeline")
+	}
+	for i, r := range rs {
+		if r.total, err = redis.Int64(vals[2*i], nil); err != nil {
+			return err
+		}
+		r.ok = true
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package pacing
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memTokens struct {
+	sync.Mutex
+	counts   map[string]int64
+	fail     bool
+	failKeys map[string]bool // 只有这些key失败，模拟redis的一个分片不可用
+}
+
+func (m *memTokens) take(reqs []*refillReq) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.fail {
+		return errors.New("redis down")
+	}
+	var err error
+	for _, r := range reqs {
+		if m.failKeys[r.key] {
+			err = errors.New("shard down")
+			continue
+		}
+		m.counts[r.key] += r.n
+		r.total = m.counts[r.key]
+		r.ok = true
+	}
+	return err
+}
+
+func TestDistributedUneven(t *testing.T) {
+	store := &memTokens{counts: make(map[string]int64)}
+	two := func() int { return 2 }
+	hot := newDistPacer("main", &DistConf{Enabled: true}, two, store)
+	cold := newDistPacer("main", &DistConf{Enabled: true}, two, store)
+	now := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	// 90%的请求落在hot上，全集群每分钟上限100
+	allowed := map[*distPacer]int{}
+	for i := 0; i < 1000; i++ {
+		d := hot
+		if i%10 == 0 {
+			d = cold
+		}
+		if !d.overCap("ym_1", 100, now) {
+			d.add("ym_1", now, 1)
+			allowed[d]++
+		}
+		if i%5 == 0 {
+			hot.refill(now)
+			cold.refill(now)
+		}
+	}
+
+	total := allowed[hot] + allowed[cold]
+	// 最多透支每个实例一个lease(100/2/4)
+	if total < 100 || total > 100+2*12 {
+		t.Errorf("cluster should allow about 100 clicks, got %d", total)
+	}
+	if allowed[hot] <= 50 {
+		t.Errorf("hot instance should not be limited to its local share, got %d", allowed[hot])
+	}
+	if !hot.overCap("ym_1", 100, now) {
+		t.Error("offer should be over cap after cluster limit is reached")
+	}
+
+	// 下一分钟重新计数
+	next := now.Add(time.Minute)
+	if hot.overCap("ym_1", 100, next) {
+		t.Error("new minute should not be over cap")
+	}
+	hot.refill(next.Add(2 * time.Minute))
+	if len(hot.leases) != 1 {
+		t.Errorf("old leases should be dropped, got %d", len(hot.leases))
+	}
+}
+
+func TestDistributedFallback(t *testing.T) {
+	store := &memTokens{counts: make(map[string]int64), fail: true}
+	d := newDistPacer("main", &DistConf{Enabled: true, Lease: 5}, func() int { return 1 }, store)
+	now := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 5; i++ {
+		if d.overCap("ym_1", 100, now) {
+			t.Fatal("overdraft of one lease should be allowed before refill")
+		}
+		d.add("ym_1", now, 1)
+	}
+	if !d.overCap("ym_1", 100, now) {
+		t.Error("overdraft should be limited to one lease")
+	}
+
+	d.refill(now)
+	if d.healthy(now) || !d.healthy(now.Add(10*time.Second)) {
+		t.Error("should fall back to local pacing for fallback_seconds")
+	}
+
+	// redis恢复后透支的部分补记到计数中
+	store.fail = false
+	d.overCap("ym_1", 100, now)
+	d.refill(now)
+	if c := store.counts["pacing:main:ym_1:"+strconv.FormatInt(now.Unix()/60, 10)]; c != 10 {
+		t.Errorf("counter should include debt 5 and lease 5, got %d", c)
+	}
+	if d.overCap("ym_1", 100, now) {
+		t.Error("granted tokens should be usable")
+	}
+}
+
+func TestPacingLimit(t *testing.T) {
+	ctrl := newPacingController(700, func() int { return 4 })
+	if ctrl.limit("US", -1) != 700 || ctrl.limit("CN", -1) != 1400 || ctrl.limit("CN", 100) != 100 {
+		t.Error("cluster limit: ", ctrl.limit("US", -1), ctrl.limit("CN", -1), ctrl.limit("CN", 100))
+	}
+}
+
+func TestDistributedPartialFailure(t *testing.T) {
+	now := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	minute := strconv.FormatInt(now.Unix()/60, 10)
+	store := &memTokens{counts: make(map[string]int64),
+		failKeys: map[string]bool{"pacing:main:ym_2:" + minute: true}}
+	d := newDistPacer("main", &DistConf{Enabled: true, Lease: 5}, func() int { return 1 }, store)
+
+	d.overCap("ym_1", 100, now)
+	d.overCap("ym_2", 100, now)
+	d.refill(now)
+
+	// 成功的分片正常领取，失败的没有计数也没有token
+	if l := d.leases["pacing:main:ym_1:"+minute]; l.granted != 5 || store.counts[l.key] != 5 {
+		t.Errorf("ym_1 should be granted by the healthy shard, got %d", l.granted)
+	}
+	if l := d.leases["pacing:main:ym_2:"+minute]; l.granted != 0 || store.counts[l.key] != 0 {
+		t.Errorf("ym_2 should not be granted, got %d", l.granted)
+	}
+	if d.healthy(now) {
+		t.Error("should fall back to local pacing on shard error")
+	}
+}
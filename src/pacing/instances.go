@@ -0,0 +1,332 @@
+package pacing
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/garyburd/redigo/redis"
+
+	"cache"
+	"logger"
+	"metrics"
+)
+
+/*
+实例数(全局pacing按实例数平分)：
+	provider:
+		static  固定为instances，没有配置时为default_instances(与原来AWS失败时一致，不能按1个实例放开全局pacing)
+		env     读环境变量env(默认TWORKER_INSTANCES)
+		file    读文件file中的数字，可由部署脚本维护
+		redis   每个tworker每heartbeat_seconds把自己写入redis的有序集合redis_key(score为过期时间，过期为3个心跳)，
+		        实例数为未过期的成员数；退出时(Close)删除自己，graceful handoff时新旧进程只在交接期间同时计数
+		aws     查询autoscaling_group_name的实例数(原逻辑)
+	为空时配置了autoscaling_group_name则为aws，否则为static
+	每refresh_seconds(默认60，aws默认900)刷新一次；失败时保留上次的值并打日志，启动时就失败则使用default_instances(默认20)
+*/
+
+type InstanceConf struct {
+	Provider         string `json:"provider"`
+	Instances        int    `json:"instances"`         // static，默认default_instances
+	Env              string `json:"env"`               // env，默认TWORKER_INSTANCES
+	File             string `json:"file"`              // file
+	RedisKey         string `json:"redis_key"`         // redis，默认offer:instances
+	InstanceId       string `json:"instance_id"`       // redis，默认hostname:pid
+	HeartbeatSeconds int    `json:"heartbeat_seconds"` // redis，默认10
+	RefreshSeconds   int    `json:"refresh_seconds"`
+	DefaultInstances int    `json:"default_instances"`
+}
+
+// Validate checks conf, autoScalingGroupName is required by aws provider
+func (cf *InstanceConf) Validate(autoScalingGroupName string) error {
+	if cf.Instances < 0 || cf.HeartbeatSeconds < 0 || cf.RefreshSeconds < 0 || cf.DefaultInstances < 0 {
+		return errors.New("instances, heartbeat_seconds, refresh_seconds and default_instances should not be negative")
+	}
+	switch cf.Provider {
+	case "", "static", "env", "redis":
+	case "file":
+		if cf.File == "" {
+			return errors.New("file required by file provider")
+		}
+	case "aws":
+		if autoScalingGroupName == "" {
+			return errors.New("autoscaling_group_name required by aws provider")
+		}
+	default:
+		return fmt.Errorf("unknown provider %q", cf.Provider)
+	}
+	return nil
+}
+
+func (cf *InstanceConf) setDefault(autoScalingGroupName string) {
+	if cf.Provider == "" {
+		cf.Provider = "static"
+		if autoScalingGroupName != "" {
+			cf.Provider = "aws"
+		}
+	}
+	if cf.Env == "" {
+		cf.Env = "TWORKER_INSTANCES"
+	}
+	if cf.RedisKey == "" {
+		cf.RedisKey = "offer:instances"
+	}
+	if cf.InstanceId == "" {
+		host, _ := os.Hostname()
+		cf.InstanceId = host + ":" + strconv.Itoa(os.Getpid())
+	}
+	if cf.HeartbeatSeconds == 0 {
+		cf.HeartbeatSeconds = 10
+	}
+	if cf.RefreshSeconds == 0 {
+		cf.RefreshSeconds = 60
+		if cf.Provider == "aws" {
+			cf.RefreshSeconds = 900
+		}
+	}
+	if cf.DefaultInstances == 0 {
+		cf.DefaultInstances = 20
+	}
+	if cf.Instances == 0 {
+		cf.Instances = cf.DefaultInstances
+	}
+}
+
+// InstanceProvider returns the number of running tworkers
+type InstanceProvider interface {
+	Instances() (int, error)
+}
+
+type staticProvider int
+
+func (p staticProvider) Instances() (int, error) {
+	return int(p), nil
+}
+
+type envProvider string
+
+func (p envProvider) Instances() (int, error) {
+	return parseInstances(os.Getenv(string(p)))
+}
+
+type fileProvider string
+
+func (p fileProvider) Instances() (int, error) {
+	b, err := ioutil.ReadFile(string(p))
+	if err != nil {
+		return 0, err
+	}
+	return parseInstances(string(b))
+}
+
+func parseInstances(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("instances %d should be positive", n)
+	}
+	return n, nil
+}
+
+type redisProvider struct {
+	key  string
+	id   string
+	ttl  time.Duration
+	stop chan struct{}
+	once sync.Once
+}
+
+// run heartbeats every interval until Close
+func (p *redisProvider) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.heartbeat(); err != nil {
+				logger.Default().Warn("pacing redis heartbeat error", logger.Fields{"key": p.key, "err": err})
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Close stops heartbeat and removes this instance, so the others see the new count on next refresh
+func (p *redisProvider) Close() error {
+	var err error
+	p.once.Do(func() {
+		close(p.stop)
+		conn := cache.GetConn(0)
+		defer conn.Close()
+		_, err = conn.Do("ZREM", p.key, p.id)
+	})
+	return err
+}
+
+// heartbeat registers this instance until now+ttl
+func (p *redisProvider) heartbeat() error {
+	conn := cache.GetConn(0)
+	defer conn.Close()
+	_, err := conn.Do("ZADD", p.key, time.Now().Add(p.ttl).Unix(), p.id)
+	return err
+}
+
+func (p *redisProvider) Instances() (int, error) {
+	conn := cache.GetConn(0)
+	defer conn.Close()
+	conn.Send("ZREMRANGEBYSCORE", p.key, "-inf", time.Now().Unix())
+	conn.Send("ZCARD", p.key)
+	vals, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return 0, err
+	}
+	n, err := redis.Int(vals[len(vals)-1], nil)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, errors.New("no instance registered in " + p.key)
+	}
+	return n, nil
+}
+
+type awsProvider struct {
+	group, region string
+}
+
+func (p awsProvider) Instances() (int, error) {
+	sess, err := session.NewSession(aws.NewConfig().WithRegion(p.region))
+	if err != nil {
+		return 0, fmt.Errorf("AWS NewSession: %w", err)
+	}
+
+	svc := autoscaling.New(sess)
+	input := &autoscaling.DescribeAutoScalingGroupsInput{}
+	input.SetAutoScalingGroupNames([]*string{
+		&p.group,
+	})
+
+	output, err := svc.DescribeAutoScalingGroups(input)
+	if err != nil {
+		return 0, fmt.Errorf("AWS DescribeAutoScalingGroups: %w", err)
+	}
+
+	if output == nil {
+		return 0, fmt.Errorf("AWS DescribeAutoScalingGroups: empty output of %s ASG", p.group)
+	}
+	groups := output.AutoScalingGroups
+	if len(groups) != 1 {
+		return 0, fmt.Errorf("un-expected size of %s ASG: %d", p.group, len(groups))
+	}
+
+	nInstances := len(groups[0].Instances)
+	if nInstances == 0 {
+		return 0, fmt.Errorf("un-expected result of %s ASG, instances size zero", p.group)
+	}
+	return nInstances, nil
+}
+
+var instancesGauge = metrics.NewGauge("offer_pacing_instances", "Instance count used by click pacing.")
+
+// Instances keeps the latest instance count of a provider
+type Instances struct {
+	conf     InstanceConf
+	provider InstanceProvider
+	n        int64 // atomic
+}
+
+// NewInstances creates provider by conf and reads the count once, the redis provider registers this instance.
+// Call Watch to refresh it periodically
+func NewInstances(cf *InstanceConf, autoScalingGroupName, awsRegion string) (*Instances, error) {
+	if err := cf.Validate(autoScalingGroupName); err != nil {
+		return nil, err
+	}
+	ins := &Instances{conf: *cf}
+	ins.conf.setDefault(autoScalingGroupName)
+
+	switch ins.conf.Provider {
+	case "static":
+		ins.provider = staticProvider(ins.conf.Instances)
+	case "env":
+		ins.provider = envProvider(ins.conf.Env)
+	case "file":
+		ins.provider = fileProvider(ins.conf.File)
+	case "redis":
+		p := &redisProvider{
+			key:  ins.conf.RedisKey,
+			id:   ins.conf.InstanceId,
+			ttl:  3 * time.Duration(ins.conf.HeartbeatSeconds) * time.Second,
+			stop: make(chan struct{}),
+		}
+		if err := p.heartbeat(); err != nil {
+			logger.Default().Warn("pacing redis heartbeat error", logger.Fields{"key": p.key, "err": err})
+		}
+		go p.run(time.Duration(ins.conf.HeartbeatSeconds) * time.Second)
+		ins.provider = p
+	case "aws":
+		ins.provider = awsProvider{group: autoScalingGroupName, region: awsRegion}
+	}
+
+	n, err := ins.provider.Instances()
+	if err != nil {
+		logger.Default().Warn("pacing instances provider error, use default_instances", logger.Fields{
+			"provider": ins.conf.Provider, "instances": ins.conf.DefaultInstances, "err": err})
+		n = ins.conf.DefaultInstances
+	}
+	ins.set(n)
+	return ins, nil
+}
+
+func (ins *Instances) set(n int) {
+	atomic.StoreInt64(&ins.n, int64(n))
+	instancesGauge.Set(float64(n))
+}
+
+// Get returns the latest instance count
+func (ins *Instances) Get() int {
+	return int(atomic.LoadInt64(&ins.n))
+}
+
+// refresh keeps the last count on error
+func (ins *Instances) refresh() {
+	n, err := ins.provider.Instances()
+	if err != nil {
+		logger.Default().Warn("pacing instances provider error, keep last count", logger.Fields{
+			"provider": ins.conf.Provider, "instances": ins.Get(), "err": err})
+		return
+	}
+	if n != ins.Get() {
+		logger.Default().Info("pacing instances changed", logger.Fields{"from": ins.Get(), "to": n})
+	}
+	ins.set(n)
+}
+
+// Close unregisters this instance from providers keeping state (redis), it is called on shutdown
+func (ins *Instances) Close() error {
+	if c, ok := ins.provider.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Watch refreshes count every refresh_seconds
+func (ins *Instances) Watch() {
+	go func() {
+		for range time.Tick(time.Duration(ins.conf.RefreshSeconds) * time.Second) {
+			ins.refresh()
+		}
+	}()
+}
@@ -0,0 +1,111 @@
+package pacing
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInstanceProviders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pacing_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "instances")
+	ioutil.WriteFile(file, []byte("4\n"), 0644)
+
+	os.Setenv("PACING_TEST_INSTANCES", " 3")
+	defer os.Unsetenv("PACING_TEST_INSTANCES")
+
+	cases := []struct {
+		conf InstanceConf
+		want int
+	}{
+		{InstanceConf{}, 20},
+		{InstanceConf{DefaultInstances: 10}, 10},
+		{InstanceConf{Provider: "static", Instances: 2}, 2},
+		{InstanceConf{Provider: "env", Env: "PACING_TEST_INSTANCES"}, 3},
+		{InstanceConf{Provider: "file", File: file}, 4},
+		// 启动时失败使用default_instances
+		{InstanceConf{Provider: "env", Env: "PACING_TEST_NOT_SET", DefaultInstances: 5}, 5},
+		{InstanceConf{Provider: "file", File: filepath.Join(dir, "none")}, 20},
+	}
+	for _, c := range cases {
+		ins, err := NewInstances(&c.conf, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ins.Get() != c.want {
+			t.Errorf("%+v: expect %d, got %d", c.conf, c.want, ins.Get())
+		}
+		if err := ins.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestInstancesRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pacing_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "instances")
+	ioutil.WriteFile(file, []byte("4"), 0644)
+
+	ins, err := NewInstances(&InstanceConf{Provider: "file", File: file}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl := NewPacingController(ins)
+	if th := ctrl.threshold("US", -1); th != 175 {
+		t.Error("700/4: ", th)
+	}
+
+	ioutil.WriteFile(file, []byte("2"), 0644)
+	ins.refresh()
+	if th := ctrl.threshold("CN", -1); th != 700 {
+		t.Error("700/2*2: ", th)
+	}
+	if th := ctrl.threshold("US", 100); th != 50 {
+		t.Error("manual 100/2: ", th)
+	}
+
+	// 读取失败保留上次的值
+	ioutil.WriteFile(file, []byte("0"), 0644)
+	ins.refresh()
+	os.Remove(file)
+	ins.refresh()
+	if ins.Get() != 2 {
+		t.Error("instances should be kept on error: ", ins.Get())
+	}
+}
+
+func TestInstanceConf(t *testing.T) {
+	for _, cf := range []*InstanceConf{
+		{Provider: "consul"},
+		{Provider: "file"},
+		{Provider: "aws"},
+		{Instances: -1},
+	} {
+		if cf.Validate("") == nil {
+			t.Errorf("expect error: %+v", cf)
+		}
+	}
+	if err := (&InstanceConf{Provider: "aws"}).Validate("OfferServerNewASG"); err != nil {
+		t.Error(err)
+	}
+
+	cf := &InstanceConf{}
+	cf.setDefault("OfferServerNewASG")
+	if cf.Provider != "aws" || cf.RefreshSeconds != 900 {
+		t.Errorf("default provider with autoscaling group: %+v", cf)
+	}
+	cf = &InstanceConf{Provider: "redis"}
+	cf.setDefault("OfferServerNewASG")
+	if cf.RefreshSeconds != 60 || cf.HeartbeatSeconds != 10 || cf.InstanceId == "" {
+		t.Errorf("default redis conf: %+v", cf)
+	}
+}
@@ -6,20 +6,20 @@ import (
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/brg-liuwei/gotools"
 )
 
+const offerGlobalPacing = 700 // 700 clicks per minite
+
 type PacingController struct {
 	sync.Mutex
 	m          *gotools.ExpiredMap
-	pacing     int
-	nInstances int
+	pacing     int        // 全局pacing，按实例数平分
+	nInstances func() int // 实例数
+	dist       *distPacer // 开启集群pacing时不为nil
 }
 
-func newPacingController(pacing, nInstances int) *PacingController {
+func newPacingController(pacing int, nInstances func() int) *PacingController {
 	return &PacingController{
 		m:          gotools.NewExpiredMap(65536),
 		pacing:     pacing,
@@ -27,41 +27,23 @@ func newPacingController(pacing, nInstances int) *PacingController {
 	}
 }
 
-func NewPacingController(autoScalingGroupName, awsRegion string) *PacingController {
-	offerGlobalPacing := 700 // 700 clicks per minite
-	sess, err := session.NewSession(aws.NewConfig().WithRegion(awsRegion))
-	if err != nil {
-		fmt.Println("[AWS] AWS NewSession error: ", err)
-		return newPacingController(offerGlobalPacing, 20) // by default, nInstances = 20
-	}
-
-	svc := autoscaling.New(sess)
-	input := &autoscaling.DescribeAutoScalingGroupsInput{}
-	input.SetAutoScalingGroupNames([]*string{
-		&autoScalingGroupName,
-	})
-
-	output, err := svc.DescribeAutoScalingGroups(input)
-	if err != nil {
-		fmt.Println("[AWS] Invoke AWS API DescribeAutoScalingGroups error: ", err)
-		return newPacingController(offerGlobalPacing, 20)
-	}
-
-	groups := output.AutoScalingGroups
-	if len(groups) != 1 {
-		fmt.Println("[AWS] Un-expected size of ", autoScalingGroupName, " ASG: ", len(groups))
-		return newPacingController(offerGlobalPacing, 20)
-	}
+// NewPacingController shares global pacing among the latest count of instances
+func NewPacingController(instances *Instances) *PacingController {
+	return newPacingController(offerGlobalPacing, instances.Get)
+}
 
-	nInstances := len(groups[0].Instances)
-	if nInstances == 0 {
-		fmt.Println("[AWS] Un-expected result of ", autoScalingGroupName, " ASG, instances size zero")
-		return newPacingController(offerGlobalPacing, 20)
-	}
-	return newPacingController(offerGlobalPacing/nInstances, nInstances)
+// Distribute shares limits of offers among instances by redis counters, see distributed.go.
+// name separates counters of controllers, it should be called before serving
+func (ctrl *PacingController) Distribute(name string, cf *DistConf) {
+	ctrl.dist = newDistPacer(name, cf, ctrl.nInstances, redisTokens{})
+	go ctrl.dist.run()
 }
 
 func (ctrl *PacingController) Add(uniqId string, now time.Time, count int) (newCount int) {
+	if ctrl.dist != nil {
+		// 本地计数也一直记，redis不可用时使用
+		ctrl.dist.add(uniqId, now, count)
+	}
 	key := fmt.Sprintf("%s_%d", uniqId, now.Minute())
 	ctrl.Lock()
 	defer ctrl.Unlock()
@@ -79,6 +61,9 @@ func (ctrl *PacingController) Add(uniqId string, now time.Time, count int) (newC
 }
 
 func (ctrl *PacingController) OverCap(uniqId, country string, manualPacing int, now time.Time) bool {
+	if ctrl.dist != nil && ctrl.dist.healthy(now) {
+		return ctrl.dist.overCap(uniqId, ctrl.limit(country, manualPacing), now)
+	}
 	key := fmt.Sprintf("%s_%d", uniqId, now.Minute())
 	ctrl.Lock()
 	iCount := ctrl.m.Get(key)
@@ -89,7 +74,24 @@ func (ctrl *PacingController) OverCap(uniqId, country string, manualPacing int,
 		return false
 	}
 
-	threshold := ctrl.pacing
+	return int(iValue.Int()) > ctrl.threshold(country, manualPacing)
+}
+
+// limit returns clicks per minute allowed in the cluster
+func (ctrl *PacingController) limit(country string, manualPacing int) int {
+	if manualPacing != -1 {
+		return manualPacing
+	}
+	if country == "CN" {
+		return ctrl.pacing * 2
+	}
+	return ctrl.pacing
+}
+
+// threshold returns clicks per minute allowed on this instance
+func (ctrl *PacingController) threshold(country string, manualPacing int) int {
+	nInstances := ctrl.nInstances()
+	threshold := ctrl.pacing / nInstances
 	if country == "CN" {
 		// 国内速度翻倍
 		threshold *= 2
@@ -97,10 +99,9 @@ func (ctrl *PacingController) OverCap(uniqId, country string, manualPacing int,
 
 	if manualPacing != -1 {
 		// -1 means use default config
-		threshold = manualPacing / ctrl.nInstances
+		threshold = manualPacing / nInstances
 	}
-
-	return int(iValue.Int()) > threshold
+	return threshold
 }
 
 func (ctrl *PacingController) Size() int {
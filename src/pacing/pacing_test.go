@@ -10,7 +10,12 @@ import (
 func TestPacing(t *testing.T) {
 	now := time.Now().UTC()
 	id := "ym_111"
-	pc := pacing.NewPacingController("OfferServerNewASG", "ap-southeast-1")
+	// 700/350: 每个实例每分钟2个点击
+	instances, err := pacing.NewInstances(&pacing.InstanceConf{Provider: "static", Instances: 350}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := pacing.NewPacingController(instances)
 
 	if pc.OverCap(id, "US", -1, now) {
 		t.Error("unexpected overcap")
@@ -30,14 +35,16 @@ func TestPacing(t *testing.T) {
 	if !pc.OverCap(id, "US", -1, now) {
 		t.Error("unexpected not overcap")
 	}
+	if pc.OverCap(id, "CN", -1, now) {
+		t.Error("CN pacing should be doubled")
+	}
 
 	if pc.Size() != 1 {
 		t.Error("pc.Size error")
 	}
 
-	time.Sleep(3 * time.Minute)
-
-	if pc.OverCap(id, "US", -1, now) {
-		t.Error("expired")
+	// 按分钟计数
+	if pc.OverCap(id, "US", -1, now.Add(time.Minute)) {
+		t.Error("next minute should not be over cap")
 	}
 }
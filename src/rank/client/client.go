@@ -0,0 +1,332 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"logger"
+	"metrics"
+)
+
+/*
+rank接口客户端(rank_apis、imp_rank_api、video_rank_api共用)：
+	每个Pool持有一个长连接的http.Client，单次调用超时timeout，同时受请求deadline约束
+	选择host: 按权重随机选两个健康的host，取 inflight/weight 较小的一个(weighted power of two choices)
+	被动摘除: 连续fail_threshold次连接错误、超时或5xx后摘除该host
+	主动探活: 每probe_interval_ms对摘除的host发一次 GET host+probe_path，有响应且不是5xx即恢复
+	所有host都被摘除时在全部host中选择，避免rank完全不可用
+请求deadline到期导致的失败不计入host的失败次数
+*/
+
+type Conf struct {
+	TimeoutMs           int            `json:"timeout_ms"`              // rank_apis和imp_rank_api单次调用超时，默认200
+	VideoTimeoutMs      int            `json:"video_timeout_ms"`        // video_rank_api单次调用超时，默认50
+	MaxIdleConnsPerHost int            `json:"max_idle_conns_per_host"` // 默认64
+	FailThreshold       int            `json:"fail_threshold"`          // 默认3
+	ProbeIntervalMs     int            `json:"probe_interval_ms"`       // 默认1000
+	ProbePath           string         `json:"probe_path"`              // 为空时探测api本身
+	Weights             map[string]int `json:"weights"`                 // api -> 权重，默认1
+}
+
+func (cf *Conf) Validate() error {
+	if cf.TimeoutMs < 0 || cf.VideoTimeoutMs < 0 || cf.MaxIdleConnsPerHost < 0 ||
+		cf.FailThreshold < 0 || cf.ProbeIntervalMs < 0 {
+		return errors.New("timeout_ms, video_timeout_ms, max_idle_conns_per_host, fail_threshold and probe_interval_ms should not be negative")
+	}
+	for api, w := range cf.Weights {
+		if w <= 0 {
+			return fmt.Errorf("weight of %s should be positive", api)
+		}
+	}
+	return nil
+}
+
+func (cf *Conf) SetDefault() {
+	if cf.TimeoutMs == 0 {
+		cf.TimeoutMs = 200
+	}
+	if cf.VideoTimeoutMs == 0 {
+		cf.VideoTimeoutMs = 50
+	}
+	if cf.MaxIdleConnsPerHost == 0 {
+		cf.MaxIdleConnsPerHost = 64
+	}
+	if cf.FailThreshold == 0 {
+		cf.FailThreshold = 3
+	}
+	if cf.ProbeIntervalMs == 0 {
+		cf.ProbeIntervalMs = 1000
+	}
+}
+
+type host struct {
+	api      string
+	weight   int64
+	inflight int64
+	fails    int64 // 连续失败次数
+	down     int32
+}
+
+func (h *host) isDown() bool {
+	return atomic.LoadInt32(&h.down) == 1
+}
+
+func (h *host) load() float64 {
+	return float64(atomic.LoadInt64(&h.inflight)) / float64(h.weight)
+}
+
+type Pool struct {
+	name      string
+	hosts     []*host
+	timeout   time.Duration
+	threshold int64
+	probePath string
+	client    *http.Client
+	stop      chan struct{}
+}
+
+var (
+	poolsMu sync.Mutex
+	pools   = make(map[string]*Pool)
+
+	hostRequests = metrics.NewCounterVec("offer_rank_host_requests_total",
+		"Rank calls by host and result: ok, error, status, deadline.", "pool", "host", "result")
+	hostDuration = metrics.NewHistogramVec("offer_rank_host_duration_seconds",
+		"Latency of rank calls by host.", nil, "pool", "host")
+	hostEjections = metrics.NewCounterVec("offer_rank_host_ejections_total",
+		"Times a rank host was ejected.", "pool", "host")
+)
+
+func init() {
+	metrics.NewGaugeFunc("offer_rank_host_up", "1 if rank host is healthy, 0 if ejected.",
+		func(emit metrics.Emit) {
+			eachHost(func(p *Pool, h *host) {
+				up := 1.0
+				if h.isDown() {
+					up = 0
+				}
+				emit(up, p.name, h.api)
+			})
+		}, "pool", "host")
+	metrics.NewGaugeFunc("offer_rank_host_inflight", "In-flight rank calls by host.",
+		func(emit metrics.Emit) {
+			eachHost(func(p *Pool, h *host) {
+				emit(float64(atomic.LoadInt64(&h.inflight)), p.name, h.api)
+			})
+		}, "pool", "host")
+}
+
+func eachHost(f func(p *Pool, h *host)) {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	for _, p := range pools {
+		for _, h := range p.hosts {
+			f(p, h)
+		}
+	}
+}
+
+// NewPool creates a pool named name (used as metric label), the pool with the same name is closed
+func NewPool(name string, apis []string, timeout time.Duration, cf *Conf) *Pool {
+	p := &Pool{
+		name:      name,
+		hosts:     make([]*host, 0, len(apis)),
+		timeout:   timeout,
+		threshold: int64(cf.FailThreshold),
+		probePath: cf.ProbePath,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{
+					Timeout:   timeout,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				MaxIdleConns:        cf.MaxIdleConnsPerHost * len(apis),
+				MaxIdleConnsPerHost: cf.MaxIdleConnsPerHost,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		stop: make(chan struct{}),
+	}
+	for _, api := range apis {
+		w := cf.Weights[api]
+		if w <= 0 {
+			w = 1
+		}
+		p.hosts = append(p.hosts, &host{api: api, weight: int64(w)})
+	}
+	if p.threshold <= 0 {
+		p.threshold = 3
+	}
+
+	interval := time.Duration(cf.ProbeIntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+	go p.probeLoop(interval)
+
+	poolsMu.Lock()
+	if old := pools[name]; old != nil {
+		old.Close()
+	}
+	pools[name] = p
+	poolsMu.Unlock()
+	return p
+}
+
+// Close stops probing and closes idle connections
+func (p *Pool) Close() {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+		p.client.Transport.(*http.Transport).CloseIdleConnections()
+	}
+}
+
+// sample picks one host by weight among healthy hosts, or among all hosts if all are down
+func (p *Pool) sample() *host {
+	var total int64
+	for _, h := range p.hosts {
+		if !h.isDown() {
+			total += h.weight
+		}
+	}
+	all := total == 0
+	if all {
+		for _, h := range p.hosts {
+			total += h.weight
+		}
+	}
+	n := rand.Int63n(total)
+	for _, h := range p.hosts {
+		if !all && h.isDown() {
+			continue
+		}
+		if n -= h.weight; n < 0 {
+			return h
+		}
+	}
+	return p.hosts[len(p.hosts)-1]
+}
+
+func (p *Pool) pick() *host {
+	a, b := p.sample(), p.sample()
+	if b.load() < a.load() {
+		return b
+	}
+	return a
+}
+
+// Post sends json body to api+suffix of a picked host and returns the body of 200 response,
+// nil pool (rank not initialized) returns error
+func (p *Pool) Post(ctx context.Context, suffix string, body []byte, gz bool) ([]byte, error) {
+	if p == nil || len(p.hosts) == 0 {
+		return nil, errors.New("no rank host")
+	}
+	h := p.pick()
+
+	if gz {
+		var buf bytes.Buffer
+		enc := gzip.NewWriter(&buf)
+		enc.Write(body)
+		enc.Close()
+		body = buf.Bytes()
+	}
+	req, err := http.NewRequest("POST", h.api+suffix, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if gz {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	callCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	atomic.AddInt64(&h.inflight, 1)
+	start := time.Now()
+	b, status, err := p.do(req.WithContext(callCtx))
+	atomic.AddInt64(&h.inflight, -1)
+	hostDuration.With(p.name, h.api).Observe(metrics.Since(start))
+
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// 请求deadline到期，不是host的问题
+		hostRequests.With(p.name, h.api, "deadline").Inc()
+		return nil, fmt.Errorf("%s: %w", h.api, err)
+	case err != nil:
+		hostRequests.With(p.name, h.api, "error").Inc()
+		p.fail(h)
+		return nil, fmt.Errorf("%s: %w", h.api, err)
+	case status != http.StatusOK:
+		hostRequests.With(p.name, h.api, "status").Inc()
+		if status >= 500 {
+			p.fail(h)
+		} else {
+			atomic.StoreInt64(&h.fails, 0)
+		}
+		return nil, fmt.Errorf("%s: unexpected status %d", h.api, status)
+	}
+	hostRequests.With(p.name, h.api, "ok").Inc()
+	atomic.StoreInt64(&h.fails, 0)
+	return b, nil
+}
+
+func (p *Pool) do(req *http.Request) ([]byte, int, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return b, resp.StatusCode, err
+}
+
+func (p *Pool) fail(h *host) {
+	if atomic.AddInt64(&h.fails, 1) >= p.threshold && atomic.CompareAndSwapInt32(&h.down, 0, 1) {
+		hostEjections.With(p.name, h.api).Inc()
+		logger.Default().Warn("rank host ejected", logger.Fields{"pool": p.name, "host": h.api})
+	}
+}
+
+func (p *Pool) probeLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			for _, h := range p.hosts {
+				if h.isDown() && p.probe(h, interval) {
+					atomic.StoreInt64(&h.fails, 0)
+					atomic.StoreInt32(&h.down, 0)
+					logger.Default().Info("rank host recovered", logger.Fields{"pool": p.name, "host": h.api})
+				}
+			}
+		}
+	}
+}
+
+// probe returns true if host responds without 5xx
+func (p *Pool) probe(h *host, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", h.api+p.probePath, nil)
+	if err != nil {
+		return false
+	}
+	_, status, err := p.do(req.WithContext(ctx))
+	return err == nil && status < 500
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPostGzip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" || r.URL.RawQuery != "user_hash=1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"errmsg": "ok"}`))
+	}))
+	defer srv.Close()
+
+	p := NewPool("test_gzip", []string{srv.URL}, time.Second, &Conf{})
+	defer p.Close()
+	b, err := p.Post(context.Background(), "?user_hash=1", []byte(`{}`), true)
+	if err != nil || string(b) != `{"errmsg": "ok"}` {
+		t.Errorf("unexpected response %s, %v", b, err)
+	}
+	if _, err := p.Post(context.Background(), "?user_hash=2", []byte(`{}`), true); err == nil {
+		t.Error("400 should be an error")
+	}
+	if p.hosts[0].isDown() {
+		t.Error("4xx should not eject host")
+	}
+
+	var nilPool *Pool
+	if _, err := nilPool.Post(context.Background(), "", nil, false); err == nil {
+		t.Error("nil pool should fail")
+	}
+}
+
+func TestEjectAndProbe(t *testing.T) {
+	var broken int32 = 1
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&broken) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("bad"))
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("good"))
+	}))
+	defer good.Close()
+
+	p := NewPool("test_eject", []string{bad.URL, good.URL}, time.Second,
+		&Conf{FailThreshold: 2, ProbeIntervalMs: 20})
+	defer p.Close()
+
+	fails := 0
+	for i := 0; i < 100; i++ {
+		if _, err := p.Post(context.Background(), "", nil, false); err != nil {
+			fails++
+		}
+	}
+	if fails != 2 || !p.hosts[0].isDown() {
+		t.Fatalf("bad host should be ejected after 2 failures, got %d failures", fails)
+	}
+
+	// 探活失败时保持摘除
+	time.Sleep(100 * time.Millisecond)
+	if !p.hosts[0].isDown() {
+		t.Fatal("bad host should stay ejected")
+	}
+
+	atomic.StoreInt32(&broken, 0)
+	deadline := time.Now().Add(2 * time.Second)
+	for p.hosts[0].isDown() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.hosts[0].isDown() {
+		t.Fatal("recovered host should be restored by probe")
+	}
+}
+
+func TestAllDown(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	p := NewPool("test_all_down", []string{srv.URL}, time.Second, &Conf{FailThreshold: 1, ProbeIntervalMs: 3600000})
+	defer p.Close()
+	p.Post(context.Background(), "", nil, false)
+	if !p.hosts[0].isDown() {
+		t.Fatal("host should be ejected")
+	}
+	// 全部摘除时仍然发出请求
+	before := hostRequests.With("test_all_down", srv.URL, "status").Value()
+	p.Post(context.Background(), "", nil, false)
+	if hostRequests.With("test_all_down", srv.URL, "status").Value() != before+1 {
+		t.Error("request should be sent when all hosts are down")
+	}
+}
+
+func TestDeadlineNotCounted(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	p := NewPool("test_deadline", []string{srv.URL}, time.Second, &Conf{FailThreshold: 1})
+	defer p.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if _, err := p.Post(ctx, "", nil, false); err == nil {
+		t.Fatal("expect deadline error")
+	}
+	if p.hosts[0].isDown() {
+		t.Error("request deadline should not eject host")
+	}
+
+	// 单次调用超时计为失败
+	p = NewPool("test_deadline", []string{srv.URL}, 5*time.Millisecond, &Conf{FailThreshold: 1})
+	defer p.Close()
+	if _, err := p.Post(context.Background(), "", nil, false); err == nil {
+		t.Fatal("expect timeout error")
+	}
+	if !p.hosts[0].isDown() {
+		t.Error("call timeout should eject host")
+	}
+}
+
+func TestWeightedPick(t *testing.T) {
+	p := NewPool("test_weight", []string{"http://a", "http://b"}, time.Second,
+		&Conf{Weights: map[string]int{"http://a": 3}})
+	defer p.Close()
+
+	n := 0
+	for i := 0; i < 4000; i++ {
+		if p.pick() == p.hosts[0] {
+			n++
+		}
+	}
+	// 空闲时按权重的两次采样取第一个: P(a) = 3/4
+	if n < 2800 || n > 3200 {
+		t.Errorf("expect about 3000 picks of weighted host, got %d", n)
+	}
+
+	// 选负载低的host
+	atomic.StoreInt64(&p.hosts[0].inflight, 100)
+	n = 0
+	for i := 0; i < 4000; i++ {
+		if p.pick() == p.hosts[0] {
+			n++
+		}
+	}
+	// 只有两次都采到a时才选a: (3/4)^2
+	if n < 2050 || n > 2450 {
+		t.Errorf("expect about 2250 picks of loaded host, got %d", n)
+	}
+}
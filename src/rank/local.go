@@ -0,0 +1,238 @@
+package rank
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+
+	"github.com/brg-liuwei/gotools"
+
+	"estimator"
+	"http_context"
+	"metrics"
+	"raw_ad"
+)
+
+/*
+进程内排序(localrank)：
+	score = payout * ctr * cvr，即单次展示的期望收益(ecpm/1000)
+	先验ctr, cvr 取自先验表，按 (channel,country,slot) -> (channel,slot) -> (channel,country) -> (channel)
+	-> (country) -> 全局 -> 默认值 逐级回退，ctr和cvr分别回退
+	再由estimator按该offer的在线点击、转化数据做平滑，没有数据时即为先验
+	每个广告位以 explore_rate 的概率从剩余候选中随机选一个，避免新offer永远没有曝光
+
+远程rank出错、超时或errmsg不为ok时用localrank兜底；primary_slots中的slot直接使用localrank
+实验参数ranker(local/remote)优先于primary_slots
+*/
+
+type LocalConf struct {
+	PrimarySlots []string `json:"primary_slots"` // 不请求远程rank的slot
+	ExploreRate  float64  `json:"explore_rate"`  // 0~1
+	PriorFile    string   `json:"prior_file"`    // 为空时只用默认值
+	DefaultCtr   float64  `json:"default_ctr"`
+	DefaultCvr   float64  `json:"default_cvr"`
+}
+
+// Prior is one line of prior file, empty channel, country or slot matches any
+type Prior struct {
+	Channel string  `json:"channel"`
+	Country string  `json:"country"`
+	Slot    string  `json:"slot"`
+	Ctr     float64 `json:"ctr"`
+	Cvr     float64 `json:"cvr"`
+}
+
+type priorKey struct {
+	channel, country, slot string
+}
+
+type localRanker struct {
+	primary    map[string]bool
+	explore    float64
+	priors     map[priorKey]*Prior
+	defaultCtr float64
+	defaultCvr float64
+}
+
+var (
+	local atomic.Value // *localRanker
+
+	localRankTotal = metrics.NewCounterVec("offer_local_rank_total",
+		"Requests ranked in process, reason is primary or fallback.", "reason")
+)
+
+func init() {
+	local.Store(&localRanker{defaultCtr: 0.01, defaultCvr: 0.02})
+}
+
+// ValidateLocal checks conf and loads prior file
+func ValidateLocal(cf *LocalConf) error {
+	_, err := newLocalRanker(cf)
+	return err
+}
+
+// ReloadLocal replaces the local ranker, old one is kept on error
+func ReloadLocal(cf *LocalConf) error {
+	l, err := newLocalRanker(cf)
+	if err != nil {
+		return err
+	}
+	local.Store(l)
+	return nil
+}
+
+func loadLocal() *localRanker {
+	return local.Load().(*localRanker)
+}
+
+func newLocalRanker(cf *LocalConf) (*localRanker, error) {
+	if cf.ExploreRate < 0 || cf.ExploreRate > 1 {
+		return nil, fmt.Errorf("explore_rate should be 0~1: %v", cf.ExploreRate)
+	}
+	if cf.DefaultCtr < 0 || cf.DefaultCtr > 1 || cf.DefaultCvr < 0 || cf.DefaultCvr > 1 {
+		return nil, errors.New("default_ctr and default_cvr should be 0~1")
+	}
+
+	l := &localRanker{
+		primary:    make(map[string]bool, len(cf.PrimarySlots)),
+		explore:    cf.ExploreRate,
+		priors:     make(map[priorKey]*Prior),
+		defaultCtr: cf.DefaultCtr,
+		defaultCvr: cf.DefaultCvr,
+	}
+	if l.defaultCtr == 0 {
+		l.defaultCtr = 0.01
+	}
+	if l.defaultCvr == 0 {
+		l.defaultCvr = 0.02
+	}
+	for _, slot := range cf.PrimarySlots {
+		l.primary[slot] = true
+	}
+
+	if cf.PriorFile == "" {
+		return l, nil
+	}
+	var priors []*Prior
+	if err := gotools.DecodeJsonFile(cf.PriorFile, &priors); err != nil {
+		return nil, fmt.Errorf("load prior_file %s error: %v", cf.PriorFile, err)
+	}
+	if err := l.setPriors(priors); err != nil {
+		return nil, fmt.Errorf("prior_file %s: %v", cf.PriorFile, err)
+	}
+	return l, nil
+}
+
+func (l *localRanker) setPriors(priors []*Prior) error {
+	for i, p := range priors {
+		if p.Ctr < 0 || p.Ctr > 1 || p.Cvr < 0 || p.Cvr > 1 {
+			return fmt.Errorf("line %d: ctr and cvr should be 0~1", i)
+		}
+		l.priors[priorKey{p.Channel, p.Country, p.Slot}] = p
+	}
+	return nil
+}
+
+// estimate returns ctr and cvr of (channel, country, slot), 0 in prior means not set
+func (l *localRanker) estimate(channel, country, slot string) (ctr, cvr float64) {
+	for _, k := range [...]priorKey{
+		{channel, country, slot},
+		{channel, "", slot},
+		{channel, country, ""},
+		{channel, "", ""},
+		{"", country, ""},
+		{"", "", ""},
+	} {
+		p := l.priors[k]
+		if p == nil {
+			continue
+		}
+		if ctr == 0 {
+			ctr = p.Ctr
+		}
+		if cvr == 0 {
+			cvr = p.Cvr
+		}
+		if ctr > 0 && cvr > 0 {
+			return
+		}
+	}
+	if ctr == 0 {
+		ctr = l.defaultCtr
+	}
+	if cvr == 0 {
+		cvr = l.defaultCvr
+	}
+	return
+}
+
+type scored struct {
+	raw  *raw_ad.RawAdObj
+	ecpm float64 // 单次展示收益
+}
+
+// rank sorts raws by score, white offers (IsT) first
+func (l *localRanker) rank(raws []*raw_ad.RawAdObj, ctx *http_context.Context) []*raw_ad.RawAdObj {
+	ctx.Method = "localrank"
+
+	rcRaws := make([]*raw_ad.RawAdObj, 0, ctx.AdNum)
+	cands := make([]scored, 0, len(raws))
+	for _, raw := range raws {
+		if raw.IsT {
+			if len(rcRaws) < ctx.AdNum {
+				rawObj := *raw
+				rcRaws = append(rcRaws, &rawObj)
+			}
+			continue
+		}
+		ctr, cvr := l.estimate(raw.Channel, ctx.Country, ctx.SlotId)
+		est := estimator.Get(raw.UniqId, ctx.SlotId, ctx.Country, ctr, cvr)
+		cands = append(cands, scored{raw: raw, ecpm: float64(raw.Payout) * est.Ctr * est.Cvr})
+	}
+	sort.SliceStable(cands, func(i, j int) bool { return cands[i].ecpm > cands[j].ecpm })
+
+	floor := ctx.FloorPrice()
+	for len(rcRaws) < ctx.AdNum && len(cands) > 0 {
+		i := 0
+		if l.explore > 0 && len(cands) > 1 && rand.Float64() < l.explore {
+			i = rand.Intn(len(cands))
+		}
+		c := cands[i]
+		cands = append(cands[:i], cands[i+1:]...)
+
+		ctx.Estimate(c.raw.Channel + "_" + c.raw.Id + " local ecpm: " + fmt.Sprintf("%.6f", c.ecpm))
+		if belowFloor(&RespData{Id: c.raw.Id, Channel: c.raw.Channel, Ecpm: c.ecpm}, floor, ctx) {
+			continue
+		}
+
+		rawObj := *c.raw
+		rawObj.AttachArgs = append(rawObj.AttachArgs, fmt.Sprintf("e=%f", 1000*c.ecpm))
+		rawObj.AttachArgs = append(rawObj.AttachArgs, fmt.Sprintf("po=%f", rawObj.Payout))
+		rcRaws = append(rcRaws, &rawObj)
+	}
+	return rcRaws
+}
+
+// localPrimary returns true if slot does not use remote rank, experiment ranker overrides primary_slots
+func localPrimary(ctx *http_context.Context) bool {
+	switch ctx.ExpParams.Ranker {
+	case "local":
+		return true
+	case "remote":
+		return false
+	}
+	return loadLocal().primary[ctx.SlotId]
+}
+
+func localRank(raws []*raw_ad.RawAdObj, ctx *http_context.Context) []*raw_ad.RawAdObj {
+	localRankTotal.With("primary").Inc()
+	return loadLocal().rank(raws, ctx)
+}
+
+// fallback is used when remote rank fails
+func fallback(raws []*raw_ad.RawAdObj, ctx *http_context.Context) []*raw_ad.RawAdObj {
+	localRankTotal.With("fallback").Inc()
+	return loadLocal().rank(raws, ctx)
+}
@@ -0,0 +1,188 @@
+package rank
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"http_context"
+	"rank/client"
+	"raw_ad"
+)
+
+func testRaws() []*raw_ad.RawAdObj {
+	return []*raw_ad.RawAdObj{
+		{Id: "1", Channel: "nym", Payout: 1},
+		{Id: "2", Channel: "wby", Payout: 2},
+		{Id: "3", Channel: "nym", Payout: 3},
+		{Id: "4", Channel: "tst", Payout: 0.1, IsT: true},
+	}
+}
+
+func testRanker(t *testing.T, cf *LocalConf) *localRanker {
+	l, err := newLocalRanker(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestEstimateBackoff(t *testing.T) {
+	l := testRanker(t, &LocalConf{DefaultCtr: 0.1, DefaultCvr: 0.2})
+	l.setPriors([]*Prior{
+		{Channel: "nym", Ctr: 0.01, Cvr: 0.02},
+		{Channel: "nym", Country: "US", Ctr: 0.03},
+		{Channel: "nym", Slot: "335", Cvr: 0.05},
+		{Country: "CN", Ctr: 0.04},
+	})
+
+	for _, c := range []struct {
+		channel, country, slot string
+		ctr, cvr               float64
+	}{
+		{"nym", "US", "335", 0.03, 0.05},
+		{"nym", "US", "415", 0.03, 0.02},
+		{"nym", "HK", "415", 0.01, 0.02},
+		{"wby", "CN", "335", 0.04, 0.2},
+		{"wby", "US", "335", 0.1, 0.2},
+	} {
+		ctr, cvr := l.estimate(c.channel, c.country, c.slot)
+		if ctr != c.ctr || cvr != c.cvr {
+			t.Errorf("estimate(%s, %s, %s) = %v, %v, expect %v, %v",
+				c.channel, c.country, c.slot, ctr, cvr, c.ctr, c.cvr)
+		}
+	}
+}
+
+func TestLocalRank(t *testing.T) {
+	l := testRanker(t, &LocalConf{})
+	l.setPriors([]*Prior{{Channel: "wby", Ctr: 0.05, Cvr: 0.02}})
+
+	raws := testRaws()
+	ctx := &http_context.Context{AdNum: 3, SlotId: "335", Country: "US"}
+	rc := l.rank(raws, ctx)
+
+	// 白名单优先，其后 wby: 2*0.05*0.02=0.002, nym 3: 3*0.01*0.02=0.0006
+	var ids []string
+	for _, raw := range rc {
+		ids = append(ids, raw.Id)
+	}
+	if fmt.Sprint(ids) != "[4 2 3]" {
+		t.Errorf("unexpected order: %v", ids)
+	}
+	if ctx.Method != "localrank" {
+		t.Errorf("unexpected method: %s", ctx.Method)
+	}
+	if len(rc[1].AttachArgs) != 2 || rc[1].AttachArgs[0] != "e=2.000000" {
+		t.Errorf("unexpected attach args: %v", rc[1].AttachArgs)
+	}
+	if len(raws[1].AttachArgs) != 0 {
+		t.Error("raw obj should be copied")
+	}
+}
+
+func TestLocalExplore(t *testing.T) {
+	l := testRanker(t, &LocalConf{ExploreRate: 1})
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		ctx := &http_context.Context{AdNum: 1, SlotId: "335"}
+		rc := l.rank(testRaws()[:3], ctx)
+		if len(rc) != 1 {
+			t.Fatalf("expect 1 offer, got %d", len(rc))
+		}
+		seen[rc[0].Id] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("explore should reach every candidate, got %v", seen)
+	}
+}
+
+func TestLocalConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rank_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	good := filepath.Join(dir, "good.json")
+	ioutil.WriteFile(good, []byte(`[{"channel": "nym", "ctr": 0.02, "cvr": 0.03}]`), 0644)
+	bad := filepath.Join(dir, "bad.json")
+	ioutil.WriteFile(bad, []byte(`[{"channel": "nym", "ctr": 2}]`), 0644)
+
+	l := testRanker(t, &LocalConf{PriorFile: good, PrimarySlots: []string{"900"}})
+	if ctr, cvr := l.estimate("nym", "US", "335"); ctr != 0.02 || cvr != 0.03 {
+		t.Errorf("prior file not loaded: %v, %v", ctr, cvr)
+	}
+	if !l.primary["900"] {
+		t.Error("primary slot not loaded")
+	}
+
+	for _, cf := range []*LocalConf{
+		{ExploreRate: 1.5},
+		{DefaultCtr: -1},
+		{PriorFile: bad},
+		{PriorFile: filepath.Join(dir, "missing.json")},
+	} {
+		if ValidateLocal(cf) == nil {
+			t.Errorf("expect error for %+v", cf)
+		}
+	}
+}
+
+func TestSelectFallback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"tot": 0, "errmsg": "internal error"}`))
+	}))
+	defer srv.Close()
+
+	old, oldPool := conf, impRankPool
+	conf = &Conf{RankApis: []string{srv.URL}, ImpRankApi: srv.URL, VideoRankApi: srv.URL}
+	impRankPool = client.NewPool("imp_rank", []string{srv.URL}, time.Second, &client.Conf{})
+	defer func() { impRankPool.Close(); conf, impRankPool = old, oldPool }()
+	if err := ReloadLocal(&LocalConf{PrimarySlots: []string{"900"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer ReloadLocal(&LocalConf{})
+
+	ctx := &http_context.Context{AdNum: 2, SlotId: "335", AdType: "1", L: testPrinter{t}}
+	if rc := Select(testRaws(), ctx); len(rc) != 2 || ctx.Method != "localrank" {
+		t.Errorf("expect localrank fallback, got %d offers, method %s", len(rc), ctx.Method)
+	}
+
+	// primary slot不请求远程rank
+	fallbacks := localRankTotal.With("fallback").Value()
+	ctx = &http_context.Context{AdNum: 2, SlotId: "900", AdType: "1", L: testPrinter{t}}
+	if rc := Select(testRaws(), ctx); len(rc) != 2 || ctx.Method != "localrank" {
+		t.Errorf("expect localrank primary, got %d offers, method %s", len(rc), ctx.Method)
+	}
+	if localRankTotal.With("fallback").Value() != fallbacks {
+		t.Error("primary slot should not request remote rank")
+	}
+
+	// 实验参数ranker优先于primary_slots
+	ctx = &http_context.Context{AdNum: 2, SlotId: "900", AdType: "1", L: testPrinter{t}}
+	ctx.ExpParams.Ranker = "remote"
+	Select(testRaws(), ctx)
+	if localRankTotal.With("fallback").Value() != fallbacks+1 {
+		t.Error("experiment ranker remote should request remote rank")
+	}
+	ctx = &http_context.Context{AdNum: 2, SlotId: "335", AdType: "1", L: testPrinter{t}}
+	ctx.ExpParams.Ranker = "local"
+	Select(testRaws(), ctx)
+	if localRankTotal.With("fallback").Value() != fallbacks+1 {
+		t.Error("experiment ranker local should not request remote rank")
+	}
+}
+
+type testPrinter struct {
+	t *testing.T
+}
+
+func (p testPrinter) Println(v ...interface{}) {
+	p.t.Log(v...)
+}
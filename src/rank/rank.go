@@ -1,18 +1,17 @@
 package rank
 
 import (
-	"bytes"
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"math/rand"
-	"net/http"
 	"regexp"
 	"strconv"
 	"sync/atomic"
+	"time"
 
 	"http_context"
+	"metrics"
+	"rank/client"
 	"rank/video"
 	"raw_ad"
 )
@@ -21,11 +20,19 @@ type Conf struct {
 	RankApis     []string `json:"rank_apis"`
 	ImpRankApi   string   `json:"imp_rank_api"`
 	VideoRankApi string   `json:"video_rank_api"`
+
+	LocalRank LocalConf   `json:"local_rank"`
+	Client    client.Conf `json:"client"`
+	Shadow    ShadowConf  `json:"shadow"`
 }
 
 var (
-	conf  *Conf
-	iHost int64 = 0
+	conf *Conf
+
+	rankPool, impRankPool *client.Pool
+
+	floorFilted      int64 = 0 // 因低于slot底价被丢弃的offer数
+	deadlineExceeded int64 = 0 // 因请求超时降级为localrank的次数
 )
 
 var spaceReg *regexp.Regexp
@@ -42,7 +49,36 @@ func Init(cf *Conf) {
 	if len(conf.VideoRankApi) == 0 {
 		panic("missing video_rank_api in conf")
 	}
-	video.Init(cf.VideoRankApi)
+	if err := ReloadLocal(&cf.LocalRank); err != nil {
+		panic("local_rank conf error: " + err.Error())
+	}
+	cf.Client.SetDefault()
+	rankPool = client.NewPool("rank", cf.RankApis, time.Duration(cf.Client.TimeoutMs)*time.Millisecond, &cf.Client)
+	impRankPool = client.NewPool("imp_rank", []string{cf.ImpRankApi}, time.Duration(cf.Client.TimeoutMs)*time.Millisecond, &cf.Client)
+	video.Init(cf.VideoRankApi, &cf.Client)
+	if err := ReloadShadow(&cf.Shadow); err != nil {
+		panic("shadow conf error: " + err.Error())
+	}
+}
+
+// FloorFilted returns the number of ranked offers dropped by slot floor price
+func FloorFilted() int64 {
+	return atomic.LoadInt64(&floorFilted)
+}
+
+// DeadlineExceeded returns the number of rank calls degraded by request deadline
+func DeadlineExceeded() int64 {
+	return atomic.LoadInt64(&deadlineExceeded)
+}
+
+// belowFloor: rank返回的ecpm为单次展示收益，底价为千次展示收益
+func belowFloor(rcData *RespData, floor float64, ctx *http_context.Context) bool {
+	if floor <= 0 || 1000*rcData.Ecpm >= floor {
+		return false
+	}
+	atomic.AddInt64(&floorFilted, 1)
+	ctx.Estimate(rcData.Channel + "_" + rcData.Id + " below floor: " + fmt.Sprintf("%.6f", floor))
+	return true
 }
 
 type Offer struct {
@@ -284,6 +320,11 @@ func priorityCopy(pChannel string, raws []*raw_ad.RawAdObj, ctx *http_context.Co
 	return rc
 }
 
+// cplFirst: slot 1244是专门给测试cpl的slot，其它slot通过实验参数cpl_first开启
+func cplFirst(ctx *http_context.Context) bool {
+	return ctx.SlotId == "1244" || ctx.ExpParams.CplFirst
+}
+
 func SelectWg(raws []*raw_ad.RawAdObj, ctx *http_context.Context) []*raw_ad.RawAdObj {
 	if len(raws) == 0 {
 		return nil
@@ -295,7 +336,7 @@ func SelectWg(raws []*raw_ad.RawAdObj, ctx *http_context.Context) []*raw_ad.RawA
 	}
 
 	cplOffers := make([]*raw_ad.RawAdObj, 0, 8)
-	if !ctx.IsWugan() && ctx.SlotId == "1244" { // 专门给测试cpl的slot
+	if !ctx.IsWugan() && cplFirst(ctx) {
 		for i := 0; i < len(raws); i++ {
 			if raws[i].PayoutType == "CPL" && len(cplOffers) < ctx.AdNum {
 				rawCopy := *raws[i]
@@ -308,6 +349,10 @@ func SelectWg(raws []*raw_ad.RawAdObj, ctx *http_context.Context) []*raw_ad.RawA
 		return cplOffers
 	}
 
+	if localPrimary(ctx) {
+		return localRank(raws, ctx)
+	}
+
 	pData, whiteOffers := createPostDataWg(raws, ctx)
 	if pData.AdNum == 0 {
 		rcRaws := make([]*raw_ad.RawAdObj, 0, len(whiteOffers))
@@ -320,63 +365,38 @@ func SelectWg(raws []*raw_ad.RawAdObj, ctx *http_context.Context) []*raw_ad.RawA
 
 	reqb, _ := json.Marshal(pData)
 
-	n := int64(len(conf.RankApis))
-	i := int(atomic.AddInt64(&iHost, int64(1)) % n) // round robin
-
-	var buf bytes.Buffer
-	if ctx.RankUseGzip {
-		enc := gzip.NewWriter(&buf)
-		enc.Write(reqb)
-		enc.Close()
-	} else {
-		buf.Write(reqb)
+	if ctx.Expired() { // 请求已超时，不再请求rank
+		atomic.AddInt64(&deadlineExceeded, 1)
+		return fallback(raws, ctx)
 	}
 
-	var reqUrl string
+	pool, suffix := rankPool, "?user_hash="+strconv.Itoa(ctx.UserHash)
 	if ctx.ImpRank() {
-		reqUrl = conf.ImpRankApi + "?user_hash=" + strconv.Itoa(ctx.UserHash)
-	} else {
-		reqUrl = conf.RankApis[i] + "?user_hash=" + strconv.Itoa(ctx.UserHash)
-	}
-
-	req, err := http.NewRequest("POST", reqUrl, &buf)
-	if err != nil {
-		ctx.L.Println("CTR Request err: ", err)
-		return randomCopy(raws, ctx)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	if ctx.RankUseGzip {
-		req.Header.Set("Content-Encoding", "gzip")
-	}
-
-	client := &http.Client{}
-	rep, repErr := client.Do(req)
-	if rep != nil {
-		defer rep.Body.Close()
+		pool = impRankPool
 	}
+	start := time.Now()
+	b, repErr := pool.Post(ctx.StdContext(), suffix, reqb, ctx.RankUseGzip)
+	metrics.ObserveUpstream("rank", start, repErr)
 	if repErr != nil {
+		if ctx.Expired() {
+			atomic.AddInt64(&deadlineExceeded, 1)
+		}
 		ctx.L.Println("CTR Response err: ", repErr)
-		return randomCopy(raws, ctx)
-	}
-
-	b, err := ioutil.ReadAll(rep.Body)
-	if err != nil {
-		ctx.L.Println("Read CTR Response err: ", err)
-		return randomCopy(raws, ctx)
+		return fallback(raws, ctx)
 	}
 
 	var repData PostResp
 	if err := json.Unmarshal(b, &repData); err != nil {
 		ctx.L.Println("Decode Json Response err: ", err,
 			", req body:", string(reqb), ", resp body: ", string(b))
-		return randomCopy(raws, ctx)
+		return fallback(raws, ctx)
 	}
 
 	if repData.ErrMsg != "ok" {
 		ctx.L.Println("rank err: ", repData.ErrMsg)
-		return randomCopy(raws, ctx)
+		return fallback(raws, ctx)
 	}
+	shadowRank(raws, reqb, &repData, ctx)
 
 	if repData.Tot <= 0 {
 		return nil
@@ -391,8 +411,12 @@ func SelectWg(raws []*raw_ad.RawAdObj, ctx *http_context.Context) []*raw_ad.RawA
 		rcRaws = append(rcRaws, &rawObj)
 	}
 
+	floor := ctx.FloorPrice()
 	for _, rcData := range repData.Data {
 		ctx.Estimate(rcData.Channel + "_" + rcData.Id + " ecpm: " + fmt.Sprintf("%.6f", rcData.Ecpm))
+		if belowFloor(&rcData, floor, ctx) {
+			continue
+		}
 		for i := 0; i != len(raws); i++ {
 			if nTot <= 0 {
 				return rcRaws
@@ -431,7 +455,7 @@ func Select(raws []*raw_ad.RawAdObj, ctx *http_context.Context) []*raw_ad.RawAdO
 	}
 
 	cplOffers := make([]*raw_ad.RawAdObj, 0, 8)
-	if !ctx.IsWugan() && ctx.SlotId == "1244" { // 专门给测试cpl的slot
+	if !ctx.IsWugan() && cplFirst(ctx) {
 		for i := 0; i < len(raws); i++ {
 			if raws[i].PayoutType == "CPL" && len(cplOffers) < ctx.AdNum {
 				rawCopy := *raws[i]
@@ -444,66 +468,45 @@ func Select(raws []*raw_ad.RawAdObj, ctx *http_context.Context) []*raw_ad.RawAdO
 		return cplOffers
 	}
 
+	if localPrimary(ctx) {
+		return localRank(raws, ctx)
+	}
+
 	pData := createPostData(raws, ctx)
 	reqb, _ := json.Marshal(pData)
 
-	n := int64(len(conf.RankApis))
-	i := int(atomic.AddInt64(&iHost, int64(1)) % n) // round robin
-
-	var buf bytes.Buffer
-	if ctx.RankUseGzip {
-		enc := gzip.NewWriter(&buf)
-		enc.Write(reqb)
-		enc.Close()
-	} else {
-		buf.Write(reqb)
+	if ctx.Expired() { // 请求已超时，不再请求rank
+		atomic.AddInt64(&deadlineExceeded, 1)
+		return fallback(raws, ctx)
 	}
 
-	var reqUrl string
+	pool, suffix := rankPool, "?user_hash="+strconv.Itoa(ctx.UserHash)
 	if ctx.ImpRank() {
-		reqUrl = conf.ImpRankApi + "?user_hash=" + strconv.Itoa(ctx.UserHash)
-	} else {
-		reqUrl = conf.RankApis[i] + "?user_hash=" + strconv.Itoa(ctx.UserHash)
-	}
-
-	req, err := http.NewRequest("POST", reqUrl, &buf)
-	if err != nil {
-		ctx.L.Println("CTR Request err: ", err)
-		return randomCopy(raws, ctx)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	if ctx.RankUseGzip {
-		req.Header.Set("Content-Encoding", "gzip")
-	}
-
-	client := &http.Client{}
-	rep, repErr := client.Do(req)
-	if rep != nil {
-		defer rep.Body.Close()
+		pool = impRankPool
 	}
+	start := time.Now()
+	b, repErr := pool.Post(ctx.StdContext(), suffix, reqb, ctx.RankUseGzip)
+	metrics.ObserveUpstream("rank", start, repErr)
 	if repErr != nil {
+		if ctx.Expired() {
+			atomic.AddInt64(&deadlineExceeded, 1)
+		}
 		ctx.L.Println("CTR Response err: ", repErr)
-		return randomCopy(raws, ctx)
-	}
-
-	b, err := ioutil.ReadAll(rep.Body)
-	if err != nil {
-		ctx.L.Println("Read CTR Response err: ", err)
-		return randomCopy(raws, ctx)
+		return fallback(raws, ctx)
 	}
 
 	var repData PostResp
 	if err := json.Unmarshal(b, &repData); err != nil {
 		ctx.L.Println("Decode Json Response err: ", err,
 			", req body:", string(reqb), ", resp body: ", string(b))
-		return randomCopy(raws, ctx)
+		return fallback(raws, ctx)
 	}
 
 	if repData.ErrMsg != "ok" {
 		ctx.L.Println("rank err: ", repData.ErrMsg)
-		return randomCopy(raws, ctx)
+		return fallback(raws, ctx)
 	}
+	shadowRank(raws, reqb, &repData, ctx)
 
 	if repData.Tot <= 0 {
 		return nil
@@ -512,8 +515,12 @@ func Select(raws []*raw_ad.RawAdObj, ctx *http_context.Context) []*raw_ad.RawAdO
 	nTot := repData.Tot
 	rcRaws := make([]*raw_ad.RawAdObj, 0, repData.Tot)
 
+	floor := ctx.FloorPrice()
 	for _, rcData := range repData.Data {
 		ctx.Estimate(rcData.Channel + "_" + rcData.Id + " ecpm: " + fmt.Sprintf("%.6f", rcData.Ecpm))
+		if belowFloor(&rcData, floor, ctx) {
+			continue
+		}
 		for i := 0; i != len(raws); i++ {
 			if nTot <= 0 {
 				return rcRaws
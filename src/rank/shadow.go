@@ -0,0 +1,394 @@
+package rank
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"estimator"
+	"http_context"
+	"logger"
+	"metrics"
+	"rank/client"
+	"raw_ad"
+	"util"
+)
+
+/*
+shadow rank(迁移ranker时在线上流量上验证候选ranker)：
+	远程rank返回ok后，按rate采样把同一个PostReq异步发给候选ranker，不影响本次请求的结果和延迟
+	队列满时直接丢弃；shadow请求使用自己的超时，不受请求deadline约束
+	对比生产和shadow返回的前k个offer(k为ad_num)：
+		overlap@k = 两者前k个的交集 / 较长一方的个数
+		expected eCPM = 前k个offer的 payout*ctr*cvr 均值(ctr、cvr与localrank相同，来自先验和estimator)，
+		两边用同一个估计，差值只反映排序的不同
+	按slot累计，/rank/shadow 查看(POST清零)，debug日志输出每次对比
+*/
+
+type ShadowConf struct {
+	RankApis   []string `json:"rank_apis"`    // 候选ranker，为空时不开启
+	ImpRankApi string   `json:"imp_rank_api"` // 为空时展示广告不做shadow
+	Rate       float64  `json:"rate"`         // 采样比例，0~1
+	TimeoutMs  int      `json:"timeout_ms"`   // 默认300
+}
+
+func (cf *ShadowConf) Validate() error {
+	if cf.Rate < 0 || cf.Rate > 1 {
+		return errors.New("rate should be 0~1")
+	}
+	if cf.TimeoutMs < 0 {
+		return errors.New("timeout_ms should not be negative")
+	}
+	if cf.Rate > 0 && len(cf.RankApis) == 0 && cf.ImpRankApi == "" {
+		return errors.New("rank_apis or imp_rank_api required when rate > 0")
+	}
+	return nil
+}
+
+type shadowRanker struct {
+	rate    float64
+	pool    *client.Pool
+	impPool *client.Pool
+}
+
+type shadowJob struct {
+	pool    *client.Pool
+	suffix  string
+	reqb    []byte
+	gz      bool
+	prod    []string // 生产ranker前k个offer: channel_id
+	k       int
+	slot    string
+	country string
+	reqId   string
+	raws    map[string]*raw_ad.RawAdObj
+}
+
+const (
+	shadowWorkers = 4
+	shadowQueue   = 1000
+)
+
+var (
+	shadow     atomic.Value // *shadowRanker
+	shadowJobs = make(chan *shadowJob, shadowQueue)
+	startOnce  sync.Once
+
+	shadowTotal = metrics.NewCounterVec("offer_rank_shadow_total",
+		"Shadow rank calls by result: ok, error, dropped.", "result")
+	shadowOverlap = metrics.NewHistogram("offer_rank_shadow_overlap",
+		"overlap@k between production and shadow ranker.", []float64{0, 0.2, 0.4, 0.6, 0.8, 0.99, 1})
+)
+
+func init() {
+	shadow.Store(&shadowRanker{})
+}
+
+func loadShadow() *shadowRanker {
+	return shadow.Load().(*shadowRanker)
+}
+
+// ReloadShadow replaces shadow ranker, workers are started on first call
+func ReloadShadow(cf *ShadowConf) error {
+	if err := cf.Validate(); err != nil {
+		return err
+	}
+	s := &shadowRanker{rate: cf.Rate}
+	if cf.Rate > 0 {
+		timeout := time.Duration(cf.TimeoutMs) * time.Millisecond
+		if timeout <= 0 {
+			timeout = 300 * time.Millisecond
+		}
+		clientConf := &client.Conf{}
+		clientConf.SetDefault()
+		if len(cf.RankApis) > 0 {
+			s.pool = client.NewPool("shadow_rank", cf.RankApis, timeout, clientConf)
+		}
+		if cf.ImpRankApi != "" {
+			s.impPool = client.NewPool("shadow_imp_rank", []string{cf.ImpRankApi}, timeout, clientConf)
+		}
+	}
+	old := loadShadow()
+	shadow.Store(s)
+	if s.pool == nil && old.pool != nil {
+		old.pool.Close()
+	}
+	if s.impPool == nil && old.impPool != nil {
+		old.impPool.Close()
+	}
+	startOnce.Do(func() {
+		for i := 0; i < shadowWorkers; i++ {
+			go shadowWorker()
+		}
+	})
+	return nil
+}
+
+func offerKey(channel, id string) string {
+	return channel + "_" + id
+}
+
+// shadowRank queues the request of production rank, resp is the ok response of production
+func shadowRank(raws []*raw_ad.RawAdObj, reqb []byte, resp *PostResp, ctx *http_context.Context) {
+	s := loadShadow()
+	if s.rate <= 0 || rand.Float64() >= s.rate {
+		return
+	}
+	pool := s.pool
+	if ctx.ImpRank() {
+		pool = s.impPool
+	}
+	if pool == nil {
+		return
+	}
+
+	k := ctx.AdNum
+	if k <= 0 {
+		k = 1
+	}
+	job := &shadowJob{
+		pool:    pool,
+		suffix:  "?user_hash=" + strconv.Itoa(ctx.UserHash),
+		reqb:    reqb,
+		gz:      ctx.RankUseGzip,
+		prod:    topK(resp.Data, k),
+		k:       k,
+		slot:    ctx.SlotId,
+		country: ctx.Country,
+		raws:    make(map[string]*raw_ad.RawAdObj, len(raws)),
+	}
+	if ctx.Log != nil {
+		job.reqId = ctx.Log.ReqId
+	}
+	for _, raw := range raws {
+		job.raws[offerKey(raw.Channel, raw.Id)] = raw
+	}
+
+	select {
+	case shadowJobs <- job:
+	default:
+		shadowTotal.With("dropped").Inc()
+	}
+}
+
+func topK(data []RespData, k int) []string {
+	keys := make([]string, 0, k)
+	seen := make(map[string]bool, k)
+	for i := range data {
+		if len(keys) >= k {
+			break
+		}
+		key := offerKey(data[i].Channel, data[i].Id)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func shadowWorker() {
+	for job := range shadowJobs {
+		job.run()
+	}
+}
+
+func (job *shadowJob) run() {
+	b, err := job.pool.Post(context.Background(), job.suffix, job.reqb, job.gz)
+	var resp PostResp
+	if err == nil {
+		err = json.Unmarshal(b, &resp)
+	}
+	if err == nil && resp.ErrMsg != "ok" {
+		err = errors.New("errmsg: " + resp.ErrMsg)
+	}
+	if err != nil {
+		shadowTotal.With("error").Inc()
+		shadowStats.add(job.slot, nil)
+		logger.Default().Debug("shadow rank error", logger.Fields{
+			"req_id": job.reqId, "slot": job.slot, "error": err})
+		return
+	}
+	shadowTotal.With("ok").Inc()
+
+	c := job.compare(topK(resp.Data, job.k))
+	shadowOverlap.Observe(c.overlap)
+	shadowStats.add(job.slot, c)
+	logger.Default().Debug("shadow rank", logger.Fields{
+		"req_id": job.reqId, "slot": job.slot, "k": job.k,
+		"prod": job.prod, "shadow": c.shadow,
+		"overlap": c.overlap, "prod_ecpm": c.prodEcpm, "shadow_ecpm": c.shadowEcpm})
+}
+
+type comparison struct {
+	shadow     []string
+	overlap    float64
+	prodEcpm   float64 // 千次展示收益
+	shadowEcpm float64
+}
+
+func (job *shadowJob) compare(shadowTop []string) *comparison {
+	c := &comparison{shadow: shadowTop}
+	n := len(job.prod)
+	if len(shadowTop) > n {
+		n = len(shadowTop)
+	}
+	if n == 0 {
+		c.overlap = 1
+		return c
+	}
+	inProd := make(map[string]bool, len(job.prod))
+	for _, key := range job.prod {
+		inProd[key] = true
+	}
+	hit := 0
+	for _, key := range shadowTop {
+		if inProd[key] {
+			hit++
+		}
+	}
+	c.overlap = float64(hit) / float64(n)
+	c.prodEcpm = job.expectedEcpm(job.prod)
+	c.shadowEcpm = job.expectedEcpm(shadowTop)
+	return c
+}
+
+// expectedEcpm returns mean payout*ctr*cvr*1000 of keys, offers not in request are 0
+func (job *shadowJob) expectedEcpm(keys []string) float64 {
+	if len(keys) == 0 {
+		return 0
+	}
+	l := loadLocal()
+	sum := 0.0
+	for _, key := range keys {
+		raw := job.raws[key]
+		if raw == nil {
+			continue
+		}
+		ctr, cvr := l.estimate(raw.Channel, job.country, job.slot)
+		est := estimator.Get(raw.UniqId, job.slot, job.country, ctr, cvr)
+		sum += 1000 * float64(raw.Payout) * est.Ctr * est.Cvr
+	}
+	return sum / float64(len(keys))
+}
+
+type shadowStat struct {
+	requests   int64
+	errors     int64
+	overlap    float64
+	prodEcpm   float64
+	shadowEcpm float64
+}
+
+type shadowStatSet struct {
+	sync.Mutex
+	slots map[string]*shadowStat
+	since time.Time
+}
+
+var shadowStats = &shadowStatSet{slots: make(map[string]*shadowStat), since: time.Now()}
+
+func (set *shadowStatSet) add(slot string, c *comparison) {
+	set.Lock()
+	defer set.Unlock()
+	st := set.slots[slot]
+	if st == nil {
+		st = &shadowStat{}
+		set.slots[slot] = st
+	}
+	st.requests++
+	if c == nil {
+		st.errors++
+		return
+	}
+	st.overlap += c.overlap
+	st.prodEcpm += c.prodEcpm
+	st.shadowEcpm += c.shadowEcpm
+}
+
+func (set *shadowStatSet) reset() {
+	set.Lock()
+	set.slots = make(map[string]*shadowStat)
+	set.since = time.Now()
+	set.Unlock()
+}
+
+// ShadowReport is the aggregated diff of one slot, "*" for all slots
+type ShadowReport struct {
+	Slot       string  `json:"slot"`
+	Requests   int64   `json:"requests"`
+	ErrorRate  float64 `json:"error_rate"`
+	Overlap    float64 `json:"overlap_at_k"`
+	ProdEcpm   float64 `json:"prod_ecpm"`
+	ShadowEcpm float64 `json:"shadow_ecpm"`
+	EcpmDelta  float64 `json:"ecpm_delta"` // (shadow - prod) / prod
+}
+
+func (st *shadowStat) report(slot string) *ShadowReport {
+	r := &ShadowReport{Slot: slot, Requests: st.requests}
+	if st.requests == 0 {
+		return r
+	}
+	r.ErrorRate = float64(st.errors) / float64(st.requests)
+	if ok := float64(st.requests - st.errors); ok > 0 {
+		r.Overlap = st.overlap / ok
+		r.ProdEcpm = st.prodEcpm / ok
+		r.ShadowEcpm = st.shadowEcpm / ok
+	}
+	if r.ProdEcpm > 0 {
+		r.EcpmDelta = (r.ShadowEcpm - r.ProdEcpm) / r.ProdEcpm
+	}
+	return r
+}
+
+func (set *shadowStatSet) report() []*ShadowReport {
+	set.Lock()
+	defer set.Unlock()
+	total := &shadowStat{}
+	res := make([]*ShadowReport, 0, len(set.slots)+1)
+	for slot, st := range set.slots {
+		res = append(res, st.report(slot))
+		total.requests += st.requests
+		total.errors += st.errors
+		total.overlap += st.overlap
+		total.prodEcpm += st.prodEcpm
+		total.shadowEcpm += st.shadowEcpm
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Requests > res[j].Requests })
+	return append([]*ShadowReport{total.report("*")}, res...)
+}
+
+/*
+只允许内网访问:
+
+	GET  /rank/shadow    各slot的对比结果(自上次清零)
+	POST /rank/shadow    清零
+*/
+func ShadowHandler(w http.ResponseWriter, r *http.Request) {
+	if !util.IsPrivateAddr(r.RemoteAddr) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method == "POST" {
+		shadowStats.reset()
+		w.Write([]byte("ok"))
+		return
+	}
+	shadowStats.Lock()
+	since := shadowStats.since
+	shadowStats.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": loadShadow().rate > 0,
+		"since":   since.Unix(),
+		"slots":   shadowStats.report(),
+	})
+}
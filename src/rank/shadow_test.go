@@ -0,0 +1,120 @@
+package rank
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"http_context"
+	"rank/client"
+)
+
+func rankServer(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+}
+
+func TestShadowRank(t *testing.T) {
+	prod := rankServer(`{"tot": 2, "errmsg": "ok", "data": [
+		{"id": "3", "channel": "nym", "ecpm": 0.003}, {"id": "2", "channel": "wby", "ecpm": 0.002}]}`)
+	defer prod.Close()
+	cand := rankServer(`{"tot": 2, "errmsg": "ok", "data": [
+		{"id": "3", "channel": "nym", "ecpm": 0.003}, {"id": "1", "channel": "nym", "ecpm": 0.001}]}`)
+	defer cand.Close()
+
+	oldPool := impRankPool
+	impRankPool = client.NewPool("imp_rank", []string{prod.URL}, time.Second, &client.Conf{})
+	defer func() { impRankPool.Close(); impRankPool = oldPool }()
+	if err := ReloadShadow(&ShadowConf{ImpRankApi: cand.URL, Rate: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer ReloadShadow(&ShadowConf{})
+	shadowStats.reset()
+
+	ctx := &http_context.Context{AdNum: 2, SlotId: "335", AdType: "1", L: testPrinter{t}}
+	rc := Select(testRaws(), ctx)
+	if len(rc) != 2 || rc[0].Id != "3" || rc[1].Id != "2" {
+		t.Fatalf("shadow should not change production result: %+v", rc)
+	}
+
+	var r *ShadowReport
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if rs := shadowStats.report(); len(rs) == 2 {
+			r = rs[1]
+			break
+		}
+	}
+	if r == nil {
+		t.Fatal("shadow result not recorded")
+	}
+	// 默认ctr 0.01, cvr 0.02: prod (3+2)/2*0.2, shadow (3+1)/2*0.2
+	if r.Slot != "335" || r.Requests != 1 || r.ErrorRate != 0 || r.Overlap != 0.5 ||
+		math.Abs(r.ProdEcpm-0.5) > 1e-9 || math.Abs(r.ShadowEcpm-0.4) > 1e-9 || math.Abs(r.EcpmDelta+0.2) > 1e-9 {
+		t.Errorf("unexpected report: %+v", r)
+	}
+
+	// 非展示广告没有配置shadow rank_apis，不发送
+	before := shadowTotal.With("ok").Value() + shadowTotal.With("error").Value()
+	shadowRank(testRaws(), nil, &PostResp{}, &http_context.Context{AdType: "3"})
+	time.Sleep(20 * time.Millisecond)
+	if shadowTotal.With("ok").Value()+shadowTotal.With("error").Value() != before {
+		t.Error("shadow should be skipped without rank_apis")
+	}
+}
+
+func TestShadowError(t *testing.T) {
+	cand := rankServer(`{"tot": 0, "errmsg": "internal error"}`)
+	defer cand.Close()
+	if err := ReloadShadow(&ShadowConf{RankApis: []string{cand.URL}, Rate: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer ReloadShadow(&ShadowConf{})
+	shadowStats.reset()
+
+	shadowRank(testRaws(), []byte(`{}`), &PostResp{}, &http_context.Context{AdNum: 1, SlotId: "415", AdType: "3"})
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if rs := shadowStats.report(); rs[0].Requests == 1 {
+			if rs[0].ErrorRate != 1 {
+				t.Errorf("unexpected report: %+v", rs[0])
+			}
+			return
+		}
+	}
+	t.Fatal("shadow error not recorded")
+}
+
+func TestShadowConf(t *testing.T) {
+	for _, cf := range []*ShadowConf{
+		{Rate: 2, RankApis: []string{"http://a"}},
+		{Rate: 0.1},
+		{TimeoutMs: -1},
+	} {
+		if cf.Validate() == nil {
+			t.Errorf("expect error for %+v", cf)
+		}
+	}
+}
+
+func TestShadowHandler(t *testing.T) {
+	get := func(method, remote string) (int, string) {
+		r := httptest.NewRequest(method, "/rank/shadow", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		ShadowHandler(w, r)
+		return w.Code, w.Body.String()
+	}
+	if code, _ := get("GET", "8.8.8.8:1"); code != http.StatusForbidden {
+		t.Errorf("expect 403, got %d", code)
+	}
+	shadowStats.add("335", nil)
+	if _, body := get("GET", "10.0.0.1:1"); !strings.Contains(body, `"slot":"335"`) {
+		t.Errorf("unexpected body: %s", body)
+	}
+	if _, body := get("POST", "10.0.0.1:1"); body != "ok" || len(shadowStats.report()) != 1 {
+		t.Error("stats should be reset")
+	}
+}
@@ -1,26 +1,24 @@
 package video
 
 import (
-	"bytes"
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"math/rand"
-	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"http_context"
+	"metrics"
+	"rank/client"
 	"raw_ad"
 )
 
-var (
-	rankApi string
-)
+// 单次调用不超过client.video_timeout_ms，同时受请求deadline约束
+var pool *client.Pool
 
-func Init(api string) {
-	rankApi = api
+func Init(api string, cf *client.Conf) {
+	pool = client.NewPool("video_rank", []string{api}, time.Duration(cf.VideoTimeoutMs)*time.Millisecond, cf)
 }
 
 type Offer struct {
@@ -164,42 +162,16 @@ func SelectCreative(raws []*raw_ad.RawAdObj, ctx *http_context.Context) []string
 		return randomCreative(raws, ctx)
 	}
 
-	var buf bytes.Buffer
-	if ctx.RankUseGzip {
-		enc := gzip.NewWriter(&buf)
-		enc.Write(reqb)
-		enc.Close()
-	} else {
-		buf.Write(reqb)
-	}
-
-	reqUrl := rankApi + "/get_creatives?user_hash=" + strconv.Itoa(ctx.UserHash)
-
-	req, err := http.NewRequest("POST", reqUrl, &buf)
-	if err != nil {
-		ctx.L.Println("Video Creatives Rank request err: ", err)
-		return randomCreative(raws, ctx)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	if ctx.RankUseGzip {
-		req.Header.Set("Content-Encoding", "gzip")
-	}
-
-	client := &http.Client{
-		Timeout: 50 * time.Millisecond,
-	}
-	resp, err := client.Do(req)
-	if resp != nil {
-		defer resp.Body.Close()
-	}
+	start := time.Now()
+	b, err := pool.Post(ctx.StdContext(), "/get_creatives?user_hash="+strconv.Itoa(ctx.UserHash), reqb, ctx.RankUseGzip)
+	metrics.ObserveUpstream("video_creative_rank", start, err)
 	if err != nil {
 		ctx.L.Println("Video Creatives Rank response err: ", err)
 		return randomCreative(raws, ctx)
 	}
 
 	var respData CreativeResp
-	if err = json.NewDecoder(resp.Body).Decode(&respData); err != nil {
+	if err = json.Unmarshal(b, &respData); err != nil {
 		return randomCreative(raws, ctx)
 	}
 
@@ -222,36 +194,9 @@ func Select(raws []*raw_ad.RawAdObj, ctx *http_context.Context) []*raw_ad.RawAdO
 		return randomCopy(raws, ctx)
 	}
 
-	var buf bytes.Buffer
-	if ctx.RankUseGzip {
-		enc := gzip.NewWriter(&buf)
-		enc.Write(reqb)
-		enc.Close()
-	} else {
-		buf.Write(reqb)
-	}
-
-	reqUrl := rankApi + "/rank?user_hash=" + strconv.Itoa(ctx.UserHash)
-
-	req, err := http.NewRequest("POST", reqUrl, &buf)
-	if err != nil {
-		ctx.L.Println("Video Rank request err: ", err)
-		ctx.ServerId = "rcp2"
-		return randomCopy(raws, ctx)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	if ctx.RankUseGzip {
-		req.Header.Set("Content-Encoding", "gzip")
-	}
-
-	client := &http.Client{
-		Timeout: 50 * time.Millisecond,
-	}
-	resp, err := client.Do(req)
-	if resp != nil {
-		defer resp.Body.Close()
-	}
+	start := time.Now()
+	b, err := pool.Post(ctx.StdContext(), "/rank?user_hash="+strconv.Itoa(ctx.UserHash), reqb, ctx.RankUseGzip)
+	metrics.ObserveUpstream("video_rank", start, err)
 	if err != nil {
 		ctx.L.Println("Video Rank response err: ", err)
 		ctx.ServerId = "rcp3"
@@ -259,7 +204,7 @@ func Select(raws []*raw_ad.RawAdObj, ctx *http_context.Context) []*raw_ad.RawAdO
 	}
 
 	var respData PostResp
-	if err = json.NewDecoder(resp.Body).Decode(&respData); err != nil {
+	if err = json.Unmarshal(b, &respData); err != nil {
 		ctx.ServerId = "rcp4"
 		return randomCopy(raws, ctx)
 	}
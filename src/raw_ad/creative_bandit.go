@@ -0,0 +1,86 @@
+package raw_ad
+
+import (
+	"fmt"
+
+	"creative_bandit"
+	"http_context"
+)
+
+func imgMatch(img *Img, w, h, rule int) bool {
+	if w == 0 || h == 0 {
+		return true
+	}
+	switch rule {
+	case -2: // 比值浮动不超过20%即可
+		return img.RatioFuzzyMatch(w, h, 0.2)
+	case -1: // 比值完全匹配即可
+		return img.RatioMatch(w, h)
+	case 1: // 绝对值完全匹配
+		return img.Match(w, h)
+	case 2: // 比值完全匹配，宽高浮动不超过20%
+		return img.AbsFuzzyMatch(w, h, 0.2)
+	case 3: // 比值浮动不超过20%，宽高浮动不超过20%
+		return img.FuzzyMatch(w, h, 0.2, 0.2)
+	}
+	return false
+}
+
+// GetMatchedImgs returns all images of lang matching (w, h) by rule
+func GetMatchedImgs(m map[string][]Img, lang string, w, h, rule int) []*Img {
+	imgs := m[lang]
+	rc := make([]*Img, 0, len(imgs))
+	for i := range imgs {
+		if imgMatch(&imgs[i], w, h, rule) {
+			rc = append(rc, &imgs[i])
+		}
+	}
+	return rc
+}
+
+// banditOn: 实验参数creative(bandit/max)优先于creative_bandit的slot开关
+func banditOn(ctx *http_context.Context) bool {
+	switch ctx.ExpParams.Creative {
+	case "bandit":
+		return true
+	case "max":
+		return false
+	}
+	return creative_bandit.Enabled(ctx.SlotId)
+}
+
+// chooseCreative 在slot开启creative_bandit时按点击反馈选择创意，
+// 冷启动、只有一个候选或有渲染图时使用原规则(getMatchedCreative)；展示由tracking上报，这里只登记下发的创意
+func (raw *RawAdObj) chooseCreative(ctx *http_context.Context, w, h int) *Img {
+	fallback := raw.getMatchedCreative(ctx.Lang, w, h, ctx.ImgRule)
+	if !banditOn(ctx) || raw.RenderImgs != nil {
+		return fallback
+	}
+
+	k := creative_bandit.Key{
+		Offer:  raw.UniqId,
+		Format: creative_bandit.FormatOf(ctx.SlotId),
+		Size:   fmt.Sprintf("%dx%d", w, h),
+	}
+	imgs := GetMatchedImgs(raw.Creatives, ctx.Lang, w, h, ctx.ImgRule)
+	if len(imgs) == 0 && ctx.Lang != "ALL" {
+		imgs = GetMatchedImgs(raw.Creatives, "ALL", w, h, ctx.ImgRule)
+	}
+
+	ids := make([]string, 0, len(imgs))
+	for _, im := range imgs {
+		ids = append(ids, im.Id)
+	}
+	fallbackId := ""
+	if fallback != nil {
+		fallbackId = fallback.Id
+	}
+	if id := creative_bandit.Pick(k, ids, fallbackId); id != fallbackId {
+		for _, im := range imgs {
+			if im.Id == id {
+				return im
+			}
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,98 @@
+package raw_ad
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"creative_bandit"
+	"experiment"
+	"http_context"
+)
+
+func TestGetMatchedImgs(t *testing.T) {
+	m := map[string][]Img{
+		"ALL": {
+			{Id: "a", Width: 600, Height: 500},
+			{Id: "b", Width: 1200, Height: 1000},
+			{Id: "c", Width: 320, Height: 50},
+		},
+	}
+	if imgs := GetMatchedImgs(m, "ALL", 300, 250, -1); len(imgs) != 2 || imgs[0].Id != "a" || imgs[1].Id != "b" {
+		t.Errorf("unexpected matched images: %v", imgs)
+	}
+	if imgs := GetMatchedImgs(m, "EN", 300, 250, -1); len(imgs) != 0 {
+		t.Errorf("unexpected matched images: %v", imgs)
+	}
+}
+
+// trackImp reports impressions of creative, "ok" means the creative was registered by chooseCreative
+func trackImp(offer, size, creative, n string) string {
+	r := httptest.NewRequest("GET", "/creative/track?event=imp&offer="+offer+"&format=0&size="+size+"&creative_id="+creative+"&n="+n, nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	creative_bandit.TrackHandler(w, r)
+	return w.Body.String()
+}
+
+func TestChooseCreative(t *testing.T) {
+	creative_bandit.Reload(&creative_bandit.Conf{Slots: []string{"335"}, MinImps: 5})
+	defer creative_bandit.Reload(&creative_bandit.Conf{})
+
+	raw := NewRawAdObj()
+	raw.UniqId = "nym_" + strconv.FormatInt(time.Now().UnixNano(), 10) // 默认bandit是全局的，每次运行用新的offer
+	raw.Creatives = map[string][]Img{
+		"ALL": {
+			{Id: "a", Width: 600, Height: 500},
+			{Id: "b", Width: 1200, Height: 1000},
+		},
+	}
+
+	ctx := &http_context.Context{SlotId: "415", Lang: "EN", ImgRule: -1}
+	if img := raw.chooseCreative(ctx, 300, 250); img == nil || img.Id != "b" {
+		t.Errorf("slot without bandit should choose max image, got %v", img)
+	}
+	if res := trackImp(raw.UniqId, "300x250", "b", "1"); res != "ignored" {
+		t.Error("slot without bandit should not register creative: ", res)
+	}
+
+	ctx.SlotId = "335"
+	ctx.ExpParams = experiment.Params{Creative: "max"}
+	if img := raw.chooseCreative(ctx, 300, 250); img == nil || img.Id != "b" || trackImp(raw.UniqId, "300x250", "b", "1") != "ignored" {
+		t.Errorf("experiment creative=max should turn bandit off, got %v", img)
+	}
+	ctx.ExpParams = experiment.Params{}
+
+	raw.RenderImgs = map[string]string{"300x250": "http://render/300x250.jpg"}
+	fallback := raw.getMatchedCreative(ctx.Lang, 300, 250, ctx.ImgRule)
+	if img := raw.chooseCreative(ctx, 300, 250); img != fallback || trackImp(raw.UniqId, "300x250", "b", "1") != "ignored" {
+		t.Errorf("render images should bypass bandit, got %v", img)
+	}
+	raw.RenderImgs = nil
+
+	// 冷启动使用原规则，并登记下发的创意
+	if img := raw.chooseCreative(ctx, 300, 250); img == nil || img.Id != "b" {
+		t.Errorf("cold start should choose max image, got %v", img)
+	}
+	if res := trackImp(raw.UniqId, "300x250", "b", "5"); res != "ok" {
+		t.Error("cold start creative should be registered: ", res)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		seen[raw.chooseCreative(ctx, 300, 250).Id] = true
+	}
+	if !seen["a"] {
+		t.Error("bandit should explore creative a after cold start")
+	}
+	if res := trackImp(raw.UniqId, "300x250", "a", "1"); res != "ok" {
+		t.Error("bandit pick should be registered: ", res)
+	}
+
+	ctx.SlotId = "415"
+	ctx.ExpParams = experiment.Params{Creative: "bandit"}
+	if img := raw.chooseCreative(ctx, 600, 500); img == nil || img.Id != "b" || trackImp(raw.UniqId, "600x500", "b", "1") != "ok" {
+		t.Errorf("experiment creative=bandit should turn bandit on, got %v", img)
+	}
+}
@@ -167,6 +167,8 @@ type Video struct {
 	OverseasCDN string `json:"overseas_cdn"`
 	Type        string `json:"type"` // mp4
 	Lang        string `json:"language"`
+	Duration    int    `json:"duration"` // 秒
+	Cover       string `json:"cover"`    // 封面图
 }
 
 type RawAdObj struct {
@@ -201,6 +203,9 @@ type RawAdObj struct {
 	ThirdPartyClkTks []string `json:"third_party_clk_tks"`
 	ThirdPartyImpTks []string `json:"third_party_imp_tks"`
 
+	// 第三方视频播放进度监测, vast event(start, firstQuartile, midpoint, thirdQuartile, complete) -> urls
+	ThirdPartyVideoTks map[string][]string `json:"third_party_video_tks"`
+
 	LandingType     int      `json:"landing_type"`
 	ProductCategory string   `json:"product_category"` // "AppDownload: [GP,Itune,DDL],  Content: [Other]"
 	AppCategory     []string `json:"app_category"`
@@ -293,6 +298,11 @@ func NewRawAdObj() *RawAdObj {
 	}
 }
 
+// 实时api返回的广告，监测链接由上游给出
+func (raw *RawAdObj) IsRealApi() bool {
+	return raw.Channel == "huicheng"
+}
+
 func (raw *RawAdObj) SetLastUrl(url string) {
 	raw.lastUrl = url
 }
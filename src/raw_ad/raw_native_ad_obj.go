@@ -66,7 +66,7 @@ func (raw *RawAdObj) ToNativeAd(ctx *http_context.Context, pos int) *ad.NativeAd
 		} else {
 			core.Icon = ""
 		}
-		if img := raw.getMatchedCreative(ctx.Lang, ctx.ImgW, ctx.ImgH, ctx.ImgRule); img != nil {
+		if img := raw.chooseCreative(ctx, ctx.ImgW, ctx.ImgH); img != nil {
 			core.Image = ctx.CreativeCdnConv(img.Url, img.DomesticCDN)
 			raw.CreativeChosen = img
 		}
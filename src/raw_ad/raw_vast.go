@@ -0,0 +1,60 @@
+package raw_ad
+
+import (
+	"strings"
+
+	"util"
+	"vast_module"
+)
+
+// 将上游vast(展开wrapper后)的视频和监测链接填充到raw中
+func (raw *RawAdObj) FillResolvedVast(res *vast_module.ResolvedAd) {
+	typ := strings.TrimPrefix(res.Media.Type, "video/") // MediaFile的type为mime，如video/webm
+	if typ == "" {
+		typ = "mp4"
+	}
+	video := Video{
+		Id:       raw.Channel + "_" + util.ToMd5(res.Media.Url),
+		W:        res.Media.Width,
+		H:        res.Media.Height,
+		Url:      res.Media.Url,
+		Type:     typ,
+		Lang:     "ALL",
+		Duration: res.Duration,
+	}
+	raw.Videos["ALL"] = append(raw.Videos["ALL"], video)
+
+	// companion图片作为封面，没有其它图片时也作为icon
+	if res.Cover != nil {
+		cover := Img{
+			Id:     video.Id + "_cover",
+			Width:  res.Cover.Width,
+			Height: res.Cover.Height,
+			Url:    res.Cover.Url,
+			Lang:   "ALL",
+		}
+		raw.Creatives["ALL"] = append(raw.Creatives["ALL"], cover)
+		if len(raw.Icons["ALL"]) == 0 {
+			raw.Icons["ALL"] = []Img{cover}
+		}
+	}
+
+	if raw.AppDownload.TrackLink == "" {
+		raw.AppDownload.TrackLink = res.ClickThrough
+	}
+	if raw.AppDownload.Title == "" {
+		raw.AppDownload.Title = res.Title
+	}
+	if raw.AppDownload.Desc == "" {
+		raw.AppDownload.Desc = res.Desc
+	}
+
+	raw.ThirdPartyImpTks = append(raw.ThirdPartyImpTks, res.Impressions...)
+	raw.ThirdPartyClkTks = append(raw.ThirdPartyClkTks, res.ClickTrackings...)
+	if len(res.Trackings) > 0 && raw.ThirdPartyVideoTks == nil {
+		raw.ThirdPartyVideoTks = make(map[string][]string, len(res.Trackings))
+	}
+	for event, urls := range res.Trackings {
+		raw.ThirdPartyVideoTks[event] = append(raw.ThirdPartyVideoTks[event], urls...)
+	}
+}
@@ -69,7 +69,7 @@ func (raw *RawAdObj) ToVideoAd(ctx *http_context.Context) *ad.AdObj {
 		bak.Video.W = chosenVideo.W
 		bak.Video.H = chosenVideo.H
 
-		if img := raw.getMatchedCreative(ctx.Lang, ctx.ImgW, ctx.ImgH, ctx.ImgRule); img != nil {
+		if img := raw.chooseCreative(ctx, ctx.ImgW, ctx.ImgH); img != nil {
 			raw.CreativeChosen = img
 			bak.Img = ad.ImgObj{
 				Id:  img.Id,
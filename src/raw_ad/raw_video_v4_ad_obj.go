@@ -55,6 +55,9 @@ func (raw *RawAdObj) ToVideoV4Ad(ctx *http_context.Context) *ad.VideoAdObj {
 
 	// rewarded_video_adobj
 	rc.RewardedVideo.PlayLocal = 1
+	if raw.IsRealApi() { // 实时api的视频不在客户端缓存中，在线播放
+		rc.RewardedVideo.PlayLocal = 0
+	}
 
 	raw.VideoChoseCreatives(ctx)
 
@@ -65,6 +68,7 @@ func (raw *RawAdObj) ToVideoV4Ad(ctx *http_context.Context) *ad.VideoAdObj {
 		video.Url = ctx.CreativeCdnConv(raw.VideoChosen.Url, raw.VideoChosen.DomesticCDN)
 		video.W = raw.VideoChosen.W
 		video.H = raw.VideoChosen.H
+		video.Duration = raw.VideoChosen.Duration
 
 		img := &rc.RewardedVideo.Img
 		img.Id = raw.ImageChosen.Id
@@ -111,6 +115,13 @@ func (raw *RawAdObj) ToVideoV4Ad(ctx *http_context.Context) *ad.VideoAdObj {
 	}
 
 	rc.ClkTks = util.AppendArgsToMonitors(ctx.PostClkTks, appArgsStr)
+
+	// XXX 实时API，监测
+	if raw.IsRealApi() {
+		rc.ImpTks = append(rc.ImpTks, raw.ThirdPartyImpTks...)
+		rc.ClkTks = append(rc.ClkTks, raw.ThirdPartyClkTks...)
+		rc.VideoTks = raw.ThirdPartyVideoTks
+	}
 	rc.Title = raw.AppDownload.Title
 	rc.Desc = raw.AppDownload.Desc
 	rc.Icon = ctx.CreativeCdnConv(iconChosen.Url, iconChosen.DomesticCDN)
@@ -163,6 +174,7 @@ func (raw *RawAdObj) ToNativeVideoV4Ad(ctx *http_context.Context) *ad.NativeVide
 		rc.Video.Url = ctx.CreativeCdnConv(video.Url, video.DomesticCDN)
 		rc.Video.W = video.W
 		rc.Video.H = video.H
+		rc.Video.Duration = video.Duration
 	} else {
 		return nil
 	}
@@ -219,6 +231,13 @@ func (raw *RawAdObj) ToNativeVideoV4Ad(ctx *http_context.Context) *ad.NativeVide
 
 	rc.ClkTks = util.AppendArgsToMonitors(ctx.PostClkTks, appArgsStr)
 
+	// XXX 实时API，监测
+	if raw.IsRealApi() {
+		rc.ImpTks = append(rc.ImpTks, raw.ThirdPartyImpTks...)
+		rc.ClkTks = append(rc.ClkTks, raw.ThirdPartyClkTks...)
+		rc.VideoTks = raw.ThirdPartyVideoTks
+	}
+
 	vastXmlData := vast_module.NativeV4(rc)
 	if len(vastXmlData) == 0 {
 		ctx.L.Println("vast data empty ", raw.Channel, "_", raw.Id)
@@ -55,7 +55,7 @@ func (raw *RawAdObj) contact(t *ssp.TemplateObj, m map[string]string, ctx *http_
 		if strings.Contains(pos.Key, "{$g_img_") {
 			var w, h int = 1, 1
 			if _, err := fmt.Sscanf(pos.Key, "{$g_img_%dx%d}", &w, &h); err == nil {
-				if creative := raw.getMatchedCreative(ctx.Lang, w, h, ctx.ImgRule); creative != nil {
+				if creative := raw.chooseCreative(ctx, w, h); creative != nil {
 					raw.CreativeChosen = creative
 					res = append(res, pos.Prefix+ctx.CreativeCdnConv(creative.Url, creative.DomesticCDN))
 					continue
@@ -77,7 +77,7 @@ func (raw *RawAdObj) contact(t *ssp.TemplateObj, m map[string]string, ctx *http_
 			creativeReplaced = true
 			var w, h int = 1, 1
 			if _, err := fmt.Sscanf(pos.Key, "{$img_%dx%d}", &w, &h); err == nil {
-				if creative := raw.getMatchedCreative(ctx.Lang, w, h, ctx.ImgRule); creative != nil {
+				if creative := raw.chooseCreative(ctx, w, h); creative != nil {
 					raw.CreativeChosen = creative
 					res = append(res, pos.Prefix+ctx.CreativeCdnConv(creative.Url, creative.DomesticCDN))
 					continue
@@ -115,7 +115,7 @@ func (raw *RawAdObj) ReplaceTpl(t *ssp.TemplateObj, tpl []byte, m map[string]str
 			creativeReplaced = true
 			var w, h int = 1, 1
 			if _, err := fmt.Sscanf(string(b), "{$img_%dx%d}", &w, &h); err == nil {
-				creative := raw.getMatchedCreative(ctx.Lang, w, h, ctx.ImgRule)
+				creative := raw.chooseCreative(ctx, w, h)
 				if creative != nil {
 					raw.CreativeChosen = creative
 					return []byte(ctx.CreativeCdnConv(creative.Url, creative.DomesticCDN))
@@ -126,7 +126,7 @@ func (raw *RawAdObj) ReplaceTpl(t *ssp.TemplateObj, tpl []byte, m map[string]str
 		if bytes.Contains(b, []byte("{$g_img_")) {
 			var w, h int = 1, 1
 			if _, err := fmt.Sscanf(string(b), "{$g_img_%dx%d}", &w, &h); err == nil {
-				creative := raw.getMatchedCreative(ctx.Lang, w, h, ctx.ImgRule)
+				creative := raw.chooseCreative(ctx, w, h)
 				if creative != nil {
 					raw.CreativeChosen = creative
 					return []byte(ctx.CreativeCdnConv(creative.Url, creative.DomesticCDN))
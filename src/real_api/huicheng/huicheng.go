@@ -2,6 +2,7 @@ package huicheng
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net/http"
@@ -14,8 +15,17 @@ import (
 	"github.com/satori/go.uuid"
 
 	"http_context"
+	"metrics"
+	"real_api/sign"
+	"util"
+	"vast_module"
 )
 
+var ErrBelowFloor = errors.New("huicheng price below floor")
+
+// 上游只给vast tag时，展开wrapper链
+var vastResolver = vast_module.NewResolver(5, 500*time.Millisecond)
+
 type Item struct {
 	Action   int        `json:"action"`
 	ImgList  []string   `json:"imglist"`
@@ -25,8 +35,21 @@ type Item struct {
 	Desc     string     `json:"desc"`
 	Trackers []*Tracker `json:"trackers"`
 	Html     string     `json:"html"`
+	Price    float64    `json:"price"` // 出价(eCPM, USD)，未返回时为0
+	Video    *VideoItem `json:"video"` // 视频广告才有
 }
 
+type VideoItem struct {
+	Url      string `json:"url"`
+	Duration int    `json:"duration"` // 秒
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Size     int64  `json:"size"`
+	Cover    string `json:"cover"`    // 封面图
+	VastUrl  string `json:"vast_url"` // 没有url时，视频由vast tag给出
+}
+
+// type: show, click 以及视频播放进度 start, firstQuartile, midpoint, thirdQuartile, complete
 type Tracker struct {
 	Type string   `json:"type"`
 	Urls []string `json:"urls"`
@@ -47,6 +70,23 @@ func (item *Item) ToImg() []raw_ad.Img {
 	return imgs
 }
 
+func (item *Item) ToVideo() *raw_ad.Video {
+	if item.Video == nil || item.Video.Url == "" {
+		return nil
+	}
+	return &raw_ad.Video{
+		Id:       "huicheng_" + util.ToMd5(item.Video.Url),
+		Size:     item.Video.Size,
+		W:        item.Video.Width,
+		H:        item.Video.Height,
+		Url:      item.Video.Url,
+		Type:     "mp4",
+		Lang:     "ALL",
+		Duration: item.Video.Duration,
+		Cover:    item.Video.Cover,
+	}
+}
+
 func (item *Item) ToRawAdObj() (*raw_ad.RawAdObj, error) {
 	raw := raw_ad.NewRawAdObj()
 
@@ -66,19 +106,44 @@ func (item *Item) ToRawAdObj() (*raw_ad.RawAdObj, error) {
 	app.Desc = item.Desc
 	app.Rate = rand.Float32() + 4
 	app.TrackLink = item.ClkUrl
-	if imgs := item.ToImg(); len(imgs) != 0 {
+	imgs := item.ToImg()
+	if video := item.ToVideo(); video != nil {
+		raw.Videos["ALL"] = []raw_ad.Video{*video}
+		if video.Cover != "" {
+			cover := raw_ad.Img{
+				Id:     video.Id + "_cover",
+				Width:  video.W,
+				Height: video.H,
+				Url:    video.Cover,
+				Lang:   "ALL",
+			}
+			raw.Creatives["ALL"] = append(raw.Creatives["ALL"], cover)
+			if len(imgs) == 0 {
+				raw.Icons["ALL"] = []raw_ad.Img{cover}
+			}
+		}
+	}
+	if len(imgs) != 0 {
 		raw.Icons["ALL"] = imgs
-		raw.Creatives["ALL"] = imgs
-	} else {
+		raw.Creatives["ALL"] = append(raw.Creatives["ALL"], imgs...)
+	}
+	// 只有vast_url的视频广告可以没有图片，视频在请求时解析
+	if len(raw.Creatives["ALL"]) == 0 && (item.Video == nil || item.Video.VastUrl == "") {
 		return nil, fmt.Errorf("huicheng offer no imgs")
 	}
 	raw.ContentType = 2 // 2：下载类
 
 	for _, track := range item.Trackers {
-		if track.Type == "show" {
-			raw.ThirdPartyImpTks = append(raw.ThirdPartyClkTks, track.Urls...)
-		} else if track.Type == "click" {
+		switch track.Type {
+		case "show":
+			raw.ThirdPartyImpTks = append(raw.ThirdPartyImpTks, track.Urls...)
+		case "click":
 			raw.ThirdPartyClkTks = append(raw.ThirdPartyClkTks, track.Urls...)
+		case "start", "firstQuartile", "midpoint", "thirdQuartile", "complete":
+			if raw.ThirdPartyVideoTks == nil {
+				raw.ThirdPartyVideoTks = make(map[string][]string)
+			}
+			raw.ThirdPartyVideoTks[track.Type] = append(raw.ThirdPartyVideoTks[track.Type], track.Urls...)
 		}
 	}
 
@@ -86,10 +151,26 @@ func (item *Item) ToRawAdObj() (*raw_ad.RawAdObj, error) {
 }
 
 // TODO 考虑使用链接池节省消耗
-func Request(api string, timeout int, ctx *http_context.Context) (*raw_ad.RawAdObj, error) {
+// floor: slot底价(eCPM, USD)，0表示不限制; signer为nil时不签名
+func Request(api string, timeout int, floor float64, signer *sign.Signer, ctx *http_context.Context) (*raw_ad.RawAdObj, error) {
 	// 只要1：1
 	ctx.ImgW, ctx.ImgH = 100, 100
+	return request(api, timeout, floor, signer, ctx, false)
+}
 
+// RequestVideo requests a video ad, size of video is decided by ctx.ImgW and ctx.ImgH
+func RequestVideo(api string, timeout int, floor float64, signer *sign.Signer, ctx *http_context.Context) (*raw_ad.RawAdObj, error) {
+	raw, err := request(api, timeout, floor, signer, ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw.Videos["ALL"]) == 0 {
+		return nil, fmt.Errorf("huicheng offer no video")
+	}
+	return raw, nil
+}
+
+func request(api string, timeout int, floor float64, signer *sign.Signer, ctx *http_context.Context, video bool) (*raw_ad.RawAdObj, error) {
 	now := time.Now()
 	params := make([]string, 0, 16)
 	params = append(params, fmt.Sprintf("bid=%s", uuid.Must(uuid.NewV4())))
@@ -122,21 +203,33 @@ func Request(api string, timeout int, ctx *http_context.Context) (*raw_ad.RawAdO
 		params = append(params, "nt=4G")
 	}
 	params = append(params, "opt="+ctx.Params("cn"))
+	if floor > 0 {
+		params = append(params, fmt.Sprintf("bidfloor=%.4f", floor))
+	}
+	if video {
+		params = append(params, "adtype=video")
+	}
 
 	uri := api + strings.Join(params, "&")
 	req, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
 		return nil, err
 	}
+	if signer != nil {
+		signer.Sign(req)
+	}
 
 	client := &http.Client{
 		Timeout: time.Duration(timeout) * time.Millisecond,
 	}
 
-	resp, err := client.Do(req)
+	start := time.Now()
+	resp, err := client.Do(req.WithContext(ctx.StdContext())) // 受请求deadline约束
+	metrics.ObserveUpstream("huicheng", start, err)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("no huicheng offer")
@@ -147,5 +240,24 @@ func Request(api string, timeout int, ctx *http_context.Context) (*raw_ad.RawAdO
 		return nil, err
 	}
 
-	return item.ToRawAdObj()
+	if floor > 0 && item.Price > 0 && item.Price < floor {
+		return nil, ErrBelowFloor
+	}
+
+	raw, err := item.ToRawAdObj()
+	if err != nil {
+		return nil, err
+	}
+
+	if video && len(raw.Videos["ALL"]) == 0 && item.Video != nil && item.Video.VastUrl != "" {
+		res, err := vastResolver.ResolveUrlContext(ctx.StdContext(), item.Video.VastUrl)
+		if err != nil {
+			return nil, err
+		}
+		raw.FillResolvedVast(res)
+	}
+	if !video && len(raw.Creatives["ALL"]) == 0 {
+		return nil, fmt.Errorf("huicheng offer no imgs")
+	}
+	return raw, nil
 }
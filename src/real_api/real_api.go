@@ -1,32 +1,145 @@
 package real_api
 
 import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+
 	"http_context"
 	"raw_ad"
 	"real_api/huicheng"
+	"real_api/sign"
 )
 
 type Conf struct {
-	HuichengApi string `json:"huicheng_api"`
+	SecretsPath string `json:"secrets_path"` // 实时api的secret文件，不要把key写在offer.conf中
+
+	HuichengApi  string     `json:"huicheng_api"` // ${secret:ref}占位由config展开
+	HuichengSign *sign.Conf `json:"huicheng_sign"`
+
+	EnableVideo bool `json:"enable_video"` // 视频广告位在索引offer不足时是否请求实时api
 }
 
 type RealApi struct {
 	conf *Conf
+
+	huichengApi    string
+	huichengSigner *sign.Signer
 }
 
-var global *RealApi
+var (
+	global unsafe.Pointer // *RealApi, SIGHUP时可重新加载
+
+	floorFilted int64 // 因低于slot底价被丢弃的广告数
+)
+
+var ErrDeadline = errors.New("real_api: request deadline exceeded")
+
+// ErrNoAdapter is returned when huicheng_api is not configured
+var ErrNoAdapter = errors.New("real_api: no adapter configured")
 
 func Init(conf *Conf) {
-	global = &RealApi{
-		conf: conf,
+	api, err := newRealApi(conf)
+	if err != nil {
+		panic(err)
 	}
+	atomic.StorePointer(&global, unsafe.Pointer(api))
+}
 
+// Reload re-reads secrets and rebuilds signers, current conf is kept on error
+func Reload(conf *Conf) error {
+	api, err := newRealApi(conf)
+	if err != nil {
+		return err
+	}
+	atomic.StorePointer(&global, unsafe.Pointer(api))
+	return nil
+}
+
+// Validate checks conf by building a RealApi without replacing current one, huicheng_api is optional
+func Validate(conf *Conf) error {
+	_, err := newRealApi(conf)
+	return err
+}
+
+func load() *RealApi {
+	return (*RealApi)(atomic.LoadPointer(&global))
+}
+
+func newRealApi(conf *Conf) (*RealApi, error) {
+	if conf.SecretsPath != "" {
+		if err := sign.LoadSecrets(conf.SecretsPath); err != nil {
+			return nil, err
+		}
+	}
+
+	var signer *sign.Signer
+	if conf.HuichengSign != nil {
+		var err error
+		if signer, err = sign.NewSigner(conf.HuichengSign); err != nil {
+			return nil, err
+		}
+	}
+
+	return &RealApi{
+		conf:           conf,
+		huichengApi:    conf.HuichengApi,
+		huichengSigner: signer,
+	}, nil
+}
+
+// Check returns error if real_api is not initialized, it is ok without any adapter (real-time ads disabled)
+func Check() error {
+	if load() == nil {
+		return errors.New("real_api not initialized")
+	}
+	return nil
 }
 
 func Request(ctx *http_context.Context) (*raw_ad.RawAdObj, error) {
-	return global.request(ctx)
+	return load().request(ctx)
+}
+
+func VideoEnabled() bool {
+	api := load()
+	return api != nil && api.huichengApi != "" && api.conf.EnableVideo
+}
+
+// RequestVideo requests a real-time video ad, it is used when indexed video offers are exhausted
+func RequestVideo(ctx *http_context.Context) (*raw_ad.RawAdObj, error) {
+	if !VideoEnabled() {
+		return nil, fmt.Errorf("real_api video disabled")
+	}
+	return load().requestVideo(ctx)
+}
+
+// FloorFilted returns the number of real-time ads dropped by slot floor price
+func FloorFilted() int64 {
+	return atomic.LoadInt64(&floorFilted)
 }
 
 func (s *RealApi) request(ctx *http_context.Context) (*raw_ad.RawAdObj, error) {
-	return huicheng.Request(s.conf.HuichengApi, 1000, ctx)
+	if s.huichengApi == "" {
+		return nil, ErrNoAdapter
+	}
+	if ctx.Expired() {
+		return nil, ErrDeadline
+	}
+	raw, err := huicheng.Request(s.huichengApi, 1000, ctx.FloorPrice(), s.huichengSigner, ctx)
+	if err == huicheng.ErrBelowFloor {
+		atomic.AddInt64(&floorFilted, 1)
+	}
+	return raw, err
+}
+
+func (s *RealApi) requestVideo(ctx *http_context.Context) (*raw_ad.RawAdObj, error) {
+	if ctx.Expired() {
+		return nil, ErrDeadline
+	}
+	raw, err := huicheng.RequestVideo(s.huichengApi, 1000, ctx.FloorPrice(), s.huichengSigner, ctx)
+	if err == huicheng.ErrBelowFloor {
+		atomic.AddInt64(&floorFilted, 1)
+	}
+	return raw, err
 }
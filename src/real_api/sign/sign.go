@@ -0,0 +1,264 @@
+package sign
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// 实时api的签名配置，secret不写在offer.conf中，只写引用:
+// "env:HUICHENG_SECRET"从环境变量读取, "huicheng"从secrets文件读取(json: {"huicheng": "xxx"})
+type Conf struct {
+	Method    string `json:"method"`     // hmac-sha1, hmac-sha256, md5
+	Placement string `json:"placement"`  // query(默认), header
+	SecretRef string `json:"secret_ref"` // secret引用
+
+	SignKey  string `json:"sign_key"`  // 签名参数名/header名，默认 sign / X-Sign
+	TsKey    string `json:"ts_key"`    // 时间戳参数名/header名，默认 timestamp / X-Timestamp
+	NonceKey string `json:"nonce_key"` // 随机串参数名/header名，默认 nonce / X-Nonce
+}
+
+var (
+	secretsLock sync.RWMutex
+	secrets     map[string]string
+
+	placeholderReg = regexp.MustCompile(`\$\{secret:([^}]+)\}`)
+)
+
+// LoadSecrets loads json secrets file, eg: {"huicheng": "xxx", "offer_api_token": "yyy"}
+func LoadSecrets(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m := make(map[string]string)
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return fmt.Errorf("decode secrets file %s err: %v", path, err)
+	}
+
+	secretsLock.Lock()
+	secrets = m
+	secretsLock.Unlock()
+	return nil
+}
+
+// GetSecret resolves a secret reference: "env:NAME" or a key of secrets file
+func GetSecret(ref string) (string, error) {
+	if strings.HasPrefix(ref, "env:") {
+		name := ref[len("env:"):]
+		if v := os.Getenv(name); v != "" {
+			return v, nil
+		}
+		return "", fmt.Errorf("secret env %s not set", name)
+	}
+
+	secretsLock.RLock()
+	defer secretsLock.RUnlock()
+	if v, ok := secrets[ref]; ok && v != "" {
+		return v, nil
+	}
+	return "", fmt.Errorf("secret %s not found", ref)
+}
+
+// Expand replaces ${secret:ref} in conf strings (such as api urls) with secret values
+func Expand(s string) (string, error) {
+	var expandErr error
+	res := placeholderReg.ReplaceAllStringFunc(s, func(m string) string {
+		ref := placeholderReg.FindStringSubmatch(m)[1]
+		v, err := GetSecret(ref)
+		if err != nil {
+			expandErr = err
+			return m
+		}
+		return v
+	})
+	return res, expandErr
+}
+
+// ExpandAll expands ${secret:ref} in every string of v (pointer to a conf struct, nested structs, pointers,
+// slices and string maps included), it is the one place where secrets of offer.conf are resolved.
+// Each error is prefixed with the json path of the field, such as "real_api_conf.huicheng_api"
+func ExpandAll(v interface{}) []error {
+	var errs []error
+	expandValue(reflect.ValueOf(v), "", &errs)
+	return errs
+}
+
+func expandValue(v reflect.Value, path string, errs *[]error) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			expandValue(v.Elem(), path, errs)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			if sf.PkgPath != "" {
+				continue // unexported
+			}
+			name := strings.Split(sf.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = sf.Name
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			expandValue(v.Field(i), name, errs)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			expandValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			for _, k := range v.MapKeys() {
+				expandValue(v.MapIndex(k), fmt.Sprintf("%s[%v]", path, k), errs)
+			}
+			return
+		}
+		for _, k := range v.MapKeys() {
+			s, err := Expand(v.MapIndex(k).String())
+			if err != nil {
+				*errs = append(*errs, fmt.Errorf("%s[%v]: %v", path, k, err))
+				continue
+			}
+			v.SetMapIndex(k, reflect.ValueOf(s).Convert(v.Type().Elem()))
+		}
+	case reflect.String:
+		s, err := Expand(v.String())
+		if err != nil {
+			*errs = append(*errs, fmt.Errorf("%s: %v", path, err))
+			return
+		}
+		if v.CanSet() {
+			v.SetString(s)
+		}
+	}
+}
+
+type Signer struct {
+	conf   Conf
+	secret []byte
+	newMac func() hash.Hash
+}
+
+func NewSigner(conf *Conf) (*Signer, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("sign conf nil")
+	}
+
+	secret, err := GetSecret(conf.SecretRef)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Signer{
+		conf:   *conf,
+		secret: []byte(secret),
+	}
+
+	switch strings.ToLower(s.conf.Method) {
+	case "hmac-sha1":
+		s.newMac = func() hash.Hash { return hmac.New(sha1.New, s.secret) }
+	case "hmac-sha256":
+		s.newMac = func() hash.Hash { return hmac.New(sha256.New, s.secret) }
+	case "md5":
+		s.newMac = nil // md5(canonical + secret)
+	default:
+		return nil, fmt.Errorf("unsupported sign method: %s", s.conf.Method)
+	}
+
+	switch s.conf.Placement {
+	case "", "query":
+		s.conf.Placement = "query"
+		setDefault(&s.conf.SignKey, "sign")
+		setDefault(&s.conf.TsKey, "timestamp")
+		setDefault(&s.conf.NonceKey, "nonce")
+	case "header":
+		setDefault(&s.conf.SignKey, "X-Sign")
+		setDefault(&s.conf.TsKey, "X-Timestamp")
+		setDefault(&s.conf.NonceKey, "X-Nonce")
+	default:
+		return nil, fmt.Errorf("unsupported sign placement: %s", s.conf.Placement)
+	}
+
+	return s, nil
+}
+
+func setDefault(s *string, v string) {
+	if *s == "" {
+		*s = v
+	}
+}
+
+// Sign adds timestamp, nonce and signature to req.
+// 签名串: 按key排序的query参数(含timestamp和nonce) "k1=v1&k2=v2..."
+func (s *Signer) Sign(req *http.Request) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := strings.Replace(uuid.Must(uuid.NewV4()).String(), "-", "", -1)
+
+	query := req.URL.Query()
+	query.Set(s.conf.TsKey, ts)
+	query.Set(s.conf.NonceKey, nonce)
+
+	sign := s.Sum(canonical(query))
+
+	if s.conf.Placement == "header" {
+		req.Header.Set(s.conf.TsKey, ts)
+		req.Header.Set(s.conf.NonceKey, nonce)
+		req.Header.Set(s.conf.SignKey, sign)
+		return
+	}
+
+	query.Set(s.conf.SignKey, sign)
+	req.URL.RawQuery = query.Encode()
+}
+
+// Sum returns hex signature of canonical string
+func (s *Signer) Sum(canonical string) string {
+	if s.newMac == nil {
+		b := md5.Sum([]byte(canonical + string(s.secret)))
+		return hex.EncodeToString(b[:])
+	}
+	mac := s.newMac()
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func canonical(query map[string][]string) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, k+"="+v)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,123 @@
+package sign
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGetSecret(t *testing.T) {
+	os.Setenv("SIGN_TEST_SECRET", "abc")
+	if v, err := GetSecret("env:SIGN_TEST_SECRET"); err != nil || v != "abc" {
+		t.Error("env secret: ", v, ", err: ", err)
+	}
+	if _, err := GetSecret("env:SIGN_TEST_NOT_EXIST"); err == nil {
+		t.Error("missing env secret should return error")
+	}
+
+	secrets = map[string]string{"token": "t0k3n"}
+	s, err := Expand("http://127.0.0.1/api?t=${secret:token}&page=%d")
+	if err != nil || s != "http://127.0.0.1/api?t=t0k3n&page=%d" {
+		t.Error("expand: ", s, ", err: ", err)
+	}
+	if _, err := Expand("http://127.0.0.1/api?t=${secret:none}"); err == nil {
+		t.Error("expand missing secret should return error")
+	}
+}
+
+func TestExpandAll(t *testing.T) {
+	secrets = map[string]string{"token": "t0k3n"}
+	type api struct {
+		Url string `json:"url"`
+	}
+	conf := struct {
+		Api     string            `json:"api"`
+		Apis    []string          `json:"apis"`
+		Nested  *api              `json:"nested"`
+		Items   []api             `json:"items"`
+		Weights map[string]string `json:"weights"`
+		Port    int               `json:"port"`
+		plain   string
+	}{
+		Api:     "http://a?t=${secret:token}",
+		Apis:    []string{"http://b?t=${secret:token}"},
+		Nested:  &api{Url: "http://c?t=${secret:none}"},
+		Items:   []api{{Url: "http://d?token=${secret:token}"}},
+		Weights: map[string]string{"e": "${secret:token}"},
+		plain:   "${secret:token}",
+	}
+
+	errs := ExpandAll(&conf)
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "nested.url: secret none not found") {
+		t.Error("expand errors: ", errs)
+	}
+	if conf.Api != "http://a?t=t0k3n" || conf.Apis[0] != "http://b?t=t0k3n" ||
+		conf.Items[0].Url != "http://d?token=t0k3n" || conf.Weights["e"] != "t0k3n" {
+		t.Errorf("not expanded: %+v", conf)
+	}
+	if conf.plain != "${secret:token}" {
+		t.Error("unexported field should be skipped")
+	}
+}
+
+func TestSignQuery(t *testing.T) {
+	secrets = map[string]string{"key": "secret"}
+	methods := []string{"md5", "hmac-sha1", "hmac-sha256"}
+	for _, method := range methods {
+		s, err := NewSigner(&Conf{Method: method, SecretRef: "key"})
+		if err != nil {
+			t.Fatal(method, " new signer err: ", err)
+		}
+
+		req, _ := http.NewRequest("GET", "http://127.0.0.1/ad?b=2&a=1", nil)
+		s.Sign(req)
+
+		q := req.URL.Query()
+		if q.Get("timestamp") == "" || q.Get("nonce") == "" {
+			t.Error(method, " missing timestamp or nonce: ", req.URL.RawQuery)
+		}
+		sign := q.Get("sign")
+		q.Del("sign")
+		if expect := s.Sum(canonical(q)); sign != expect {
+			t.Error(method, " sign: ", sign, ", expect: ", expect)
+		}
+	}
+}
+
+func TestSignHeader(t *testing.T) {
+	secrets = map[string]string{"key": "secret"}
+	s, err := NewSigner(&Conf{Method: "hmac-sha256", Placement: "header", SecretRef: "key"})
+	if err != nil {
+		t.Fatal("new signer err: ", err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://127.0.0.1/ad?a=1", nil)
+	s.Sign(req)
+
+	if req.URL.RawQuery != "a=1" {
+		t.Error("query should not be changed: ", req.URL.RawQuery)
+	}
+
+	q := req.URL.Query()
+	q.Set("X-Timestamp", req.Header.Get("X-Timestamp"))
+	q.Set("X-Nonce", req.Header.Get("X-Nonce"))
+	if expect := s.Sum(canonical(q)); req.Header.Get("X-Sign") != expect {
+		t.Error("sign: ", req.Header.Get("X-Sign"), ", expect: ", expect)
+	}
+}
+
+func TestNewSignerErr(t *testing.T) {
+	secrets = map[string]string{"key": "secret"}
+	confs := []*Conf{
+		nil,
+		&Conf{Method: "sha512", SecretRef: "key"},
+		&Conf{Method: "md5", Placement: "body", SecretRef: "key"},
+		&Conf{Method: "md5", SecretRef: "none"},
+	}
+	for i, conf := range confs {
+		if _, err := NewSigner(conf); err == nil {
+			t.Error("conf[", i, "] should return error")
+		}
+	}
+}
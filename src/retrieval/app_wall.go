@@ -9,6 +9,7 @@ import (
 
 	"ad"
 	"http_context"
+	"logger"
 	"rank"
 	"raw_ad"
 )
@@ -34,13 +35,14 @@ func (s *Service) appWallHandler(w http.ResponseWriter, r *http.Request) {
 	s.stat.GetNatStat().IncrTot()
 	ctx, err := http_context.NewContext(r, s.l)
 	if err != nil {
-		s.l.Println("appWallHandler new context err: ", err)
+		logger.FromContext(r.Context()).Warn("new context error", logger.Fields{"err": err})
 		if n, err := NewRtvResp("url params error", 42, nil).WriteTo(w); err != nil {
-			s.l.Println("[AppWall] context err resp write: ", n, ", error: ", err)
+			logger.FromContext(r.Context()).Warn("resp write error", logger.Fields{"resp": "context err", "bytes": n, "err": err})
 		}
 		s.stat.GetNatStat().IncrCtxErr()
 		return
 	}
+	defer ctx.Cancel()
 
 	ctx.Estimate("BeginAppWallAd: " + ctx.Platform)
 	defer func() {
@@ -52,7 +54,7 @@ func (s *Service) appWallHandler(w http.ResponseWriter, r *http.Request) {
 	if handler == nil {
 		ctx.Phase = "AppWallDnfLoading"
 		if n, err := NewRtvResp("dnf handler nil", 2, ctx).WriteTo(w); err != nil {
-			s.l.Println("[AppWall] dnf nil resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "dnf nil", "bytes": n, "err": err})
 		}
 		s.stat.GetNatStat().IncrDnfNil()
 		return
@@ -63,7 +65,7 @@ func (s *Service) appWallHandler(w http.ResponseWriter, r *http.Request) {
 	if tpl == nil {
 		ctx.Phase = "AppWallTplNil"
 		if n, err := NewRtvResp("no match tpl", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[AppWall] no match tpl resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no match tpl", "bytes": n, "err": err})
 		}
 		s.stat.GetNatStat().IncrTplNoMatch()
 		return
@@ -72,7 +74,7 @@ func (s *Service) appWallHandler(w http.ResponseWriter, r *http.Request) {
 	if tpl.SlotSwitch == 2 {
 		ctx.Phase = "AppWallTplClosed"
 		if n, err := NewRtvResp("slot closed", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[AppWall] slot closed resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot closed", "bytes": n, "err": err})
 		}
 		s.stat.GetNatStat().IncrTplNoMatch()
 		return
@@ -128,7 +130,7 @@ func (s *Service) appWallHandler(w http.ResponseWriter, r *http.Request) {
 
 	if ndocs == 0 {
 		if n, err := NewRtvResp("No ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[AppWall] no ads resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no ads", "bytes": n, "err": err})
 		}
 		s.stat.GetNatStat().IncrRetrievalFilted()
 		return
@@ -180,7 +182,7 @@ func (s *Service) appWallHandler(w http.ResponseWriter, r *http.Request) {
 	if len(topRaws) == 0 {
 		ctx.Phase = "AppWallRankZero"
 		if n, err := NewRtvResp("No ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[AppWall] rank no ads resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "rank no ads", "bytes": n, "err": err})
 		}
 		s.stat.GetNatStat().IncrRankFilted()
 		return
@@ -213,7 +215,7 @@ func (s *Service) appWallHandler(w http.ResponseWriter, r *http.Request) {
 
 	if len(resp.AdList) > 0 {
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[AppWall] resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"bytes": n, "err": err})
 		}
 		ctx.Estimate("WriteTo")
 		s.stat.GetNatStat().IncrImp()
@@ -222,7 +224,7 @@ func (s *Service) appWallHandler(w http.ResponseWriter, r *http.Request) {
 
 	ctx.Phase = "AppWallZero"
 	if n, err := NewRtvResp("no app wall ad suggestted", 6, ctx).WriteTo(w); err != nil {
-		s.l.Println("[AppWall] no wugan ad resp write: ", n, ", error:", err)
+		ctx.Log.Warn("resp write error", logger.Fields{"resp": "no wugan ad", "bytes": n, "err": err})
 	}
 	s.stat.GetNatStat().IncrWuganFilted()
 	return
@@ -5,7 +5,7 @@ import (
 	"net/http"
 	"strings"
 
-	"aes"
+	"encoder"
 )
 
 type FunnyResp struct {
@@ -59,10 +59,6 @@ func (s *Service) funnyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	b, _ := json.Marshal(resp)
-	if apiVersion != "v1" {
-		b = aes.EncryptBytes(b)
-	}
-
-	w.Write(b)
+	encoder.Encode(w, b, encoder.Options{Aes: apiVersion != "v1"})
 	return
 }
@@ -0,0 +1,112 @@
+package retrieval
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	dnf "github.com/brg-liuwei/godnf"
+
+	"aes"
+	"cache"
+	"real_api"
+	"ssp"
+)
+
+/*
+健康检查：
+	/healthz: 存活检查，进程能处理http请求即返回200
+	/readyz: 就绪检查，索引、slot、redis(cache.Init)、实时api(只检查已初始化，没有配置adapter时不影响)和aes都就绪才返回200，否则503；
+	         shutdown期间也返回503，负载均衡器可以提前摘掉实例
+*/
+
+type checkResult struct {
+	Name   string `json:"name"`
+	Ok     bool   `json:"ok"`
+	Msg    string `json:"msg,omitempty"`
+	CostMs int64  `json:"cost_ms"`
+}
+
+type readyResp struct {
+	Status string         `json:"status"` // ok, fail
+	Checks []*checkResult `json:"checks"`
+}
+
+var readyChecks = []struct {
+	name  string
+	check func() error
+}{
+	{"index", checkIndex},
+	{"slot_store", checkSlotStore},
+	{"redis", func() error { return cache.Ping(50 * time.Millisecond) }},
+	{"real_api", real_api.Check},
+	{"aes", checkAes},
+}
+
+func checkIndex() error {
+	if dnf.GetHandler() == nil {
+		return errors.New("dnf handler nil")
+	}
+	return nil
+}
+
+func checkSlotStore() error {
+	store := ssp.GetGlobalSlotStore()
+	if store == nil {
+		return errors.New("slot store not loaded")
+	}
+	if store.Len() == 0 {
+		return errors.New("slot store empty")
+	}
+	return nil
+}
+
+func checkAes() error {
+	if !aes.Inited() {
+		return errors.New("aes key not initialized")
+	}
+	return nil
+}
+
+func (s *Service) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok","uptime":` +
+		strconv.FormatInt(int64(time.Since(s.startAt).Seconds()), 10) + "}"))
+}
+
+func (s *Service) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	resp := &readyResp{
+		Status: "ok",
+		Checks: make([]*checkResult, 0, len(readyChecks)+1),
+	}
+
+	if atomic.LoadInt32(&s.draining) == 1 {
+		resp.Checks = append(resp.Checks, &checkResult{Name: "draining", Msg: "service is shutting down"})
+	}
+
+	for _, c := range readyChecks {
+		start := time.Now()
+		res := &checkResult{Name: c.name, Ok: true}
+		if err := c.check(); err != nil {
+			res.Ok, res.Msg = false, err.Error()
+		}
+		res.CostMs = int64(time.Since(start) / time.Millisecond)
+		resp.Checks = append(resp.Checks, res)
+	}
+
+	for _, res := range resp.Checks {
+		if !res.Ok {
+			resp.Status = "fail"
+		}
+	}
+
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
@@ -7,6 +7,7 @@ import (
 	dnf "github.com/brg-liuwei/godnf"
 
 	"http_context"
+	"logger"
 	"rank"
 	"raw_ad"
 	"ssp"
@@ -15,17 +16,18 @@ import (
 func (s *Service) interstitialHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, err := http_context.NewContext(r, s.l)
 	if err != nil {
-		s.l.Println("interstitialHandler new context err: ", err)
+		logger.FromContext(r.Context()).Warn("new context error", logger.Fields{"err": err})
 		if n, err := NewRtvResp(err.Error(), 42, nil).WriteTo(w); err != nil {
-			s.l.Println("[interstitial] context resp write: ", n, ", error: ", err)
+			logger.FromContext(r.Context()).Warn("resp write error", logger.Fields{"resp": "context err", "bytes": n, "err": err})
 		}
 		return
 	}
+	defer ctx.Cancel()
 
 	handler := dnf.GetHandler()
 	if handler == nil {
 		if n, err := NewRtvResp("dnf handler nil", 2, ctx).WriteTo(w); err != nil {
-			s.l.Println("[interstitial] dnf nil resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "dnf nil", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -33,14 +35,14 @@ func (s *Service) interstitialHandler(w http.ResponseWriter, r *http.Request) {
 	tpl := s.getTpl(ctx.SlotId)
 	if tpl == nil {
 		if n, err := NewRtvResp("no match tpl", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[interstitial] tpl resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no match tpl", "bytes": n, "err": err})
 		}
 		return
 	}
 
 	if tpl.SlotSwitch == 2 {
 		if n, err := NewRtvResp("slot closed", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[interstitial] slot closed resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot closed", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -48,7 +50,7 @@ func (s *Service) interstitialHandler(w http.ResponseWriter, r *http.Request) {
 	// 插屏
 	if !tpl.MatchSspFormat(9) && !tpl.MatchSspFormat(1) {
 		if n, err := NewRtvResp("not interstitial slot", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[interstitial] not interstitial slot resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "not interstitial slot", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -56,19 +58,19 @@ func (s *Service) interstitialHandler(w http.ResponseWriter, r *http.Request) {
 
 	if rand.Float64() > tpl.ImpressionRate {
 		if n, err := NewRtvResp("no match ad", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[interstitial] slot improssion rate control resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot impression rate control", "bytes": n, "err": err})
 		}
 		return
 	}
 
 	if err := ctx.GetFreq(); err != nil {
-		s.l.Println("[interstitial] get frequency error: ", err)
+		ctx.Log.Error("get freq error", logger.Fields{"err": err})
 	}
 
 	// 单用户频控
 	if !ctx.UserFreqCap(10) {
 		if n, err := NewRtvResp("no ads, user cap", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[interstitial] reach user cap resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "reach user cap", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -96,7 +98,7 @@ func (s *Service) interstitialHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	if len(tpls) == 0 {
 		if n, err := NewRtvResp("no tpl selected", 6, ctx).WriteTo(w); err != nil {
-			s.l.Println("[interstitial] no tpl selected resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no tpl selected", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -142,7 +144,7 @@ func (s *Service) interstitialHandler(w http.ResponseWriter, r *http.Request) {
 	ndocs := len(docs)
 	if ndocs == 0 {
 		if n, err := NewRtvResp("no ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[interstitial] no ads, resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no ads", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -160,7 +162,7 @@ func (s *Service) interstitialHandler(w http.ResponseWriter, r *http.Request) {
 	raws := rank.RandCopy(rawList, ctx, 1)
 	if len(raws) == 0 {
 		if n, err := NewRtvResp("No rank ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[interstitial] no rank ads, resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no rank ads", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -176,13 +178,13 @@ func (s *Service) interstitialHandler(w http.ResponseWriter, r *http.Request) {
 
 	if len(resp.AdList) > 0 {
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[interstitial] resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"bytes": n, "err": err})
 		}
 		return
 	}
 
 	if n, err := NewRtvResp("no ad suggesteed", 6, ctx).WriteTo(w); err != nil {
-		s.l.Println("[interstitial] no interstitial ad resp write: ", n, ", error: ", err)
+		ctx.Log.Warn("resp write error", logger.Fields{"resp": "no interstitial ad", "bytes": n, "err": err})
 	}
 	return
 }
@@ -7,6 +7,7 @@ import (
 	dnf "github.com/brg-liuwei/godnf"
 
 	"http_context"
+	"logger"
 )
 
 var touTiaoOfferPkgs = []string{"517166184", "529092160", "1086047750", "1142110895", "11334496215"}
@@ -27,14 +28,15 @@ func (s *Service) jstagHandler(w http.ResponseWriter, r *http.Request) {
 
 	ctx, err := http_context.NewContext(r, s.l)
 	if err != nil {
-		s.l.Println("jstagHandler new context err: ", err)
+		logger.FromContext(r.Context()).Warn("new context error", logger.Fields{"err": err})
 		resp := NewRtvResp("url parameters error", 42, nil)
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[jstag] context err resp write: ", n, ", error:", err)
+			logger.FromContext(r.Context()).Warn("resp write error", logger.Fields{"resp": "context err", "bytes": n, "err": err})
 		}
 		s.stat.GetJstagStat().IncrCtxErr()
 		return
 	}
+	defer ctx.Cancel()
 
 	ctx.Estimate("BeginJstagAd: " + ctx.Platform)
 	defer func() {
@@ -47,7 +49,7 @@ func (s *Service) jstagHandler(w http.ResponseWriter, r *http.Request) {
 	if tpl == nil {
 		ctx.Phase = "JstagTplNil"
 		if n, err := NewRtvResp("tpl empty", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[jstag] no match tpl resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no match tpl", "bytes": n, "err": err})
 		}
 		s.stat.GetJstagStat().IncrTplNoMatch()
 		return
@@ -57,7 +59,7 @@ func (s *Service) jstagHandler(w http.ResponseWriter, r *http.Request) {
 		// slot switch 2: closed
 		ctx.Phase = "JstagTplClosed"
 		if n, err := NewRtvResp("slot closed", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[jstag] slot closed resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot closed", "bytes": n, "err": err})
 		}
 		s.stat.GetJstagStat().IncrTplNoMatch()
 		return
@@ -68,7 +70,7 @@ func (s *Service) jstagHandler(w http.ResponseWriter, r *http.Request) {
 		resp := NewRtvResp("dnf_handler nil", 2, ctx)
 		resp.CK = ctx.Ck
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[jstag] dnf nil resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "dnf nil", "bytes": n, "err": err})
 		}
 		s.stat.GetJstagStat().IncrDnfNil()
 		return
@@ -76,7 +78,7 @@ func (s *Service) jstagHandler(w http.ResponseWriter, r *http.Request) {
 
 	if !tpl.SlotImpInCap(tpl.MaxImpression) {
 		if n, err := NewRtvResp("slot reach impression cap", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[Jstag] slot reach impression cap resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot reach impression cap", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -93,7 +95,7 @@ func (s *Service) jstagHandler(w http.ResponseWriter, r *http.Request) {
 		resp := NewRtvResp("No ads (fy zero)", 1, ctx)
 		resp.CK = ctx.Ck
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[Jstag] no ads resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no ads", "bytes": n, "err": err})
 		}
 		ctx.Phase = "JstagNoAds"
 		s.stat.GetJstagStat().IncrRetrievalFilted()
@@ -120,7 +122,7 @@ func (s *Service) jstagHandler(w http.ResponseWriter, r *http.Request) {
 
 	if len(resp.AdList) > 0 {
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[jstag] resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"bytes": n, "err": err})
 		}
 		ctx.Estimate("WriteTo")
 		s.stat.GetJstagStat().IncrImp()
@@ -131,7 +133,7 @@ func (s *Service) jstagHandler(w http.ResponseWriter, r *http.Request) {
 	resp = NewRtvResp("no jstag ad suggestted", 6, ctx)
 	resp.CK = ctx.Ck
 	if n, err := resp.WriteTo(w); err != nil {
-		s.l.Println("[jstag] no wugan ad resp write: ", n, ", error:", err)
+		ctx.Log.Warn("resp write error", logger.Fields{"resp": "no wugan ad", "bytes": n, "err": err})
 	}
 	s.stat.GetJstagStat().IncrWuganFilted()
 	return
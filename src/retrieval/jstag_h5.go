@@ -9,6 +9,7 @@ import (
 
 	"ad"
 	"http_context"
+	"logger"
 	"raw_ad"
 	"ssp"
 	"util"
@@ -62,7 +63,7 @@ func (s *Service) getIntegralWallDocs(ctx *http_context.Context,
 	ctx.Estimate("GetTpl: " + ctx.SlotId)
 	if tpl == nil {
 		ctx.Phase = "JstagH5WallTplNil"
-		s.l.Println("[JstagH5] Wall, no match tpl, slotId: ", ctx.SlotId)
+		ctx.Log.Debug("integral wall no match tpl", nil)
 		s.stat.GetJstagH5Stat().IncrTplNoMatch()
 		return
 	}
@@ -70,7 +71,7 @@ func (s *Service) getIntegralWallDocs(ctx *http_context.Context,
 	if tpl.SlotSwitch == 2 {
 		// slot switch 2: closed
 		ctx.Phase = "JstagH5WallTplClosed"
-		s.l.Println("[JstagH5] Wall, slot closed, SlotId: ", ctx.SlotId)
+		ctx.Log.Debug("integral wall slot closed", nil)
 		s.stat.GetJstagH5Stat().IncrTplNoMatch()
 		return
 	}
@@ -101,7 +102,7 @@ func (s *Service) getPicDocs(ctx *http_context.Context,
 	ctx.Estimate("GetTpl: " + ctx.SlotId)
 	if tpl == nil {
 		ctx.Phase = "JstagH5TplNil"
-		s.l.Println("[JstagH5] no match tpl, slotId: ", ctx.SlotId)
+		ctx.Log.Debug("no match tpl", nil)
 		s.stat.GetJstagH5Stat().IncrTplNoMatch()
 		return
 	}
@@ -109,13 +110,13 @@ func (s *Service) getPicDocs(ctx *http_context.Context,
 	if tpl.SlotSwitch == 2 {
 		// slot switch 2: closed
 		ctx.Phase = "JstagH5TplClosed"
-		s.l.Println("[JstagH5] slot closed, slotid: ", ctx.SlotId)
+		ctx.Log.Debug("slot closed", nil)
 		s.stat.GetJstagH5Stat().IncrTplNoMatch()
 		return
 	}
 
 	if !tpl.SlotImpInCap(tpl.MaxImpression) {
-		s.l.Println("[JstagH5] slot reach impression cap, slotid: ", ctx.SlotId)
+		ctx.Log.Debug("slot reach impression cap", nil)
 		return
 	}
 
@@ -162,7 +163,7 @@ func (s *Service) getOnePicAd(ctx *http_context.Context,
 	handler *dnf.Handler, conds []dnf.Cond) *ad.NativeAdObj {
 
 	if ctx.ImgW*ctx.ImgH == 0 {
-		s.l.Println("[JstagH5] missing imgw or imgh, use 950x500 format")
+		ctx.Log.Debug("missing imgw or imgh, use 950x500", nil)
 		ctx.ImgW = 950
 		ctx.ImgH = 500
 	}
@@ -171,7 +172,7 @@ func (s *Service) getOnePicAd(ctx *http_context.Context,
 	ndocs := len(docs)
 	if ndocs == 0 {
 		ctx.Phase = "JstagH5AdsNoPics"
-		s.l.Println("[jstag_h5] ads no pics, SlotId: ", ctx.SlotId, " imgw: ", ctx.ImgW, " imgh: ", ctx.ImgH)
+		ctx.Log.Debug("ads no pics", logger.Fields{"imgw": ctx.ImgW, "imgh": ctx.ImgH})
 		return nil
 	}
 
@@ -200,7 +201,7 @@ func (s Service) getIntegralWallAds(ctx *http_context.Context,
 	ndocs := len(docs)
 	if ndocs == 0 {
 		ctx.Phase = "JstagH5AdsNoPics"
-		s.l.Println("[jstag_h5] ads no pics, slotid: ", ctx.SlotId)
+		ctx.Log.Debug("ads no pics", nil)
 		return nil
 	}
 
@@ -232,14 +233,15 @@ func (s *Service) jstagH5Handler(w http.ResponseWriter, r *http.Request) {
 
 	ctx, err := http_context.NewContext(r, s.l)
 	if err != nil {
-		s.l.Println("jstagH5Handler new context err: ", err)
+		logger.FromContext(r.Context()).Warn("new context error", logger.Fields{"err": err})
 		resp := NewRtvResp("url parameters error", 42, nil)
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[jstag_h5] context err resp write: ", n, ", error:", err)
+			logger.FromContext(r.Context()).Warn("resp write error", logger.Fields{"resp": "context err", "bytes": n, "err": err})
 		}
 		s.stat.GetJstagH5Stat().IncrCtxErr()
 		return
 	}
+	defer ctx.Cancel()
 
 	ctx.Estimate("BeginJstagH5Ad: " + ctx.Platform)
 	defer func() {
@@ -252,7 +254,7 @@ func (s *Service) jstagH5Handler(w http.ResponseWriter, r *http.Request) {
 		ctx.Phase = "JstagH5DnfLoading"
 		resp := NewRtvResp("dnf_handler nil", 2, ctx)
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[jstag_h5] dnf nil resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "dnf nil", "bytes": n, "err": err})
 		}
 		s.stat.GetJstagH5Stat().IncrDnfNil()
 		return
@@ -268,7 +270,7 @@ func (s *Service) jstagH5Handler(w http.ResponseWriter, r *http.Request) {
 	if picAd == nil {
 		resp := NewRtvResp("No pic ads", 1, ctx)
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[JstagH5] no pic ads resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no pic ads", "bytes": n, "err": err})
 		}
 		ctx.Phase = "JstagH5NoPicAds"
 		s.stat.GetJstagH5Stat().IncrRetrievalFilted()
@@ -279,7 +281,7 @@ func (s *Service) jstagH5Handler(w http.ResponseWriter, r *http.Request) {
 	if ctx.IntegralWall {
 		integralWallAds := s.getIntegralWallAds(ctx, handler, conds, ctx.AdNum-1)
 		if len(integralWallAds) == 0 {
-			s.l.Println("[JstagH5] no integralWallAds ads, SlotId: ", ctx.SlotId)
+			ctx.Log.Debug("no integral wall ads", nil)
 			ctx.Phase = "JstagH5NoAppWallAds"
 			s.stat.GetJstagH5Stat().IncrRetrievalFilted()
 		}
@@ -287,7 +289,7 @@ func (s *Service) jstagH5Handler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		fuyuAds := s.getFuyuAds(ctx, handler, conds, ctx.AdNum-1)
 		if len(fuyuAds) == 0 {
-			s.l.Println("[JstagH5] no fuyu ads, SlotId: ", ctx.SlotId)
+			ctx.Log.Debug("no fuyu ads", nil)
 			ctx.Phase = "JstagH5NoFuyuAds"
 			s.stat.GetJstagH5Stat().IncrRetrievalFilted()
 		}
@@ -304,7 +306,7 @@ func (s *Service) jstagH5Handler(w http.ResponseWriter, r *http.Request) {
 
 	if len(resp.AdList) > 0 {
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[jstag_h5] resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"bytes": n, "err": err})
 		}
 		ctx.Estimate("WriteTo")
 		s.stat.GetJstagH5Stat().IncrImp()
@@ -314,7 +316,7 @@ func (s *Service) jstagH5Handler(w http.ResponseWriter, r *http.Request) {
 	ctx.Phase = "JstagH5Zero"
 	resp = NewRtvResp("no jstag_h5 ad suggestted", 6, ctx)
 	if n, err := resp.WriteTo(w); err != nil {
-		s.l.Println("[jstag_h5] no wugan ad resp write: ", n, ", error:", err)
+		ctx.Log.Warn("resp write error", logger.Fields{"resp": "no wugan ad", "bytes": n, "err": err})
 	}
 	s.stat.GetJstagH5Stat().IncrWuganFilted()
 	return
@@ -2,11 +2,11 @@ package retrieval
 
 import (
 	"encoding/json"
-	"io"
 	"net/http"
 
 	dnf "github.com/brg-liuwei/godnf"
 
+	"encoder"
 	"http_context"
 	"raw_ad"
 	"util"
@@ -20,18 +20,21 @@ type jsMediaResp struct {
 }
 
 func NewJmResp(errMsg string, errNo int, ctx *http_context.Context) *jsMediaResp {
-	return &jsMediaResp{
+	resp := &jsMediaResp{
 		ErrNo:  errNo,
 		ErrMsg: errMsg,
-		Cookie: ctx.Ck,
 		AdList: make([]interface{}, 0, 5),
 	}
+	if ctx != nil {
+		resp.Cookie = ctx.Ck
+	}
+	return resp
 }
 
-func (resp *jsMediaResp) WriteTo(w io.Writer) (int, error) {
-	enc := json.NewEncoder(w)
-	enc.Encode(resp)
-	return 0, nil
+func (resp *jsMediaResp) WriteTo(w http.ResponseWriter) (int, error) {
+	b, _ := json.Marshal(resp)
+	b = append(b, '\n')
+	return encoder.Encode(w, b, encoder.Options{})
 }
 
 func (s *Service) jstagMediaHandler(w http.ResponseWriter, r *http.Request) {
@@ -40,6 +43,7 @@ func (s *Service) jstagMediaHandler(w http.ResponseWriter, r *http.Request) {
 		NewJmResp("init ad error", 3, nil).WriteTo(w)
 		return
 	}
+	defer ctx.Cancel()
 
 	tpl := s.getTpl(ctx.SlotId)
 	if tpl == nil || tpl.SlotSwitch == 2 {
@@ -8,6 +8,7 @@ import (
 	dnf "github.com/brg-liuwei/godnf"
 
 	"http_context"
+	"logger"
 	"rank"
 	"raw_ad"
 )
@@ -16,13 +17,14 @@ func (s *Service) lifeHandler(w http.ResponseWriter, r *http.Request) {
 	s.stat.GetLifeStat().IncrTot()
 	ctx, err := http_context.NewContext(r, s.l)
 	if err != nil {
-		s.l.Println("lifeHandler new context err: ", err)
+		logger.FromContext(r.Context()).Warn("new context error", logger.Fields{"err": err})
 		if n, err := NewRtvResp("url parameters error", 2, nil).WriteTo(w); err != nil {
-			s.l.Println("[life] context err resp write: ", n, ", error:", err)
+			logger.FromContext(r.Context()).Warn("resp write error", logger.Fields{"resp": "context err", "bytes": n, "err": err})
 		}
 		s.stat.GetLifeStat().IncrCtxErr()
 		return
 	}
+	defer ctx.Cancel()
 	s.SetCtxTks(ctx)
 
 	ctx.Estimate("BeginLifeAd: " + ctx.Platform)
@@ -35,7 +37,7 @@ func (s *Service) lifeHandler(w http.ResponseWriter, r *http.Request) {
 	if handler == nil {
 		ctx.Phase = "LifeDnfLoading"
 		if n, err := NewRtvResp("dnf_handler nil", 2, ctx).WriteTo(w); err != nil {
-			s.l.Println("[native] dnf nil resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "dnf nil", "bytes": n, "err": err})
 		}
 		s.stat.GetLifeStat().IncrDnfNil()
 		return
@@ -46,7 +48,7 @@ func (s *Service) lifeHandler(w http.ResponseWriter, r *http.Request) {
 	if tpl == nil {
 		ctx.Phase = "LifeTplNil"
 		if n, err := NewRtvResp("no match tpl", 2, ctx).WriteTo(w); err != nil {
-			s.l.Println("[life] no match tpl resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no match tpl", "bytes": n, "err": err})
 		}
 		s.stat.GetLifeStat().IncrTplNoMatch()
 		return
@@ -56,7 +58,7 @@ func (s *Service) lifeHandler(w http.ResponseWriter, r *http.Request) {
 		// slot switch 2: closed
 		ctx.Phase = "LifeTplClosed"
 		if n, err := NewRtvResp("slot closed", 2, ctx).WriteTo(w); err != nil {
-			s.l.Println("[life] slot closed resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot closed", "bytes": n, "err": err})
 		}
 		s.stat.GetLifeStat().IncrTplNoMatch()
 		return
@@ -65,7 +67,7 @@ func (s *Service) lifeHandler(w http.ResponseWriter, r *http.Request) {
 	if rand.Float64() > tpl.ImpressionRate {
 		ctx.Phase = "LifeImpressionCtrl"
 		if n, err := NewRtvResp("no match ad", 2, ctx).WriteTo(w); err != nil {
-			s.l.Println("[life] slot improssion rate control resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot impression rate control", "bytes": n, "err": err})
 		}
 		s.stat.GetLifeStat().IncrImpRateFilted()
 		return
@@ -76,7 +78,7 @@ func (s *Service) lifeHandler(w http.ResponseWriter, r *http.Request) {
 	ctx.Estimate("GenRetrievalConditions: " + dnf.ConditionsToString(conds))
 
 	if err := ctx.GetFreq(); err != nil {
-		s.l.Println("[life] GetFreq error: ", err)
+		ctx.Log.Error("get freq error", logger.Fields{"err": err})
 	}
 
 	docs, _ := handler.Search(conds, func(a dnf.DocAttr) bool {
@@ -161,7 +163,7 @@ func (s *Service) lifeHandler(w http.ResponseWriter, r *http.Request) {
 
 	if ndocs == 0 {
 		if n, err := NewRtvResp("No ads", 2, ctx).WriteTo(w); err != nil {
-			s.l.Println("[life] no ads resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no ads", "bytes": n, "err": err})
 		}
 		s.stat.GetLifeStat().IncrRetrievalFilted()
 		return
@@ -201,7 +203,7 @@ func (s *Service) lifeHandler(w http.ResponseWriter, r *http.Request) {
 	if len(raws) == 0 {
 		ctx.Phase = "LifeRankZero"
 		if n, err := NewRtvResp("No ads", 2, ctx).WriteTo(w); err != nil {
-			s.l.Println("[life] rank no ads resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "rank no ads", "bytes": n, "err": err})
 		}
 		s.stat.GetLifeStat().IncrRankFilted()
 		return
@@ -222,12 +224,12 @@ func (s *Service) lifeHandler(w http.ResponseWriter, r *http.Request) {
 	ctx.Estimate("ToLifeAds: " + strconv.Itoa(len(resp.AdList)))
 
 	if err := ctx.IncrPreClickFreq(); err != nil {
-		s.l.Println("[life] IncrPreClickFreq error: ", err)
+		ctx.Log.Error("incr pre click freq error", logger.Fields{"err": err})
 	}
 
 	if len(resp.AdList) > 0 {
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[life] resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"bytes": n, "err": err})
 		}
 		ctx.Estimate("WriteTo")
 		s.stat.GetLifeStat().IncrImp()
@@ -236,7 +238,7 @@ func (s *Service) lifeHandler(w http.ResponseWriter, r *http.Request) {
 
 	ctx.Phase = "LifeZero"
 	if n, err := NewRtvResp("no life ad suggestted", 2, ctx).WriteTo(w); err != nil {
-		s.l.Println("[life] no life ad resp write: ", n, ", error:", err)
+		ctx.Log.Warn("resp write error", logger.Fields{"resp": "no life ad", "bytes": n, "err": err})
 	}
 	return
 }
@@ -0,0 +1,128 @@
+package retrieval
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	dnf "github.com/brg-liuwei/godnf"
+
+	"http_context"
+	"logger"
+	"metrics"
+	"pacing"
+	"rank"
+	"real_api"
+	"ssp"
+)
+
+/*
+/metrics (prometheus text format):
+	offer_http_request_duration_seconds{handler}   handler延迟
+	offer_http_requests_total{handler,code}
+	offer_endpoint_events_total{endpoint,event}    原SubStatistic计数，event为json字段名
+	offer_phase_total{phase}                       见status.RecordReq
+	offer_upstream_*{upstream}                     rank、video_rank、huicheng、vast
+	offer_redis_*{cmd}
+	offer_floor_filted_total{source}, offer_rank_deadline_exceeded_total
+	offer_local_rank_total{reason}                 进程内排序(primary slot或远程rank失败兜底)，由rank导出
+	offer_rank_host_*{pool,host}                   rank各host的请求、延迟、摘除和健康状态，由rank/client导出
+	offer_rank_shadow_total{result}, offer_rank_shadow_overlap   shadow rank，由rank导出
+	offer_cap_filtered_total{state}, offer_cap_refresh_errors_total   日/月cap，由offer_cap导出
+	offer_budget_pacing_filtered_total, offer_budget_pacing_offers   预算pacing，由pacing导出
+	offer_pacing_instances                         点击pacing使用的实例数，由pacing导出
+	offer_pacing_refills_total{result}, offer_pacing_fallbacks_total   集群pacing领取token，由pacing导出
+	offer_index_loaded, offer_slots, offer_index_docs(由update导出)
+*/
+
+var (
+	handlerDuration = metrics.NewHistogramVec("offer_http_request_duration_seconds",
+		"Latency of retrieval handlers.", nil, "handler")
+	handlerRequests = metrics.NewCounterVec("offer_http_requests_total",
+		"Retrieval requests by handler and status code.", "handler", "code")
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// instrument records latency and status code of handler h,
+// and writes an access log line with request id (returned in X-Request-Id)
+func instrument(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		http_context.LimitBody(w, r)
+		pacing.BudgetRequest() // 预算pacing按请求数学习流量曲线
+		entry := logger.NewEntry(name, r)
+		w.Header().Set(logger.ReqIdHeader, entry.ReqId)
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h(rec, r.WithContext(logger.WithEntry(r.Context(), entry)))
+		handlerDuration.With(name).Observe(metrics.Since(start))
+		handlerRequests.With(name, strconv.Itoa(rec.code)).Inc()
+		entry.Finish(rec.code)
+	}
+}
+
+// handle registers h on path of mux, the handler label is path without leading slash
+func handle(mux *http.ServeMux, path string, h http.HandlerFunc) {
+	mux.HandleFunc(path, instrument(strings.Trim(path, "/"), h))
+}
+
+func (s *Service) registerMetrics() {
+	metrics.NewCounterFunc("offer_endpoint_events_total",
+		"Per endpoint request and filter counters (SubStatistic).", s.collectStat, "endpoint", "event")
+
+	metrics.NewCounterFunc("offer_floor_filted_total", "Offers dropped by slot floor price.",
+		func(emit metrics.Emit) {
+			emit(float64(rank.FloorFilted()), "rank")
+			emit(float64(real_api.FloorFilted()), "real_api")
+		}, "source")
+	metrics.NewCounterFunc("offer_rank_deadline_exceeded_total", "Rank calls degraded to localrank by request deadline.",
+		func(emit metrics.Emit) {
+			emit(float64(rank.DeadlineExceeded()))
+		})
+
+	metrics.NewGaugeFunc("offer_index_loaded", "1 if dnf index is loaded.",
+		func(emit metrics.Emit) {
+			if dnf.GetHandler() != nil {
+				emit(1)
+			} else {
+				emit(0)
+			}
+		})
+	metrics.NewGaugeFunc("offer_slots", "Number of slots in slot store.",
+		func(emit metrics.Emit) {
+			n := 0
+			if store := ssp.GetGlobalSlotStore(); store != nil {
+				n = store.Len()
+			}
+			emit(float64(n))
+		})
+}
+
+var subStatType = reflect.TypeOf(SubStatistic{})
+
+// collectStat emits every SubStatistic field of every endpoint, names come from json tags
+func (s *Service) collectStat(emit metrics.Emit) {
+	v := reflect.ValueOf(&s.stat).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.Type != subStatType {
+			continue
+		}
+		endpoint := strings.Split(f.Tag.Get("json"), ",")[0]
+		sub := reflect.ValueOf(v.Field(i).Addr().Interface().(*SubStatistic).Load()).Elem()
+		for j := 0; j < sub.NumField(); j++ {
+			event := strings.Split(subStatType.Field(j).Tag.Get("json"), ",")[0]
+			emit(float64(sub.Field(j).Int()), endpoint, event)
+		}
+	}
+}
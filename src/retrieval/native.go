@@ -5,6 +5,7 @@ import (
 	"strconv"
 
 	"http_context"
+	"logger"
 	"raw_ad"
 	"real_api"
 )
@@ -16,13 +17,14 @@ func (s *Service) nativeHandler(w http.ResponseWriter, r *http.Request) {
 	s.stat.GetNatStat().IncrTot()
 	ctx, err := http_context.NewContext(r, s.l)
 	if err != nil {
-		s.l.Println("nativeHandler new context err: ", err)
+		logger.FromContext(r.Context()).Warn("new context error", logger.Fields{"err": err})
 		if n, err := NewRtvResp("url parameters error", 42, nil).WriteTo(w); err != nil {
-			s.l.Println("[native] context err resp write: ", n, ", error:", err)
+			logger.FromContext(r.Context()).Warn("resp write error", logger.Fields{"resp": "context err", "bytes": n, "err": err})
 		}
 		s.stat.GetNatStat().IncrCtxErr()
 		return
 	}
+	defer ctx.Cancel()
 	s.SetCtxTks(ctx)
 
 	ctx.Estimate("BeginNavieAd: " + ctx.Platform)
@@ -35,13 +37,13 @@ func (s *Service) nativeHandler(w http.ResponseWriter, r *http.Request) {
 	if raw, err := real_api.Request(ctx); err == nil {
 		raws = append(raws, raw)
 	} else {
-		s.l.Println("[real_api] ", err)
+		ctx.Log.Warn("real api error", logger.Fields{"err": err})
 	}
 
 	if len(raws) == 0 {
 		ctx.Phase = "NativeRankZero"
 		if n, err := NewRtvResp("No ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[native] rank no ads resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "rank no ads", "bytes": n, "err": err})
 		}
 		s.stat.GetNatStat().IncrRankFilted()
 		return
@@ -67,7 +69,7 @@ func (s *Service) nativeHandler(w http.ResponseWriter, r *http.Request) {
 
 	if len(resp.AdList) > 0 {
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[native] resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"bytes": n, "err": err})
 		}
 		ctx.Estimate("WriteTo")
 		s.stat.GetNatStat().IncrImp()
@@ -76,7 +78,7 @@ func (s *Service) nativeHandler(w http.ResponseWriter, r *http.Request) {
 
 	ctx.Phase = "NativeZero"
 	if n, err := NewRtvResp("no native ad suggestted", 6, ctx).WriteTo(w); err != nil {
-		s.l.Println("[native] no wugan ad resp write: ", n, ", error:", err)
+		ctx.Log.Warn("resp write error", logger.Fields{"resp": "no wugan ad", "bytes": n, "err": err})
 	}
 	s.stat.GetNatStat().IncrWuganFilted()
 	return
@@ -1,7 +1,6 @@
 package retrieval
 
 import (
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"math/rand"
@@ -9,7 +8,9 @@ import (
 
 	dnf "github.com/brg-liuwei/godnf"
 
+	"encoder"
 	"http_context"
+	"logger"
 	"rank"
 	"raw_ad"
 )
@@ -67,29 +68,26 @@ func (p *pageadResp) WriteTo(w http.ResponseWriter) (int, error) {
 	}
 
 	b, _ := json.Marshal(p)
-	if p.ctx != nil && p.ctx.UseGzip && len(b) > 1000 {
-		enc := gzip.NewWriter(w)
-		defer enc.Close()
-		w.Header().Set("Content-Encoding", "gzip")
-		return enc.Write(b)
-	}
-	return w.Write(b)
+	opt := encoder.NewOptions(p.ctx)
+	opt.CTGzip, opt.Aes = false, false // pagead给web使用，不加密
+	return encoder.Encode(w, b, opt)
 }
 
 func (s *Service) pageadHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, err := http_context.NewContext(r, s.l)
 	if err != nil {
-		s.l.Println("page handler new context err: ", err)
+		logger.FromContext(r.Context()).Warn("new context error", logger.Fields{"err": err})
 		if n, err := NewPageadResp("page handler new context error "+err.Error(), 42, nil).WriteTo(w); err != nil {
-			s.l.Println("[pagead] context err resp write: ", n, ", error: ", err)
+			logger.FromContext(r.Context()).Warn("resp write error", logger.Fields{"resp": "context err", "bytes": n, "err": err})
 		}
 		return
 	}
+	defer ctx.Cancel()
 
 	handler := dnf.GetHandler()
 	if handler == nil {
 		if n, err := NewPageadResp("dnf handler nil", 2, ctx).WriteTo(w); err != nil {
-			s.l.Println("[pagead] dnf handler nil resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "dnf nil", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -97,22 +95,22 @@ func (s *Service) pageadHandler(w http.ResponseWriter, r *http.Request) {
 	tpl := s.getTpl(ctx.SlotId)
 	if tpl == nil {
 		if n, err := NewPageadResp("no match tpl", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[pagead] no match tpl resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no match tpl", "bytes": n, "err": err})
 		}
 		return
 	}
 
 	if tpl.SlotSwitch == 2 {
 		if n, err := NewPageadResp("slot closed", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[pagead] slot closed resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot closed", "bytes": n, "err": err})
 		}
 		return
 	}
 
 	if ctx.AdType != "16" && ctx.AdType != "17" {
-		s.l.Println("page not support adtype ", ctx.AdType)
+		ctx.Log.Debug("not support adtype", nil)
 		if n, err := NewPageadResp("page not support adtype "+ctx.AdType, 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[pagead] not support adtype ", ctx.AdType, " resp write: ", n, " error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "not support adtype", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -123,21 +121,21 @@ func (s *Service) pageadHandler(w http.ResponseWriter, r *http.Request) {
 	ctx.Adapters, ctx.Control = tpl.GetPageadTpl(ctx.Format)
 	if len(ctx.Adapters) == 0 {
 		if n, err := NewPageadResp("ad has no adapter", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[pagead] slot has no adapters ", ctx.SlotId, " resp write: ", n, " error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot has no adapters", "bytes": n, "err": err})
 		}
 		return
 	}
 
 	if rand.Float64() > tpl.ImpressionRate {
 		if n, err := NewPageadResp("no matched ad", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[pagead] slot impression rate resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot impression rate", "bytes": n, "err": err})
 		}
 		return
 	}
 
 	// 获取广告频控数据
 	if err := ctx.GetFreq(); err != nil {
-		s.l.Println("[pagead] get frequency error ", err)
+		ctx.Log.Error("get freq error", logger.Fields{"err": err})
 	}
 
 	// channel 类型
@@ -189,7 +187,7 @@ func (s *Service) pageadHandler(w http.ResponseWriter, r *http.Request) {
 	ndocs := len(docs)
 	if ndocs == 0 {
 		if n, err := NewPageadResp("no ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[pagead] banner no ads, resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "banner no ads", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -206,12 +204,12 @@ func (s *Service) pageadHandler(w http.ResponseWriter, r *http.Request) {
 	raws := rank.Select(rawList, ctx)
 	if len(raws) == 0 {
 		if n, err := NewPageadResp("no rank ads", 2, ctx).WriteTo(w); err != nil {
-			s.l.Println("[pagead] no rank ads, resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no rank ads", "bytes": n, "err": err})
 		}
 		return
 	}
 
-	ctx.StaticBaseUrl = s.conf.PageadStaticBaseUrl
+	ctx.StaticBaseUrl = s.loadConf().PageadStaticBaseUrl
 	s.SetCtxTks(ctx)
 
 	resp := NewPageadResp("ok", 0, ctx)
@@ -226,13 +224,13 @@ func (s *Service) pageadHandler(w http.ResponseWriter, r *http.Request) {
 
 	if len(resp.offers) > 0 {
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[pagead] banner resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "banner", "bytes": n, "err": err})
 		}
 		return
 	}
 
 	if n, err := NewPageadResp("no ad suggested", 6, ctx).WriteTo(w); err != nil {
-		s.l.Println("[pagead] banner no ad suggested resp write: ", n, ", error: ", err)
+		ctx.Log.Warn("resp write error", logger.Fields{"resp": "banner no ad suggested", "bytes": n, "err": err})
 	}
 	return
 }
@@ -1,10 +1,7 @@
 package retrieval
 
 import (
-	"bytes"
-	"compress/gzip"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"log"
 	"math/rand"
@@ -17,8 +14,9 @@ import (
 	dnf "github.com/brg-liuwei/godnf"
 	"github.com/brg-liuwei/gotools"
 
-	"aes"
+	"encoder"
 	"http_context"
+	"logger"
 	"raw_ad"
 	"status"
 	"util"
@@ -152,35 +150,7 @@ func (resp *promoteResp) WriteTo(w http.ResponseWriter) (int, error) {
 	}
 	w.Header().Set("Title", resp.SemiTitle)
 	b, _ := json.Marshal(resp)
-
-	if resp.ctx != nil && resp.ctx.UseGzipCT {
-		var buf bytes.Buffer
-		enc := gzip.NewWriter(&buf)
-		if n, err := enc.Write(b); err != nil {
-			enc.Close()
-			return n, err
-		}
-		enc.Close()
-		w.Header().Set("CT-Content-Encoding", "gzip")
-
-		if resp.ctx.UseAes {
-			b = aes.EncryptBytes(buf.Bytes())
-			if resp.ctx.TestEncode != "hex" {
-				w.Header().Set("CT-Encrypt", "binary")
-				decodeBytes := make([]byte, hex.DecodedLen(len(b)))
-				hex.Decode(decodeBytes, b)
-				return w.Write(decodeBytes)
-			}
-			w.Header().Set("CT-Encrypt", "hex")
-		}
-
-		return w.Write(b)
-	}
-
-	if resp.ctx != nil && resp.ctx.UseAes {
-		b = aes.EncryptBytes(b)
-	}
-	return w.Write(b)
+	return encoder.Encode(w, b, encoder.NewOptions(resp.ctx))
 }
 
 type LogInfo map[string]string
@@ -220,11 +190,12 @@ func (s *Service) promoteHandler(w http.ResponseWriter, r *http.Request) {
 	s.stat.GetPmtStat().IncrTot()
 	ctx, err := http_context.NewContext(r, s.l)
 	if err != nil {
-		s.l.Println("promoteHandler NewContext error: ", err)
+		logger.FromContext(r.Context()).Warn("new context error", logger.Fields{"err": err})
 		http.Error(w, "request parameters error", http.StatusBadGateway)
 		s.stat.GetPmtStat().IncrCtxErr()
 		return
 	}
+	defer ctx.Cancel()
 	ctx.AdType = "8" // 8: promote type
 
 	logInfo := initLogInfo(ctx)
@@ -250,9 +221,9 @@ func (s *Service) promoteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(ctx.InstalledPkg) == 0 && ctx.NotifyFrom == "b" {
-		s.l.Println("promoteHandler install pkg empty")
+		ctx.Log.Debug("install pkg empty", nil)
 		if n, err := NewPromoteResp("", base64MatchTitle, nil, ctx).WriteTo(w); err != nil {
-			s.l.Println("[promote] empty installed pkg resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "empty installed pkg", "bytes": n, "err": err})
 		}
 		s.stat.GetPmtStat().IncrInsPkgErr()
 		return
@@ -264,7 +235,7 @@ func (s *Service) promoteHandler(w http.ResponseWriter, r *http.Request) {
 	if tpl == nil {
 		ctx.Phase = "PmtTplNil"
 		if n, err := NewPromoteResp("", base64MatchTitle, nil, ctx).WriteTo(w); err != nil {
-			s.l.Println("[promote] slot tpl nil, resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot tpl nil", "bytes": n, "err": err})
 		}
 		s.stat.GetPmtStat().IncrTplNoMatch()
 		return
@@ -273,7 +244,7 @@ func (s *Service) promoteHandler(w http.ResponseWriter, r *http.Request) {
 	if tpl.SlotSwitch == 2 {
 		ctx.Phase = "PmtSlotClosed"
 		if n, err := NewPromoteResp("", base64MatchTitle, nil, ctx).WriteTo(w); err != nil {
-			s.l.Println("[promote] slot tpl closed, resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot tpl closed", "bytes": n, "err": err})
 		}
 		s.stat.GetPmtStat().IncrTplNoMatch()
 		return
@@ -283,7 +254,7 @@ func (s *Service) promoteHandler(w http.ResponseWriter, r *http.Request) {
 	if handler == nil {
 		ctx.Phase = "PmtDnfLoading"
 		if n, err := NewPromoteResp("", base64MatchTitle, nil, ctx).WriteTo(w); err != nil {
-			s.l.Println("[promote] dnf nil resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "dnf nil", "bytes": n, "err": err})
 		}
 		s.stat.GetPmtStat().IncrDnfNil()
 		return
@@ -394,13 +365,13 @@ func (s *Service) promoteHandler(w http.ResponseWriter, r *http.Request) {
 	ctx.Estimate("SearchNDocs: " + strconv.Itoa(len(docs)))
 
 	if iOSHijackFrom != "" {
-		s.l.Println("<<< iOSHijackFrom: ", iOSHijackFrom, ", pkg: ", ctx.InstalledPkg, ", offer size: ", len(docs))
+		ctx.Log.Debug("ios hijack", logger.Fields{"hijack_from": iOSHijackFrom, "pkg": ctx.InstalledPkg, "offers": len(docs)})
 	}
 
 	ndocs := len(docs)
 	if ndocs <= 0 {
 		if n, err := NewPromoteResp("", base64MatchTitle, nil, ctx).WriteTo(w); err != nil {
-			s.l.Println("[promote] no ads resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no ads", "bytes": n, "err": err})
 		}
 		s.stat.GetPmtStat().IncrRetrievalFilted()
 		return
@@ -476,7 +447,7 @@ func (s *Service) promoteHandler(w http.ResponseWriter, r *http.Request) {
 	logInfo["hit_url"] = strconv.Itoa(len(urls))
 
 	if n, err := resp.WriteTo(w); err != nil {
-		s.l.Println("[promote] resp write: ", n, ", error:", err)
+		ctx.Log.Warn("resp write error", logger.Fields{"bytes": n, "err": err})
 	}
 	ctx.Estimate("WriteTo")
 	s.stat.GetPmtStat().IncrImp()
@@ -1,13 +1,10 @@
 package retrieval
 
 import (
-	"bytes"
-	"compress/gzip"
-	"encoding/hex"
 	"encoding/json"
 	"net/http"
 
-	"aes"
+	"encoder"
 	"http_context"
 	"subscription"
 )
@@ -34,39 +31,7 @@ func (resp *subResp) WriteTo(w http.ResponseWriter) (int, error) {
 		b, _ = json.Marshal(resp.subscriptions)
 	}
 
-	if resp.ctx != nil {
-
-		var buf bytes.Buffer
-
-		if resp.ctx.UseGzipCT && len(b) > 1000 {
-			w.Header().Set("CT-Content-Encoding", "gzip")
-			enc := gzip.NewWriter(&buf)
-			enc.Write(b)
-			enc.Close()
-			b = buf.Bytes()
-		}
-
-		if resp.ctx.UseAes {
-			b = aes.EncryptBytes(b)
-			w.Header().Set("CT-Encrypt", "hex") // by default, set hex
-
-			if resp.ctx.TestEncode != "hex" {
-				w.Header().Set("CT-Encrypt", "binary") // overwrite CT-Encrypt
-				decodeBytes := make([]byte, hex.DecodedLen(len(b)))
-				hex.Decode(decodeBytes, b)
-				b = decodeBytes
-			}
-		}
-
-		if resp.ctx.UseGzip && len(b) > 1000 {
-			w.Header().Set("Content-Encoding", "gzip")
-			enc := gzip.NewWriter(w)
-			defer enc.Close()
-			return enc.Write(b)
-		}
-	}
-
-	return w.Write(b)
+	return encoder.Encode(w, b, encoder.LegacyOptions(resp.ctx))
 }
 
 func (s *Service) subHandler(w http.ResponseWriter, r *http.Request) {
@@ -75,6 +40,7 @@ func (s *Service) subHandler(w http.ResponseWriter, r *http.Request) {
 		NewSubResp(nil).WriteTo(w)
 		return
 	}
+	defer ctx.Cancel()
 
 	conds := s.makeRetrievalConditions(ctx)
 
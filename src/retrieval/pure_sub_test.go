@@ -0,0 +1,112 @@
+package retrieval
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"aes"
+	"http_context"
+	"subscription"
+)
+
+func init() {
+	aes.Init(&aes.Conf{
+		Key: "1122334455667788112233445566778811223344556677881122334455667788",
+	})
+}
+
+// decodeSub reverses the get_sub_ad encoding by response headers
+func decodeSub(t *testing.T, h http.Header, b []byte) []byte {
+	gunzip := func(b []byte) []byte {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, _ := ioutil.ReadAll(r)
+		return rc
+	}
+	if h.Get("Content-Encoding") == "gzip" {
+		b = gunzip(b)
+	}
+	switch h.Get("CT-Encrypt") {
+	case "binary":
+		b = aes.DecryptBytes([]byte(hex.EncodeToString(b)))
+	case "hex":
+		b = aes.DecryptBytes(b)
+	}
+	if h.Get("CT-Content-Encoding") == "gzip" {
+		b = gunzip(b)
+	}
+	return b
+}
+
+func TestSubRespEncoding(t *testing.T) {
+	small := []*subscription.Subscription{{ClkUrl: "http://c", ImpUrl: "http://i"}}
+	large := []*subscription.Subscription{{ClkUrl: "http://c", Js: []string{strings.Repeat("x", 2000)}}}
+	random := make([]byte, 2000) // 压缩后仍超过MinCompressSize
+	rand.New(rand.NewSource(1)).Read(random)
+	noisy := []*subscription.Subscription{{ClkUrl: "http://c", Js: []string{hex.EncodeToString(random)}}}
+
+	cases := []struct {
+		subs    []*subscription.Subscription
+		ctx     *http_context.Context
+		headers map[string]string // 除Content-Type外的全部header
+	}{
+		{nil, nil, nil},
+		{small, &http_context.Context{}, nil},
+		{small, &http_context.Context{UseGzip: true, UseDeflate: true}, nil},
+		{large, &http_context.Context{UseDeflate: true}, nil},
+		{large, &http_context.Context{UseGzip: true, UseDeflate: true},
+			map[string]string{"Content-Encoding": "gzip", "Vary": "Accept-Encoding"}},
+		// CT-Encrypt总是设置，默认binary
+		{small, &http_context.Context{UseAes: true}, map[string]string{"CT-Encrypt": "binary"}},
+		{small, &http_context.Context{UseAes: true, TestEncode: "hex"}, map[string]string{"CT-Encrypt": "hex"}},
+		// 不超过MinCompressSize不做CT gzip
+		{small, &http_context.Context{UseAes: true, UseGzipCT: true}, map[string]string{"CT-Encrypt": "binary"}},
+		{large, &http_context.Context{UseAes: true, UseGzipCT: true, TestEncode: "hex"},
+			map[string]string{"CT-Content-Encoding": "gzip", "CT-Encrypt": "hex"}},
+		// aes之后仍做标准gzip
+		{large, &http_context.Context{UseAes: true, UseGzip: true},
+			map[string]string{"CT-Encrypt": "binary", "Content-Encoding": "gzip", "Vary": "Accept-Encoding"}},
+		{noisy, &http_context.Context{UseAes: true, UseGzipCT: true, UseGzip: true},
+			map[string]string{"CT-Content-Encoding": "gzip", "CT-Encrypt": "binary",
+				"Content-Encoding": "gzip", "Vary": "Accept-Encoding"}},
+	}
+	for i, c := range cases {
+		w := httptest.NewRecorder()
+		resp := NewSubResp(c.ctx)
+		resp.subscriptions = c.subs
+		resp.WriteTo(w)
+
+		want := http.Header{"Content-Type": {"application/json; charset=utf-8"}}
+		for k, v := range c.headers {
+			want.Set(k, v)
+		}
+		if !reflect.DeepEqual(w.Header(), want) {
+			t.Errorf("case %d: header %v, want %v", i, w.Header(), want)
+		}
+
+		expect := []byte("[]")
+		if len(c.subs) != 0 {
+			expect, _ = json.Marshal(c.subs)
+		}
+		if got := decodeSub(t, w.Header(), w.Body.Bytes()); !bytes.Equal(got, expect) {
+			t.Errorf("case %d: decoded body %.100s, want %.100s", i, got, expect)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	NewSubResp(nil).WriteTo(w)
+	if w.Body.String() != "[]" {
+		t.Errorf("empty body %q, want []", w.Body.String())
+	}
+}
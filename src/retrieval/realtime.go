@@ -9,6 +9,7 @@ import (
 
 	"ad"
 	"http_context"
+	"logger"
 	"rank"
 	"raw_ad"
 	"util"
@@ -44,13 +45,14 @@ func (s *Service) realtimeHandler(w http.ResponseWriter, r *http.Request) {
 	s.stat.GetRltStat().IncrTot()
 	ctx, err := http_context.NewContext(r, s.l)
 	if err != nil {
-		s.l.Println("realtimeHandler new context err: ", err)
+		logger.FromContext(r.Context()).Warn("new context error", logger.Fields{"err": err})
 		if n, err := NewRtvResp("url parameters error", 42, nil).WriteTo(w); err != nil {
-			s.l.Println("[realtime] context err resp write: ", n, ", error:", err)
+			logger.FromContext(r.Context()).Warn("resp write error", logger.Fields{"resp": "context err", "bytes": n, "err": err})
 		}
 		s.stat.GetRltStat().IncrCtxErr()
 		return
 	}
+	defer ctx.Cancel()
 
 	ctx.DetailReqType = "jstag_rlt"
 
@@ -64,7 +66,7 @@ func (s *Service) realtimeHandler(w http.ResponseWriter, r *http.Request) {
 	if handler == nil {
 		ctx.Phase = "RealtimeDnfLoading"
 		if n, err := NewRtvResp("dnf_handler nil", 2, ctx).WriteTo(w); err != nil {
-			s.l.Println("[realtime] dnf nil resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "dnf nil", "bytes": n, "err": err})
 		}
 		s.stat.GetRltStat().IncrDnfNil()
 		return
@@ -75,7 +77,7 @@ func (s *Service) realtimeHandler(w http.ResponseWriter, r *http.Request) {
 	if tpl == nil {
 		ctx.Phase = "RealTimeTplNil"
 		if n, err := NewRtvResp("no match tpl", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[realtime] no match tpl resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no match tpl", "bytes": n, "err": err})
 		}
 		s.stat.GetRltStat().IncrTplNoMatch()
 		return
@@ -85,7 +87,7 @@ func (s *Service) realtimeHandler(w http.ResponseWriter, r *http.Request) {
 		// slot switch 2: closed
 		ctx.Phase = "RealTimeTplClosed"
 		if n, err := NewRtvResp("slot closed", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[realtime] slot closed resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot closed", "bytes": n, "err": err})
 		}
 		s.stat.GetRltStat().IncrTplNoMatch()
 		return
@@ -96,7 +98,7 @@ func (s *Service) realtimeHandler(w http.ResponseWriter, r *http.Request) {
 		if rand.Float64() > tpl.ImpressionRate {
 			ctx.Phase = "RealTimeImpressionCtrl"
 			if n, err := NewRtvResp("no match ad", 5, ctx).WriteTo(w); err != nil {
-				s.l.Println("[realtime] slot improssion rate control resp write: ", n, ", error:", err)
+				ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot impression rate control", "bytes": n, "err": err})
 			}
 			s.stat.GetRltStat().IncrImpRateFilted()
 			return
@@ -106,7 +108,7 @@ func (s *Service) realtimeHandler(w http.ResponseWriter, r *http.Request) {
 	if ctx.ImgH*ctx.ImgW == 0 {
 		ctx.ImgH = 500
 		ctx.ImgW = 950
-		s.l.Println("[realtime] missing imgw or imgh, use 950x500")
+		ctx.Log.Debug("missing imgw or imgh, use 950x500", nil)
 	}
 
 	conds := s.makeRetrievalConditions(ctx)
@@ -114,7 +116,7 @@ func (s *Service) realtimeHandler(w http.ResponseWriter, r *http.Request) {
 	ctx.Estimate("GenRealtimeConditions: " + dnf.ConditionsToString(conds))
 
 	if err := ctx.GetFreq(); err != nil {
-		s.l.Println("[realtime] GetFreq error: ", err)
+		ctx.Log.Error("get freq error", logger.Fields{"err": err})
 	}
 
 	docs, _ := handler.Search(conds, func(a dnf.DocAttr) bool {
@@ -202,7 +204,7 @@ func (s *Service) realtimeHandler(w http.ResponseWriter, r *http.Request) {
 
 	if ndocs == 0 {
 		if n, err := NewRtvResp("No ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[realtime] no ads resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no ads", "bytes": n, "err": err})
 		}
 		s.stat.GetRltStat().IncrRetrievalFilted()
 		return
@@ -234,7 +236,7 @@ func (s *Service) realtimeHandler(w http.ResponseWriter, r *http.Request) {
 	if len(raws) == 0 {
 		ctx.Phase = "RealtimeRankZero"
 		if n, err := NewRtvResp("No ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[realtime] rank no ads resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "rank no ads", "bytes": n, "err": err})
 		}
 		s.stat.GetRltStat().IncrRankFilted()
 		return
@@ -260,7 +262,7 @@ func (s *Service) realtimeHandler(w http.ResponseWriter, r *http.Request) {
 
 	if len(resp.AdList) > 0 {
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[realtime] resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"bytes": n, "err": err})
 		}
 		ctx.Estimate("WriteTo")
 		s.stat.GetRltStat().IncrImp()
@@ -269,7 +271,7 @@ func (s *Service) realtimeHandler(w http.ResponseWriter, r *http.Request) {
 
 	ctx.Phase = "RealtimeZero"
 	if n, err := NewRtvResp("no realtime ad suggestted", 6, ctx).WriteTo(w); err != nil {
-		s.l.Println("[realtime] no wugan ad resp write: ", n, ", error:", err)
+		ctx.Log.Warn("resp write error", logger.Fields{"resp": "no wugan ad", "bytes": n, "err": err})
 	}
 	s.stat.GetRltStat().IncrWuganFilted()
 	return
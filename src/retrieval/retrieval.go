@@ -1,9 +1,6 @@
 package retrieval
 
 import (
-	"bytes"
-	"compress/gzip"
-	"encoding/hex"
 	"encoding/json"
 	"math/rand"
 	"net/http"
@@ -11,9 +8,10 @@ import (
 
 	dnf "github.com/brg-liuwei/godnf"
 
-	"aes"
 	"cpt"
+	"encoder"
 	"http_context"
+	"logger"
 	"rank"
 	"raw_ad"
 	"status"
@@ -73,55 +71,21 @@ func (resp *rtvResp) WriteTo(w http.ResponseWriter) (int, error) {
 	}
 
 	b, _ := json.Marshal(resp)
-
-	if resp.ctx != nil && resp.ctx.UseGzipCT {
-		var buf bytes.Buffer
-		enc := gzip.NewWriter(&buf)
-		if n, err := enc.Write(b); err != nil {
-			enc.Close()
-			return n, err
-		}
-		enc.Close()
-		w.Header().Set("CT-Content-Encoding", "gzip")
-
-		if resp.ctx.UseAes { // 加密
-			b = aes.EncryptBytes(buf.Bytes())
-			if resp.ctx.TestEncode != "hex" {
-				w.Header().Set("CT-Encrypt", "binary")
-				decodeBytes := make([]byte, hex.DecodedLen(len(b)))
-				hex.Decode(decodeBytes, b)
-				return w.Write(decodeBytes)
-			} else {
-				w.Header().Set("CT-Encrypt", "hex")
-			}
-		}
-		return w.Write(b)
-	}
-
-	if resp.ctx != nil && resp.ctx.UseAes {
-		b = aes.EncryptBytes(b)
-	}
-
-	if resp.ctx.UseGzip && len(b) > 1000 {
-		enc := gzip.NewWriter(w)
-		defer enc.Close()
-		w.Header().Set("Content-Encoding", "gzip")
-		return enc.Write(b)
-	}
-	return w.Write(b)
+	return encoder.Encode(w, b, encoder.NewOptions(resp.ctx))
 }
 
 func (s *Service) retrievalHandler(w http.ResponseWriter, r *http.Request) {
 	s.stat.GetSdkStat().IncrTot()
 	ctx, err := http_context.NewContext(r, s.l)
 	if err != nil {
-		s.l.Println("retrievalHandler new context err: ", err)
+		logger.FromContext(r.Context()).Warn("new context error", logger.Fields{"err": err})
 		if n, err := NewRtvResp(err.Error(), 42, nil).WriteTo(w); err != nil {
-			s.l.Println("[retrieval] context resp write", n, "error: ", err)
+			logger.FromContext(r.Context()).Warn("resp write error", logger.Fields{"resp": "context err", "bytes": n, "err": err})
 		}
 		s.stat.GetSdkStat().IncrCtxErr()
 		return
 	}
+	defer ctx.Cancel()
 
 	ctx.Estimate("BeginAd: " + ctx.Platform)
 	defer func() {
@@ -133,7 +97,7 @@ func (s *Service) retrievalHandler(w http.ResponseWriter, r *http.Request) {
 	if handler == nil {
 		ctx.Phase = "RenderDnfLoading"
 		if n, err := NewRtvResp("dnf_handler nil", 2, ctx).WriteTo(w); err != nil {
-			s.l.Println("[retrieval] dnf nil resp write", n, "error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "dnf nil", "bytes": n, "err": err})
 		}
 		s.stat.GetSdkStat().IncrDnfNil()
 		return
@@ -145,7 +109,7 @@ func (s *Service) retrievalHandler(w http.ResponseWriter, r *http.Request) {
 	if tpl == nil {
 		ctx.Phase = "RenderNoMatchTpl"
 		if n, err := NewRtvResp("no match tpl", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[retrieval] tpl resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no match tpl", "bytes": n, "err": err})
 		}
 		s.stat.GetSdkStat().IncrTplNoMatch()
 		return
@@ -155,7 +119,7 @@ func (s *Service) retrievalHandler(w http.ResponseWriter, r *http.Request) {
 		// slot switch 2: closed
 		ctx.Phase = "RenderSlotClosed"
 		if n, err := NewRtvResp("slot closed", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[retrieval] slot closed resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot closed", "bytes": n, "err": err})
 		}
 		s.stat.GetSdkStat().IncrTplNoMatch()
 		return
@@ -166,7 +130,7 @@ func (s *Service) retrievalHandler(w http.ResponseWriter, r *http.Request) {
 		if rand.Float64() > tpl.ImpressionRate {
 			ctx.Phase = "RenderImpCtrl"
 			if n, err := NewRtvResp("no match ad", 5, ctx).WriteTo(w); err != nil {
-				s.l.Println("[retrieval] slot improssion rate control resp write: ", n, ", error:", err)
+				ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot impression rate control", "bytes": n, "err": err})
 			}
 			s.stat.GetSdkStat().IncrImpRateFilted()
 			return
@@ -176,7 +140,7 @@ func (s *Service) retrievalHandler(w http.ResponseWriter, r *http.Request) {
 	if len(tpl.Templates) == 0 {
 		ctx.Phase = "RenderTplSizeNoMatch"
 		if n, err := NewRtvResp("tpl size 0", 6, ctx).WriteTo(w); err != nil {
-			s.l.Println("[retrieval] tpl size 0, resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "tpl size 0", "bytes": n, "err": err})
 		}
 		s.stat.GetSdkStat().IncrTplSizeErr()
 		return
@@ -188,7 +152,7 @@ func (s *Service) retrievalHandler(w http.ResponseWriter, r *http.Request) {
 
 	if !tpl.SlotImpInCap(tpl.MaxImpression) {
 		if n, err := NewRtvResp("slot reach impression cap", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[retrieval] slot reach impression cap resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot reach impression cap", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -199,7 +163,7 @@ func (s *Service) retrievalHandler(w http.ResponseWriter, r *http.Request) {
 	pacing := s.LoadPacing()
 
 	if err := ctx.GetFreq(); err != nil {
-		s.l.Println("[retrieval] GetFreq error: ", err)
+		ctx.Log.Error("get freq error", logger.Fields{"err": err})
 	}
 
 	docs, _ := handler.Search(conds, func(a dnf.DocAttr) bool {
@@ -318,7 +282,7 @@ func (s *Service) retrievalHandler(w http.ResponseWriter, r *http.Request) {
 
 	if ndocs == 0 {
 		if n, err := NewRtvResp("No ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[retrieval] no ads, resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no ads", "bytes": n, "err": err})
 		}
 		if ctx.IsWugan() && ctx.Platform == "iOS" && ctx.Country == "CN" {
 			ctx.Phase = "CNiOSWuganEmpty"
@@ -353,7 +317,7 @@ func (s *Service) retrievalHandler(w http.ResponseWriter, r *http.Request) {
 	if len(raws) == 0 {
 		ctx.Phase = "RenderRankZero"
 		if n, err := NewRtvResp("No ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[retrieval] rank get no ads, resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "rank no ads", "bytes": n, "err": err})
 		}
 		s.stat.GetSdkStat().IncrRankFilted()
 		return
@@ -379,12 +343,12 @@ func (s *Service) retrievalHandler(w http.ResponseWriter, r *http.Request) {
 	ctx.Estimate("ToAds")
 
 	if err := ctx.IncrPreClickFreq(); err != nil {
-		s.l.Println("[retrieval] IncrPreClickFreq error: ", err)
+		ctx.Log.Error("incr pre click freq error", logger.Fields{"err": err})
 	}
 
 	if len(resp.AdList) > 0 {
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[retrieval] resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"bytes": n, "err": err})
 		}
 		ctx.Estimate("WriteTo")
 		s.stat.GetSdkStat().IncrImp()
@@ -393,7 +357,7 @@ func (s *Service) retrievalHandler(w http.ResponseWriter, r *http.Request) {
 
 	ctx.Phase = "RenderZero"
 	if n, err := NewRtvResp("no ad suggestted", 6, ctx).WriteTo(w); err != nil {
-		s.l.Println("[retrieval] no wugan ad resp write: ", n, ", error:", err)
+		ctx.Log.Warn("resp write error", logger.Fields{"resp": "no wugan ad", "bytes": n, "err": err})
 	}
 	s.stat.GetSdkStat().IncrWuganFilted()
 	return
@@ -1,10 +1,12 @@
 package retrieval
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -16,7 +18,10 @@ import (
 	"github.com/brg-liuwei/gotools"
 
 	"http_context"
+	"logger"
+	"metrics"
 	common "offer"
+	"offer_cap"
 	"pacing"
 	"raw_ad"
 	"ssp"
@@ -80,6 +85,13 @@ type Conf struct {
 	LifePath         string `json:"life_path"`
 	JstagMediaPath   string `json:"jstag_media_path"`
 
+	// 请求超时(毫秒)，slot配置timeout_ms或header X-Request-Timeout可覆盖，但不超过max_request_timeout_ms
+	RequestTimeoutMs    int `json:"request_timeout_ms"`
+	MaxRequestTimeoutMs int `json:"max_request_timeout_ms"`
+
+	// 过滤原因漏斗采样: 0每个请求都记录，n记录1/n的请求，-1关闭
+	FunnelSample int `json:"funnel_sample"`
+
 	LogPath        string `json:"log_path"`
 	LogRotateNum   int    `json:"log_rotate_backup"`
 	LogRotateLines int    `json:"log_rotate_lines"`
@@ -110,8 +122,10 @@ type Conf struct {
 
 	ForceStartSlots []string `json:"promote_start_slots"`
 
-	AutoscalingGroupName string `json:"autoscaling_group_name"`
-	AutoscalingRegion    string `json:"autoscaling_group_region"`
+	AutoscalingGroupName string              `json:"autoscaling_group_name"`
+	AutoscalingRegion    string              `json:"autoscaling_group_region"`
+	PacingInstances      pacing.InstanceConf `json:"pacing_instances"` // 实例数来源，见pacing/instances.go
+	DistributedPacing    pacing.DistConf     `json:"distributed_pacing"`
 
 	NgpServerApi        string `json:"ngp_server_api"`
 	VastServerApi       string `json:"vast_server_api"`
@@ -121,12 +135,18 @@ type Conf struct {
 }
 
 type Service struct {
-	conf   *Conf
+	conf   unsafe.Pointer // *Conf, SIGHUP时可重新加载
+	mux    *http.ServeMux // 对外端口只注册检索接口，不用DefaultServeMux(status端口)
+	srv    *http.Server
 	l      *gotools.RotateLogger
 	stat   Statistic
 	pc     unsafe.Pointer // pacing controller
 	fuyuPc unsafe.Pointer // fuyu pacing controller
 
+	instances *pacing.Instances
+
+	startAt  time.Time
+	draining int32 // 1: shutdown中，readyz返回503
 }
 
 func NewService(conf *Conf) (*Service, error) {
@@ -140,23 +160,67 @@ func NewService(conf *Conf) (*Service, error) {
 	}
 	l.SetLineRotate(conf.LogRotateLines)
 
+	http_context.SetRequestTimeout(time.Duration(conf.RequestTimeoutMs)*time.Millisecond,
+		time.Duration(conf.MaxRequestTimeoutMs)*time.Millisecond)
+	http_context.SetFunnelSample(conf.FunnelSample)
+
+	instances, err := pacing.NewInstances(&conf.PacingInstances, conf.AutoscalingGroupName, conf.AutoscalingRegion)
+	if err != nil {
+		return nil, errors.New("[RETRIEVAL] pacing instances: " + err.Error())
+	}
+	instances.Watch()
+
+	mux := http.NewServeMux()
 	svc := &Service{
-		conf:   conf,
+		conf:   unsafe.Pointer(conf),
+		mux:    mux,
+		srv:    &http.Server{Handler: mux},
 		l:      l,
-		pc:     unsafe.Pointer(pacing.NewPacingController(conf.AutoscalingGroupName, conf.AutoscalingRegion)),
-		fuyuPc: unsafe.Pointer(pacing.NewPacingController(conf.AutoscalingGroupName, conf.AutoscalingRegion)),
-	}
+		pc:     unsafe.Pointer(pacing.NewPacingController(instances)),
+		fuyuPc: unsafe.Pointer(pacing.NewPacingController(instances)),
 
-	go func() {
-		for range time.NewTicker(15 * time.Minute).C {
-			svc.StorePacing(pacing.NewPacingController(conf.AutoscalingGroupName, conf.AutoscalingRegion))
-			svc.StoreFuyuPacing(pacing.NewPacingController(conf.AutoscalingGroupName, conf.AutoscalingRegion))
-		}
-	}()
+		instances: instances,
+
+		startAt: time.Now(),
+	}
+	if conf.DistributedPacing.Enabled {
+		svc.LoadPacing().Distribute("main", &conf.DistributedPacing)
+		svc.LoadFuyuPacing().Distribute("fuyu", &conf.DistributedPacing)
+	}
+	svc.registerMetrics()
 
 	return svc, nil
 }
 
+func (s *Service) loadConf() *Conf {
+	return (*Conf)(atomic.LoadPointer(&s.conf))
+}
+
+// Reload replaces reloadable parts of conf, such as tracking links, vast urls and request timeouts.
+// 监听地址、handler路径、日志、autoscaling、pacing_instances和distributed_pacing配置需要重启才能生效
+func (s *Service) Reload(cf *Conf) {
+	old := s.loadConf()
+	conf := *cf
+
+	conf.ServerName, conf.ListenPort = old.ServerName, old.ListenPort
+	conf.Path, conf.NativePath, conf.RealtimePath = old.Path, old.NativePath, old.RealtimePath
+	conf.PromotionPath, conf.VideoPath, conf.WuganPath = old.PromotionPath, old.VideoPath, old.WuganPath
+	conf.FunnyPath, conf.InmobiPath, conf.JstagPath = old.FunnyPath, old.InmobiPath, old.JstagPath
+	conf.JstagH5Path, conf.NgpPath, conf.AppWallPath = old.JstagH5Path, old.NgpPath, old.AppWallPath
+	conf.InterstitialPath, conf.PageadPath, conf.LifePath = old.InterstitialPath, old.PageadPath, old.LifePath
+	conf.JstagMediaPath = old.JstagMediaPath
+	conf.LogPath, conf.LogRotateNum, conf.LogRotateLines = old.LogPath, old.LogRotateNum, old.LogRotateLines
+	conf.AutoscalingGroupName, conf.AutoscalingRegion = old.AutoscalingGroupName, old.AutoscalingRegion
+	conf.PacingInstances, conf.DistributedPacing = old.PacingInstances, old.DistributedPacing
+
+	http_context.SetRequestTimeout(time.Duration(conf.RequestTimeoutMs)*time.Millisecond,
+		time.Duration(conf.MaxRequestTimeoutMs)*time.Millisecond)
+	http_context.SetFunnelSample(conf.FunnelSample)
+
+	atomic.StorePointer(&s.conf, unsafe.Pointer(&conf))
+	s.l.Println("[reload] retrieval conf reloaded")
+}
+
 func (s *Service) LoadPacing() *pacing.PacingController {
 	return (*pacing.PacingController)(atomic.LoadPointer(&s.pc))
 }
@@ -194,7 +258,17 @@ func (s *Service) getVideoTplAndUpdateSlot(ctx *http_context.Context) *ssp.SlotI
 }
 
 // 广告通用搜索条件
+// adSearch returns the reason if raw is filtered, and records it into ctx.Funnel
 func (s *Service) adSearch(raw *raw_ad.RawAdObj, ctx *http_context.Context, tpl *ssp.SlotInfo) (string, bool) {
+	msg, ok := s.adFilter(raw, ctx, tpl)
+	ctx.Funnel.Record(raw.Channel, msg, ok)
+	if !ok && ctx.Log.Enabled(logger.Debug) {
+		ctx.Log.Debug("ad filtered", logger.Fields{"offer": raw.Id, "channel": raw.Channel, "reason": msg})
+	}
+	return msg, ok
+}
+
+func (s *Service) adFilter(raw *raw_ad.RawAdObj, ctx *http_context.Context, tpl *ssp.SlotInfo) (string, bool) {
 	// debug
 	if ctx.IsDebug {
 		if ctx.Channel != "" && ctx.Channel != raw.Channel {
@@ -226,6 +300,16 @@ func (s *Service) adSearch(raw *raw_ad.RawAdObj, ctx *http_context.Context, tpl
 		return "offer black", false
 	}
 
+	// 广告主日/月cap，接近上限时按概率放行
+	if ok, state := offer_cap.Allow(raw); !ok {
+		return "offer cap " + state, false
+	}
+
+	// 带日cap的offer按预算pacing放行
+	if !pacing.AllowBudget(raw) {
+		return "budget pacing", false
+	}
+
 	// 无感没有这三个
 	if !ctx.IsWugan() {
 		// white channel
@@ -265,7 +349,7 @@ func (s *Service) IsDefIcon(platform, icon string) bool {
 }
 
 func httpsReplaceCopy(tracks []string) []string {
-	// 注意，这里不能直接在数组里面修改，因为ctx的track数组是引用的s.conf.xxxTks，要修改成https，必须复制数组
+	// 注意，这里不能直接在数组里面修改，因为ctx的track数组是引用的conf.xxxTks，要修改成https，必须复制数组
 	newTracks := make([]string, 0, len(tracks))
 	for _, tk := range tracks {
 		if !strings.HasPrefix(tk, "https") {
@@ -277,25 +361,26 @@ func httpsReplaceCopy(tracks []string) []string {
 }
 
 func (s *Service) SetCtxTks(ctx *http_context.Context) {
+	conf := s.loadConf()
 	if ctx.Platform == "iOS" {
-		ctx.PreImpTks = s.conf.IosPreImpTks
-		ctx.PostImpTks = s.conf.IosPostImpTks
+		ctx.PreImpTks = conf.IosPreImpTks
+		ctx.PostImpTks = conf.IosPostImpTks
 		// url for debug
 		ctx.PostImpTksDebug = []string{"http://log.ambimob.com/ios/v1/impression"}
 		// 3/4/9是无感，不用发点击日志
 		if ctx.AdType != "3" && ctx.AdType != "4" && ctx.AdType != "9" {
-			ctx.PreClkTks = s.conf.IosPreClkTks
-			ctx.PostClkTks = s.conf.IosPostClkTks
+			ctx.PreClkTks = conf.IosPreClkTks
+			ctx.PostClkTks = conf.IosPostClkTks
 			ctx.PostClkTksDebug = []string{"http://log.ambimob.com/ios/v1/click"}
 		}
 	} else if ctx.Platform == "Android" {
-		copy(ctx.PreImpTks, s.conf.AndroidPreImpTks)
-		ctx.PostImpTks = s.conf.AndroidPostImpTks
+		copy(ctx.PreImpTks, conf.AndroidPreImpTks)
+		ctx.PostImpTks = conf.AndroidPostImpTks
 		ctx.PostImpTksDebug = []string{"http://log.ambimob.com/android/v1/impression"}
 		// 3/4/9是无感，不用发点击日志
 		if ctx.AdType != "3" && ctx.AdType != "4" && ctx.AdType != "9" {
-			ctx.PreClkTks = s.conf.AndroidPreClkTks
-			ctx.PostClkTks = s.conf.AndroidPostClkTks
+			ctx.PreClkTks = conf.AndroidPreClkTks
+			ctx.PostClkTks = conf.AndroidPostClkTks
 			ctx.PostClkTksDebug = []string{"http://log.ambimob.com/android/v1/click"}
 		}
 	} else {
@@ -305,11 +390,11 @@ func (s *Service) SetCtxTks(ctx *http_context.Context) {
 
 	// 新版插屏需要
 	if ctx.AdType == "15" {
-		ctx.VastServerApi = s.conf.VastServerApi
+		ctx.VastServerApi = conf.VastServerApi
 		if ctx.Country == "CN" {
-			ctx.VastJsUrl = s.conf.VastJsUrlCN
+			ctx.VastJsUrl = conf.VastJsUrlCN
 		} else {
-			ctx.VastJsUrl = s.conf.VastJsUrl
+			ctx.VastJsUrl = conf.VastJsUrl
 		}
 	}
 }
@@ -391,46 +476,53 @@ func (s *Service) matchKeyWords(raw *raw_ad.RawAdObj, ctx *http_context.Context)
 	return false
 }
 
-func (s *Service) statistic() {
-	for i := 0; ; i++ {
-		time.Sleep(time.Second)
-		s.l.Println(s.stat.QpsStat())
-		if i%10 == 0 {
-			s.l.Println("@@@ sdkStat: ", s.stat.GetSdkStat().ToString())
-			s.l.Println("@@@ natStat: ", s.stat.GetNatStat().ToString())
-			s.l.Println("@@@ rtStat: ", s.stat.GetRtStat().ToString())
-			s.l.Println("@@@ pmtStat: ", s.stat.GetPmtStat().ToString())
-			s.l.Println("@@@ wuganStat: ", s.stat.GetWuganStat().ToString())
-			s.l.Println("@@@ jstagStat: ", s.stat.GetJstagStat().ToString())
-			s.l.Println("@@@ realtimeStat: ", s.stat.GetRltStat().ToString())
-			s.l.Println("@@@ jstagH5Stat: ", s.stat.GetJstagH5Stat().ToString())
-		}
-	}
+// Addr returns listen address of retrieval service
+func (s *Service) Addr() string {
+	conf := s.loadConf()
+	return fmt.Sprintf("%s:%d", conf.ServerName, conf.ListenPort)
 }
 
-func (s *Service) Serve() {
-	http.HandleFunc(s.conf.Path, s.retrievalHandler)
-	http.HandleFunc(s.conf.NativePath, s.nativeHandler)
-	http.HandleFunc(s.conf.PromotionPath, s.promoteHandler)
-	http.HandleFunc(s.conf.VideoPath, s.videoHandler)
-	http.HandleFunc(s.conf.WuganPath, s.wuganHandler)
-	http.HandleFunc("/get_sub_ad", s.subHandler)
-	http.HandleFunc(s.conf.FunnyPath, s.funnyHandler)
-	http.HandleFunc(s.conf.JstagPath, s.jstagHandler)
-	http.HandleFunc(s.conf.JstagMediaPath, s.jstagMediaHandler)
-	http.HandleFunc(s.conf.RealtimePath, s.realtimeHandler)
-	http.HandleFunc(s.conf.JstagH5Path, s.jstagH5Handler)
-	http.HandleFunc(s.conf.AppWallPath, s.appWallHandler)
-	http.HandleFunc(s.conf.InterstitialPath, s.interstitialHandler)
+// Serve registers handlers and serves on ln, http.ErrServerClosed returned after Shutdown
+func (s *Service) Serve(ln net.Listener) error {
+	handle(s.mux, s.loadConf().Path, s.retrievalHandler)
+	handle(s.mux, s.loadConf().NativePath, s.nativeHandler)
+	handle(s.mux, s.loadConf().PromotionPath, s.promoteHandler)
+	handle(s.mux, s.loadConf().VideoPath, s.videoHandler)
+	handle(s.mux, s.loadConf().WuganPath, s.wuganHandler)
+	handle(s.mux, "/get_sub_ad", s.subHandler)
+	handle(s.mux, s.loadConf().FunnyPath, s.funnyHandler)
+	handle(s.mux, s.loadConf().JstagPath, s.jstagHandler)
+	handle(s.mux, s.loadConf().JstagMediaPath, s.jstagMediaHandler)
+	handle(s.mux, s.loadConf().RealtimePath, s.realtimeHandler)
+	handle(s.mux, s.loadConf().JstagH5Path, s.jstagH5Handler)
+	handle(s.mux, s.loadConf().AppWallPath, s.appWallHandler)
+	handle(s.mux, s.loadConf().InterstitialPath, s.interstitialHandler)
 	// pagead
-	http.HandleFunc(s.conf.PageadPath, s.pageadHandler)
-	http.HandleFunc(s.conf.LifePath, s.lifeHandler)
-
-	http.HandleFunc("/video/v4/creative/get", s.videoCreativeHandler)
-	http.HandleFunc("/video/v4/ad/get", s.videoAdHandler)
-	http.HandleFunc("/video/v4/native/get", s.videov4NativeHandler)
+	handle(s.mux, s.loadConf().PageadPath, s.pageadHandler)
+	handle(s.mux, s.loadConf().LifePath, s.lifeHandler)
+
+	handle(s.mux, "/video/v4/creative/get", s.videoCreativeHandler)
+	handle(s.mux, "/video/v4/ad/get", s.videoAdHandler)
+	handle(s.mux, "/video/v4/native/get", s.videov4NativeHandler)
+
+	// 管理接口(admin/log、track、estimator等)不在对外端口上，由worker注册在status端口
+	for _, mux := range []*http.ServeMux{s.mux, http.DefaultServeMux} {
+		mux.HandleFunc("/healthz", s.healthzHandler)
+		mux.HandleFunc("/readyz", s.readyzHandler)
+		mux.Handle("/metrics", metrics.Handler())
+	}
 
-	go s.statistic()
+	return s.srv.Serve(ln)
+}
 
-	panic(http.ListenAndServe(fmt.Sprintf("%s:%d", s.conf.ServerName, s.conf.ListenPort), nil))
+// Shutdown stops accepting and waits in-flight requests until ctx done
+func (s *Service) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.draining, 1)
+	s.l.Println("[shutdown] retrieval service draining")
+	err := s.srv.Shutdown(ctx)
+	if e := s.instances.Close(); e != nil {
+		s.l.Println("[shutdown] unregister pacing instance error: ", e)
+	}
+	s.l.Println("[shutdown] retrieval service stopped, err: ", err)
+	return err
 }
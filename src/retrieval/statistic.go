@@ -1,8 +1,6 @@
 package retrieval
 
 import (
-	"encoding/json"
-	"fmt"
 	"sync/atomic"
 )
 
@@ -28,17 +26,6 @@ type Statistic struct {
 	LifeStat    SubStatistic `json:"life"`
 }
 
-func (stat *Statistic) QpsStat() string {
-	stat.TotalReq = atomic.LoadInt64(&stat.SdkStat.TotReq) +
-		atomic.LoadInt64(&stat.NatStat.TotReq) +
-		atomic.LoadInt64(&stat.RtStat.TotReq)
-
-	delta := stat.TotalReq - stat.TotalReqLastSec
-	stat.TotalReqLastSec = stat.TotalReq
-
-	return fmt.Sprint(">>> total req:", stat.TotalReq, ", qps: ", delta)
-}
-
 func (stat *Statistic) IncrTot() int64 {
 	return incr(&stat.TotalReq)
 }
@@ -123,12 +110,6 @@ func (sub *SubStatistic) Load() *SubStatistic {
 	}
 }
 
-func (sub *SubStatistic) ToString() string {
-	dup := sub.Load()
-	b, _ := json.Marshal(dup)
-	return string(b)
-}
-
 func (sub *SubStatistic) IncrTot() int64 {
 	return incr(&sub.TotReq)
 }
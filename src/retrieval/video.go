@@ -8,6 +8,7 @@ import (
 	dnf "github.com/brg-liuwei/godnf"
 
 	"http_context"
+	"logger"
 	"rank"
 	"raw_ad"
 	"util"
@@ -18,13 +19,14 @@ func (s *Service) videoHandler(w http.ResponseWriter, r *http.Request) {
 	s.stat.GetNatStat().IncrTot()
 	ctx, err := http_context.NewContext(r, s.l)
 	if err != nil {
-		s.l.Println("videoHandler new context err: ", err)
+		logger.FromContext(r.Context()).Warn("new context error", logger.Fields{"err": err})
 		if n, err := NewRtvResp("url parameters error", 42, ctx).WriteTo(w); err != nil {
-			s.l.Println("[video] context err resp write: ", n, ", error:", err)
+			logger.FromContext(r.Context()).Warn("resp write error", logger.Fields{"resp": "context err", "bytes": n, "err": err})
 		}
 		s.stat.GetNatStat().IncrCtxErr()
 		return
 	}
+	defer ctx.Cancel()
 
 	ctx.Estimate("BeginVideoAd: " + ctx.Platform)
 	defer func() {
@@ -35,7 +37,7 @@ func (s *Service) videoHandler(w http.ResponseWriter, r *http.Request) {
 	handler := dnf.GetHandler()
 	if handler == nil {
 		if n, err := NewRtvResp("dnf_handler nil", 2, ctx).WriteTo(w); err != nil {
-			s.l.Println("[video] dnf nil resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "dnf nil", "bytes": n, "err": err})
 		}
 		s.stat.GetNatStat().IncrDnfNil()
 		return
@@ -45,7 +47,7 @@ func (s *Service) videoHandler(w http.ResponseWriter, r *http.Request) {
 	ctx.Estimate("GetTpl:" + ctx.SlotId)
 	if tpl == nil {
 		if n, err := NewRtvResp("no active video slot matched", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[video] no match tpl resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no match tpl", "bytes": n, "err": err})
 		}
 		s.stat.GetNatStat().IncrTplNoMatch()
 		return
@@ -53,14 +55,14 @@ func (s *Service) videoHandler(w http.ResponseWriter, r *http.Request) {
 
 	if tpl.SlotSwitch == 2 {
 		if n, err := NewRtvResp("slot closed", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[video] slot closed resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot closed", "bytes": n, "err": err})
 		}
 		return
 	}
 
 	if rand.Float64() > tpl.ImpressionRate {
 		if n, err := NewRtvResp("no match ad", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[video] slot improssion rate control resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot impression rate control", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -81,7 +83,7 @@ func (s *Service) videoHandler(w http.ResponseWriter, r *http.Request) {
 		ctx.AdType = "7"
 	} else {
 		// use default adtype(7)
-		s.l.Println("unexpected video format: ", tpl.Format, ", slot id: ", ctx.SlotId)
+		ctx.Log.Warn("unexpected video format", logger.Fields{"format": tpl.Format})
 	}
 
 	ctx.PkgName = ctx.PkgName + "(vdo" + ctx.AdType + ")"
@@ -89,27 +91,27 @@ func (s *Service) videoHandler(w http.ResponseWriter, r *http.Request) {
 	if ctx.ImgH*ctx.ImgW == 0 {
 		if n, err := NewRtvResp("missing required parameter imgw or imgh",
 			6, ctx).WriteTo(w); err != nil {
-			s.l.Println("[video] missing imgw or imgh resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "missing imgw or imgh", "bytes": n, "err": err})
 		}
 		s.stat.GetNatStat().IncrImgSizeErr()
 		return
 	}
 
 	if err := ctx.GetFreq(); err != nil {
-		s.l.Println("[video] GetFreq error: ", err)
+		ctx.Log.Error("get freq error", logger.Fields{"err": err})
 	}
 
 	if ctx.IsRewardedVideo() {
 		if !ctx.VideoInRequestCap() || !ctx.VideoInCompleteCap(tpl.VideoFreqCap) || !tpl.SlotImpInCap(tpl.MaxComplete) {
 			if n, err := NewRtvResp("user reach freq cap of slot or slot reach complete cap", 1, ctx).WriteTo(w); err != nil {
-				s.l.Println("[video] user reach freq cap of slot or slot reach complete cap resp write: ", n, ", error:", err)
+				ctx.Log.Warn("resp write error", logger.Fields{"resp": "user reach freq cap of slot or slot reach complete cap", "bytes": n, "err": err})
 			}
 			return
 		}
 	} else {
 		if !tpl.SlotImpInCap(tpl.MaxImpression) {
 			if n, err := NewRtvResp("slot reach impression cap", 1, ctx).WriteTo(w); err != nil {
-				s.l.Println("[video] slot reach impression cap resp write: ", n, ", error:", err)
+				ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot reach impression cap", "bytes": n, "err": err})
 			}
 			return
 		}
@@ -171,7 +173,7 @@ func (s *Service) videoHandler(w http.ResponseWriter, r *http.Request) {
 
 	if ndocs == 0 {
 		if n, err := NewRtvResp("No ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[video] no ads resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no ads", "bytes": n, "err": err})
 		}
 		s.stat.GetNatStat().IncrRetrievalFilted()
 		return
@@ -205,7 +207,7 @@ func (s *Service) videoHandler(w http.ResponseWriter, r *http.Request) {
 
 	if len(raws) == 0 {
 		if n, err := NewRtvResp("No ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[video] rank no ads resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "rank no ads", "bytes": n, "err": err})
 		}
 		s.stat.GetNatStat().IncrRankFilted()
 		return
@@ -229,7 +231,7 @@ func (s *Service) videoHandler(w http.ResponseWriter, r *http.Request) {
 
 	if len(resp.AdList) > 0 {
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[video] resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"bytes": n, "err": err})
 		}
 		ctx.Estimate("WriteTo")
 		s.stat.GetNatStat().IncrImp()
@@ -237,23 +239,24 @@ func (s *Service) videoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if n, err := NewRtvResp("no video ad suggestted", 6, ctx).WriteTo(w); err != nil {
-		s.l.Println("[video] no wugan ad resp write: ", n, ", error:", err)
+		ctx.Log.Warn("resp write error", logger.Fields{"resp": "no wugan ad", "bytes": n, "err": err})
 	}
 	s.stat.GetNatStat().IncrWuganFilted()
 	return
 }
 
 func (s *Service) SetVideoCtxTks(ctx *http_context.Context) {
+	conf := s.loadConf()
 	if ctx.Platform == "iOS" {
-		ctx.PreImpTks = s.conf.IosVideoPreImpTks
-		ctx.PreClkTks = s.conf.IosVideoPreClkTks
-		ctx.PostImpTks = s.conf.IosVideoPostImpTks
-		ctx.PostClkTks = s.conf.IosVideoPostClkTks
+		ctx.PreImpTks = conf.IosVideoPreImpTks
+		ctx.PreClkTks = conf.IosVideoPreClkTks
+		ctx.PostImpTks = conf.IosVideoPostImpTks
+		ctx.PostClkTks = conf.IosVideoPostClkTks
 	} else if ctx.Platform == "Android" {
-		ctx.PreImpTks = s.conf.AndroidVideoPreImpTks
-		ctx.PreClkTks = s.conf.AndroidVideoPreClkTks
-		ctx.PostImpTks = s.conf.AndroidVideoPostImpTks
-		ctx.PostClkTks = s.conf.AndroidVideoPostClkTks
+		ctx.PreImpTks = conf.AndroidVideoPreImpTks
+		ctx.PreClkTks = conf.AndroidVideoPreClkTks
+		ctx.PostImpTks = conf.AndroidVideoPostImpTks
+		ctx.PostClkTks = conf.AndroidVideoPostClkTks
 	} else {
 		// untouch code here
 		panic("unexpected platform: " + ctx.Platform)
@@ -1,20 +1,19 @@
 package retrieval
 
 import (
-	"bytes"
-	"compress/gzip"
-	"encoding/hex"
 	"encoding/json"
 	"math/rand"
 	"net/http"
 
 	dnf "github.com/brg-liuwei/godnf"
 
-	"aes"
+	"encoder"
 	"http_context"
+	"logger"
 	"rank"
 	rank_video "rank/video"
 	"raw_ad"
+	"real_api"
 	"util"
 )
 
@@ -42,56 +41,24 @@ type CreativeResp struct {
 }
 
 func NewCreativeResp(errMsg string, ctx *http_context.Context) *CreativeResp {
-	return &CreativeResp{
+	resp := &CreativeResp{
 		Error:     errMsg,
 		Creatives: make([]*Creative, 0),
-		Country:   ctx.Country,
-		SlotId:    ctx.SlotId,
-		IsWifi:    ctx.IsWifi(),
 		ctx:       ctx,
 	}
+	if ctx != nil {
+		resp.Country = ctx.Country
+		resp.SlotId = ctx.SlotId
+		resp.IsWifi = ctx.IsWifi()
+	}
+	return resp
 }
 
 func (resp *CreativeResp) WriteTo(w http.ResponseWriter) (int, error) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("Err-Msg", resp.Error)
 	b, _ := json.Marshal(resp)
-
-	if resp.ctx != nil && resp.ctx.UseGzipCT {
-		var buf bytes.Buffer
-		enc := gzip.NewWriter(&buf)
-		if n, err := enc.Write(b); err != nil {
-			enc.Close()
-			return n, err
-		}
-		enc.Close()
-		w.Header().Set("CT-Content-Encoding", "gzip")
-
-		if resp.ctx.UseAes { // 加密
-			b = aes.EncryptBytes(buf.Bytes())
-			if resp.ctx.TestEncode != "hex" {
-				w.Header().Set("CT-Encrypt", "binary")
-				decodeBytes := make([]byte, hex.DecodedLen(len(b)))
-				hex.Decode(decodeBytes, b)
-				return w.Write(decodeBytes)
-			} else {
-				w.Header().Set("CT-Encrypt", "hex")
-			}
-		}
-		return w.Write(b)
-	}
-
-	if resp.ctx != nil && resp.ctx.UseAes {
-		b = aes.EncryptBytes(b)
-	}
-
-	if resp.ctx != nil && resp.ctx.UseGzip && len(b) > 1000 {
-		enc := gzip.NewWriter(w)
-		defer enc.Close()
-		w.Header().Set("Content-Encoding", "gzip")
-		return enc.Write(b)
-	}
-	return w.Write(b)
+	return encoder.Encode(w, b, encoder.NewOptions(resp.ctx))
 }
 
 func ShuffleCreatives(arr []Creative) {
@@ -130,15 +97,18 @@ func NewVideoResp(errMsg string, errNo int, ctx *http_context.Context) *videoRes
 func (s *Service) videoCreativeHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, err := http_context.NewContext(r, s.l)
 	if err != nil {
-		s.l.Println("video creative handler new context error: ", err)
-		http.Error(w, `{"err_msg": "url params error", "err_no":42}`, http.StatusOK)
+		logger.FromContext(r.Context()).Warn("new context error", logger.Fields{"err": err})
+		if n, err := NewRtvResp("url params error", 42, nil).WriteTo(w); err != nil {
+			logger.FromContext(r.Context()).Warn("resp write error", logger.Fields{"resp": "context err", "bytes": n, "err": err})
+		}
 		return
 	}
+	defer ctx.Cancel()
 
 	handler := dnf.GetHandler()
 	if handler == nil {
 		if n, err := NewCreativeResp("dnf handler nil", ctx).WriteTo(w); err != nil {
-			s.l.Println("[videov4] dnf nil rewp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "dnf nil", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -146,33 +116,33 @@ func (s *Service) videoCreativeHandler(w http.ResponseWriter, r *http.Request) {
 	tpl := s.getVideoTplAndUpdateSlot(ctx)
 	if tpl == nil {
 		if n, err := NewCreativeResp("no active video slot matched", ctx).WriteTo(w); err != nil {
-			s.l.Println("[videov4] no active video resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no active video", "bytes": n, "err": err})
 		}
 		return
 	}
 
 	if rand.Float64() > tpl.ImpressionRate {
 		if n, err := NewCreativeResp("no match ad creative", ctx).WriteTo(w); err != nil {
-			s.l.Println("[videov4] slot improssion rate control resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot impression rate control", "bytes": n, "err": err})
 		}
 		return
 	}
 
 	if err := ctx.GetFreq(); err != nil {
-		s.l.Println("[videov4] GetFreq error: ", err)
+		ctx.Log.Error("get freq error", logger.Fields{"err": err})
 	}
 
 	if ctx.IsRewardedVideo() {
 		if !ctx.VideoInRequestCap() || !ctx.VideoInCompleteCap(tpl.VideoFreqCap) || !tpl.SlotImpInCap(tpl.MaxComplete) {
 			if n, err := NewCreativeResp("user reach freq cap of slot or slot reach complete cap", ctx).WriteTo(w); err != nil {
-				s.l.Println("[videov4] user reach freq cap of slot or slot reach complete cap resp write: ", n, ", error:", err)
+				ctx.Log.Warn("resp write error", logger.Fields{"resp": "user reach freq cap of slot or slot reach complete cap", "bytes": n, "err": err})
 			}
 			return
 		}
 	} else {
 		if !tpl.SlotImpInCap(tpl.MaxImpression) {
 			if n, err := NewCreativeResp("slot reach impression cap", ctx).WriteTo(w); err != nil {
-				s.l.Println("[videov4] slot reach impression cap resp write: ", n, ", error:", err)
+				ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot reach impression cap", "bytes": n, "err": err})
 			}
 			return
 		}
@@ -296,7 +266,7 @@ func (s *Service) videoCreativeHandler(w http.ResponseWriter, r *http.Request) {
 
 	if len(ids) == 0 {
 		if n, err := NewCreativeResp("no rank creatives", ctx).WriteTo(w); err != nil {
-			s.l.Println("[videov4] no rank creatives resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no rank creatives", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -311,13 +281,13 @@ func (s *Service) videoCreativeHandler(w http.ResponseWriter, r *http.Request) {
 
 	if len(resp.Creatives) > 0 {
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[videov4] resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"bytes": n, "err": err})
 		}
 		return
 	}
 
 	if n, err := NewCreativeResp("no creatives suggestted", ctx).WriteTo(w); err != nil {
-		s.l.Println("[videov4] no creatives resp write: ", n, ", error: ", err)
+		ctx.Log.Warn("resp write error", logger.Fields{"resp": "no creatives", "bytes": n, "err": err})
 	}
 
 	return
@@ -326,12 +296,13 @@ func (s *Service) videoCreativeHandler(w http.ResponseWriter, r *http.Request) {
 func (s *Service) videoAdHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, err := http_context.NewContext(r, s.l)
 	if err != nil {
-		s.l.Println("videoAdHandler new context err: ", err)
+		logger.FromContext(r.Context()).Warn("new context error", logger.Fields{"err": err})
 		if n, err := NewRtvResp("url params error", 42, ctx).WriteTo(w); err != nil {
-			s.l.Println("[videov4] context err resp write: ", n, ", error: ", err)
+			logger.FromContext(r.Context()).Warn("resp write error", logger.Fields{"resp": "context err", "bytes": n, "err": err})
 		}
 		return
 	}
+	defer ctx.Cancel()
 
 	if ctx.Country == "CN" {
 		ctx.ButtonText = "立即下载"
@@ -342,7 +313,7 @@ func (s *Service) videoAdHandler(w http.ResponseWriter, r *http.Request) {
 	handler := dnf.GetHandler()
 	if handler == nil {
 		if n, err := NewRtvResp("dnf handler nil", 2, ctx).WriteTo(w); err != nil {
-			s.l.Println("[videov4] dnf nil resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "dnf nil", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -350,33 +321,33 @@ func (s *Service) videoAdHandler(w http.ResponseWriter, r *http.Request) {
 	tpl := s.getVideoTplAndUpdateSlot(ctx)
 	if tpl == nil {
 		if n, err := NewRtvResp("no active video slot matched", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[videov4] no match tpl resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no match tpl", "bytes": n, "err": err})
 		}
 		return
 	}
 
 	if rand.Float64() > tpl.ImpressionRate {
 		if n, err := NewRtvResp("no match ad", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[videov4] slot improssion rate control resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot impression rate control", "bytes": n, "err": err})
 		}
 		return
 	}
 
 	if err := ctx.GetFreq(); err != nil {
-		s.l.Println("[videov4] GetFreq error: ", err)
+		ctx.Log.Error("get freq error", logger.Fields{"err": err})
 	}
 
 	if ctx.IsRewardedVideo() {
 		if !ctx.VideoInRequestCap() || !ctx.VideoInCompleteCap(tpl.VideoFreqCap) || !tpl.SlotImpInCap(tpl.MaxComplete) {
 			if n, err := NewRtvResp("user reach freq cap of slot or slot reach complete cap", 1, ctx).WriteTo(w); err != nil {
-				s.l.Println("[videov4] user reach freq cap of slot or slot reach complete cap resp write: ", n, ", error:", err)
+				ctx.Log.Warn("resp write error", logger.Fields{"resp": "user reach freq cap of slot or slot reach complete cap", "bytes": n, "err": err})
 			}
 			return
 		}
 	} else {
 		if !tpl.SlotImpInCap(tpl.MaxImpression) {
 			if n, err := NewRtvResp("slot reach impression cap", 1, ctx).WriteTo(w); err != nil {
-				s.l.Println("[videov4] slot reach impression cap resp write: ", n, ", error:", err)
+				ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot reach impression cap", "bytes": n, "err": err})
 			}
 			return
 		}
@@ -400,7 +371,7 @@ func (s *Service) videoAdHandler(w http.ResponseWriter, r *http.Request) {
 		ctx.AdType = "7"
 	} else {
 		// use default adtype(7)
-		s.l.Println("unexpected video format: ", tpl.Format, ", slot id: ", ctx.SlotId)
+		ctx.Log.Warn("unexpected video format", logger.Fields{"format": tpl.Format})
 	}
 
 	ctx.PkgName = ctx.PkgName + "(vdo" + ctx.AdType + ")"
@@ -408,7 +379,7 @@ func (s *Service) videoAdHandler(w http.ResponseWriter, r *http.Request) {
 	if ctx.ImgH*ctx.ImgW == 0 {
 		if n, err := NewRtvResp("missing required parameter imgw or imgh",
 			6, ctx).WriteTo(w); err != nil {
-			s.l.Println("[videov4] missing imgw or imgh resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "missing imgw or imgh", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -452,39 +423,45 @@ func (s *Service) videoAdHandler(w http.ResponseWriter, r *http.Request) {
 	util.Shuffle(docs)
 	ndocs := len(docs)
 
-	if ndocs == 0 {
-		if n, err := NewRtvResp("No ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[videov4] no ads resp write: ", n, ", error: ", err)
-		}
-		return
-	}
+	var raws []*raw_ad.RawAdObj
+	if ndocs > 0 {
+		docCnt := 0
 
-	docCnt := 0
+		listCap := ndocs
+		if listCap > rankLimitCap {
+			listCap = rankLimitCap
+		}
+		if listCap > rankUseGzipCap {
+			ctx.RankUseGzip = true
+		} else {
+			ctx.RankUseGzip = false
+		}
+		rawList := make([]*raw_ad.RawAdObj, 0, listCap)
 
-	listCap := ndocs
-	if listCap > rankLimitCap {
-		listCap = rankLimitCap
-	}
-	if listCap > rankUseGzipCap {
-		ctx.RankUseGzip = true
-	} else {
-		ctx.RankUseGzip = false
-	}
-	rawList := make([]*raw_ad.RawAdObj, 0, listCap)
+		for i := 0; i != ndocs && docCnt < listCap; i++ {
+			docCnt++
+			rawAdInter, _ := handler.DocId2Attr(docs[i])
+			raw := rawAdInter.(*raw_ad.RawAdObj)
 
-	for i := 0; i != ndocs && docCnt < listCap; i++ {
-		docCnt++
-		rawAdInter, _ := handler.DocId2Attr(docs[i])
-		raw := rawAdInter.(*raw_ad.RawAdObj)
+			rawList = append(rawList, raw)
+		}
 
-		rawList = append(rawList, raw)
+		raws = rank_video.Select(rawList, ctx)
 	}
 
-	raws := rank_video.Select(rawList, ctx)
+	if len(raws) == 0 { // 索引中的视频offer不足，请求实时api
+		raws = s.realApiVideo(ctx, false)
+	}
 
 	if len(raws) == 0 {
-		if n, err := NewRtvResp("No rank ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[videov4] rank no ads resp write: ", n, ", error:", err)
+		if ndocs == 0 {
+			if n, err := NewRtvResp("No ads", 1, ctx).WriteTo(w); err != nil {
+				ctx.Log.Warn("resp write error", logger.Fields{"resp": "no ads", "bytes": n, "err": err})
+			}
+		} else {
+			if n, err := NewRtvResp("No rank ads", 1, ctx).WriteTo(w); err != nil {
+				ctx.Log.Warn("resp write error", logger.Fields{"resp": "rank no ads", "bytes": n, "err": err})
+			}
 		}
 		return
 	}
@@ -500,13 +477,13 @@ func (s *Service) videoAdHandler(w http.ResponseWriter, r *http.Request) {
 
 	if len(resp.AdList) > 0 {
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[videov4] resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"bytes": n, "err": err})
 		}
 		return
 	}
 
 	if n, err := NewRtvResp("no video ad suggestted", 6, ctx).WriteTo(w); err != nil {
-		s.l.Println("[videov4] no video ad resp write: ", n, ", error:", err)
+		ctx.Log.Warn("resp write error", logger.Fields{"resp": "no video ad", "bytes": n, "err": err})
 	}
 	return
 }
@@ -515,17 +492,18 @@ func (s *Service) videoAdHandler(w http.ResponseWriter, r *http.Request) {
 func (s *Service) videov4NativeHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, err := http_context.NewContext(r, s.l)
 	if err != nil {
-		s.l.Println("native video new context error: ", err)
+		logger.FromContext(r.Context()).Warn("new context error", logger.Fields{"err": err})
 		if n, err := NewRtvResp("url params error", 42, ctx).WriteTo(w); err != nil {
-			s.l.Println("[native-videov4] context err resp write: ", n, ", error: ", err)
+			logger.FromContext(r.Context()).Warn("resp write error", logger.Fields{"resp": "context err", "bytes": n, "err": err})
 		}
 		return
 	}
+	defer ctx.Cancel()
 
 	handler := dnf.GetHandler()
 	if handler == nil {
 		if n, err := NewRtvResp("dnf handler nil", 2, ctx).WriteTo(w); err != nil {
-			s.l.Println("[native-videov4] dnf nil rewp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "dnf nil", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -533,7 +511,7 @@ func (s *Service) videov4NativeHandler(w http.ResponseWriter, r *http.Request) {
 	tpl := s.getVideoTplAndUpdateSlot(ctx)
 	if tpl == nil {
 		if n, err := NewRtvResp("no active video slot matched", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[native-videov4] no match tpl resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no match tpl", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -542,20 +520,20 @@ func (s *Service) videov4NativeHandler(w http.ResponseWriter, r *http.Request) {
 
 	if !tpl.MatchSspFormat(8) {
 		if n, err := NewRtvResp("not native video slot", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[native-videov4] not native video slot resp write: ", n, ", error: ", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "not native video slot", "bytes": n, "err": err})
 		}
 		return
 	}
 
 	if rand.Float64() > tpl.ImpressionRate {
 		if n, err := NewRtvResp("no match ad", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[native-videov4] slot improssion rate control resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot impression rate control", "bytes": n, "err": err})
 		}
 		return
 	}
 
 	if err := ctx.GetFreq(); err != nil {
-		s.l.Println("[native-videov4] GetFreq error: ", err)
+		ctx.Log.Error("get freq error", logger.Fields{"err": err})
 	}
 
 	// 原生视频adtype 为6
@@ -567,7 +545,7 @@ func (s *Service) videov4NativeHandler(w http.ResponseWriter, r *http.Request) {
 	if ctx.ImgH*ctx.ImgW == 0 {
 		if n, err := NewRtvResp("missing required parameter imgw or imgh",
 			6, ctx).WriteTo(w); err != nil {
-			s.l.Println("[native-video] missing imgw or imgh resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "missing imgw or imgh", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -614,38 +592,38 @@ func (s *Service) videov4NativeHandler(w http.ResponseWriter, r *http.Request) {
 	util.Shuffle(docs)
 	ndocs := len(docs)
 
-	if ndocs == 0 {
-		if n, err := NewRtvResp("No ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[video] no ads resp write: ", n, ", error: ", err)
+	var raws []*raw_ad.RawAdObj
+	if ndocs > 0 {
+		docCnt := 0
+		listCap := ndocs
+		if listCap > rankLimitCap {
+			listCap = rankLimitCap
 		}
-		return
-	}
+		if listCap > rankUseGzipCap {
+			ctx.RankUseGzip = true
+		} else {
+			ctx.RankUseGzip = false
+		}
+		rawList := make([]*raw_ad.RawAdObj, 0, listCap)
 
-	docCnt := 0
-	listCap := ndocs
-	if listCap > rankLimitCap {
-		listCap = rankLimitCap
-	}
-	if listCap > rankUseGzipCap {
-		ctx.RankUseGzip = true
-	} else {
-		ctx.RankUseGzip = false
-	}
-	rawList := make([]*raw_ad.RawAdObj, 0, listCap)
+		for i := 0; i != ndocs && docCnt < listCap; i++ {
+			docCnt++
+			rawAdInter, _ := handler.DocId2Attr(docs[i])
+			raw := rawAdInter.(*raw_ad.RawAdObj)
 
-	for i := 0; i != ndocs && docCnt < listCap; i++ {
-		docCnt++
-		rawAdInter, _ := handler.DocId2Attr(docs[i])
-		raw := rawAdInter.(*raw_ad.RawAdObj)
+			rawList = append(rawList, raw)
+		}
 
-		rawList = append(rawList, raw)
+		raws = rank.Select(rawList, ctx)
 	}
 
-	raws := rank.Select(rawList, ctx)
+	if len(raws) == 0 { // 索引中的视频offer不足，请求实时api
+		raws = s.realApiVideo(ctx, true)
+	}
 
 	if len(raws) == 0 {
 		if n, err := NewRtvResp("No ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[native-videov4] rank get no ads, resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "rank no ads", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -662,13 +640,49 @@ func (s *Service) videov4NativeHandler(w http.ResponseWriter, r *http.Request) {
 
 	if len(resp.AdList) > 0 {
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[native-videov4] resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"bytes": n, "err": err})
 		}
 		return
 	}
 
 	if n, err := NewRtvResp("no video ad suggestted", 6, ctx).WriteTo(w); err != nil {
-		s.l.Println("[native-videov4] no video ad resp write: ", n, ", error:", err)
+		ctx.Log.Warn("resp write error", logger.Fields{"resp": "no video ad", "bytes": n, "err": err})
 	}
 	return
 }
+
+// 实时api视频广告，native为true时用于原生视频
+func (s *Service) realApiVideo(ctx *http_context.Context, native bool) []*raw_ad.RawAdObj {
+	if !real_api.VideoEnabled() || ctx.ExpParams.NoRealApi {
+		return nil
+	}
+
+	raw, err := real_api.RequestVideo(ctx)
+	if err != nil {
+		ctx.Log.Warn("real api video error", logger.Fields{"err": err})
+		return nil
+	}
+
+	if native {
+		if !raw.HasMatchedNativeVideo(ctx) {
+			ctx.Debug(raw.UniqId, "no matched native video")
+			return nil
+		}
+	} else {
+		// 实时api的视频不在客户端缓存中，直接选中素材
+		raw.VideoChosen = raw.TryGetMatchedVideo(ctx)
+		raw.ImageChosen = raw.VideoGetMacthedImg(ctx)
+		if raw.ImageChosen == nil {
+			if imgs := raw.GetImgs(ctx); len(imgs) > 0 {
+				raw.ImageChosen = &imgs[0]
+			}
+		}
+		if raw.VideoChosen == nil || raw.ImageChosen == nil {
+			ctx.Debug(raw.UniqId, "no matched video")
+			return nil
+		}
+	}
+
+	ctx.Method = "realapi"
+	return []*raw_ad.RawAdObj{raw}
+}
@@ -0,0 +1,70 @@
+package retrieval
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"http_context"
+	"real_api"
+)
+
+const vastOnlyInline = `<VAST version="3.0"><Ad id="hc"><InLine>
+<AdTitle>vast title</AdTitle>
+<Impression><![CDATA[http://imp/vast]]></Impression>
+<Creatives>
+<Creative><Linear>
+<Duration>00:00:15</Duration>
+<VideoClicks><ClickThrough><![CDATA[http://landing]]></ClickThrough></VideoClicks>
+<MediaFiles><MediaFile delivery="progressive" type="video/mp4" width="1280" height="720"><![CDATA[http://media/a.mp4]]></MediaFile></MediaFiles>
+</Linear></Creative>
+<Creative><CompanionAds>
+<Companion width="1200" height="628"><StaticResource creativeType="image/jpeg"><![CDATA[http://media/cover.jpg]]></StaticResource></Companion>
+</CompanionAds></Creative>
+</Creatives>
+</InLine></Ad></VAST>`
+
+// 上游只给vast_url(没有图片和视频url)时，视频和封面都来自vast
+func TestRealApiVastOnlyVideo(t *testing.T) {
+	vastSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(vastOnlyInline))
+	}))
+	defer vastSrv.Close()
+	hcSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"action": 2, "title": "hc", "clickurl": "http://clk", "video": {"vast_url": "` + vastSrv.URL + `"}}`))
+	}))
+	defer hcSrv.Close()
+
+	real_api.Init(&real_api.Conf{HuichengApi: hcSrv.URL + "/ad?", EnableVideo: true})
+	defer real_api.Init(&real_api.Conf{})
+
+	r := httptest.NewRequest("GET", "/video/v4/ad/get?slot_id=1&platform=Android&country=US&imgw=1200&imgh=628", nil)
+	ctx, err := http_context.NewContext(r, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Cancel()
+	if _, err := real_api.RequestVideo(ctx); err != nil {
+		t.Fatal("vast-only huicheng ad rejected: ", err)
+	}
+
+	raws := (&Service{}).realApiVideo(ctx, false)
+	if len(raws) != 1 {
+		t.Fatal("vast-only video should be served")
+	}
+	raw := raws[0]
+	if raw.VideoChosen.Url != "http://media/a.mp4" || raw.VideoChosen.Type != "mp4" || raw.ImageChosen.Url != "http://media/cover.jpg" {
+		t.Errorf("video %+v, image %+v", raw.VideoChosen, raw.ImageChosen)
+	}
+
+	adv := raw.ToVideoV4Ad(ctx)
+	if adv == nil {
+		t.Fatal("vast-only video should be rendered")
+	}
+	if !strings.HasSuffix(adv.RewardedVideo.Img.Url, "cover.jpg") || !strings.HasSuffix(adv.RewardedVideo.Video.Url, "a.mp4") {
+		t.Errorf("rendered video %+v", adv.RewardedVideo)
+	}
+}
@@ -1,9 +1,6 @@
 package retrieval
 
 import (
-	"bytes"
-	"compress/gzip"
-	"encoding/hex"
 	"encoding/json"
 	"math/rand"
 	"net/http"
@@ -13,8 +10,9 @@ import (
 	dnf "github.com/brg-liuwei/godnf"
 
 	"ad"
-	"aes"
+	"encoder"
 	"http_context"
+	"logger"
 	"rank"
 	"raw_ad"
 	"status"
@@ -103,41 +101,7 @@ func (resp *wuganResp) WriteTo(w http.ResponseWriter) (int, error) {
 	}
 
 	b, _ := json.Marshal(resp)
-
-	if resp.ctx != nil && resp.ctx.UseGzipCT {
-		var buf bytes.Buffer
-		enc := gzip.NewWriter(&buf)
-		if n, err := enc.Write(b); err != nil {
-			enc.Close()
-			return n, err
-		}
-		enc.Close()
-		w.Header().Set("CT-Content-Encoding", "gzip")
-
-		if resp.ctx.UseAes { // 加密
-			b = aes.EncryptBytes(buf.Bytes())
-			if resp.ctx.TestEncode != "hex" {
-				w.Header().Set("CT-Encrypt", "binary")
-				decodeBytes := make([]byte, hex.DecodedLen(len(b)))
-				hex.Decode(decodeBytes, b)
-				return w.Write(decodeBytes)
-			} else {
-				w.Header().Set("CT-Encrypt", "hex")
-			}
-		}
-		return w.Write(b)
-	}
-
-	if resp.ctx != nil && resp.ctx.UseAes {
-		b = aes.EncryptBytes(b)
-	}
-	if resp.ctx != nil && resp.ctx.UseGzip && len(b) > 1000 {
-		enc := gzip.NewWriter(w)
-		defer enc.Close()
-		w.Header().Set("Content-Encoding", "gzip")
-		return enc.Write(b)
-	}
-	return w.Write(b)
+	return encoder.Encode(w, b, encoder.NewOptions(resp.ctx))
 }
 
 /*
@@ -147,13 +111,14 @@ func (s *Service) wuganHandler(w http.ResponseWriter, r *http.Request) {
 	s.stat.GetWuganStat().IncrTot()
 	ctx, err := http_context.NewContext(r, s.l)
 	if err != nil {
-		s.l.Println("wuganHandler new context err: ", err)
+		logger.FromContext(r.Context()).Warn("new context error", logger.Fields{"err": err})
 		if n, err := NewWuganResp("url parameters error", 42, nil).WriteTo(w); err != nil {
-			s.l.Println("[wugan] context err resp write: ", n, ", error:", err)
+			logger.FromContext(r.Context()).Warn("resp write error", logger.Fields{"resp": "context err", "bytes": n, "err": err})
 		}
 		s.stat.GetWuganStat().IncrCtxErr()
 		return
 	}
+	defer ctx.Cancel()
 
 	ctx.Estimate("BeginWuganAd: " + ctx.Platform)
 	defer func() {
@@ -165,7 +130,7 @@ func (s *Service) wuganHandler(w http.ResponseWriter, r *http.Request) {
 	if handler == nil {
 		ctx.Phase = "WuganDnfLoading"
 		if n, err := NewWuganResp("dnf_handler nil", 2, ctx).WriteTo(w); err != nil {
-			s.l.Println("[wugan] dnf nil resp write:", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "dnf nil", "bytes": n, "err": err})
 		}
 		s.stat.GetWuganStat().IncrDnfNil()
 		return
@@ -188,7 +153,7 @@ func (s *Service) wuganHandler(w http.ResponseWriter, r *http.Request) {
 	if tpl == nil {
 		ctx.Phase = "WuganTplNil"
 		if n, err := NewWuganResp("no match tpl", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[wugan] no match tpl resp write:", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no match tpl", "bytes": n, "err": err})
 		}
 		s.stat.GetWuganStat().IncrTplNoMatch()
 		return
@@ -198,7 +163,7 @@ func (s *Service) wuganHandler(w http.ResponseWriter, r *http.Request) {
 		// slot switch 2: closed
 		ctx.Phase = "WuganSlotClosed"
 		if n, err := NewWuganResp("slot closed", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[wugan] slot closed resp write:", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot closed", "bytes": n, "err": err})
 		}
 		s.stat.GetWuganStat().IncrTplNoMatch()
 		return
@@ -208,7 +173,7 @@ func (s *Service) wuganHandler(w http.ResponseWriter, r *http.Request) {
 		s.stat.GetWuganStat().IncrWuganFilted()
 		ctx.Phase = "WuganSlotPreclickClosed"
 		if n, err := NewWuganResp("slot cache closed", 5, ctx).WriteTo(w); err != nil {
-			s.l.Println("[wugan] slot wugan closed, resp write:", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "slot wugan closed", "bytes": n, "err": err})
 		}
 		return
 	}
@@ -224,7 +189,7 @@ func (s *Service) wuganHandler(w http.ResponseWriter, r *http.Request) {
 	pacing := s.LoadPacing()
 
 	if err := ctx.GetFreq(); err != nil {
-		s.l.Println("[wugan] GetFreq error: ", err)
+		ctx.Log.Error("get freq error", logger.Fields{"err": err})
 	}
 
 	docs, _ := handler.Search(conds, func(a dnf.DocAttr) bool {
@@ -355,7 +320,7 @@ func (s *Service) wuganHandler(w http.ResponseWriter, r *http.Request) {
 
 	if len(wuganAds) == 0 && len(subs) == 0 {
 		if n, err := NewWuganResp("No ads", 1, ctx).WriteTo(w); err != nil {
-			s.l.Println("[wugan] no ads resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"resp": "no ads", "bytes": n, "err": err})
 		}
 		ctx.Phase = "WuganNoAds"
 		s.stat.GetWuganStat().IncrRetrievalFilted()
@@ -378,12 +343,12 @@ func (s *Service) wuganHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := ctx.IncrPreClickFreq(); err != nil {
-		s.l.Println("[wugan] IncrPreClickFreq error: ", err)
+		ctx.Log.Error("incr pre click freq error", logger.Fields{"err": err})
 	}
 
 	if len(resp.natList) > 0 || len(resp.Subscriptions) > 0 {
 		if n, err := resp.WriteTo(w); err != nil {
-			s.l.Println("[wugan] resp write: ", n, ", error:", err)
+			ctx.Log.Warn("resp write error", logger.Fields{"bytes": n, "err": err})
 		}
 		ctx.Estimate("WriteTo")
 		s.stat.GetWuganStat().IncrImp()
@@ -391,7 +356,7 @@ func (s *Service) wuganHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if n, err := NewWuganResp("no cached ad suggestted", 6, ctx).WriteTo(w); err != nil {
-		s.l.Println("[wugan] no wugan ads, resp write: ", n, ", error:", err)
+		ctx.Log.Warn("resp write error", logger.Fields{"resp": "no wugan ad", "bytes": n, "err": err})
 	}
 	s.stat.GetWuganStat().IncrWuganFilted()
 	return
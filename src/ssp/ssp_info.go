@@ -597,6 +597,12 @@ type SlotInfo struct {
 	PmtSwitch     int `json:"pmt_switch"`      // 1:开启 2:关闭
 	SemiPmtSwitch int `json:"semi_pmt_switch"` // 1:开启 2:关闭
 
+	// 底价(eCPM, USD)，0表示不设底价；国家底价优先于slot底价
+	FloorPrice        float64            `json:"floor_price"`
+	CountryFloorPrice map[string]float64 `json:"country_floor_price"` // eg: {"US": 2.5, "CN": 0.8}
+
+	TimeoutMs int `json:"timeout_ms"` // 请求超时(毫秒)，0表示使用全局配置
+
 	brothers []*SlotInfo
 
 	preNum       int // wugan ads number per webview
@@ -760,6 +766,14 @@ func (slot *SlotInfo) SlotImpInCap(limit int) bool {
 	}
 }
 
+// slot级别的底价(eCPM, USD)，返回0表示不限制
+func (slot *SlotInfo) GetFloorPrice(country string) float64 {
+	if floor, ok := slot.CountryFloorPrice[strings.ToUpper(country)]; ok {
+		return floor
+	}
+	return slot.FloorPrice
+}
+
 // 更新模板信息
 func (slot *SlotInfo) UpdateTpl() {
 	// XXX hot fix: 兼容老版插屏和新版插屏
@@ -982,6 +996,14 @@ func (slot *SlotStore) Update(r io.Reader) (cont bool) {
 				}
 			}
 
+			if len(info.CountryFloorPrice) > 0 {
+				floors := make(map[string]float64, len(info.CountryFloorPrice))
+				for country, floor := range info.CountryFloorPrice {
+					floors[strings.ToUpper(country)] = floor
+				}
+				info.CountryFloorPrice = floors
+			}
+
 			if len(info.IdStr) == 0 {
 				info.IdStr = strconv.Itoa(info.Id) // IdStr，兼容旧版协议
 			}
@@ -1008,6 +1030,13 @@ func (slot *SlotStore) Get(id string) *SlotInfo {
 	return slot.m[id]
 }
 
+// Len returns number of slots in store
+func (slot *SlotStore) Len() int {
+	slot.RLock()
+	defer slot.RUnlock()
+	return len(slot.m)
+}
+
 func (slot *SlotStore) Set(info *SlotInfo) {
 	slot.Lock()
 	defer slot.Unlock()
@@ -33,3 +33,22 @@ func TestRegexpFail(t *testing.T) {
 		}
 	}
 }
+
+func TestFloorPrice(t *testing.T) {
+	slot := &SlotInfo{
+		FloorPrice:        1.5,
+		CountryFloorPrice: map[string]float64{"US": 3, "CN": 0},
+	}
+	cases := map[string]float64{
+		"US": 3,
+		"us": 3,
+		"CN": 0,
+		"JP": 1.5,
+		"":   1.5,
+	}
+	for country, expect := range cases {
+		if floor := slot.GetFloorPrice(country); floor != expect {
+			t.Error("country: ", country, ", floor: ", floor, ", expect: ", expect)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package status
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"http_context"
+	"metrics"
+)
+
+var rejectTotal = metrics.NewCounterVec("offer_filter_rejects_total",
+	"Candidates rejected by adSearch, sampled requests scaled up.", "reason")
+
+/*
+过滤原因漏斗，按slot和channel两个维度展示：
+	requests(仅slot) -> candidates(adSearch的候选) -> rejects(按原因) -> passed -> served
+served按返回offer id的前缀(channel_id)归到channel，实时api、cpt等不经过adSearch的offer也计入served，
+所以served可能大于passed。采样的请求按1/sample放大。
+*/
+
+type funnelKey struct {
+	slot    string
+	channel string
+}
+
+type funnelCell struct {
+	candidates int
+	served     int
+	rejects    map[string]int
+}
+
+type minuteFunnel struct {
+	sync.Mutex
+	minute   int64
+	requests map[string]int // slot -> 请求数
+	cells    map[funnelKey]*funnelCell
+}
+
+func (m *minuteFunnel) getCell(k funnelKey) *funnelCell {
+	c := m.cells[k]
+	if c == nil {
+		c = &funnelCell{rejects: make(map[string]int, 4)}
+		m.cells[k] = c
+	}
+	return c
+}
+
+// offer id格式为channel_id
+func offerChannel(oid string) string {
+	if i := strings.Index(oid, "_"); i > 0 {
+		return oid[:i]
+	}
+	return "unknown"
+}
+
+func (m *minuteFunnel) record(minute int64, slot string, f *http_context.Funnel, offers []string) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.minute != minute || m.cells == nil {
+		m.minute = minute
+		m.requests = make(map[string]int, 256)
+		m.cells = make(map[funnelKey]*funnelCell, 1024)
+	}
+
+	n := f.Sample
+	m.requests[slot] += n
+	for ch, cnt := range f.Candidates {
+		m.getCell(funnelKey{slot, ch}).candidates += cnt * n
+	}
+	for ch, reasons := range f.Rejects {
+		c := m.getCell(funnelKey{slot, ch})
+		for reason, cnt := range reasons {
+			c.rejects[reason] += cnt * n
+			rejectTotal.With(reason).Add(int64(cnt * n))
+		}
+	}
+	for _, oid := range offers {
+		m.getCell(funnelKey{slot, offerChannel(oid)}).served += n
+	}
+}
+
+func (m *minuteFunnel) mergeInto(minute int64, q *query, r *funnelReport) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.minute != minute {
+		return
+	}
+	for slot, n := range m.requests {
+		if q.slots == nil || q.slots[slot] {
+			r.stage(r.Slots, slot).Requests += n
+		}
+	}
+	for k, c := range m.cells {
+		if (q.slots == nil || q.slots[k.slot]) && (q.channels == nil || q.channels[k.channel]) {
+			r.stage(r.Slots, k.slot).add(c)
+			r.stage(r.Channels, k.channel).add(c)
+		}
+	}
+}
+
+type funnelStage struct {
+	Requests   int            `json:"requests,omitempty"`
+	Candidates int            `json:"candidates"`
+	Rejected   int            `json:"rejected"`
+	Rejects    map[string]int `json:"rejects"`
+	Passed     int            `json:"passed"`
+	Served     int            `json:"served"`
+}
+
+func (st *funnelStage) add(c *funnelCell) {
+	st.Candidates += c.candidates
+	st.Served += c.served
+	for reason, n := range c.rejects {
+		st.Rejects[reason] += n
+		st.Rejected += n
+	}
+	st.Passed = st.Candidates - st.Rejected
+}
+
+type funnelReport struct {
+	From     string                  `json:"from"`
+	To       string                  `json:"to"`
+	Minutes  int                     `json:"minutes"`
+	Filters  map[string][]string     `json:"filters,omitempty"`
+	Slots    map[string]*funnelStage `json:"slots"`
+	Channels map[string]*funnelStage `json:"channels"`
+}
+
+func (r *funnelReport) stage(m map[string]*funnelStage, key string) *funnelStage {
+	st := m[key]
+	if st == nil {
+		st = &funnelStage{Rejects: make(map[string]int)}
+		m[key] = st
+	}
+	return st
+}
+
+func (r *report) recordFunnel(now time.Time, slot string, f *http_context.Funnel, offers []string) {
+	minute := now.Unix() / 60
+	r.Funnels[minute%60].record(minute, slot, f, offers)
+}
+
+func (r *report) queryFunnel(now time.Time, q *query) *funnelReport {
+	fr := &funnelReport{
+		Minutes:  q.minutes,
+		Filters:  q.filters(),
+		Slots:    make(map[string]*funnelStage),
+		Channels: make(map[string]*funnelStage),
+	}
+	cur := now.Unix() / 60
+	for minute := cur - int64(q.minutes) + 1; minute <= cur; minute++ {
+		r.Funnels[minute%60].mergeInto(minute, q, fr)
+	}
+	fr.From = time.Unix((cur-int64(q.minutes)+1)*60, 0).UTC().Format("2006-01-02 15:04:05")
+	fr.To = now.UTC().Format("2006-01-02 15:04:05")
+	return fr
+}
+
+// writeFunnelCSV writes rows as: view,key,stage,reason,count
+func writeFunnelCSV(out io.Writer, r *funnelReport) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"view", "key", "stage", "reason", "count"})
+
+	view := func(name string, m map[string]*funnelStage) {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			st := m[k]
+			row := func(stage, reason string, n int) {
+				w.Write([]string{name, k, stage, reason, strconv.Itoa(n)})
+			}
+			if name == "slot" {
+				row("requests", "", st.Requests)
+			}
+			row("candidates", "", st.Candidates)
+			reasons := make([]string, 0, len(st.Rejects))
+			for reason := range st.Rejects {
+				reasons = append(reasons, reason)
+			}
+			sort.Slice(reasons, func(i, j int) bool {
+				return st.Rejects[reasons[i]] > st.Rejects[reasons[j]] ||
+					st.Rejects[reasons[i]] == st.Rejects[reasons[j]] && reasons[i] < reasons[j]
+			})
+			for _, reason := range reasons {
+				row("rejected", reason, st.Rejects[reason])
+			}
+			row("passed", "", st.Passed)
+			row("served", "", st.Served)
+		}
+	}
+	view("slot", r.Slots)
+	view("channel", r.Channels)
+
+	w.Flush()
+	return w.Error()
+}
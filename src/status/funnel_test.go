@@ -0,0 +1,75 @@
+package status
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"http_context"
+)
+
+func newTestFunnel(sample int) *http_context.Funnel {
+	return &http_context.Funnel{
+		Sample:     sample,
+		Candidates: make(map[string]int),
+		Rejects:    make(map[string]map[string]int),
+	}
+}
+
+func TestFunnel(t *testing.T) {
+	var r report
+	now := time.Now()
+
+	f := newTestFunnel(1)
+	f.Record("nym", "", true)
+	f.Record("nym", "black channel", false)
+	f.Record("wby", "traffic rate", false)
+	f.Record("wby", "traffic rate", false)
+	f.Record("wby", "", true)
+	r.recordFunnel(now, "335", f, []string{"nym_1", "wby_2", "hc_3"})
+
+	// 1/10采样，按10倍计入
+	f = newTestFunnel(10)
+	f.Record("nym", "pkg black", false)
+	r.recordFunnel(now, "415", f, nil)
+
+	fr := r.queryFunnel(now, mustQuery(t, "minutes=1"))
+	st := fr.Slots["335"]
+	if st.Requests != 1 || st.Candidates != 5 || st.Rejected != 3 || st.Passed != 2 || st.Served != 3 {
+		t.Errorf("slot 335: %+v", st)
+	}
+	if st.Rejects["traffic rate"] != 2 || st.Rejects["black channel"] != 1 {
+		t.Errorf("slot 335 rejects: %+v", st.Rejects)
+	}
+	if st = fr.Slots["415"]; st.Requests != 10 || st.Rejects["pkg black"] != 10 {
+		t.Errorf("slot 415: %+v", st)
+	}
+	if st = fr.Channels["nym"]; st.Candidates != 12 || st.Rejected != 11 || st.Served != 1 {
+		t.Errorf("channel nym: %+v", st)
+	}
+	if st = fr.Channels["hc"]; st.Candidates != 0 || st.Served != 1 {
+		t.Errorf("channel hc: %+v", st)
+	}
+
+	fr = r.queryFunnel(now, mustQuery(t, "slot=335&channel=wby"))
+	if len(fr.Slots) != 1 || len(fr.Channels) != 1 || fr.Slots["335"].Candidates != 3 {
+		t.Errorf("filtered: %+v %+v", fr.Slots, fr.Channels)
+	}
+
+	var buf bytes.Buffer
+	if err := writeFunnelCSV(&buf, fr); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"view,key,stage,reason,count",
+		"slot,335,requests,,1",
+		"slot,335,rejected,traffic rate,2",
+		"channel,wby,passed,,1",
+		"channel,wby,served,,1",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, buf.String())
+		}
+	}
+}
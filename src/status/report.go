@@ -1,66 +1,136 @@
 package status
 
 import (
-	"bytes"
-	"encoding/json"
 	"sync"
 	"time"
 )
 
-type reportInfo struct {
-	sync.Mutex
-	inited bool
+/*
+每个请求按(platform, country, adtype, slot)聚合到当前分钟的cell中，60个分钟槽循环使用，
+槽中记录的分钟和当前时间不一致时说明数据已过期，写入时重置、查询时跳过。
+查询时按过滤条件合并最近n分钟的cell。
+分钟槽的读写锁只保护cell的创建和重置，计数由每个cell自己的锁保护，不同cell的请求互不阻塞；
+每个cell最多记录maxCellOffers个offer，之后新出现的offer计入otherOffers。
+*/
+
+const (
+	maxCellOffers = 512
+	otherOffers   = "other"
+)
 
-	Utc       string           `json:"utc"`
-	Retrieval *retrievalReport `json:"retrieval"`
-	Phase     *phaseReport     `json:"phase"`
+type cellKey struct {
+	platform string // iOS, Android(非iOS都归为Android)
+	country  string
+	adtype   string
+	slot     string
 }
 
-func (info *reportInfo) visit() {
-	if info.inited {
-		return
-	}
+type cell struct {
+	sync.Mutex
+	req        int
+	filled     int
+	offers     map[string]int
+	phases     map[string]int
+	fuyuPhases map[string]int
+}
 
-	info.Lock()
-	defer info.Unlock()
+type minuteReport struct {
+	sync.RWMutex
+	minute int64 // unix minute
+	cells  map[cellKey]*cell
+}
 
-	if info.inited {
-		return
+// getCell returns cell of k in minute, the slot is reset if it holds an expired minute
+func (m *minuteReport) getCell(minute int64, k cellKey) *cell {
+	m.RLock()
+	if m.minute == minute {
+		if c := m.cells[k]; c != nil {
+			m.RUnlock()
+			return c
+		}
 	}
+	m.RUnlock()
 
-	info.inited = true
-	info.Retrieval = NewRetrievalReport()
-	info.Phase = NewPhaseReport()
+	m.Lock()
+	defer m.Unlock()
+	if m.minute != minute || m.cells == nil {
+		m.minute = minute
+		m.cells = make(map[cellKey]*cell, 1024)
+	}
+	c := m.cells[k]
+	if c == nil {
+		c = &cell{
+			offers:     make(map[string]int),
+			phases:     make(map[string]int),
+			fuyuPhases: make(map[string]int),
+		}
+		m.cells[k] = c
+	}
+	return c
 }
 
-func (info *reportInfo) clear() {
-	info.Lock()
-	defer info.Unlock()
+func (m *minuteReport) record(minute int64, r *Request) {
+	k := cellKey{platform: "Android", country: r.country, adtype: r.adtype, slot: r.slotid}
+	if r.platform == "iOS" {
+		k.platform = "iOS"
+	}
+
+	c := m.getCell(minute, k)
+	c.Lock()
+	defer c.Unlock()
 
-	info.inited = false
-	info.Retrieval = nil
-	info.Phase = nil
+	c.req += r.numReq
+	c.filled += r.numFilled
+	for _, oid := range r.offers {
+		if _, ok := c.offers[oid]; !ok && len(c.offers) >= maxCellOffers {
+			oid = otherOffers
+		}
+		c.offers[oid]++
+	}
+	if r.phase != "" {
+		c.phases[r.phase]++
+	}
+	if r.fuyuPhase == "" {
+		c.fuyuPhases["Normal"]++
+	} else {
+		c.fuyuPhases[r.fuyuPhase]++
+	}
 }
 
-func (info *reportInfo) getReports(t time.Time) (buff *bytes.Buffer) {
-	info.Utc = t.Format("2006-01-02 15:04:05")
-	info.visit()
-	info.Retrieval.preReport()
+func (m *minuteReport) mergeInto(minute int64, q *query, s *summary) {
+	m.RLock()
+	defer m.RUnlock()
 
-	buff = bytes.NewBuffer(nil)
-	enc := json.NewEncoder(buff)
-	if err := enc.Encode(info); err != nil {
-		panic(err)
+	if m.minute != minute {
+		return
+	}
+	for k, c := range m.cells {
+		if q.match(&k) {
+			c.Lock()
+			s.merge(&k, c, q)
+			c.Unlock()
+		}
 	}
-	return
 }
 
 type report struct {
-	Info [60]reportInfo
+	Minutes [60]minuteReport
+	Funnels [60]minuteFunnel
 }
 
-func (r *report) getReports() *bytes.Buffer {
-	now := time.Now().UTC()
+func (r *report) record(now time.Time, req *Request) {
+	minute := now.Unix() / 60
+	r.Minutes[minute%60].record(minute, req)
+}
 
-	return r.Info[now.Add(-1*time.Minute).Minute()].getReports(now)
+// query merges the latest q.minutes minutes, the current minute included
+func (r *report) query(now time.Time, q *query) *summary {
+	s := newSummary(q)
+	cur := now.Unix() / 60
+	for minute := cur - int64(q.minutes) + 1; minute <= cur; minute++ {
+		r.Minutes[minute%60].mergeInto(minute, q, s)
+	}
+	s.From = time.Unix((cur-int64(q.minutes)+1)*60, 0).UTC().Format("2006-01-02 15:04:05")
+	s.To = now.UTC().Format("2006-01-02 15:04:05")
+	return s
 }
@@ -14,6 +14,8 @@ type Request struct {
 	adtype    string
 	slotid    string
 	offers    []string
+	phase     string
+	fuyuPhase string
 }
 
 func ctxToReq(ctx *http_context.Context, offers []string) *Request {
@@ -29,5 +31,7 @@ func ctxToReq(ctx *http_context.Context, offers []string) *Request {
 		adtype:    ctx.AdType,
 		slotid:    ctx.SlotId,
 		offers:    offers,
+		phase:     ctx.Phase,
+		fuyuPhase: ctx.FuyuPhase,
 	}
 }
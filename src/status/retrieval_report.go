@@ -2,8 +2,12 @@ package status
 
 import (
 	"container/heap"
+	"errors"
 	"fmt"
-	"sync"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 type elem struct {
@@ -12,119 +16,223 @@ type elem struct {
 	FillRate string `json:"fill_rate"`
 }
 
-func NewElem(r *Request) *elem {
-	e := &elem{
-		Req:    r.numReq,
-		Filled: r.numFilled,
-	}
+func (e *elem) add(req, filled int) {
+	e.Req += req
+	e.Filled += filled
+}
+
+func (e *elem) setRate() {
 	if e.Req <= 0 {
 		e.FillRate = "0%"
 	} else {
 		e.FillRate = fmt.Sprintf("%.2f%%",
 			100*float32(e.Filled)/float32(e.Req))
 	}
-	return e
 }
 
-func (e *elem) AddReq(r *Request) *elem {
-	e.Req += r.numReq
-	e.Filled += r.numFilled
-	if e.Req <= 0 {
-		e.FillRate = "0%"
-	} else {
-		e.FillRate = fmt.Sprintf("%.2f%%",
-			100*float32(e.Filled)/float32(e.Req))
+func addTo(m map[string]*elem, key string, req, filled int) {
+	e := m[key]
+	if e == nil {
+		e = &elem{}
+		m[key] = e
 	}
-	return e
+	e.add(req, filled)
 }
 
-type retrievalReport struct {
-	sync.Mutex
+// query: /status?minutes=5&slot=335,415&country=US&adtype=1&offer=xxx&format=csv,
+// /funnel?minutes=5&slot=335&channel=nym,wby
+// 同一维度多个值用逗号分隔，不同维度之间是and关系
+type query struct {
+	minutes   int
+	format    string
+	slots     map[string]bool
+	countries map[string]bool
+	adtypes   map[string]bool
+	offers    map[string]bool // 只影响filled和offer维度，phase无法按offer区分
+	channels  map[string]bool // 只用于funnel
+}
+
+func parseQuery(form url.Values) (*query, error) {
+	q := &query{minutes: 1, format: "json"}
+
+	if s := form.Get("minutes"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 60 {
+			return nil, errors.New("minutes should be 1..60")
+		}
+		q.minutes = n
+	}
+
+	switch f := form.Get("format"); f {
+	case "", "json":
+	case "csv":
+		q.format = f
+	default:
+		return nil, errors.New("format should be json or csv")
+	}
 
-	iosCountryMap     map[string]*elem
-	androidCountryMap map[string]*elem
+	q.slots = parseSet(form.Get("slot"), false)
+	q.countries = parseSet(form.Get("country"), true)
+	q.adtypes = parseSet(form.Get("adtype"), false)
+	q.offers = parseSet(form.Get("offer"), false)
+	q.channels = parseSet(form.Get("channel"), false)
+	return q, nil
+}
+
+func parseSet(s string, upper bool) map[string]bool {
+	if s == "" {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			if upper {
+				v = strings.ToUpper(v)
+			}
+			set[v] = true
+		}
+	}
+	return set
+}
 
-	iosAdTypeMap     map[string]*elem
-	androidAdTypeMap map[string]*elem
+func (q *query) match(k *cellKey) bool {
+	return (q.slots == nil || q.slots[k.slot]) &&
+		(q.countries == nil || q.countries[strings.ToUpper(k.country)]) &&
+		(q.adtypes == nil || q.adtypes[k.adtype])
+}
 
-	slotMap  map[string]*elem
-	offerMap map[string]*elem
+func (q *query) filters() map[string][]string {
+	m := make(map[string][]string)
+	for name, set := range map[string]map[string]bool{
+		"slot": q.slots, "country": q.countries, "adtype": q.adtypes, "offer": q.offers, "channel": q.channels,
+	} {
+		for v := range set {
+			m[name] = append(m[name], v)
+		}
+		sort.Strings(m[name])
+	}
+	for name, vs := range m {
+		if len(vs) == 0 {
+			delete(m, name)
+		}
+	}
+	return m
+}
 
+type retrievalReport struct {
 	PlatformAdtypeMap       map[string]map[string]*elem `json:"dim_adtype"`
 	PlatformTop20CountryMap map[string]map[string]*elem `json:"dim_top20_country"`
 
 	Top20SlotMap  map[string]*elem `json:"dim_top20_slot"`
 	Top30OfferMap map[string]*elem `json:"dim_top30_offer"`
+}
 
-	topOk bool
+type phaseReport struct {
+	Phase     map[string]int `json:"phase"`
+	FuyuPhase map[string]int `json:"fuyu_phase"`
 }
 
-func NewRetrievalReport() *retrievalReport {
-	return &retrievalReport{
-		iosCountryMap:     make(map[string]*elem),
-		androidCountryMap: make(map[string]*elem),
-		iosAdTypeMap:      make(map[string]*elem),
-		androidAdTypeMap:  make(map[string]*elem),
+type summary struct {
+	From    string              `json:"from"`
+	To      string              `json:"to"`
+	Minutes int                 `json:"minutes"`
+	Filters map[string][]string `json:"filters,omitempty"`
 
-		slotMap:  make(map[string]*elem),
-		offerMap: make(map[string]*elem),
+	Total     *elem            `json:"total"`
+	Retrieval *retrievalReport `json:"retrieval"`
+	Phase     *phaseReport     `json:"phase"`
 
-		topOk: false,
-	}
+	// 完整维度，json中只输出top，csv中全部输出
+	platformCountry map[string]map[string]*elem
+	slots           map[string]*elem
+	offers          map[string]*elem
 }
 
-func (report *retrievalReport) recordRequest(r *Request) {
-	report.Lock()
-	defer report.Unlock()
+func newSummary(q *query) *summary {
+	return &summary{
+		Minutes: q.minutes,
+		Filters: q.filters(),
+		Total:   &elem{},
+		Retrieval: &retrievalReport{
+			PlatformAdtypeMap: map[string]map[string]*elem{
+				"iOS":     make(map[string]*elem),
+				"Android": make(map[string]*elem),
+			},
+		},
+		Phase: &phaseReport{
+			Phase:     make(map[string]int, 256),
+			FuyuPhase: map[string]int{"CNiOSWuganEmpty": 0},
+		},
+		platformCountry: map[string]map[string]*elem{
+			"iOS":     make(map[string]*elem),
+			"Android": make(map[string]*elem),
+		},
+		slots:  make(map[string]*elem),
+		offers: make(map[string]*elem),
+	}
+}
 
-	if r.platform == "iOS" {
-		if e := report.iosAdTypeMap[r.adtype]; e != nil {
-			e.AddReq(r)
-		} else {
-			report.iosAdTypeMap[r.adtype] = NewElem(r)
+func (s *summary) merge(k *cellKey, c *cell, q *query) {
+	filled := c.filled
+	if q.offers != nil {
+		filled = 0
+		for oid := range q.offers {
+			filled += c.offers[oid]
 		}
+	}
 
-		if e := report.iosCountryMap[r.country]; e != nil {
-			e.AddReq(r)
-		} else {
-			report.iosCountryMap[r.country] = NewElem(r)
-		}
-	} else {
-		if e := report.androidAdTypeMap[r.adtype]; e != nil {
-			e.AddReq(r)
-		} else {
-			report.androidAdTypeMap[r.adtype] = NewElem(r)
-		}
+	s.Total.add(c.req, filled)
+	addTo(s.Retrieval.PlatformAdtypeMap[k.platform], k.adtype, c.req, filled)
+	addTo(s.platformCountry[k.platform], k.country, c.req, filled)
 
-		if e := report.androidCountryMap[r.country]; e != nil {
-			e.AddReq(r)
-		} else {
-			report.androidCountryMap[r.country] = NewElem(r)
-		}
+	for phase, n := range c.phases {
+		s.Phase.Phase[phase] += n
+	}
+	for phase, n := range c.fuyuPhases {
+		s.Phase.FuyuPhase[phase] += n
 	}
 
-	if r.adtype == "8" {
+	if k.adtype == "8" {
 		// 不统计promote
 		return
 	}
 
-	if e := report.slotMap[r.slotid]; e != nil {
-		e.AddReq(r)
-	} else {
-		report.slotMap[r.slotid] = NewElem(r)
+	addTo(s.slots, k.slot, c.req, filled)
+	for oid, n := range c.offers {
+		if q.offers == nil || q.offers[oid] {
+			addTo(s.offers, oid, n, n)
+		}
 	}
+}
 
-	for _, oid := range r.offers {
-		if e := report.offerMap[oid]; e != nil {
-			e.Req++
-			e.Filled++
-		} else {
-			report.offerMap[oid] = &elem{
-				Req:    1,
-				Filled: 1,
+// finish computes fill rates and top dimensions
+func (s *summary) finish() {
+	for _, m := range []map[string]*elem{s.slots, s.offers,
+		s.platformCountry["iOS"], s.platformCountry["Android"],
+		s.Retrieval.PlatformAdtypeMap["iOS"], s.Retrieval.PlatformAdtypeMap["Android"]} {
+		for _, e := range m {
+			e.setRate()
+		}
+	}
+	s.Total.setRate()
+
+	s.Retrieval.PlatformTop20CountryMap = make(map[string]map[string]*elem, 2)
+	for platform, countries := range s.platformCountry {
+		top := make(map[string]*elem, 32)
+		setTop(top, countries, 20)
+		for _, c := range []string{"CN", "TW", "HK"} {
+			if e := countries[c]; e != nil {
+				top[c] = e
 			}
 		}
+		s.Retrieval.PlatformTop20CountryMap[platform] = top
 	}
+
+	s.Retrieval.Top20SlotMap = make(map[string]*elem, 20)
+	setTop(s.Retrieval.Top20SlotMap, s.slots, 20)
+
+	s.Retrieval.Top30OfferMap = make(map[string]*elem, 30)
+	setTop(s.Retrieval.Top30OfferMap, s.offers, 30)
 }
 
 type Item struct {
@@ -166,52 +274,3 @@ func setTop(dst, src map[string]*elem, top int) {
 		dst[item.Key] = item.Elem
 	}
 }
-
-func (report *retrievalReport) preReport() {
-	// for quick return
-	if report.topOk {
-		return
-	}
-
-	report.Lock()
-	defer report.Unlock()
-
-	// double check
-	if report.topOk {
-		return
-	}
-
-	iosTopCountry := make(map[string]*elem, 32)
-	setTop(iosTopCountry, report.iosCountryMap, 20)
-	iosTopCountry["CN"] = report.iosCountryMap["CN"]
-	iosTopCountry["TW"] = report.iosCountryMap["TW"]
-	iosTopCountry["HK"] = report.iosCountryMap["HK"]
-	report.iosCountryMap = nil
-
-	androidTopCountry := make(map[string]*elem, 32)
-	setTop(androidTopCountry, report.androidCountryMap, 20)
-	androidTopCountry["CN"] = report.androidCountryMap["CN"]
-	androidTopCountry["TW"] = report.androidCountryMap["TW"]
-	androidTopCountry["HK"] = report.androidCountryMap["HK"]
-	report.androidCountryMap = nil
-
-	report.PlatformTop20CountryMap = map[string]map[string]*elem{
-		"iOS":     iosTopCountry,
-		"Android": androidTopCountry,
-	}
-
-	report.PlatformAdtypeMap = map[string]map[string]*elem{
-		"iOS":     report.iosAdTypeMap,
-		"Android": report.androidAdTypeMap,
-	}
-
-	report.Top20SlotMap = make(map[string]*elem, 20)
-	setTop(report.Top20SlotMap, report.slotMap, 20)
-	report.slotMap = nil // release memory
-
-	report.Top30OfferMap = make(map[string]*elem, 30)
-	setTop(report.Top30OfferMap, report.offerMap, 30)
-	report.offerMap = nil // release memory
-
-	report.topOk = true
-}
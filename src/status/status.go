@@ -1,35 +1,47 @@
 package status
 
 import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
 	"io"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"time"
 
+	"estimator"
 	"http_context"
+	"metrics"
 )
 
 type status struct {
-	ctrl
 	report
 }
 
+// 不受采样开关影响，每个请求都计数
+var phaseTotal = metrics.NewCounterVec("offer_phase_total", "Requests by final ctx.Phase.", "phase")
+
 func (s *status) RecordReq(ctx *http_context.Context, offers []string) {
-	if !s.SampleSwitch() || ctx == nil {
+	if ctx == nil {
 		return
 	}
-	info := &s.report.Info[ctx.Now.Minute()]
-	info.visit()
-	r := ctxToReq(ctx, offers)
-	info.Retrieval.recordRequest(r)
-	info.Phase.recordPhase(ctx)
+	if ctx.Phase != "" {
+		phaseTotal.With(ctx.Phase).Inc()
+	}
+	s.report.record(ctx.Now, ctxToReq(ctx, offers))
+	estimator.AddServed(ctx.SlotId, ctx.Country, offers)
+	if ctx.Funnel != nil {
+		s.report.recordFunnel(ctx.Now, ctx.SlotId, ctx.Funnel, offers)
+	}
 }
 
-func (s *status) GetStatus() (contentType string, r io.Reader) {
-	ok, h5Reader := s.getSampleStatus()
-	if !ok {
-		return "text/html; charset=utf8", h5Reader
-	}
-	return "application/json; charset=utf8", s.getReports()
+// GetStatus merges reports of the latest q.minutes minutes
+func (s *status) GetStatus(q *query) *summary {
+	sum := s.report.query(time.Now(), q)
+	sum.finish()
+	return sum
 }
 
 var defaultStatus *status = &status{}
@@ -38,20 +50,99 @@ func RecordReq(ctx *http_context.Context, offers []string) {
 	defaultStatus.RecordReq(ctx, offers)
 }
 
-func Serve() {
-	s := defaultStatus
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sum := defaultStatus.GetStatus(q)
+	if q.format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf8")
+		writeCSV(w, sum)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf8")
+	json.NewEncoder(w).Encode(sum)
+}
+
+func funnelHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fr := defaultStatus.report.queryFunnel(time.Now(), q)
+	if q.format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf8")
+		writeFunnelCSV(w, fr)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf8")
+	json.NewEncoder(w).Encode(fr)
+}
 
-	go func() {
-		// clear report slot
-		for t := range time.NewTicker(time.Minute).C {
-			s.report.Info[t.Add(time.Minute).Minute()].clear()
+// writeCSV writes all dimensions (not only top) as: dimension,platform,key,request,filled,fill_rate
+func writeCSV(out io.Writer, s *summary) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"dimension", "platform", "key", "request", "filled", "fill_rate"})
+
+	row := func(dim, platform, key string, e *elem) {
+		w.Write([]string{dim, platform, key, strconv.Itoa(e.Req), strconv.Itoa(e.Filled), e.FillRate})
+	}
+	rows := func(dim, platform string, m map[string]*elem) {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if m[keys[i]].Req != m[keys[j]].Req {
+				return m[keys[i]].Req > m[keys[j]].Req
+			}
+			return keys[i] < keys[j]
+		})
+		for _, k := range keys {
+			row(dim, platform, k, m[k])
+		}
+	}
+	counts := func(dim string, m map[string]int) {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			w.Write([]string{dim, "", k, strconv.Itoa(m[k]), "", ""})
 		}
-	}()
-
-	http.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
-		contentType, r := s.GetStatus()
-		w.Header().Set("Content-Type", contentType)
-		io.Copy(w, r)
-	})
-	panic(http.ListenAndServe(":8080", nil))
+	}
+
+	row("total", "", "", s.Total)
+	for _, platform := range []string{"iOS", "Android"} {
+		rows("adtype", platform, s.Retrieval.PlatformAdtypeMap[platform])
+		rows("country", platform, s.platformCountry[platform])
+	}
+	rows("slot", "", s.slots)
+	rows("offer", "", s.offers)
+	counts("phase", s.Phase.Phase)
+	counts("fuyu_phase", s.Phase.FuyuPhase)
+
+	w.Flush()
+	return w.Error()
+}
+
+const Addr = ":8080"
+
+var server = &http.Server{}
+
+// Serve serves status page on ln, http.ErrServerClosed returned after Shutdown
+func Serve(ln net.Listener) error {
+	http.HandleFunc("/status", statusHandler)
+	http.HandleFunc("/funnel", funnelHandler)
+	return server.Serve(ln)
+}
+
+func Shutdown(ctx context.Context) error {
+	return server.Shutdown(ctx)
 }
@@ -0,0 +1,180 @@
+package status
+
+import (
+	"bytes"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func req(platform, country, adtype, slot, phase string, numReq int, offers ...string) *Request {
+	return &Request{
+		numReq:    numReq,
+		numFilled: len(offers),
+		country:   country,
+		platform:  platform,
+		adtype:    adtype,
+		slotid:    slot,
+		offers:    offers,
+		phase:     phase,
+	}
+}
+
+func mustQuery(t *testing.T, raw string) *query {
+	form, _ := url.ParseQuery(raw)
+	q, err := parseQuery(form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestQueryWindow(t *testing.T) {
+	var r report
+	now := time.Date(2026, 10, 19, 12, 30, 20, 0, time.UTC)
+
+	// 60分钟前的数据与当前分钟同槽，写入当前分钟时被重置
+	r.record(now.Add(-60*time.Minute), req("iOS", "US", "1", "335", "RenderOK", 100, "old"))
+	// 59分钟前的槽没有新数据覆盖，查询时按分钟跳过
+	r.record(now.Add(-59*time.Minute), req("iOS", "US", "1", "335", "RenderOK", 100, "old"))
+	r.record(now.Add(-10*time.Minute), req("iOS", "US", "1", "335", "RenderOK", 2, "o1"))
+	r.record(now.Add(-2*time.Minute), req("Android", "CN", "1", "335", "RenderOK", 1, "o2"))
+	r.record(now, req("Android", "CN", "2", "415", "RenderZero", 1))
+	r.record(now, req("iOS", "US", "1", "335", "RenderOK", 1, "o1"))
+
+	s := r.query(now, mustQuery(t, "minutes=1"))
+	s.finish()
+	if s.Total.Req != 2 || s.Total.Filled != 1 {
+		t.Errorf("1 minute total: %+v", s.Total)
+	}
+	if s.From != "2026-10-19 12:30:00" {
+		t.Error("from: ", s.From)
+	}
+
+	s = r.query(now, mustQuery(t, "minutes=5"))
+	s.finish()
+	if s.Total.Req != 3 || s.Total.Filled != 2 || s.Total.FillRate != "66.67%" {
+		t.Errorf("5 minutes total: %+v", s.Total)
+	}
+	if s.Phase.Phase["RenderOK"] != 2 || s.Phase.Phase["RenderZero"] != 1 || s.Phase.FuyuPhase["Normal"] != 3 {
+		t.Errorf("phase: %+v", s.Phase)
+	}
+
+	s = r.query(now.Add(time.Minute), mustQuery(t, "minutes=60"))
+	s.finish()
+	if s.Total.Req != 5 || s.Retrieval.Top30OfferMap["old"] != nil {
+		t.Errorf("60 minutes total: %+v", s.Total)
+	}
+	if e := s.Retrieval.PlatformTop20CountryMap["iOS"]["US"]; e == nil || e.Req != 3 {
+		t.Errorf("iOS US: %+v", e)
+	}
+	if e := s.Retrieval.Top20SlotMap["335"]; e == nil || e.Req != 4 || e.Filled != 3 {
+		t.Errorf("slot 335: %+v", e)
+	}
+}
+
+func TestQueryFilter(t *testing.T) {
+	var r report
+	now := time.Now()
+	r.record(now, req("iOS", "US", "1", "335", "RenderOK", 2, "o1", "o2"))
+	r.record(now, req("Android", "cn", "1", "415", "RenderOK", 1, "o1"))
+	r.record(now, req("Android", "CN", "2", "415", "RenderZero", 1))
+
+	s := r.query(now, mustQuery(t, "slot=415&country=cn"))
+	s.finish()
+	if s.Total.Req != 2 || s.Total.Filled != 1 || s.Phase.Phase["RenderZero"] != 1 {
+		t.Errorf("slot+country: %+v %+v", s.Total, s.Phase)
+	}
+
+	s = r.query(now, mustQuery(t, "adtype=1&offer=o1"))
+	s.finish()
+	// request为匹配维度的全部请求，filled只计o1
+	if s.Total.Req != 3 || s.Total.Filled != 2 {
+		t.Errorf("offer filter total: %+v", s.Total)
+	}
+	if len(s.Retrieval.Top30OfferMap) != 1 || s.Retrieval.Top30OfferMap["o1"].Filled != 2 {
+		t.Errorf("offer filter offers: %+v", s.Retrieval.Top30OfferMap)
+	}
+	if got := s.Filters["offer"]; len(got) != 1 || got[0] != "o1" {
+		t.Errorf("filters: %+v", s.Filters)
+	}
+}
+
+func TestParseQueryError(t *testing.T) {
+	for _, raw := range []string{"minutes=0", "minutes=61", "minutes=x", "format=xml"} {
+		form, _ := url.ParseQuery(raw)
+		if _, err := parseQuery(form); err == nil {
+			t.Error("expect error: ", raw)
+		}
+	}
+}
+
+func TestCellOffersCap(t *testing.T) {
+	var r report
+	now := time.Now()
+	for i := 0; i < maxCellOffers+10; i++ {
+		r.record(now, req("iOS", "US", "1", "335", "RenderOK", 1, "o"+strconv.Itoa(i)))
+	}
+	r.record(now, req("iOS", "US", "1", "335", "RenderOK", 1, "o0"))
+
+	s := r.query(now, mustQuery(t, "minutes=1"))
+	if len(s.offers) != maxCellOffers+1 {
+		t.Errorf("expect %d offers tracked, got %d", maxCellOffers+1, len(s.offers))
+	}
+	if e := s.offers[otherOffers]; e == nil || e.Req != 10 {
+		t.Errorf("offers over cap should be counted as %s: %+v", otherOffers, e)
+	}
+	if e := s.offers["o0"]; e == nil || e.Req != 2 {
+		t.Errorf("tracked offer should keep counting: %+v", e)
+	}
+}
+
+func TestConcurrentRecord(t *testing.T) {
+	var r report
+	now := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(slot string) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				r.record(now, req("iOS", "US", "1", slot, "RenderOK", 1, "o1"))
+			}
+		}(strconv.Itoa(i % 2))
+	}
+	wg.Wait()
+	if s := r.query(now, mustQuery(t, "minutes=1")); s.Total.Req != 8000 {
+		t.Errorf("expect 8000 requests, got %d", s.Total.Req)
+	}
+}
+
+func TestCSV(t *testing.T) {
+	var r report
+	now := time.Now()
+	r.record(now, req("iOS", "US", "1", "335", "RenderOK", 2, "o1"))
+	r.record(now, req("Android", "HK", "1", "335", "RenderOK", 1, "o1"))
+
+	s := r.query(now, mustQuery(t, "format=csv"))
+	s.finish()
+	var buf bytes.Buffer
+	if err := writeCSV(&buf, s); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		"dimension,platform,key,request,filled,fill_rate",
+		"total,,,3,2,66.67%",
+		"adtype,iOS,1,2,1,50.00%",
+		"country,Android,HK,1,1,100.00%",
+		"slot,,335,3,2,66.67%",
+		"offer,,o1,2,2,100.00%",
+		"phase,,RenderOK,2,,",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+tworker的守护进程：
+
+  - 重启退避: worker退出后等待MinBackoff再拉起，连续崩溃时指数增长到MaxBackoff；
+    稳定运行超过CrashWindow后退避时间重置
+  - crash loop: CrashWindow内崩溃CrashLimit次以上，固定使用MaxBackoff并在状态文件中标记
+  - 崩溃日志: worker输出追加写入output，异常退出时把output保存为 <output>.crash.<时间>，只保留最近KeepCrashes个
+  - 平滑重启: SIGUSR2后通过PidFile跟踪新进程，它不是guard的子进程拿不到退出状态，
+    没有再次交接就退出按崩溃处理(崩溃日志、退避、crash loop计数)
+  - 信号转发: SIGTERM/SIGINT转发后等待worker退出(不再拉起)，SIGHUP/SIGUSR2直接转发
+  - 健康检查: 配置HealthUrl时定期探测，连续失败HealthFailures次认为worker卡死，
+    发送SIGQUIT(输出goroutine栈到崩溃日志)后重启
+  - 状态文件: 记录pid、重启次数、崩溃次数和最近一次退出原因
+*/
+
+type Conf struct {
+	Cmd     []string // worker命令及参数
+	Output  string   // worker的stdout/stderr，空表示/dev/null
+	PidFile string   // worker handoff后新进程的pid文件
+
+	KeepCrashes int // 保留的崩溃日志个数
+
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	CrashWindow time.Duration
+	CrashLimit  int
+
+	HealthUrl      string
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+	HealthGrace    time.Duration // worker启动后的加载时间，期间不探测
+	HealthFailures int
+
+	StatusFile string
+}
+
+func (c *Conf) setDefault() {
+	if c.KeepCrashes <= 0 {
+		c.KeepCrashes = 5
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = time.Second
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = 64 * c.MinBackoff
+	}
+	if c.CrashWindow <= 0 {
+		c.CrashWindow = 5 * time.Minute
+	}
+	if c.CrashLimit <= 0 {
+		c.CrashLimit = 5
+	}
+	if c.HealthInterval <= 0 {
+		c.HealthInterval = 10 * time.Second
+	}
+	if c.HealthTimeout <= 0 {
+		c.HealthTimeout = 3 * time.Second
+	}
+	if c.HealthFailures <= 0 {
+		c.HealthFailures = 3
+	}
+}
+
+type Status struct {
+	GuardPid   int       `json:"guard_pid"`
+	Pid        int       `json:"pid"`
+	StartedAt  time.Time `json:"started_at"` // 当前worker启动时间
+	Restarts   int       `json:"restarts"`
+	Crashes    int       `json:"crashes"`
+	Unhealthy  int       `json:"unhealthy"` // 因健康检查失败重启的次数
+	CrashLoop  bool      `json:"crash_loop"`
+	LastExit   string    `json:"last_exit,omitempty"`
+	LastExitAt time.Time `json:"last_exit_at"`
+	LastCrash  string    `json:"last_crash,omitempty"` // 最近的崩溃日志文件
+}
+
+type Supervisor struct {
+	conf Conf
+
+	mu        sync.Mutex
+	status    Status
+	stopping  bool
+	unhealthy bool // 当前worker是被健康检查杀掉的
+	stopCh    chan struct{}
+
+	crashes []time.Time
+	backoff time.Duration
+}
+
+func New(conf *Conf) *Supervisor {
+	s := &Supervisor{
+		conf:   *conf,
+		stopCh: make(chan struct{}),
+	}
+	s.conf.setDefault()
+	s.status.GuardPid = os.Getpid()
+	return s
+}
+
+func (s *Supervisor) logf(format string, args ...interface{}) {
+	fmt.Println(time.Now().UTC(), " - "+fmt.Sprintf(format, args...))
+}
+
+// Run launches worker and restarts it until Stop called
+func (s *Supervisor) Run() {
+	for !s.isStopping() {
+		start := time.Now()
+		exit := s.runOnce()
+
+		if s.isStopping() {
+			s.logf("tworker stopped: %s", exit)
+			break
+		}
+
+		s.mu.Lock()
+		unhealthy := s.unhealthy
+		s.unhealthy = false
+		s.mu.Unlock()
+
+		crashed := exit != "exit status 0" || unhealthy
+		if unhealthy {
+			exit = "unhealthy, " + exit
+		}
+		s.recordExit(exit, crashed, unhealthy)
+		s.logf("tworker down: %s", exit)
+
+		delay := s.nextBackoff(time.Since(start), crashed)
+		select {
+		case <-time.After(delay):
+		case <-s.stopCh:
+		}
+	}
+	s.writeStatus()
+}
+
+// Stop forwards SIGTERM to worker and stops restarting
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	if !s.stopping {
+		s.stopping = true
+		close(s.stopCh)
+	}
+	s.mu.Unlock()
+	s.Signal(syscall.SIGTERM)
+}
+
+// Signal forwards sig to current worker
+func (s *Supervisor) Signal(sig os.Signal) {
+	if pid := s.pid(); pid > 0 {
+		if p, err := os.FindProcess(pid); err == nil {
+			p.Signal(sig)
+		}
+	}
+}
+
+func (s *Supervisor) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+func (s *Supervisor) isStopping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopping
+}
+
+func (s *Supervisor) pid() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status.Pid
+}
+
+func (s *Supervisor) setPid(pid int) {
+	s.mu.Lock()
+	s.status.Pid = pid
+	s.mu.Unlock()
+	s.writeStatus()
+}
+
+// runOnce starts worker and waits until it (or the process it handed off to) exits
+func (s *Supervisor) runOnce() string {
+	out, err := s.openOutput()
+	if err != nil {
+		return "open output error: " + err.Error()
+	}
+	defer out.Close()
+
+	cmd := exec.Command(s.conf.Cmd[0], s.conf.Cmd[1:]...)
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Start(); err != nil {
+		return "start error: " + err.Error()
+	}
+
+	s.mu.Lock()
+	if !s.status.StartedAt.IsZero() {
+		s.status.Restarts++
+	}
+	s.status.StartedAt = time.Now().UTC()
+	s.mu.Unlock()
+	s.setPid(cmd.Process.Pid)
+
+	stopProbe := make(chan struct{})
+	go s.probe(stopProbe)
+	defer close(stopProbe)
+
+	exit := "exit status 0"
+	if err := cmd.Wait(); err != nil {
+		exit = err.Error()
+	}
+
+	// worker平滑重启(SIGUSR2)后，新进程不是guard的子进程，通过pid文件跟踪它
+	handedOff := false
+	for exited := cmd.Process.Pid; exit == "exit status 0"; {
+		pid := s.handoffPid(exited)
+		if pid <= 0 {
+			if handedOff {
+				exit = fmt.Sprintf("handed-off tworker %d exited unexpectedly", exited)
+			}
+			break
+		}
+		handedOff = true
+		s.logf("tworker %d handed off to %d", exited, pid)
+		s.setPid(pid)
+		for syscall.Kill(pid, 0) == nil {
+			time.Sleep(time.Second)
+		}
+		exited = pid
+	}
+
+	s.setPid(0)
+	return exit
+}
+
+func (s *Supervisor) handoffPid(exited int) int {
+	if s.conf.PidFile == "" {
+		return 0
+	}
+	b, err := ioutil.ReadFile(s.conf.PidFile)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	if pid <= 0 || pid == exited || syscall.Kill(pid, 0) != nil {
+		return 0
+	}
+	return pid
+}
+
+func (s *Supervisor) openOutput() (*os.File, error) {
+	if s.conf.Output == "" {
+		return os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	}
+	// 追加写，正常退出的输出不会被下次启动覆盖，崩溃时整个文件转为崩溃日志
+	return os.OpenFile(s.conf.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+}
+
+// probe kills worker with SIGQUIT after HealthFailures consecutive failures
+func (s *Supervisor) probe(stop chan struct{}) {
+	if s.conf.HealthUrl == "" {
+		return
+	}
+
+	select {
+	case <-time.After(s.conf.HealthGrace):
+	case <-stop:
+		return
+	}
+
+	client := &http.Client{Timeout: s.conf.HealthTimeout}
+	ticker := time.NewTicker(s.conf.HealthInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		if err := check(client, s.conf.HealthUrl); err != nil {
+			failures++
+			s.logf("tworker health check failed(%d/%d): %v", failures, s.conf.HealthFailures, err)
+		} else {
+			failures = 0
+		}
+
+		if failures >= s.conf.HealthFailures {
+			s.mu.Lock()
+			s.unhealthy = true
+			s.mu.Unlock()
+			s.Signal(syscall.SIGQUIT) // go程序收到SIGQUIT会打印goroutine栈后退出
+			go s.killAfter(s.pid(), 10*time.Second)
+			return
+		}
+	}
+}
+
+func check(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *Supervisor) killAfter(pid int, d time.Duration) {
+	time.Sleep(d)
+	if pid > 0 && s.pid() == pid {
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+func (s *Supervisor) recordExit(exit string, crashed, unhealthy bool) {
+	now := time.Now().UTC()
+
+	var crashLog string
+	if crashed {
+		crashLog = s.saveCrash(now)
+	}
+
+	s.mu.Lock()
+	s.status.LastExit = exit
+	s.status.LastExitAt = now
+	if crashed {
+		s.status.Crashes++
+		if crashLog != "" {
+			s.status.LastCrash = crashLog
+		}
+	}
+	if unhealthy {
+		s.status.Unhealthy++
+	}
+	s.mu.Unlock()
+	s.writeStatus()
+}
+
+// saveCrash keeps output of crashed worker, only the latest KeepCrashes files kept
+func (s *Supervisor) saveCrash(now time.Time) string {
+	if s.conf.Output == "" {
+		return ""
+	}
+
+	crashLog := s.conf.Output + ".crash." + now.Format("20060102-150405")
+	if err := os.Rename(s.conf.Output, crashLog); err != nil {
+		s.logf("save crash log error: %v", err)
+		return ""
+	}
+
+	files, _ := filepath.Glob(s.conf.Output + ".crash.*")
+	sort.Strings(files) // 时间格式保证字典序即时间序
+	for len(files) > s.conf.KeepCrashes {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+	return crashLog
+}
+
+// nextBackoff returns delay before next launch
+func (s *Supervisor) nextBackoff(uptime time.Duration, crashed bool) time.Duration {
+	now := time.Now()
+	if !crashed || uptime > s.conf.CrashWindow {
+		s.backoff = 0
+	}
+	if crashed {
+		s.crashes = append(s.crashes, now)
+	}
+
+	recent := s.crashes[:0]
+	for _, t := range s.crashes {
+		if now.Sub(t) <= s.conf.CrashWindow {
+			recent = append(recent, t)
+		}
+	}
+	s.crashes = recent
+	crashLoop := len(s.crashes) >= s.conf.CrashLimit
+
+	switch {
+	case crashLoop:
+		s.backoff = s.conf.MaxBackoff
+	case s.backoff == 0:
+		s.backoff = s.conf.MinBackoff
+	default:
+		s.backoff *= 2
+		if s.backoff > s.conf.MaxBackoff {
+			s.backoff = s.conf.MaxBackoff
+		}
+	}
+
+	s.mu.Lock()
+	if crashLoop && !s.status.CrashLoop {
+		s.logf("tworker crash loop: %d crashes in %v", len(s.crashes), s.conf.CrashWindow)
+	}
+	s.status.CrashLoop = crashLoop
+	s.mu.Unlock()
+	s.writeStatus()
+
+	return s.backoff
+}
+
+func (s *Supervisor) writeStatus() {
+	if s.conf.StatusFile == "" {
+		return
+	}
+	b, _ := json.MarshalIndent(s.Status(), "", "  ")
+	tmp := s.conf.StatusFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		s.logf("write status file error: %v", err)
+		return
+	}
+	os.Rename(tmp, s.conf.StatusFile)
+}
@@ -0,0 +1,175 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNextBackoff(t *testing.T) {
+	s := New(&Conf{
+		MinBackoff:  time.Second,
+		MaxBackoff:  4 * time.Second,
+		CrashWindow: time.Minute,
+		CrashLimit:  10,
+	})
+
+	expect := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+	for i, d := range expect {
+		if b := s.nextBackoff(time.Millisecond, true); b != d {
+			t.Errorf("crash %d: backoff %v, expect %v", i, b, d)
+		}
+	}
+
+	// 稳定运行后重置
+	if b := s.nextBackoff(2*time.Minute, true); b != time.Second {
+		t.Error("backoff should be reset after stable run: ", b)
+	}
+	if b := s.nextBackoff(time.Millisecond, false); b != time.Second {
+		t.Error("clean exit should use min backoff: ", b)
+	}
+}
+
+func TestCrashLoop(t *testing.T) {
+	s := New(&Conf{
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  time.Second,
+		CrashWindow: time.Minute,
+		CrashLimit:  3,
+	})
+	for i := 0; i < 3; i++ {
+		s.nextBackoff(2*time.Minute, true) // 每次都稳定运行过，但窗口内崩溃次数过多
+	}
+	if !s.Status().CrashLoop {
+		t.Fatal("crash loop not detected")
+	}
+	if b := s.nextBackoff(2*time.Minute, true); b != time.Second {
+		t.Error("crash loop should use max backoff: ", b)
+	}
+}
+
+func TestRunCrashLogs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "supervisor")
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "tworker.log")
+	statusFile := filepath.Join(dir, "tguard.status")
+	s := New(&Conf{
+		Cmd:         []string{"sh", "-c", "echo panic; exit 2"},
+		Output:      output,
+		KeepCrashes: 2,
+		MinBackoff:  time.Second, // 崩溃日志文件名精确到秒
+		MaxBackoff:  time.Second,
+		StatusFile:  statusFile,
+	})
+
+	go func() {
+		time.Sleep(3500 * time.Millisecond)
+		s.Stop()
+	}()
+	s.Run()
+
+	files, _ := filepath.Glob(output + ".crash.*")
+	if len(files) != 2 {
+		t.Fatal("expect 2 crash logs, got: ", files)
+	}
+	if b, _ := ioutil.ReadFile(files[1]); string(b) != "panic\n" {
+		t.Error("crash log content error: ", string(b))
+	}
+
+	var st Status
+	b, _ := ioutil.ReadFile(statusFile)
+	if err := json.Unmarshal(b, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Crashes < 3 || st.Restarts != st.Crashes-1 || st.LastExit != "exit status 2" {
+		t.Error("status error: ", string(b))
+	}
+}
+
+func TestHandoffExit(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "supervisor")
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "tworker.log")
+	pidFile := filepath.Join(dir, "tworker.pid")
+	ioutil.WriteFile(output, []byte("previous run\n"), 0644)
+	// 模拟SIGUSR2: worker拉起新进程写入pid文件后正常退出，新进程之后自己退出
+	s := New(&Conf{
+		Cmd:        []string{"sh", "-c", "echo handoff; sleep 1 & echo $! > " + pidFile + "; exit 0"},
+		Output:     output,
+		PidFile:    pidFile,
+		MinBackoff: time.Hour,
+	})
+	go s.Run()
+	defer s.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && s.Status().Crashes == 0 {
+		time.Sleep(50 * time.Millisecond)
+	}
+	st := s.Status()
+	if st.Crashes != 1 || !strings.Contains(st.LastExit, "exited unexpectedly") {
+		t.Fatal("disappeared handed-off worker should be regarded as crash: ", st)
+	}
+	if b, _ := ioutil.ReadFile(st.LastCrash); string(b) != "previous run\nhandoff\n" {
+		t.Error("output should be appended and kept as crash log: ", string(b))
+	}
+}
+
+func TestStopForwardSignal(t *testing.T) {
+	s := New(&Conf{Cmd: []string{"sleep", "10"}})
+
+	done := make(chan struct{})
+	go func() {
+		s.Run()
+		close(done)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	if s.Status().Pid == 0 {
+		t.Fatal("worker not started")
+	}
+	s.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("supervisor should exit after worker stopped")
+	}
+	if st := s.Status(); st.Restarts != 0 || st.Crashes != 0 {
+		t.Error("stop should not be regarded as crash: ", st)
+	}
+}
+
+func TestHealthProbe(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer ts.Close()
+
+	s := New(&Conf{
+		Cmd:            []string{"sleep", "10"},
+		MinBackoff:     time.Hour,
+		HealthUrl:      ts.URL,
+		HealthInterval: 20 * time.Millisecond,
+		HealthFailures: 2,
+	})
+	go s.Run()
+	defer s.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && s.Status().Unhealthy == 0 {
+		time.Sleep(20 * time.Millisecond)
+	}
+	st := s.Status()
+	if st.Unhealthy != 1 || !strings.HasPrefix(st.LastExit, "unhealthy") {
+		t.Error("unhealthy worker should be restarted: ", st)
+	}
+}
@@ -1,50 +1,55 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
+	"os/signal"
+	"syscall"
 	"time"
+
+	"supervisor"
 )
 
-func launch(stdout, stderr io.Writer) {
-	cmd := exec.Command("bin/tworker")
-	cmd.Stdout, cmd.Stderr = stdout, stderr
-	if err := cmd.Start(); err != nil {
-		time.Sleep(time.Second)
-		fmt.Println(time.Now().UTC(), " - start tworker error: ", err)
-		return
+// usage: tguard [flags] [tworker_output] [pid_file]
+func main() {
+	conf := &supervisor.Conf{Cmd: []string{"bin/tworker"}}
+
+	flag.IntVar(&conf.KeepCrashes, "keep-crashes", 5, "number of crash outputs kept")
+	flag.DurationVar(&conf.MinBackoff, "min-backoff", time.Second, "restart delay after first crash")
+	flag.DurationVar(&conf.MaxBackoff, "max-backoff", time.Minute, "max restart delay")
+	flag.DurationVar(&conf.CrashWindow, "crash-window", 5*time.Minute, "crash loop detection window")
+	flag.IntVar(&conf.CrashLimit, "crash-limit", 5, "crashes in crash-window regarded as crash loop")
+	flag.StringVar(&conf.HealthUrl, "health-url", "", "http health probe of tworker, empty to disable")
+	flag.DurationVar(&conf.HealthInterval, "health-interval", 10*time.Second, "health probe interval")
+	flag.DurationVar(&conf.HealthTimeout, "health-timeout", 3*time.Second, "health probe timeout")
+	flag.DurationVar(&conf.HealthGrace, "health-grace", 2*time.Minute, "no probe during tworker loading")
+	flag.IntVar(&conf.HealthFailures, "health-failures", 3, "consecutive probe failures before restart")
+	flag.StringVar(&conf.StatusFile, "status", "tguard.status", "status file, empty to disable")
+	flag.Parse()
+
+	// 兼容以前的参数: tguard <tworker_output> [pid_file]
+	if flag.NArg() > 0 {
+		conf.Output = flag.Arg(0)
 	}
-	if err := cmd.Wait(); err != nil {
-		time.Sleep(time.Second)
-		fmt.Println(time.Now().UTC(), " - tworker down, error: ", err)
-		return
+	if flag.NArg() > 1 {
+		conf.PidFile = flag.Arg(1) // 与offer.conf中graceful_config.pid_file一致
 	}
-}
 
-func main() {
-	tworkerOutput := "/dev/null"
-	if len(os.Args) > 1 {
-		tworkerOutput = os.Args[1]
-	}
+	s := supervisor.New(conf)
 
-	out, err := os.OpenFile(tworkerOutput, os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		panic(err)
-	}
-	defer out.Close()
-
-	for {
-		if len(os.Args) > 1 {
-			bak, err := os.Create(tworkerOutput + ".bak")
-			if err != nil {
-				out.Seek(0, os.SEEK_SET)
-				io.Copy(bak, out)
-				bak.Close()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigCh {
+			fmt.Println(time.Now().UTC(), " - tguard receive signal: ", sig)
+			if sig == syscall.SIGTERM || sig == syscall.SIGINT {
+				s.Stop()
+			} else {
+				s.Signal(sig)
 			}
 		}
-		out.Truncate(0)
-		launch(out, out)
-	}
+	}()
+
+	s.Run()
 }
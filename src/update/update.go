@@ -12,9 +12,15 @@ import (
 	dnf "github.com/brg-liuwei/godnf"
 	"github.com/brg-liuwei/gotools"
 
+	"metrics"
 	"raw_ad"
 )
 
+var (
+	indexDocs      = metrics.NewGauge("offer_index_docs", "Offers added to dnf index in last update, tmp test channels excluded.")
+	indexUpdatedAt = metrics.NewGauge("offer_index_updated_timestamp_seconds", "Unix time of last dnf index update.")
+)
+
 type Conf struct {
 	OfferUpdateApi string `json:"offer_update_api"`
 
@@ -162,16 +168,20 @@ func (s *Service) Serve() {
 			s.downloadChannelStatus()
 
 			chs := s.getStatus()
+			total := 0
 			for i := 0; i < len(chs); i++ {
 				offerCnt := 0
 				s.doUpdateS3(chs[i], &offerCnt)
 				s.l.Printf("[%s] update ok, raw cnt: %d", chs[i], offerCnt)
+				total += offerCnt
 			}
 
             s.doUpdateS3TmpChannels()
 
 			// offer更新完成后设置当前dnf
 			dnf.SetHandler(s.dnfHandler)
+			indexDocs.Set(float64(total))
+			indexUpdatedAt.Set(float64(time.Now().Unix()))
 
 			// 每五分钟更换一次
 			time.Sleep(time.Duration(5) * time.Minute)
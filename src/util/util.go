@@ -13,6 +13,7 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -492,3 +493,33 @@ func GetOsVersion(osv string) (major, minor, micro int) {
 	}
 	return
 }
+
+// IsPrivateAddr returns true if remote (host or host:port) is loopback or intranet address
+func IsPrivateAddr(remote string) bool {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, cidr := range privateNets {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(s)
+		nets = append(nets, n)
+	}
+	return nets
+}()
@@ -0,0 +1,396 @@
+package vast_module
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"metrics"
+)
+
+// VAST标准错误码
+const (
+	ErrCodeXmlParse       = 100 // XML parsing error
+	ErrCodeSchema         = 101 // VAST schema validation error
+	ErrCodeWrapper        = 300 // General Wrapper error
+	ErrCodeWrapperTimeout = 301 // Timeout of VAST URI provided in Wrapper element
+	ErrCodeWrapperLimit   = 302 // Wrapper limit reached
+	ErrCodeNoAdAfterWrap  = 303 // No VAST response after one or more Wrappers
+	ErrCodeNoMediaFile    = 403 // Couldn't find MediaFile that is supported
+)
+
+type ResolveError struct {
+	Code int
+	Msg  string
+}
+
+func (e *ResolveError) Error() string {
+	return fmt.Sprintf("vast resolve error %d: %s", e.Code, e.Msg)
+}
+
+// 以下为解析上游VAST所需的最小结构
+type xVast struct {
+	XMLName xml.Name `xml:"VAST"`
+	Version string   `xml:"version,attr"`
+	Errors  []string `xml:"Error"` // 没有广告时，VAST根节点下的Error
+	Ads     []xAd    `xml:"Ad"`
+}
+
+type xAd struct {
+	Id      string    `xml:"id,attr"`
+	InLine  *xInLine  `xml:"InLine"`
+	Wrapper *xWrapper `xml:"Wrapper"`
+}
+
+type xAdCommon struct {
+	AdTitle     string      `xml:"AdTitle"`
+	Description string      `xml:"Description"`
+	Errors      []string    `xml:"Error"`
+	Impressions []string    `xml:"Impression"`
+	Creatives   []xCreative `xml:"Creatives>Creative"`
+}
+
+type xInLine struct {
+	xAdCommon
+}
+
+type xWrapper struct {
+	xAdCommon
+	VASTAdTagURI string `xml:"VASTAdTagURI"`
+}
+
+type xCreative struct {
+	Id         string       `xml:"id,attr"`
+	AdId       string       `xml:"AdID,attr"`
+	Linear     *xLinear     `xml:"Linear"`
+	Companions []xCompanion `xml:"CompanionAds>Companion"`
+}
+
+type xCompanion struct {
+	Width           int               `xml:"width,attr"`
+	Height          int               `xml:"height,attr"`
+	StaticResources []xStaticResource `xml:"StaticResource"`
+}
+
+type xStaticResource struct {
+	CreativeType string `xml:"creativeType,attr"`
+	URI          string `xml:",chardata"`
+}
+
+type xLinear struct {
+	Duration       string       `xml:"Duration"`
+	Trackings      []xTracking  `xml:"TrackingEvents>Tracking"`
+	ClickThrough   string       `xml:"VideoClicks>ClickThrough"`
+	ClickTrackings []string     `xml:"VideoClicks>ClickTracking"`
+	MediaFiles     []xMediaFile `xml:"MediaFiles>MediaFile"`
+}
+
+type xTracking struct {
+	Event string `xml:"event,attr"`
+	URI   string `xml:",chardata"`
+}
+
+type xMediaFile struct {
+	Delivery string `xml:"delivery,attr"`
+	Type     string `xml:"type,attr"`
+	Width    int    `xml:"width,attr"`
+	Height   int    `xml:"height,attr"`
+	Bitrate  int    `xml:"bitrate,attr"`
+	URI      string `xml:",chardata"`
+}
+
+type MediaFile struct {
+	Url    string
+	Type   string // video/mp4
+	Width  int
+	Height int
+}
+
+// 展开wrapper后的InLine广告，各层的监测链接都已合并
+type ResolvedAd struct {
+	Id       string
+	Title    string
+	Desc     string
+	Duration int // 秒
+	Media    MediaFile
+	Cover    *MediaFile // InLine中第一个图片companion，没有时为nil
+
+	Impressions    []string
+	ClickThrough   string
+	ClickTrackings []string
+	Trackings      map[string][]string // event -> urls
+	ErrorUrls      []string            // 各层的Error url
+
+	Depth int // wrapper层数
+}
+
+type Resolver struct {
+	maxDepth int
+	timeout  time.Duration // 整个wrapper链的超时，同时受ctx的deadline约束
+	client   *http.Client
+}
+
+func NewResolver(maxDepth int, timeout time.Duration) *Resolver {
+	return &Resolver{
+		maxDepth: maxDepth,
+		timeout:  timeout,
+		client:   &http.Client{},
+	}
+}
+
+// ResolveUrl fetches VAST tag url and follows wrapper chain
+func (r *Resolver) ResolveUrl(tagUrl string) (*ResolvedAd, error) {
+	return r.ResolveUrlContext(context.Background(), tagUrl)
+}
+
+// ResolveUrlContext is like ResolveUrl, the wrapper chain is also bounded by deadline of ctx
+func (r *Resolver) ResolveUrlContext(ctx context.Context, tagUrl string) (*ResolvedAd, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	data, err := r.fetch(ctx, tagUrl)
+	if err != nil {
+		return nil, err
+	}
+	return r.resolve(ctx, data, newResolvedAd())
+}
+
+// ResolveXml resolves VAST xml which maybe a Wrapper
+func (r *Resolver) ResolveXml(data []byte) (*ResolvedAd, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	return r.resolve(ctx, data, newResolvedAd())
+}
+
+func newResolvedAd() *ResolvedAd {
+	return &ResolvedAd{
+		Trackings: make(map[string][]string),
+	}
+}
+
+func (r *Resolver) resolve(ctx context.Context, data []byte, res *ResolvedAd) (*ResolvedAd, error) {
+	for {
+		var v xVast
+		if err := xml.Unmarshal(data, &v); err != nil {
+			code := ErrCodeXmlParse
+			if res.Depth > 0 { // wrapper返回的内容无法解析
+				code = ErrCodeWrapper
+			}
+			return nil, r.fail(res, code, err.Error())
+		}
+
+		if len(v.Ads) == 0 {
+			res.ErrorUrls = append(res.ErrorUrls, trimAll(v.Errors)...)
+			return nil, r.fail(res, ErrCodeNoAdAfterWrap, "no ad in vast")
+		}
+
+		ad := v.Ads[0]
+		if ad.InLine != nil {
+			res.merge(&ad.InLine.xAdCommon)
+			if res.Id == "" {
+				res.Id = ad.Id
+			}
+			res.Title = strings.TrimSpace(ad.InLine.AdTitle)
+			res.Desc = strings.TrimSpace(ad.InLine.Description)
+			if !res.chooseMedia(ad.InLine.Creatives) {
+				return nil, r.fail(res, ErrCodeNoMediaFile, "no supported media file")
+			}
+			res.chooseCover(ad.InLine.Creatives)
+			return res, nil
+		}
+
+		if ad.Wrapper == nil {
+			return nil, r.fail(res, ErrCodeSchema, "neither InLine nor Wrapper")
+		}
+
+		res.merge(&ad.Wrapper.xAdCommon)
+		if res.Id == "" {
+			res.Id = ad.Id
+		}
+
+		res.Depth++
+		if res.Depth > r.maxDepth {
+			return nil, r.fail(res, ErrCodeWrapperLimit, "wrapper depth exceeds "+strconv.Itoa(r.maxDepth))
+		}
+
+		tagUrl := strings.TrimSpace(ad.Wrapper.VASTAdTagURI)
+		if tagUrl == "" {
+			return nil, r.fail(res, ErrCodeWrapper, "empty VASTAdTagURI")
+		}
+
+		var err error
+		if data, err = r.fetch(ctx, tagUrl); err != nil {
+			e := err.(*ResolveError)
+			return nil, r.fail(res, e.Code, e.Msg)
+		}
+	}
+}
+
+// fetch returns *ResolveError on failure: 301 for timeout, 303 for empty response and 300 for other HTTP errors
+func (r *Resolver) fetch(ctx context.Context, tagUrl string) ([]byte, error) {
+	if ctx.Err() != nil {
+		return nil, &ResolveError{Code: ErrCodeWrapperTimeout, Msg: "vast resolve timeout"}
+	}
+
+	req, err := http.NewRequest("GET", tagUrl, nil)
+	if err != nil {
+		return nil, &ResolveError{Code: ErrCodeWrapper, Msg: err.Error()}
+	}
+	start := time.Now()
+	resp, err := r.client.Do(req.WithContext(ctx))
+	metrics.ObserveUpstream("vast", start, err)
+	if err != nil {
+		return nil, &ResolveError{Code: fetchErrCode(ctx, err), Msg: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, &ResolveError{Code: ErrCodeNoAdAfterWrap, Msg: "vast uri " + tagUrl + " no content"}
+	}
+	if resp.StatusCode != 200 {
+		return nil, &ResolveError{Code: ErrCodeWrapper,
+			Msg: fmt.Sprintf("vast uri %s status code: %d", tagUrl, resp.StatusCode)}
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &ResolveError{Code: fetchErrCode(ctx, err), Msg: err.Error()}
+	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return nil, &ResolveError{Code: ErrCodeNoAdAfterWrap, Msg: "vast uri " + tagUrl + " empty response"}
+	}
+	return data, nil
+}
+
+func fetchErrCode(ctx context.Context, err error) int {
+	if ctx.Err() != nil {
+		return ErrCodeWrapperTimeout
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return ErrCodeWrapperTimeout
+	}
+	return ErrCodeWrapper
+}
+
+// 上报各层的Error url，替换[ERRORCODE]宏
+func (r *Resolver) fail(res *ResolvedAd, code int, msg string) error {
+	if len(res.ErrorUrls) > 0 {
+		urls := make([]string, 0, len(res.ErrorUrls))
+		for _, u := range res.ErrorUrls {
+			urls = append(urls, strings.Replace(u, "[ERRORCODE]", strconv.Itoa(code), -1))
+		}
+		go func() {
+			client := &http.Client{Timeout: time.Second}
+			for _, u := range urls {
+				resp, err := client.Get(u)
+				if err != nil {
+					log.Println("[VAST] report error url: ", u, ", err: ", err)
+					continue
+				}
+				resp.Body.Close()
+			}
+		}()
+	}
+	return &ResolveError{Code: code, Msg: msg}
+}
+
+func (res *ResolvedAd) merge(c *xAdCommon) {
+	res.ErrorUrls = append(res.ErrorUrls, trimAll(c.Errors)...)
+	res.Impressions = append(res.Impressions, trimAll(c.Impressions)...)
+	for _, creative := range c.Creatives {
+		if creative.Linear == nil {
+			continue
+		}
+		linear := creative.Linear
+		res.ClickTrackings = append(res.ClickTrackings, trimAll(linear.ClickTrackings)...)
+		for _, track := range linear.Trackings {
+			if uri := strings.TrimSpace(track.URI); uri != "" {
+				res.Trackings[track.Event] = append(res.Trackings[track.Event], uri)
+			}
+		}
+	}
+}
+
+// 选择InLine中的视频，优先progressive的mp4
+func (res *ResolvedAd) chooseMedia(creatives []xCreative) bool {
+	for _, creative := range creatives {
+		linear := creative.Linear
+		if linear == nil {
+			continue
+		}
+
+		var chosen *xMediaFile
+		for i := range linear.MediaFiles {
+			media := &linear.MediaFiles[i]
+			if strings.TrimSpace(media.URI) == "" || media.Delivery == "streaming" {
+				continue
+			}
+			if chosen == nil || (media.Type == "video/mp4" && chosen.Type != "video/mp4") {
+				chosen = media
+			}
+		}
+		if chosen == nil {
+			continue
+		}
+
+		res.Media = MediaFile{
+			Url:    strings.TrimSpace(chosen.URI),
+			Type:   chosen.Type,
+			Width:  chosen.Width,
+			Height: chosen.Height,
+		}
+		res.Duration = parseDuration(linear.Duration)
+		res.ClickThrough = strings.TrimSpace(linear.ClickThrough)
+		return true
+	}
+	return false
+}
+
+// 选择图片类型的静态companion作为封面
+func (res *ResolvedAd) chooseCover(creatives []xCreative) {
+	for _, creative := range creatives {
+		for _, companion := range creative.Companions {
+			for _, sr := range companion.StaticResources {
+				uri := strings.TrimSpace(sr.URI)
+				if uri == "" || !strings.HasPrefix(sr.CreativeType, "image/") {
+					continue
+				}
+				res.Cover = &MediaFile{
+					Url:    uri,
+					Type:   sr.CreativeType,
+					Width:  companion.Width,
+					Height: companion.Height,
+				}
+				return
+			}
+		}
+	}
+}
+
+func trimAll(ss []string) []string {
+	rc := make([]string, 0, len(ss))
+	for _, s := range ss {
+		if s = strings.TrimSpace(s); s != "" {
+			rc = append(rc, s)
+		}
+	}
+	return rc
+}
+
+// HH:MM:SS or HH:MM:SS.mmm
+func parseDuration(d string) int {
+	parts := strings.Split(strings.TrimSpace(d), ":")
+	if len(parts) != 3 {
+		return 0
+	}
+	h, _ := strconv.Atoi(parts[0])
+	m, _ := strconv.Atoi(parts[1])
+	sec, _ := strconv.ParseFloat(parts[2], 64)
+	return h*3600 + m*60 + int(sec)
+}
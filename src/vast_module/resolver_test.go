@@ -0,0 +1,187 @@
+package vast_module
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const inlineXml = `<VAST version="3.0"><Ad id="inline"><InLine>
+<AdTitle>title</AdTitle>
+<Error><![CDATA[http://err/inline?code=[ERRORCODE]]]></Error>
+<Impression><![CDATA[http://imp/inline]]></Impression>
+<Creatives><Creative><Linear>
+<Duration>00:00:15.500</Duration>
+<TrackingEvents><Tracking event="start"><![CDATA[http://track/inline/start]]></Tracking></TrackingEvents>
+<VideoClicks>
+<ClickThrough><![CDATA[http://landing]]></ClickThrough>
+<ClickTracking><![CDATA[http://clk/inline]]></ClickTracking>
+</VideoClicks>
+<MediaFiles>
+<MediaFile delivery="streaming" type="video/mp4" width="640" height="360"><![CDATA[http://media/stream.mp4]]></MediaFile>
+<MediaFile delivery="progressive" type="video/webm" width="640" height="360"><![CDATA[http://media/a.webm]]></MediaFile>
+<MediaFile delivery="progressive" type="video/mp4" width="1280" height="720"><![CDATA[http://media/a.mp4]]></MediaFile>
+</MediaFiles>
+</Linear></Creative>
+<Creative><CompanionAds>
+<Companion width="300" height="250"><HTMLResource><![CDATA[<div></div>]]></HTMLResource></Companion>
+<Companion width="1200" height="628"><StaticResource creativeType="image/jpeg"><![CDATA[http://media/cover.jpg]]></StaticResource></Companion>
+</CompanionAds></Creative></Creatives>
+</InLine></Ad></VAST>`
+
+const wrapperFmt = `<VAST version="3.0"><Ad id="wrapper"><Wrapper>
+<VASTAdTagURI><![CDATA[%s]]></VASTAdTagURI>
+<Error><![CDATA[%s/err?code=[ERRORCODE]]]></Error>
+<Impression><![CDATA[http://imp/wrapper]]></Impression>
+<Creatives><Creative><Linear>
+<TrackingEvents><Tracking event="complete"><![CDATA[http://track/wrapper/complete]]></Tracking></TrackingEvents>
+<VideoClicks><ClickTracking><![CDATA[http://clk/wrapper]]></ClickTracking></VideoClicks>
+</Linear></Creative></Creatives>
+</Wrapper></Ad></VAST>`
+
+func newVastServer(errCh chan string) *httptest.Server {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/inline":
+			w.Write([]byte(inlineXml))
+		case "/wrapper":
+			w.Write([]byte(fmt.Sprintf(wrapperFmt, ts.URL+"/inline", ts.URL)))
+		case "/loop":
+			w.Write([]byte(fmt.Sprintf(wrapperFmt, ts.URL+"/loop", ts.URL)))
+		case "/wrap":
+			w.Write([]byte(fmt.Sprintf(wrapperFmt, ts.URL+r.URL.Query().Get("to"), ts.URL)))
+		case "/garbage":
+			w.Write([]byte("<html>"))
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/err":
+			errCh <- r.URL.Query().Get("code")
+		}
+	}))
+	return ts
+}
+
+func TestResolveWrapper(t *testing.T) {
+	ts := newVastServer(make(chan string, 1))
+	defer ts.Close()
+
+	res, err := NewResolver(3, time.Second).ResolveUrl(ts.URL + "/wrapper")
+	if err != nil {
+		t.Fatal("resolve err: ", err)
+	}
+	if res.Depth != 1 || res.Id != "wrapper" || res.Title != "title" {
+		t.Error("depth: ", res.Depth, ", id: ", res.Id, ", title: ", res.Title)
+	}
+	if res.Media.Url != "http://media/a.mp4" || res.Media.Width != 1280 || res.Duration != 15 {
+		t.Error("media: ", res.Media, ", duration: ", res.Duration)
+	}
+	if res.ClickThrough != "http://landing" {
+		t.Error("click through: ", res.ClickThrough)
+	}
+	if res.Cover == nil || res.Cover.Url != "http://media/cover.jpg" || res.Cover.Width != 1200 {
+		t.Error("cover: ", res.Cover)
+	}
+	if len(res.Impressions) != 2 || len(res.ClickTrackings) != 2 || len(res.ErrorUrls) != 2 {
+		t.Error("imps: ", res.Impressions, ", clks: ", res.ClickTrackings, ", errs: ", res.ErrorUrls)
+	}
+	if len(res.Trackings["start"]) != 1 || len(res.Trackings["complete"]) != 1 {
+		t.Error("trackings: ", res.Trackings)
+	}
+}
+
+func TestResolveWrapperLimit(t *testing.T) {
+	errCh := make(chan string, 8)
+	ts := newVastServer(errCh)
+	defer ts.Close()
+
+	_, err := NewResolver(3, time.Second).ResolveUrl(ts.URL + "/loop")
+	if e, ok := err.(*ResolveError); !ok || e.Code != ErrCodeWrapperLimit {
+		t.Fatal("expect wrapper limit error, got: ", err)
+	}
+
+	select {
+	case code := <-errCh:
+		if code != "302" {
+			t.Error("error url code: ", code)
+		}
+	case <-time.After(time.Second):
+		t.Error("error url not reported")
+	}
+}
+
+func TestResolveErrCodes(t *testing.T) {
+	errCh := make(chan string, 8)
+	ts := newVastServer(errCh)
+	defer ts.Close()
+
+	r := NewResolver(3, time.Second)
+	for to, code := range map[string]int{
+		"/fail":    ErrCodeWrapper,
+		"/garbage": ErrCodeWrapper,
+		"/empty":   ErrCodeNoAdAfterWrap,
+	} {
+		_, err := r.ResolveUrl(ts.URL + "/wrap?to=" + to)
+		if e, ok := err.(*ResolveError); !ok || e.Code != code {
+			t.Errorf("%s: expect %d, got %v", to, code, err)
+			continue
+		}
+		select {
+		case got := <-errCh:
+			if got != fmt.Sprint(code) {
+				t.Errorf("%s: error url code %s", to, got)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: error url not reported", to)
+		}
+	}
+}
+
+func TestResolveXmlErr(t *testing.T) {
+	r := NewResolver(3, time.Second)
+	if _, err := r.ResolveXml([]byte("<VAST")); err.(*ResolveError).Code != ErrCodeXmlParse {
+		t.Error("expect xml parse error, got: ", err)
+	}
+	if _, err := r.ResolveXml([]byte(`<VAST version="3.0"></VAST>`)); err.(*ResolveError).Code != ErrCodeNoAdAfterWrap {
+		t.Error("expect no ad error, got: ", err)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	cases := map[string]int{
+		"00:00:30":     30,
+		"00:01:05.250": 65,
+		"01:00:00":     3600,
+		"30":           0,
+	}
+	for d, expect := range cases {
+		if n := parseDuration(d); n != expect {
+			t.Error("duration: ", d, ", got: ", n, ", expect: ", expect)
+		}
+	}
+}
+
+func TestResolveDeadline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(inlineXml))
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := NewResolver(3, time.Second).ResolveUrlContext(ctx, ts.URL)
+	if e, ok := err.(*ResolveError); !ok || e.Code != ErrCodeWrapperTimeout {
+		t.Error("expect timeout error, got: ", err)
+	}
+	if time.Since(start) > 80*time.Millisecond {
+		t.Error("resolve should stop at ctx deadline")
+	}
+}
@@ -93,6 +93,9 @@ func NativeV4(ad *ad.NativeVideoV4Ad) string {
 		}
 	}
 
+	// 第三方视频播放进度监测
+	tracks = appendVideoTks(tracks, ad.VideoTks)
+
 	videoClicks.ClickThroughs = clickTroughs
 	videoClicks.ClickTrackings = clickTrackings
 	creative.Linear = &vast.Linear{
@@ -193,6 +196,9 @@ func FillV4Vast(ad *ad.VideoAdObj) {
 		}
 	}
 
+	// 第三方视频播放进度监测
+	tracks = appendVideoTks(tracks, ad.VideoTks)
+
 	videoClicks.ClickThroughs = clickTroughs
 	videoClicks.ClickTrackings = clickTrackings
 	creative.Linear = &vast.Linear{
@@ -299,6 +305,21 @@ func FillVast(ad *ad.AdObj) {
 	ad.VastXmlData = video.XML()
 }
 
+func appendVideoTks(tracks []vast.Tracking, videoTks map[string][]string) []vast.Tracking {
+	for event, urls := range videoTks {
+		if _, ok := trackEvents[event]; !ok {
+			continue
+		}
+		for _, url := range urls {
+			tracks = append(tracks, vast.Tracking{
+				Event: event,
+				URI:   url,
+			})
+		}
+	}
+	return tracks
+}
+
 // 返回XML base64数据
 func (this *Video) XML() string {
 	data, err := xml.Marshal(this.VAST)
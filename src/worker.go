@@ -1,43 +1,126 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"net/http"
 	_ "net/http/pprof"
-
-	"github.com/brg-liuwei/gotools"
+	"os"
 
 	"aes"
+	"cache"
+	"click_counter"
+	"config"
+	"cpt"
+	"creative_bandit"
+	"estimator"
+	"experiment"
+	"graceful"
+	"logger"
+	"offer_cap"
+	"pacing"
+	"rank"
 	"real_api"
 	"retrieval"
 	"status"
 	"util"
 )
 
-type Conf struct {
-	RetrievalConf retrieval.Conf `json:"retrieval_config"`
-	UtilConf      util.Conf      `json:"util_config"`
-	AesConf       aes.Conf       `json:"aes_config"`
-	RealApi       real_api.Conf  `json:"real_api_conf"`
-}
+var (
+	confPath    = flag.String("config", "conf/offer.conf", "config file path")
+	checkConfig = flag.Bool("check-config", false, "validate config, print effective config with secrets redacted and exit")
+)
 
-var conf Conf
+// SIGHUP: 只重新加载retrieval、real_api、local_rank、rank shadow、creative_bandit、experiment和日志级别中可以热更新的部分
+func reload(retrievalService *retrieval.Service) error {
+	cf, err := config.Load(*confPath)
+	if err != nil {
+		return fmt.Errorf("reload %s error: %v", *confPath, err)
+	}
+	if err := real_api.Reload(&cf.RealApi); err != nil {
+		return fmt.Errorf("reload real_api conf error: %v", err)
+	}
+	if err := rank.ReloadLocal(&cf.RankConf.LocalRank); err != nil {
+		return fmt.Errorf("reload local_rank conf error: %v", err)
+	}
+	if err := rank.ReloadShadow(&cf.RankConf.Shadow); err != nil {
+		return fmt.Errorf("reload rank shadow conf error: %v", err)
+	}
+	if err := experiment.Reload(&cf.ExpConf); err != nil {
+		return fmt.Errorf("reload experiment conf error: %v", err)
+	}
+	creative_bandit.Reload(&cf.BanditConf)
+	retrievalService.Reload(&cf.RetrievalConf)
+	logger.Default().Apply(&cf.LogConf)
+	return nil
+}
 
-func startRetrievalService(cf *retrieval.Conf) {
-	retrievalService, err := retrieval.NewService(cf)
+func check() {
+	cf, err := config.Load(*confPath)
+	if cf != nil {
+		if b, e := cf.Redacted(); e == nil {
+			os.Stdout.Write(b)
+		}
+	}
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, "config error:\n"+err.Error())
+		os.Exit(1)
 	}
-	retrievalService.Serve()
+	fmt.Fprintln(os.Stderr, "config ok")
 }
+
 func main() {
-	if err := gotools.DecodeJsonFile("conf/offer.conf", &conf); err != nil {
+	flag.Parse()
+
+	if *checkConfig {
+		check()
+		return
+	}
+
+	conf, err := config.Load(*confPath)
+	if err != nil {
 		panic(err)
 	}
 
+	if err := logger.Init(&conf.LogConf); err != nil {
+		panic(err)
+	}
 	aes.Init(&conf.AesConf)
 	util.Init(&conf.UtilConf)
+	cache.Init(&conf.CacheConf)
 	real_api.Init(&conf.RealApi)
+	rank.Init(&conf.RankConf)
+	estimator.Init(&conf.EstimatorConf)
+	offer_cap.Init(&conf.CapConf)
+	estimator.OnTrack(offer_cap.Track)
+	pacing.InitBudget(&conf.BudgetConf)
+	if conf.CptEnabled {
+		cpt.Init(&conf.CptConf)
+	}
+	creative_bandit.Init(&conf.BanditConf)
+	experiment.Init(&conf.ExpConf)
 
-	go startRetrievalService(&conf.RetrievalConf)
+	retrievalService, err := retrieval.NewService(&conf.RetrievalConf)
+	if err != nil {
+		panic(err)
+	}
+
+	// 管理接口只在status端口(DefaultServeMux)上，不暴露在对外的检索端口
+	http.HandleFunc("/admin/log", logger.AdminHandler)
+	http.HandleFunc("/track", estimator.TrackHandler)
+	http.HandleFunc("/estimator", estimator.EstimateHandler)
+	http.HandleFunc("/creative/track", creative_bandit.TrackHandler)
+	http.HandleFunc("/creative/report", creative_bandit.ReportHandler)
+	http.HandleFunc("/rank/shadow", rank.ShadowHandler)
 
-	status.Serve()
+	m := graceful.New(&conf.GracefulConf)
+	m.Add(retrievalService.Addr(), retrievalService.Serve, retrievalService.Shutdown)
+	m.Add(status.Addr, status.Serve, status.Shutdown)
+	m.OnReload(func() error { return reload(retrievalService) })
+	m.OnExit(click_counter.Flush)
+	m.OnExit(estimator.Flush)
+
+	if err := m.Run(); err != nil {
+		panic(err)
+	}
 }